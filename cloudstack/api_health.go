@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// defaultAPIFailureBackoff is the interval between probes of an unavailable API when none is configured.
+const defaultAPIFailureBackoff = time.Minute
+
+// errCloudStackUnavailable is returned instead of calling the CloudStack API while it is unavailable.
+var errCloudStackUnavailable = errors.New("CloudStack API unavailable")
+
+// apiHealth tracks consecutive failed CloudStack API calls. Once threshold calls failed in a row,
+// f.e. during maintenance of the management server, the API is considered unavailable: calls fail
+// immediately, except for a single probe every backoff, until a call succeeds again.
+type apiHealth struct {
+	threshold int
+	backoff   time.Duration
+	now       func() time.Time
+
+	mu          sync.Mutex
+	failures    int
+	unavailable bool
+	nextProbe   time.Time
+	recovered   bool
+}
+
+func newAPIHealth(threshold int, backoff time.Duration) *apiHealth {
+	return &apiHealth{
+		threshold: threshold,
+		backoff:   backoff,
+		now:       time.Now,
+	}
+}
+
+// allow returns an error wrapping errCloudStackUnavailable when a call must not be made. While the API
+// is unavailable, only the first call after each backoff is allowed, to probe whether it is back.
+func (h *apiHealth) allow() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.unavailable {
+		return nil
+	}
+
+	now := h.now()
+	if now.Before(h.nextProbe) {
+		return fmt.Errorf("%w after %d consecutive failed calls, retrying in %v",
+			errCloudStackUnavailable, h.failures, h.nextProbe.Sub(now).Round(time.Second))
+	}
+	h.nextProbe = now.Add(h.backoff)
+
+	return nil
+}
+
+// record registers the outcome of a call.
+func (h *apiHealth) record(failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !failed {
+		if h.unavailable {
+			klog.Infof("CloudStack API is available again after %d consecutive failed calls", h.failures)
+			h.unavailable = false
+			h.recovered = true
+		}
+		h.failures = 0
+
+		return
+	}
+
+	h.failures++
+	if !h.unavailable && h.failures >= h.threshold {
+		klog.Warningf("CloudStack API is unavailable after %d consecutive failed calls, only retrying every %v until it is back", h.failures, h.backoff)
+		h.unavailable = true
+		h.nextProbe = h.now().Add(h.backoff)
+	}
+}
+
+// takeRecovered returns true once after the API became available again.
+func (h *apiHealth) takeRecovered() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	recovered := h.recovered
+	h.recovered = false
+
+	return recovered
+}
+
+// apiHealthTransport records the outcome of the CloudStack API requests in health, and fails
+// requests without sending them while the API is unavailable.
+type apiHealthTransport struct {
+	next   http.RoundTripper
+	health *apiHealth
+}
+
+func (t *apiHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.health.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	t.health.record(err != nil || isUnavailableStatus(resp.StatusCode))
+
+	return resp, err
+}
+
+// isUnavailableStatus returns true for the HTTP status codes of a proxy in front of a management server
+// that is down. CloudStack itself answers failed API calls with 4xx and 5xx codes like 530, which are
+// not counted, as those prove the API is available.
+func isUnavailableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
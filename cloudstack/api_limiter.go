@@ -0,0 +1,77 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// apiLimiterTransport bounds the number of concurrent requests to the CloudStack API across all reconciles.
+// A request waits for a free slot until its context is done, and holds the slot until its response body is
+// closed, as the response is still being received until then. The requests of a reconcile are sent with its
+// context, see reconcileClient, so the wait ends when the reconcile is cancelled or the HTTP client times out.
+type apiLimiterTransport struct {
+	next  http.RoundTripper
+	slots chan struct{}
+}
+
+func newAPILimiterTransport(next http.RoundTripper, limit int) *apiLimiterTransport {
+	return &apiLimiterTransport{next: next, slots: make(chan struct{}, limit)}
+}
+
+func (t *apiLimiterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, fmt.Errorf("waiting for a free CloudStack API slot: %w", req.Context().Err())
+	}
+	apiRequestsInFlight.Inc()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.release()
+
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: t.release}
+
+	return resp, nil
+}
+
+func (t *apiLimiterTransport) release() {
+	apiRequestsInFlight.Dec()
+	<-t.slots
+}
+
+// releasingBody releases the slot of its request once it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+
+	return err
+}
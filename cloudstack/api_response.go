@@ -0,0 +1,86 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// htmlSniffLength is how much of a response body is inspected to tell an HTML page from JSON.
+const htmlSniffLength = 512
+
+// errHTMLResponse is returned when the CloudStack API answered with an HTML page instead of JSON.
+var errHTMLResponse = errors.New("CloudStack API returned an HTML page instead of JSON")
+
+// htmlTitleRegexp extracts the title of an HTML page, which usually says what went wrong.
+var htmlTitleRegexp = regexp.MustCompile(`(?is)<title[^>]*>\s*(.*?)\s*</title>`)
+
+// htmlResponseTransport fails requests that are answered with an HTML page, f.e. the error or login page
+// of a proxy in front of the management server, or a web server at a wrong api-url. The CloudStack client
+// would otherwise fail to unmarshal the page with an error that does not say what was returned.
+type htmlResponseTransport struct {
+	next http.RoundTripper
+}
+
+func (t *htmlResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body := bufio.NewReaderSize(resp.Body, htmlSniffLength)
+	// A short body returns an error with what it has, which is fine to inspect.
+	peek, _ := body.Peek(htmlSniffLength)
+	if !isHTMLResponse(resp.Header.Get("Content-Type"), peek) {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}
+
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	page := ""
+	if m := htmlTitleRegexp.FindSubmatch(peek); m != nil {
+		page = fmt.Sprintf(" %q", html.UnescapeString(string(m[1])))
+	}
+
+	return nil, fmt.Errorf("%w: %s answered with status %s and the page%s; check that api-url points to the CloudStack API, "+
+		"f.e. https://cloudstack.example.com/client/api, and the configuration of any proxy in front of it",
+		errHTMLResponse, req.URL.Host, resp.Status, page)
+}
+
+// isHTMLResponse returns true when the content type or the start of the body is that of an HTML page.
+// CloudStack API responses are JSON, which never starts with '<'.
+func isHTMLResponse(contentType string, body []byte) bool {
+	if strings.Contains(strings.ToLower(contentType), "html") {
+		return true
+	}
+
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
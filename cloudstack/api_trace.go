@@ -0,0 +1,132 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// apiTraceVerbosity is the klog verbosity at which traced CloudStack API calls are logged.
+const apiTraceVerbosity = 8
+
+// redactedValue replaces the values of sensitive parameters and response fields in traces.
+const redactedValue = "REDACTED"
+
+// apiTraceSensitiveParams are the request parameters, in lower case, whose values are never logged.
+var apiTraceSensitiveParams = map[string]bool{
+	"apikey":     true,
+	"signature":  true,
+	"secretkey":  true,
+	"password":   true,
+	"sessionkey": true,
+	"userdata":   true,
+}
+
+// apiTraceSensitiveFields matches JSON fields of responses whose values are never logged, f.e. the keys of users.
+var apiTraceSensitiveFields = regexp.MustCompile(`(?i)("(?:apikey|secretkey|password|sessionkey|privatekey)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// apiTraceTransport logs the parameters and the response of every CloudStack API call, with the credentials,
+// signatures and other secrets redacted. It only logs at verbosity apiTraceVerbosity, so enabling it in the
+// configuration alone does not change the logs.
+type apiTraceTransport struct {
+	next http.RoundTripper
+}
+
+func (t *apiTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logger := klog.V(apiTraceVerbosity)
+	if !logger.Enabled() {
+		return t.next.RoundTrip(req)
+	}
+
+	params, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	command := params.Get("command")
+	logger.InfoS("CloudStack API request", "command", command, "method", req.Method, "params", redactParams(params))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		logger.InfoS("CloudStack API request failed", "command", command, "duration", time.Since(start), "err", err)
+
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp, nil //nolint:nilerr // The client reports the incomplete body itself.
+	}
+	logger.InfoS("CloudStack API response", "command", command, "status", resp.StatusCode, "duration", time.Since(start),
+		"body", apiTraceSensitiveFields.ReplaceAllString(string(body), `$1"`+redactedValue+`"`))
+
+	return resp, nil
+}
+
+// requestParams returns the parameters of an API request, from the query of a GET or the form of a POST request.
+// The body of a POST request is restored, so it can still be sent.
+func requestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return params, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		// An unparsable form is still sent as is, only its parameters are not logged.
+		return params, nil //nolint:nilerr
+	}
+	for key, values := range form {
+		params[key] = append(params[key], values...)
+	}
+
+	return params, nil
+}
+
+// redactParams encodes the request parameters with the values of sensitive parameters replaced.
+func redactParams(params url.Values) string {
+	redacted := make(url.Values, len(params))
+	for key, values := range params {
+		if apiTraceSensitiveParams[strings.ToLower(key)] {
+			redacted[key] = []string{redactedValue}
+
+			continue
+		}
+		redacted[key] = values
+	}
+
+	return redacted.Encode()
+}
@@ -20,18 +20,36 @@
 package cloudstack
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
 	"gopkg.in/gcfg.v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
 )
 
 // CSConfig wraps the config for the CloudStack cloud provider.
@@ -43,25 +61,461 @@ type CSConfig struct {
 		SSLNoVerify bool   `gcfg:"ssl-no-verify"`
 		ProjectID   string `gcfg:"project-id"`
 		Zone        string `gcfg:"zone"`
+
+		// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout limit the connections to the
+		// CloudStack API, f.e. "10s". They are separate from the timeout of async jobs.
+		DialTimeout           string `gcfg:"dial-timeout"`
+		TLSHandshakeTimeout   string `gcfg:"tls-handshake-timeout"`
+		ResponseHeaderTimeout string `gcfg:"response-header-timeout"`
+
+		// APIFailureThreshold is the number of consecutive failed API calls after which the API is considered
+		// unavailable, f.e. during maintenance. Calls then fail immediately except for a probe every APIFailureBackoff.
+		APIFailureThreshold int    `gcfg:"api-failure-threshold"`
+		APIFailureBackoff   string `gcfg:"api-failure-backoff"`
+
+		// MaxConcurrentAPICalls bounds the number of concurrent requests to the CloudStack API. 0 is unlimited.
+		MaxConcurrentAPICalls int `gcfg:"max-concurrent-api-calls"`
+
+		// CAFile is a PEM bundle of CA certificates used instead of the system trust store to verify
+		// the CloudStack API. ClientCertFile and ClientKeyFile optionally configure a client certificate.
+		CAFile         string `gcfg:"ca-file"`
+		ClientCertFile string `gcfg:"client-cert-file"`
+		ClientKeyFile  string `gcfg:"client-key-file"`
+
+		// CredentialsSecret is a namespace/name reference to a Secret with the keys "api-key" and "secret-key".
+		// Its credentials replace APIKey and SecretKey, which are then optional, and are read again every
+		// CredentialsRefreshInterval.
+		CredentialsSecret          string `gcfg:"credentials-secret"`
+		CredentialsRefreshInterval string `gcfg:"credentials-refresh-interval"`
+
+		// TraceAPICalls logs the parameters and responses of all API calls, with secrets redacted,
+		// when the verbosity is at least apiTraceVerbosity.
+		TraceAPICalls bool `gcfg:"trace-api-calls"`
+	}
+
+	// LoadBalancer holds the settings for the load balancer implementation.
+	LoadBalancer struct {
+		// NodeSelector is a label selector restricting which nodes are assigned to load balancers.
+		NodeSelector string `gcfg:"node-selector"`
+		// EmptyNodes is what an update without any node to assign does with the hosts of the rules:
+		// "keep" them (the default) or "remove" them.
+		EmptyNodes string `gcfg:"empty-nodes"`
+		// IPSharing is whether a requested IP with load balancer rules of other services can be used:
+		// "allow" it as long as the ports do not overlap (the default), or "deny" it.
+		IPSharing string `gcfg:"ip-sharing"`
+		// DefaultAlgorithm is the algorithm of services without session affinity: "roundrobin" (the default),
+		// "leastconn" or "source". The algorithm annotation overrides it.
+		DefaultAlgorithm string `gcfg:"default-algorithm"`
+		// VMCacheTTL is how long the virtual machine list is shared between reconciles, f.e. "5s".
+		VMCacheTTL string `gcfg:"vm-cache-ttl"`
+		// VerifyHostsRetries is how often the VM list is fetched again when not all nodes have a VM yet.
+		VerifyHostsRetries int `gcfg:"verify-hosts-retries"`
+		// VerifyHostsRetryDelay is the delay between those retries, f.e. "2s".
+		VerifyHostsRetryDelay string `gcfg:"verify-hosts-retry-delay"`
+		// HostVMStates is a comma-separated list of the VM states in which nodes are assigned to load balancers,
+		// f.e. "Running,Migrating". Empty assigns nodes regardless of the state of their VM.
+		HostVMStates string `gcfg:"host-vm-states"`
+		// HostMatching is a comma-separated list of the strategies matching nodes to CloudStack VMs, tried in
+		// order: "provider-id", "name", "label" and "ip". Empty matches by provider ID, then by name.
+		// HostMatchingLabel is the node label holding the VM ID for the "label" strategy.
+		HostMatching      string `gcfg:"host-matching"`
+		HostMatchingLabel string `gcfg:"host-matching-label"`
+		// NetworkMismatchRetryDelay requeues services whose nodes span networks after this delay, f.e. "30s",
+		// instead of failing them. NetworkMismatchTimeout limits how long they are requeued, f.e. "1h".
+		NetworkMismatchRetryDelay string `gcfg:"network-mismatch-retry-delay"`
+		NetworkMismatchTimeout    string `gcfg:"network-mismatch-timeout"`
+		// CapacityRetryDelay requeues services that failed because a resource limit or capacity is exhausted
+		// after this delay, f.e. "1m", doubled on every consecutive failure up to CapacityRetryMaxDelay.
+		CapacityRetryDelay    string `gcfg:"capacity-retry-delay"`
+		CapacityRetryMaxDelay string `gcfg:"capacity-retry-max-delay"`
+		// UnavailableRetryDelay and UnavailableRetryMaxDelay do the same for services that failed because the
+		// management server was unavailable or too busy.
+		UnavailableRetryDelay    string `gcfg:"unavailable-retry-delay"`
+		UnavailableRetryMaxDelay string `gcfg:"unavailable-retry-max-delay"`
+		// ReconcileEvents emits an event with the duration and CloudStack API calls of each EnsureLoadBalancer.
+		ReconcileEvents bool `gcfg:"reconcile-events"`
+		// FirewallRuleEvents emits an event on the service for every firewall rule created or deleted for it.
+		FirewallRuleEvents bool `gcfg:"firewall-rule-events"`
+		// OwnedFirewallRulesOnly tags the firewall rules we create and never deletes untagged rules.
+		OwnedFirewallRulesOnly bool `gcfg:"owned-firewall-rules-only"`
+		// OwnerTagKey and OwnerTagValue are that tag, "created-by" and "cloudstack-kubernetes-provider" by
+		// default. "{cluster}" in the value is replaced by the cluster name.
+		OwnerTagKey   string `gcfg:"owner-tag-key"`
+		OwnerTagValue string `gcfg:"owner-tag-value"`
+		// PreviousOwnerTags are comma-separated key=value owner tags used before, whose rules are still ours.
+		PreviousOwnerTags string `gcfg:"previous-owner-tags"`
+		// KeepRangedFirewallRules never deletes firewall rules spanning a port range.
+		KeepRangedFirewallRules bool `gcfg:"keep-ranged-firewall-rules"`
+		// SkipFirewallOnNetworkError skips the firewall rules of a port instead of failing the reconcile
+		// when the network cannot be fetched because of a CloudStack API error.
+		SkipFirewallOnNetworkError bool `gcfg:"skip-firewall-on-network-error"`
+		// AssumeFirewallOnNetworkError creates the firewall rules of a port as if the network supported them
+		// when it cannot be fetched because of a CloudStack API error. It excludes SkipFirewallOnNetworkError.
+		AssumeFirewallOnNetworkError bool `gcfg:"assume-firewall-on-network-error"`
+		// RequireFirewall fails the reconcile of load balancers in networks without the Firewall service,
+		// instead of creating them with a warning that their source ranges are ignored.
+		RequireFirewall bool `gcfg:"require-firewall"`
+		// OpenFirewall lets CloudStack open the firewall for all sources when it creates a load balancer rule,
+		// instead of creating firewall rules with the source ranges of the service.
+		OpenFirewall bool `gcfg:"open-firewall"`
+		// AllowedProtocols is a comma-separated list of the load balancer protocols services may use,
+		// out of "tcp", "udp" and "tcp-proxy". Empty allows all of them.
+		AllowedProtocols string `gcfg:"allowed-protocols"`
+		// TagLabels is a comma-separated list of service label keys propagated as tags onto the rules we create.
+		TagLabels string `gcfg:"tag-labels"`
+		// TagAnnotations is a comma-separated list of service annotation keys propagated as tags onto the rules we create.
+		TagAnnotations string `gcfg:"tag-annotations"`
+		// RuleMembersCacheTTL is how long the hosts assigned to a rule are remembered instead of listed, f.e. "10m".
+		RuleMembersCacheTTL string `gcfg:"rule-members-cache-ttl"`
+		// RuleRecreateCooldown is how long after a rule was recreated with new ports or a new IP it is not
+		// recreated again, f.e. "5m". Empty or "0" recreates rules whenever needed.
+		RuleRecreateCooldown string `gcfg:"rule-recreate-cooldown"`
+		// InstanceSyncInterval is how often the hosts of the load balancer rules are compared with those of the
+		// last reconcile, to re-assign hosts CloudStack dropped, f.e. "10m". Empty or "0" disables the sync.
+		InstanceSyncInterval string `gcfg:"instance-sync-interval"`
+		// DisableIPRelease never releases public IPs, f.e. when their lifecycle is managed externally.
+		DisableIPRelease bool `gcfg:"disable-ip-release"`
+		// DisableIPAssociation never associates public IPs. Services must request an IP that is already
+		// allocated, f.e. from a VIP pool managed externally. It implies DisableIPRelease.
+		DisableIPAssociation bool `gcfg:"disable-ip-association"`
+		// OrderedTeardown deletes a load balancer in phases: all its firewall rules, then its hosts, then its rules.
+		OrderedTeardown bool `gcfg:"ordered-teardown"`
+
+		// ZoneAnnotation records the CloudStack zone of the load balancer on the service as an annotation.
+		ZoneAnnotation bool `gcfg:"zone-annotation"`
+		// CapacityCheck checks the public IP limit before allocating an IP, instead of failing halfway.
+		CapacityCheck bool `gcfg:"capacity-check"`
+		// CapacityReserve is the number of public IPs of the limit that CapacityCheck keeps free, pausing
+		// new allocations for load balancers before the limit is reached.
+		CapacityReserve int `gcfg:"capacity-reserve"`
+		// HostBatchSize is the maximum number of hosts assigned to or removed from a rule per API call.
+		HostBatchSize int `gcfg:"host-batch-size"`
+		// ReuseServiceIP reuses a retained IP tagged with the service instead of allocating a new one.
+		ReuseServiceIP bool `gcfg:"reuse-service-ip"`
+		// IPSelection is the strategy for picking a new public IP: "cloudstack", "lowest" or "pool".
+		// IPPool is the VLAN name of the public IP range the "pool" strategy allocates from.
+		IPSelection string `gcfg:"ip-selection"`
+		IPPool      string `gcfg:"ip-pool"`
+		// RecoverLeakedIPs reuses an IP tagged with the service that has no rules instead of allocating a new one.
+		RecoverLeakedIPs bool `gcfg:"recover-leaked-ips"`
+		// SessionAffinityTimeout applies the ClientIP session affinity timeout through a stickiness policy.
+		SessionAffinityTimeout bool `gcfg:"session-affinity-timeout"`
+		// DefaultSourceRangesTCP and DefaultSourceRangesUDP are comma-separated CIDRs allowed to reach
+		// TCP and UDP ports of services that do not set source ranges themselves.
+		DefaultSourceRangesTCP string `gcfg:"default-source-ranges-tcp"`
+		DefaultSourceRangesUDP string `gcfg:"default-source-ranges-udp"`
+		// AllowICMPFragmentationNeeded allows ICMP fragmentation needed messages to all load balancer IPs by default.
+		AllowICMPFragmentationNeeded bool `gcfg:"allow-icmp-fragmentation-needed"`
+		// NamePrefix, NameSeparator and NameHashSuffix configure the naming scheme of load balancers.
+		NamePrefix     string `gcfg:"name-prefix"`
+		NameSeparator  string `gcfg:"name-separator"`
+		NameHashSuffix bool   `gcfg:"name-hash-suffix"`
+		// SelfTest provisions and deletes a load balancer in SelfTestNetworkID at startup, to detect
+		// missing permissions or unsuitable offerings before any service is reconciled.
+		SelfTest          bool   `gcfg:"self-test"`
+		SelfTestNetworkID string `gcfg:"self-test-network-id"`
 	}
+
+	// ZoneMapping translates CloudStack zones, keyed by zone name, to the Kubernetes
+	// topology zone and region labels of the nodes in that zone.
+	ZoneMapping map[string]*struct {
+		KubernetesZone string `gcfg:"kubernetes-zone"`
+		Region         string `gcfg:"region"`
+	} `gcfg:"zone-mapping"`
+
+	// AnnotationDefault holds cluster-wide default values for service annotations, keyed
+	// by the full annotation name. A default only applies when the service omits the annotation.
+	AnnotationDefault map[string]*struct {
+		Value string `gcfg:"value"`
+	} `gcfg:"annotation-default"`
 }
 
 var (
 	_ cloudprovider.Interface    = (*CSCloud)(nil)
+	_ cloudprovider.InformerUser = (*CSCloud)(nil)
 	_ cloudprovider.InstancesV2  = (*CSCloud)(nil)
 	_ cloudprovider.LoadBalancer = (*CSCloud)(nil)
 )
 
 // CSCloud is an implementation of Interface for CloudStack.
 type CSCloud struct {
+	// client is replaced when the credentials are rotated, use apiClient to read it. apiKey and secretKey
+	// are its credentials, for the clients of newContextClient.
 	client        *cloudstack.CloudStackClient
+	apiKey        string
+	secretKey     string
+	clientMu      sync.RWMutex
 	projectID     string // If non-"", all resources will be created within this project
 	zone          string
 	kclient       kubernetes.Interface
 	eventRecorder record.EventRecorder
+
+	// serviceLister lists services from the shared informer of the service controller, see SetInformers.
+	serviceLister corelisters.ServiceLister
+
+	// annotationDefaults are applied to services that do not set the annotation themselves.
+	annotationDefaults map[string]string
+
+	// nodeSelector restricts the nodes that are eligible as load balancer backends. Nil selects all nodes.
+	nodeSelector labels.Selector
+
+	// emptyNodes is emptyNodesKeep or emptyNodesRemove, see updateLoadBalancerWithoutNodes.
+	emptyNodes string
+
+	// ipSharing is ipSharingAllow or ipSharingDeny, see checkPublicIPConflict.
+	ipSharing string
+
+	// defaultAlgorithm is the algorithm of services without session affinity, see getLoadBalancerAlgorithm.
+	defaultAlgorithm string
+
+	// vmCache caches the virtual machine list used to resolve nodes. Nil disables caching.
+	vmCache *vmListCache
+
+	// ruleMembers caches the hosts assigned to load balancer rules. Nil disables caching.
+	ruleMembers *ruleMembersCache
+
+	// recreateCooldown defers recreating load balancer rules that were recreated recently. Nil disables it.
+	recreateCooldown *ruleRecreateCooldown
+
+	// instanceSync re-assigns hosts that were dropped from load balancer rules out-of-band. Nil disables it.
+	instanceSync *instanceSync
+
+	// verifyHostsRetries and verifyHostsRetryDelay control how long verifyHosts waits for VMs of new nodes.
+	verifyHostsRetries    int
+	verifyHostsRetryDelay time.Duration
+
+	// hostVMStates are the VM states in which nodes are assigned to load balancers. Nil allows all states.
+	hostVMStates []string
+
+	// hostMatching are the strategies matching nodes to VMs, see nodeMatcher. Nil matches by provider ID, then by name.
+	// hostMatchingLabel is the node label holding the VM ID for the label strategy.
+	hostMatching      []string
+	hostMatchingLabel string
+
+	// networkMismatchRetryDelay and networkMismatchTimeout control how services whose nodes span networks
+	// are requeued, see networkMismatchError. networkMismatchSince is when that was first seen, by service.
+	networkMismatchRetryDelay time.Duration
+	networkMismatchTimeout    time.Duration
+	networkMismatchMu         sync.Mutex
+	networkMismatchSince      map[string]time.Time
+
+	// retryBackoffs are the backoffs of the transient failure classes, see transientRetryError.
+	// retryStates are the consecutive transient failures, by service.
+	retryBackoffs map[retryClass]retryBackoff
+	retryMu       sync.Mutex
+	retryStates   map[string]retryState
+
+	// ownedFirewallRulesOnly keeps firewall rules that other tools created on the load balancer IPs.
+	ownedFirewallRulesOnly bool
+
+	// ownerTagKey and ownerTagValue tag the firewall rules we create, see ownerTag.
+	ownerTagKey   string
+	ownerTagValue string
+	// previousOwnerTags mark the firewall rules created by us before the owner tag was changed.
+	previousOwnerTags []cloudstack.Tags
+
+	// keepRangedFirewallRules keeps firewall rules spanning a port range instead of deleting them.
+	keepRangedFirewallRules bool
+
+	// capacityCheck fails load balancer reconciles early when no public IP can be allocated.
+	capacityCheck bool
+	// capacityReserve is the number of public IPs below the limit at which capacityCheck pauses allocations.
+	capacityReserve int
+
+	// hostBatchSize splits host assignments and removals into API calls of at most this many hosts.
+	hostBatchSize int
+
+	// disableIPRelease keeps all public IPs allocated when their load balancer is deleted.
+	disableIPRelease bool
+
+	// disableIPAssociation requires services to request an allocated IP instead of associating a new one.
+	disableIPAssociation bool
+
+	// orderedTeardown deletes load balancers phase by phase, see deleteRulesOrdered.
+	orderedTeardown bool
+
+	// zoneAnnotation writes ServiceAnnotationLoadBalancerZone on services with a load balancer.
+	zoneAnnotation bool
+
+	// reuseServiceIP looks for a retained IP of a previous incarnation of the service before allocating one.
+	reuseServiceIP bool
+
+	// ipSelection is the strategy for picking a new public IP, and ipPool the VLAN of the pool strategy.
+	ipSelection string
+	ipPool      string
+
+	// recoverLeakedIPs looks for an IP that was allocated for the service without rules before allocating one.
+	recoverLeakedIPs bool
+
+	// sessionAffinityTimeout manages a source based stickiness policy with the session affinity timeout on all rules.
+	sessionAffinityTimeout bool
+
+	// allowICMPFragmentationNeeded is the default of the allow-icmp-fragmentation-needed annotation.
+	allowICMPFragmentationNeeded bool
+
+	// defaultSourceRanges are the source ranges of services without source ranges, keyed by IP protocol.
+	defaultSourceRanges map[string][]string
+
+	// skipFirewallOnNetworkError keeps reconciling load balancer rules when the network lookup for their firewall rules fails.
+	skipFirewallOnNetworkError bool
+
+	// assumeFirewallOnNetworkError keeps creating firewall rules when the network lookup for them fails.
+	assumeFirewallOnNetworkError bool
+
+	// requireFirewall refuses load balancers in networks that cannot enforce their source ranges.
+	requireFirewall bool
+
+	// openFirewall creates load balancer rules that open the firewall themselves, ignoring the source ranges.
+	openFirewall bool
+
+	// allowedProtocols are the load balancer protocols services may use. Nil allows all protocols.
+	allowedProtocols []LoadBalancerProtocol
+
+	// propagatedTags are the service labels and annotations propagated as tags onto the rules.
+	propagatedTags []propagatedTag
+
+	// apiHealth fails CloudStack API calls early while the API is unavailable. Nil disables this.
+	apiHealth *apiHealth
+
+	// credentials reads the API credentials from a Secret. Nil when they only come from the cloud config.
+	credentials *credentialsSource
+
+	// nameScheme builds the names of load balancers. Rules named by another scheme are renamed to it.
+	nameScheme NameScheme
+
+	// serviceLocks serializes the load balancer reconciles of each service.
+	serviceLocks serviceLocks
+
+	// zoneMapping holds the topology labels for CloudStack zones, keyed by zone name.
+	zoneMapping map[string]topologyLabels
+
+	// selfTestNetworkID is the network the self-test runs in at startup. Empty disables the self-test.
+	selfTestNetworkID string
+
+	// reconcileEvents enables the reconcile duration events. newContextClient builds a client that sends its
+	// requests with the given context, so they are counted in its API call counter and the wait for a slot of
+	// max-concurrent-api-calls ends with it, see reconcileClient.
+	reconcileEvents  bool
+	newContextClient func(ctx context.Context, apiKey, secretKey string) *cloudstack.CloudStackClient
+
+	// firewallRuleEvents emits an event for every firewall rule change, see setFirewallRuleEvents.
+	firewallRuleEvents bool
+}
+
+// topologyLabels are the Kubernetes topology zone and region of a CloudStack zone.
+type topologyLabels struct {
+	zone   string
+	region string
+}
+
+// apiCallCounterKey is the context key of the API call counter of a reconcile.
+type apiCallCounterKey struct{}
+
+// withAPICallCounter returns a context in which the CloudStack API requests are counted in count.
+func withAPICallCounter(ctx context.Context, count *atomic.Int64) context.Context {
+	return context.WithValue(ctx, apiCallCounterKey{}, count)
+}
+
+// apiCallCounter returns the API call counter of ctx, or nil when the requests of ctx are not counted.
+func apiCallCounter(ctx context.Context) *atomic.Int64 {
+	count, _ := ctx.Value(apiCallCounterKey{}).(*atomic.Int64)
+
+	return count
+}
+
+// countingTransport counts the HTTP requests made to the CloudStack API in the counter of their context.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if count := apiCallCounter(req.Context()); count != nil {
+		count.Add(1)
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// contextTransport sends the requests with ctx, as cloudstack-go builds its requests without a context. The
+// deadline that the timeout of the HTTP client set on the request is kept.
+type contextTransport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if deadline, ok := req.Context().Deadline(); ok {
+		ctx, cancel = context.WithDeadline(t.ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(t.ctx)
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+	// The context must stay alive until the response body is read.
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: cancel}
+
+	return resp, nil
+}
+
+// The defaults of the HTTP client timeouts match those of the CloudStack client.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultHTTPRequestTimeout    = 60 * time.Second
+
+	// zoneMappingRetryInterval is the interval between attempts to list the zones to validate the zone mapping.
+	zoneMappingRetryInterval = 30 * time.Second
+)
+
+// httpClientTimeouts are the network-level timeouts of the HTTP client used for the CloudStack API.
+type httpClientTimeouts struct {
+	dial           time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+}
+
+// newHTTPClient returns an HTTP client with the same settings as the default CloudStack client,
+// but with the given TLS config and timeouts. When count is set, the requests are counted, see countingTransport.
+// HTML pages are turned into an error that explains them, see htmlResponseTransport.
+func newHTTPClient(tlsConfig *tls.Config, timeouts httpClientTimeouts, count, trace bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{
+		Timeout:   timeouts.dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = timeouts.tlsHandshake
+	transport.ResponseHeaderTimeout = timeouts.responseHeader
+
+	var rt http.RoundTripper = transport
+	if trace {
+		rt = &apiTraceTransport{next: rt}
+	}
+	rt = &htmlResponseTransport{next: rt}
+	if count {
+		rt = &countingTransport{next: rt}
+	}
+
+	return &http.Client{
+		Transport: rt,
+		// The overall request timeout must not cut off a longer response-header-timeout.
+		Timeout: max(defaultHTTPRequestTimeout, timeouts.responseHeader),
+	}
 }
 
 func init() {
+	registerMetrics()
+
 	cloudprovider.RegisterCloudProvider(ProviderName, func(config io.Reader) (cloudprovider.Interface, error) {
 		cfg, err := readConfig(config)
 		if err != nil {
@@ -91,21 +545,532 @@ func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 	cs := &CSCloud{
 		projectID: cfg.Global.ProjectID,
 		zone:      cfg.Global.Zone,
+
+		ownedFirewallRulesOnly:     cfg.LoadBalancer.OwnedFirewallRulesOnly,
+		keepRangedFirewallRules:    cfg.LoadBalancer.KeepRangedFirewallRules,
+		firewallRuleEvents:         cfg.LoadBalancer.FirewallRuleEvents,
+		skipFirewallOnNetworkError: cfg.LoadBalancer.SkipFirewallOnNetworkError,
+		requireFirewall:            cfg.LoadBalancer.RequireFirewall,
+		openFirewall:               cfg.LoadBalancer.OpenFirewall,
+		disableIPRelease:           cfg.LoadBalancer.DisableIPRelease || cfg.LoadBalancer.DisableIPAssociation,
+		disableIPAssociation:       cfg.LoadBalancer.DisableIPAssociation,
+		orderedTeardown:            cfg.LoadBalancer.OrderedTeardown,
+		zoneAnnotation:             cfg.LoadBalancer.ZoneAnnotation,
+		capacityCheck:              cfg.LoadBalancer.CapacityCheck,
+		reuseServiceIP:             cfg.LoadBalancer.ReuseServiceIP,
+		recoverLeakedIPs:           cfg.LoadBalancer.RecoverLeakedIPs,
+		sessionAffinityTimeout:     cfg.LoadBalancer.SessionAffinityTimeout,
+
+		allowICMPFragmentationNeeded: cfg.LoadBalancer.AllowICMPFragmentationNeeded,
+		assumeFirewallOnNetworkError: cfg.LoadBalancer.AssumeFirewallOnNetworkError,
+	}
+
+	if cs.skipFirewallOnNetworkError && cs.assumeFirewallOnNetworkError {
+		return nil, errors.New("load balancer skip-firewall-on-network-error and assume-firewall-on-network-error are mutually exclusive")
+	}
+
+	// With credentials-secret, the keys of the cloud config are optional, as the client is then created once the
+	// Secret was read, see loadCredentials.
+	staticKeys := cfg.Global.APIKey != "" && cfg.Global.SecretKey != ""
+	if cfg.Global.APIURL != "" && (staticKeys || cfg.Global.CredentialsSecret != "") {
+		timeouts, err := parseHTTPClientTimeouts(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		cs.reconcileEvents = cfg.LoadBalancer.ReconcileEvents
+		if cfg.Global.TraceAPICalls {
+			klog.Warningf("Tracing of CloudStack API calls is enabled; with verbosity %d or higher, all API requests and responses are logged", apiTraceVerbosity)
+		}
+		httpClient := newHTTPClient(tlsConfig, timeouts, cs.reconcileEvents, cfg.Global.TraceAPICalls)
+		// A request that timed out waiting for a slot never reached the API, so the health of the API is
+		// recorded inside of the limiter.
+		if cfg.Global.APIFailureThreshold < 0 {
+			return nil, fmt.Errorf("invalid api-failure-threshold %d: must not be negative", cfg.Global.APIFailureThreshold)
+		}
+		if cfg.Global.APIFailureThreshold > 0 {
+			backoff, err := parseDurationOption("api-failure-backoff", cfg.Global.APIFailureBackoff, defaultAPIFailureBackoff)
+			if err != nil {
+				return nil, err
+			}
+			cs.apiHealth = newAPIHealth(cfg.Global.APIFailureThreshold, backoff)
+			httpClient.Transport = &apiHealthTransport{next: httpClient.Transport, health: cs.apiHealth}
+		}
+		if cfg.Global.MaxConcurrentAPICalls < 0 {
+			return nil, fmt.Errorf("invalid max-concurrent-api-calls %d: must not be negative", cfg.Global.MaxConcurrentAPICalls)
+		}
+		if cfg.Global.MaxConcurrentAPICalls > 0 {
+			httpClient.Transport = newAPILimiterTransport(httpClient.Transport, cfg.Global.MaxConcurrentAPICalls)
+		}
+		newClient := func(apiKey, secretKey string) *cloudstack.CloudStackClient {
+			return cloudstack.NewAsyncClient(cfg.Global.APIURL, apiKey, secretKey, !cfg.Global.SSLNoVerify, cloudstack.WithHTTPClient(httpClient))
+		}
+		// The calls of a reconcile are sent with its context, to count them and to end their wait for a slot.
+		if cs.reconcileEvents || cfg.Global.MaxConcurrentAPICalls > 0 {
+			cs.newContextClient = func(ctx context.Context, apiKey, secretKey string) *cloudstack.CloudStackClient {
+				contextClient := &http.Client{
+					Transport: &contextTransport{next: httpClient.Transport, ctx: ctx},
+					Timeout:   httpClient.Timeout,
+				}
+
+				return cloudstack.NewAsyncClient(cfg.Global.APIURL, apiKey, secretKey, !cfg.Global.SSLNoVerify, cloudstack.WithHTTPClient(contextClient))
+			}
+		}
+		if staticKeys {
+			cs.setAPIClient(newClient(cfg.Global.APIKey, cfg.Global.SecretKey), cfg.Global.APIKey, cfg.Global.SecretKey)
+		}
+
+		if cfg.Global.CredentialsSecret != "" {
+			cs.credentials, err = newCredentialsSource(cfg.Global.CredentialsSecret, cfg.Global.CredentialsRefreshInterval, cfg.Global.APIKey, cfg.Global.SecretKey, newClient)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cs.client == nil && cs.credentials == nil {
+		return nil, errors.New("cloud provider configuration incomplete: api-url, and api-key and secret-key or credentials-secret, are required")
+	}
+
+	annotationDefaults, err := parseAnnotationDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cs.annotationDefaults = annotationDefaults
+
+	zoneMapping, err := parseZoneMapping(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cs.zoneMapping = zoneMapping
+
+	if cfg.LoadBalancer.NodeSelector != "" {
+		selector, err := labels.Parse(cfg.LoadBalancer.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid load balancer node-selector %q: %w", cfg.LoadBalancer.NodeSelector, err)
+		}
+		cs.nodeSelector = selector
 	}
 
-	if cfg.Global.APIURL != "" && cfg.Global.APIKey != "" && cfg.Global.SecretKey != "" {
-		cs.client = cloudstack.NewAsyncClient(cfg.Global.APIURL, cfg.Global.APIKey, cfg.Global.SecretKey, !cfg.Global.SSLNoVerify)
+	switch cfg.LoadBalancer.EmptyNodes {
+	case "", emptyNodesKeep:
+		cs.emptyNodes = emptyNodesKeep
+	case emptyNodesRemove:
+		cs.emptyNodes = emptyNodesRemove
+	default:
+		return nil, fmt.Errorf("invalid load balancer empty-nodes %q: must be %q or %q", cfg.LoadBalancer.EmptyNodes, emptyNodesKeep, emptyNodesRemove)
 	}
 
-	if cs.client == nil {
-		return nil, errors.New("cloud provider configuration incomplete: api-url, api-key, and secret-key are all required")
+	switch cfg.LoadBalancer.IPSharing {
+	case "", ipSharingAllow:
+		cs.ipSharing = ipSharingAllow
+	case ipSharingDeny:
+		cs.ipSharing = ipSharingDeny
+	default:
+		return nil, fmt.Errorf("invalid load balancer ip-sharing %q: must be %q or %q", cfg.LoadBalancer.IPSharing, ipSharingAllow, ipSharingDeny)
+	}
+
+	cs.defaultAlgorithm = "roundrobin"
+	if cfg.LoadBalancer.DefaultAlgorithm != "" {
+		if err := checkLoadBalancerAlgorithm(cfg.LoadBalancer.DefaultAlgorithm); err != nil {
+			return nil, fmt.Errorf("invalid load balancer default-algorithm: %w", err)
+		}
+		cs.defaultAlgorithm = cfg.LoadBalancer.DefaultAlgorithm
+	}
+
+	ttl, err := parseDurationOption("load balancer vm-cache-ttl", cfg.LoadBalancer.VMCacheTTL, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		cs.vmCache = newVMListCache(ttl)
+	}
+
+	ruleMembersTTL, err := parseDurationOption("load balancer rule-members-cache-ttl", cfg.LoadBalancer.RuleMembersCacheTTL, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ruleMembersTTL > 0 {
+		cs.ruleMembers = newRuleMembersCache(ruleMembersTTL)
+	}
+
+	recreateCooldown, err := parseDurationOption("load balancer rule-recreate-cooldown", cfg.LoadBalancer.RuleRecreateCooldown, 0)
+	if err != nil {
+		return nil, err
+	}
+	if recreateCooldown > 0 {
+		cs.recreateCooldown = newRuleRecreateCooldown(recreateCooldown)
+	}
+
+	instanceSyncInterval, err := parseDurationOption("load balancer instance-sync-interval", cfg.LoadBalancer.InstanceSyncInterval, 0)
+	if err != nil {
+		return nil, err
+	}
+	if instanceSyncInterval > 0 {
+		cs.instanceSync = newInstanceSync(instanceSyncInterval)
+	}
+
+	cs.nameScheme = NameScheme{
+		Prefix:     cfg.LoadBalancer.NamePrefix,
+		Separator:  cfg.LoadBalancer.NameSeparator,
+		HashSuffix: cfg.LoadBalancer.NameHashSuffix,
+	}
+	if err := cs.nameScheme.validate(); err != nil {
+		return nil, err
+	}
+
+	for protocol, value := range map[string]string{ProtoTCP: cfg.LoadBalancer.DefaultSourceRangesTCP, ProtoUDP: cfg.LoadBalancer.DefaultSourceRangesUDP} {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		ranges := strings.Split(value, ",")
+		if _, err := parseSourceRanges(ranges); err != nil {
+			return nil, fmt.Errorf("invalid load balancer default-source-ranges-%s %q: %w", protocol, value, err)
+		}
+		if cs.defaultSourceRanges == nil {
+			cs.defaultSourceRanges = make(map[string][]string, 2)
+		}
+		cs.defaultSourceRanges[protocol] = ranges
+	}
+
+	cs.allowedProtocols, err = parseAllowedProtocols(cfg.LoadBalancer.AllowedProtocols)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.ownerTagKey, cs.ownerTagValue = firewallRuleOwnerTagKey, firewallRuleOwnerTagValue
+	if cfg.LoadBalancer.OwnerTagKey != "" {
+		if slices.Contains(serviceTagKeys, cfg.LoadBalancer.OwnerTagKey) {
+			return nil, fmt.Errorf("invalid load balancer owner-tag-key %q: the tag key is used by the provider itself", cfg.LoadBalancer.OwnerTagKey)
+		}
+		cs.ownerTagKey = cfg.LoadBalancer.OwnerTagKey
+	}
+	if cfg.LoadBalancer.OwnerTagValue != "" {
+		cs.ownerTagValue = cfg.LoadBalancer.OwnerTagValue
+	}
+	cs.previousOwnerTags, err = parsePreviousOwnerTags(cfg.LoadBalancer.PreviousOwnerTags)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.propagatedTags, err = parsePropagatedTags(cfg.LoadBalancer.TagLabels, cfg.LoadBalancer.TagAnnotations, cs.ownerTagKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.LoadBalancer.CapacityReserve < 0 {
+		return nil, fmt.Errorf("invalid load balancer capacity-reserve %d: must not be negative", cfg.LoadBalancer.CapacityReserve)
+	}
+	if cfg.LoadBalancer.CapacityReserve > 0 && !cfg.LoadBalancer.CapacityCheck {
+		return nil, errors.New("load balancer capacity-reserve requires capacity-check")
+	}
+	cs.capacityReserve = cfg.LoadBalancer.CapacityReserve
+
+	switch cfg.LoadBalancer.IPSelection {
+	case "", ipSelectionCloudStack:
+		cs.ipSelection = ipSelectionCloudStack
+	case ipSelectionLowest, ipSelectionPool:
+		cs.ipSelection = cfg.LoadBalancer.IPSelection
+	default:
+		return nil, fmt.Errorf("invalid load balancer ip-selection %q: must be %q, %q or %q",
+			cfg.LoadBalancer.IPSelection, ipSelectionCloudStack, ipSelectionLowest, ipSelectionPool)
+	}
+	if (cs.ipSelection == ipSelectionPool) != (cfg.LoadBalancer.IPPool != "") {
+		return nil, fmt.Errorf("load balancer ip-pool must be set if and only if ip-selection is %q", ipSelectionPool)
+	}
+	cs.ipPool = cfg.LoadBalancer.IPPool
+
+	if cfg.LoadBalancer.HostBatchSize < 0 {
+		return nil, fmt.Errorf("invalid load balancer host-batch-size %d: must not be negative", cfg.LoadBalancer.HostBatchSize)
+	}
+	cs.hostBatchSize = cfg.LoadBalancer.HostBatchSize
+
+	if cfg.LoadBalancer.VerifyHostsRetries < 0 {
+		return nil, fmt.Errorf("invalid load balancer verify-hosts-retries %d: must not be negative", cfg.LoadBalancer.VerifyHostsRetries)
+	}
+	cs.verifyHostsRetries = cfg.LoadBalancer.VerifyHostsRetries
+
+	if strings.TrimSpace(cfg.LoadBalancer.HostVMStates) != "" {
+		for state := range strings.SplitSeq(cfg.LoadBalancer.HostVMStates, ",") {
+			state = strings.TrimSpace(state)
+			if state == "" {
+				return nil, fmt.Errorf("invalid load balancer host-vm-states %q: states must not be empty", cfg.LoadBalancer.HostVMStates)
+			}
+			cs.hostVMStates = append(cs.hostVMStates, state)
+		}
+	}
+
+	if strings.TrimSpace(cfg.LoadBalancer.HostMatching) != "" {
+		for strategy := range strings.SplitSeq(cfg.LoadBalancer.HostMatching, ",") {
+			strategy = strings.TrimSpace(strategy)
+			switch strategy {
+			case hostMatchingProviderID, hostMatchingName, hostMatchingLabel, hostMatchingIP:
+			default:
+				return nil, fmt.Errorf("invalid load balancer host-matching %q: strategies must be %q, %q, %q or %q", cfg.LoadBalancer.HostMatching,
+					hostMatchingProviderID, hostMatchingName, hostMatchingLabel, hostMatchingIP)
+			}
+			if slices.Contains(cs.hostMatching, strategy) {
+				return nil, fmt.Errorf("invalid load balancer host-matching %q: strategy %q is listed twice", cfg.LoadBalancer.HostMatching, strategy)
+			}
+			cs.hostMatching = append(cs.hostMatching, strategy)
+		}
+	}
+	if slices.Contains(cs.hostMatching, hostMatchingLabel) != (cfg.LoadBalancer.HostMatchingLabel != "") {
+		return nil, fmt.Errorf("load balancer host-matching-label must be set if and only if host-matching contains %q", hostMatchingLabel)
+	}
+	cs.hostMatchingLabel = cfg.LoadBalancer.HostMatchingLabel
+
+	cs.verifyHostsRetryDelay, err = parseDurationOption("load balancer verify-hosts-retry-delay", cfg.LoadBalancer.VerifyHostsRetryDelay, defaultVerifyHostsRetryDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.networkMismatchRetryDelay, err = parseDurationOption("load balancer network-mismatch-retry-delay", cfg.LoadBalancer.NetworkMismatchRetryDelay, 0)
+	if err != nil {
+		return nil, err
+	}
+	cs.networkMismatchTimeout, err = parseDurationOption("load balancer network-mismatch-timeout", cfg.LoadBalancer.NetworkMismatchTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	if cs.networkMismatchTimeout > 0 && cs.networkMismatchRetryDelay == 0 {
+		return nil, errors.New("load balancer network-mismatch-timeout requires network-mismatch-retry-delay")
+	}
+
+	// While backing off from an unavailable API, calls fail immediately until its next probe, so services are
+	// requeued no sooner than that by default.
+	var defaultUnavailableRetryDelay time.Duration
+	if cs.apiHealth != nil {
+		defaultUnavailableRetryDelay = cs.apiHealth.backoff
+	}
+	for class, option := range map[retryClass]struct {
+		delay, maxDelay string
+		defaultDelay    time.Duration
+	}{
+		retryClassCapacity:    {cfg.LoadBalancer.CapacityRetryDelay, cfg.LoadBalancer.CapacityRetryMaxDelay, defaultCapacityRetryDelay},
+		retryClassUnavailable: {cfg.LoadBalancer.UnavailableRetryDelay, cfg.LoadBalancer.UnavailableRetryMaxDelay, defaultUnavailableRetryDelay},
+	} {
+		backoff, err := parseRetryBackoff(class, option.delay, option.maxDelay, option.defaultDelay)
+		if err != nil {
+			return nil, err
+		}
+		if backoff != nil {
+			if cs.retryBackoffs == nil {
+				cs.retryBackoffs = make(map[retryClass]retryBackoff)
+			}
+			cs.retryBackoffs[class] = *backoff
+		}
+	}
+
+	if cfg.LoadBalancer.SelfTest {
+		if cfg.LoadBalancer.SelfTestNetworkID == "" {
+			return nil, errors.New("load balancer self-test requires self-test-network-id")
+		}
+		cs.selfTestNetworkID = cfg.LoadBalancer.SelfTestNetworkID
 	}
 
 	return cs, nil
 }
 
+// parseDurationOption parses a non-negative duration option, returning def if it is unset.
+func parseDurationOption(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+
+	return d, nil
+}
+
+// newTLSConfig returns the TLS config for the CloudStack API. Certificates are verified against
+// the system trust store, or against ca-file when it is set, unless ssl-no-verify is set.
+func newTLSConfig(cfg *CSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Global.SSLNoVerify} //nolint:gosec
+
+	if cfg.Global.CAFile != "" {
+		pem, err := os.ReadFile(cfg.Global.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca-file %q contains no PEM encoded certificates", cfg.Global.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (cfg.Global.ClientCertFile == "") != (cfg.Global.ClientKeyFile == "") {
+		return nil, errors.New("client-cert-file and client-key-file must be set together")
+	}
+	if cfg.Global.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Global.ClientCertFile, cfg.Global.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseHTTPClientTimeouts parses the HTTP client timeouts from the [Global] section.
+// Unset timeouts default to those of the CloudStack client.
+func parseHTTPClientTimeouts(cfg *CSConfig) (httpClientTimeouts, error) {
+	var (
+		timeouts httpClientTimeouts
+		err      error
+	)
+
+	if timeouts.dial, err = parseDurationOption("dial-timeout", cfg.Global.DialTimeout, defaultDialTimeout); err != nil {
+		return timeouts, err
+	}
+	if timeouts.tlsHandshake, err = parseDurationOption("tls-handshake-timeout", cfg.Global.TLSHandshakeTimeout, defaultTLSHandshakeTimeout); err != nil {
+		return timeouts, err
+	}
+	if timeouts.responseHeader, err = parseDurationOption("response-header-timeout", cfg.Global.ResponseHeaderTimeout, defaultResponseHeaderTimeout); err != nil {
+		return timeouts, err
+	}
+
+	return timeouts, nil
+}
+
+// parseAnnotationDefaults validates the configured annotation defaults and flattens them into a map.
+// Annotations that are managed by the provider itself cannot be defaulted.
+func parseAnnotationDefaults(cfg *CSConfig) (map[string]string, error) {
+	if len(cfg.AnnotationDefault) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	defaults := make(map[string]string, len(cfg.AnnotationDefault))
+	for key, d := range cfg.AnnotationDefault {
+		switch key {
+		case ServiceAnnotationLoadBalancerAddress, ServiceAnnotationLoadBalancerID, ServiceAnnotationLoadBalancerNetworkID,
+			ServiceAnnotationLoadBalancerZone:
+			return nil, fmt.Errorf("annotation %q is managed per service and cannot have a default value", key)
+		}
+		if d == nil {
+			continue
+		}
+		defaults[key] = d.Value
+	}
+
+	return defaults, nil
+}
+
+// parsePreviousOwnerTags parses the previous-owner-tags option, comma-separated key=value tags.
+func parsePreviousOwnerTags(value string) ([]cloudstack.Tags, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var tags []cloudstack.Tags
+	for tag := range strings.SplitSeq(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" || val == "" {
+			return nil, fmt.Errorf("invalid load balancer previous-owner-tags %q: expected key=value tags", value)
+		}
+		if slices.Contains(serviceTagKeys, key) {
+			return nil, fmt.Errorf("invalid load balancer previous-owner-tags %q: the tag key %q is used by the provider itself", value, key)
+		}
+		tags = append(tags, cloudstack.Tags{Key: key, Value: val})
+	}
+
+	return tags, nil
+}
+
+// parseZoneMapping validates the configured zone mapping and flattens it into a map.
+func parseZoneMapping(cfg *CSConfig) (map[string]topologyLabels, error) {
+	if len(cfg.ZoneMapping) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	mapping := make(map[string]topologyLabels, len(cfg.ZoneMapping))
+	for name, m := range cfg.ZoneMapping {
+		if m == nil {
+			continue
+		}
+		topology := topologyLabels{zone: m.KubernetesZone, region: m.Region}
+		if topology.zone == "" {
+			topology.zone = sanitizeLabel(name)
+		}
+		for _, value := range []string{topology.zone, topology.region} {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid zone-mapping for zone %q: %q is not a valid label value: %s", name, value, strings.Join(errs, "; "))
+			}
+		}
+		mapping[name] = topology
+	}
+
+	return mapping, nil
+}
+
+// missingMappedZones returns the zones of the zone mapping that do not exist in CloudStack.
+func (cs *CSCloud) missingMappedZones() ([]string, error) {
+	client := cs.apiClient()
+	r, err := client.Zone.ListZones(client.Zone.NewListZonesParams())
+	if err != nil {
+		return nil, fmt.Errorf("error listing zones to validate the zone-mapping: %w", err)
+	}
+
+	existing := make(map[string]bool, len(r.Zones))
+	for _, zone := range r.Zones {
+		existing[zone.Name] = true
+	}
+
+	var missing []string
+	for name := range cs.zoneMapping {
+		if !existing[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// validateZoneMapping logs an error if the zone mapping refers to zones that do not exist in CloudStack. It runs
+// in the background, so a CloudStack API that is unavailable while the CCM starts does not stop it; listing the
+// zones is retried until it succeeds or stop is closed.
+func (cs *CSCloud) validateZoneMapping(stop <-chan struct{}) {
+	_ = wait.PollUntilContextCancel(wait.ContextForChannel(stop), zoneMappingRetryInterval, true, func(context.Context) (bool, error) {
+		missing, err := cs.missingMappedZones()
+		if err != nil {
+			klog.Warningf("%v, retrying in %v", err, zoneMappingRetryInterval)
+
+			return false, nil
+		}
+		if len(missing) > 0 {
+			klog.Errorf("zone-mapping refers to zones that do not exist in CloudStack: %v", missing)
+		}
+
+		return true, nil
+	})
+}
+
+// topologyLabelsForZone returns the Kubernetes topology zone and region for a CloudStack zone.
+// Zones without a mapping use the sanitized zone name and no region.
+func (cs *CSCloud) topologyLabelsForZone(zoneName string) topologyLabels {
+	if topology, ok := cs.zoneMapping[zoneName]; ok {
+		return topology
+	}
+
+	return topologyLabels{zone: sanitizeLabel(zoneName)}
+}
+
 // Initialize passes a Kubernetes clientBuilder interface to the cloud provider.
-func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, _ <-chan struct{}) {
+func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	clientset := clientBuilder.ClientOrDie("cloud-controller-manager")
 	cs.kclient = clientset
 	eventBroadcaster := record.NewBroadcaster()
@@ -113,11 +1078,39 @@ func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilde
 		Interface: cs.kclient.CoreV1().Events(""),
 	})
 	cs.eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cloud-provider-cloudstack"})
+
+	// The credentials are read before any other CloudStack API call is made.
+	if cs.credentials != nil {
+		cs.loadCredentials(stop)
+		go cs.watchCredentials(stop)
+	}
+
+	if len(cs.zoneMapping) > 0 {
+		go cs.validateZoneMapping(stop)
+	}
+
+	if cs.instanceSync != nil {
+		go cs.runInstanceSync(stop)
+	}
+
+	// The self-test runs in the background, so the controllers do not wait for its CloudStack API calls, and
+	// it gates nothing: load balancers are reconciled while it runs and after it failed. A failure is only
+	// logged and exposed as a metric, as the misconfiguration may affect only some load balancers, and
+	// failing the health check would restart the CCM and run the self-test again.
+	if cs.selfTestNetworkID != "" {
+		go func() { _ = cs.runSelfTest() }()
+	}
+}
+
+// SetInformers sets up the service lister on the shared informer factory of the cloud controller manager. The
+// service controller uses the same informer and waits for its cache before it calls the load balancer methods.
+func (cs *CSCloud) SetInformers(informerFactory informers.SharedInformerFactory) {
+	cs.serviceLister = informerFactory.Core().V1().Services().Lister()
 }
 
 // LoadBalancer returns an implementation of LoadBalancer for CloudStack.
 func (cs *CSCloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
-	if cs.client == nil {
+	if cs.apiClient() == nil {
 		return nil, false
 	}
 
@@ -134,7 +1127,7 @@ func (cs *CSCloud) Instances() (cloudprovider.Instances, bool) {
 // API calls to the cloud provider when registering and syncing nodes. Implementation of this interface will
 // disable calls to the Zones interface. Also returns true if the interface is supported, false otherwise.
 func (cs *CSCloud) InstancesV2() (cloudprovider.InstancesV2, bool) {
-	if cs.client == nil {
+	if cs.apiClient() == nil {
 		return nil, false
 	}
 
@@ -90,12 +90,14 @@ func (cs *CSCloud) InstanceMetadata(_ context.Context, node *corev1.Node) (*clou
 		return nil, err
 	}
 
+	topology := cs.topologyLabelsForZone(instance.Zonename)
+
 	return &cloudprovider.InstanceMetadata{
 		ProviderID:    getInstanceProviderID(instance),
 		InstanceType:  sanitizeLabel(instance.Serviceofferingname),
 		NodeAddresses: addresses,
-		Zone:          sanitizeLabel(instance.Zonename),
-		Region:        "",
+		Zone:          topology.zone,
+		Region:        topology.region,
 	}, nil
 }
 
@@ -108,7 +110,7 @@ func (cs *CSCloud) getInstance(node *corev1.Node) (*cloudstack.VirtualMachine, e
 	if node.Spec.ProviderID == "" { //nolint:nestif
 		var err error
 		klog.V(4).Infof("looking for node by node name %v", node.Name)
-		instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
+		instance, count, err := cs.apiClient().VirtualMachine.GetVirtualMachineByName(
 			node.Name,
 			cloudstack.WithProject(cs.projectID),
 		)
@@ -132,7 +134,7 @@ func (cs *CSCloud) getInstance(node *corev1.Node) (*cloudstack.VirtualMachine, e
 		return nil, err
 	}
 
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
+	instance, count, err := cs.apiClient().VirtualMachine.GetVirtualMachineByID(
 		id,
 		cloudstack.WithProject(cs.projectID),
 	)
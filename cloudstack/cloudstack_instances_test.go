@@ -390,3 +390,29 @@ func TestInstanceMetadata(t *testing.T) {
 		})
 	}
 }
+
+func TestInstanceMetadataZoneMapping(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	cs := cloudstack.NewMockClient(mockCtrl)
+	ms := cs.VirtualMachine.(*cloudstack.MockVirtualMachineServiceIface) //nolint:forcetypeassert
+
+	fakeInstances := &CSCloud{
+		client: cs,
+		zoneMapping: map[string]topologyLabels{
+			"shouldwork": {zone: "zone-a", region: "region-1"},
+		},
+	}
+
+	ms.EXPECT().GetVirtualMachineByID("915653c4-298b-4d74-bdee-4ced282114f1", gomock.Any()).
+		Return(makeInstance("915653c4-298b-4d74-bdee-4ced282114f1", "192.168.0.1", "", "Running"), 1, nil)
+
+	metadata, err := fakeInstances.InstanceMetadata(t.Context(), makeNode("testDummyVM"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.Zone != "zone-a" || metadata.Region != "region-1" {
+		t.Errorf("zone = %q, region = %q, want %q and %q", metadata.Zone, metadata.Region, "zone-a", "region-1")
+	}
+}
@@ -21,14 +21,30 @@ package cloudstack
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"iter"
+	"maps"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
+	cloudproviderapi "k8s.io/cloud-provider/api"
 	"k8s.io/klog/v2"
 	utilnet "k8s.io/utils/net"
 )
@@ -38,6 +54,25 @@ const (
 	// by default when no explicit CIDR list is given on a LoadBalancer.
 	defaultAllowedCIDR = "0.0.0.0/0"
 
+	// defaultVerifyHostsRetryDelay is the delay between verifyHosts retries when none is configured.
+	defaultVerifyHostsRetryDelay = 2 * time.Second
+
+	// staleFirewallRulesRetryDelay is the delay before a service whose old firewall rules could not be deleted is
+	// reconciled again.
+	staleFirewallRulesRetryDelay = time.Minute
+
+	// firewallRulesSkippedRetryDelay is the delay before a service whose firewall rules were skipped because of
+	// skip-firewall-on-network-error is reconciled again.
+	firewallRulesSkippedRetryDelay = time.Minute
+
+	// PortErrorFirewallRulesSkipped is the error in the port status of a port whose firewall rules were skipped
+	// because of skip-firewall-on-network-error.
+	PortErrorFirewallRulesSkipped = "cloudstack.apache.org/FirewallRulesSkipped"
+
+	// PortErrorStaleFirewallRules is the error in the port status of a port whose old firewall rules could not be
+	// deleted and may still allow traffic.
+	PortErrorStaleFirewallRules = "cloudstack.apache.org/StaleFirewallRules"
+
 	// ServiceAnnotationLoadBalancerProxyProtocol is the annotation used on the
 	// service to enable the proxy protocol on a CloudStack load balancer.
 	// Note that this protocol only applies to TCP service ports and
@@ -54,6 +89,11 @@ const (
 	// This annotation takes precedence; spec.LoadBalancerIP is only used as a fallback.
 	ServiceAnnotationLoadBalancerAddress = "service.beta.kubernetes.io/cloudstack-load-balancer-address"
 
+	// ServiceAnnotationLoadBalancerPublicIPVLAN selects the public IP range a new IP is allocated from by the name
+	// of its VLAN as reported by CloudStack, f.e. "vlan://100", which is stable across installations unlike its ID.
+	// It only applies when an IP is allocated, not to IPs requested with ServiceAnnotationLoadBalancerAddress.
+	ServiceAnnotationLoadBalancerPublicIPVLAN = "service.beta.kubernetes.io/cloudstack-load-balancer-public-ip-vlan"
+
 	// ServiceAnnotationLoadBalancerKeepIP is a boolean annotation that, when set to "true",
 	// prevents the public IP from being released when the service is deleted.
 	ServiceAnnotationLoadBalancerKeepIP = "service.beta.kubernetes.io/cloudstack-load-balancer-keep-ip"
@@ -66,9 +106,152 @@ const (
 	// Used together with ServiceAnnotationLoadBalancerID for scoped ID-based lookups.
 	ServiceAnnotationLoadBalancerNetworkID = "service.beta.kubernetes.io/cloudstack-load-balancer-network-id"
 
+	// ServiceAnnotationLoadBalancerZone stores the CloudStack zone of the load balancer's public IP.
+	// It is informational only and written when the zone-annotation option is enabled.
+	ServiceAnnotationLoadBalancerZone = "service.beta.kubernetes.io/cloudstack-load-balancer-zone"
+
+	// ServiceAnnotationLoadBalancerManaged is a boolean annotation that, when set to "false", makes the
+	// provider ignore the service so its load balancer can be implemented by a different controller.
+	ServiceAnnotationLoadBalancerManaged = "service.beta.kubernetes.io/cloudstack-load-balancer-managed"
+
+	// ServiceAnnotationLoadBalancerAllowICMP is a boolean annotation that, when set to "true", additionally
+	// allows ICMP (f.e. ping) to the load balancer IP. Only applies to networks with the Firewall service.
+	ServiceAnnotationLoadBalancerAllowICMP = "service.beta.kubernetes.io/cloudstack-load-balancer-allow-icmp"
+
+	// ServiceAnnotationLoadBalancerICMPSourceRanges is a comma-separated list of CIDRs that are allowed to send
+	// ICMP to the load balancer IP. Defaults to the source ranges of the service.
+	ServiceAnnotationLoadBalancerICMPSourceRanges = "service.beta.kubernetes.io/cloudstack-load-balancer-icmp-source-ranges"
+
+	// ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded is a boolean annotation that allows ICMP
+	// fragmentation needed messages from anywhere to the load balancer IP, so Path MTU Discovery keeps working.
+	// Defaults to the allow-icmp-fragmentation-needed option of the cloud config.
+	ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded = "service.beta.kubernetes.io/cloudstack-load-balancer-allow-icmp-fragmentation-needed"
+
+	// icmpTypeDestinationUnreachable and icmpCodeFragmentationNeeded identify the ICMP messages used by
+	// Path MTU Discovery.
+	icmpTypeDestinationUnreachable = 3
+	icmpCodeFragmentationNeeded    = 4
+
+	// ServiceAnnotationLoadBalancerProvider is the name of the CloudStack load balancer provider, f.e.
+	// "Netscaler", that must implement the load balancer of the service. CloudStack selects the provider
+	// through the network offering of the node network, so this cannot switch providers; the service fails
+	// with an event when the network uses a different provider.
+	ServiceAnnotationLoadBalancerProvider = "service.beta.kubernetes.io/cloudstack-load-balancer-provider"
+
+	// ServiceAnnotationLoadBalancerNetwork is the ID or name of the network the load balancer is created in,
+	// for nodes with NICs in several networks. The public IP is associated with it and the nodes are assigned
+	// to the rules through their NIC in it. Without it, the network of the first NIC of the nodes is used.
+	ServiceAnnotationLoadBalancerNetwork = "service.beta.kubernetes.io/cloudstack-load-balancer-network"
+
+	// ServiceAnnotationLoadBalancerAlgorithm is the load balancing algorithm of the service's rules, one of
+	// "roundrobin", "leastconn" or "source". It overrides the algorithm derived from the session affinity.
+	ServiceAnnotationLoadBalancerAlgorithm = "service.beta.kubernetes.io/cloudstack-load-balancer-algorithm"
+
+	// ServiceAnnotationLoadBalancerPortAlgorithm overrides the algorithm for some ports, as a comma-separated list
+	// of <port>=<algorithm> where port is the number or name of a service port, f.e. "80=roundrobin,db=source".
+	ServiceAnnotationLoadBalancerPortAlgorithm = "service.beta.kubernetes.io/cloudstack-load-balancer-port-algorithm"
+
+	// ServiceAnnotationLoadBalancerForceRecreate is a nonce; whenever it changes, all load balancer and firewall
+	// rules of the service are deleted and created again on the same IP.
+	ServiceAnnotationLoadBalancerForceRecreate = "service.beta.kubernetes.io/cloudstack-load-balancer-force-recreate"
+
+	// ServiceAnnotationLoadBalancerForceRecreateProcessed stores the last force-recreate nonce that was processed.
+	ServiceAnnotationLoadBalancerForceRecreateProcessed = "service.beta.kubernetes.io/cloudstack-load-balancer-force-recreate-processed"
+
+	// ServiceAnnotationLoadBalancerBackendPort selects the port the rules forward to: "node-port" (default),
+	// or "service-port" or "target-port" to send traffic directly to routable pod IPs on the nodes hosting
+	// the pods of the service.
+	ServiceAnnotationLoadBalancerBackendPort = "service.beta.kubernetes.io/cloudstack-load-balancer-backend-port"
+
+	// ServiceAnnotationLoadBalancerInternal is a boolean annotation that, when set to "true" on a service without
+	// a requested IP, allocates no public IP and creates no rules. The status reports the internal IPs of the
+	// load balancer nodes instead, so the service is only reachable from within the network.
+	ServiceAnnotationLoadBalancerInternal = "service.beta.kubernetes.io/cloudstack-load-balancer-internal"
+
+	// ServiceAnnotationLoadBalancerBackendProtocol sets the protocol the backends receive on some ports, as a
+	// comma-separated list of <port>=<protocol> with protocol "tcp", "proxy" or "udp", f.e. "443=proxy,80=tcp".
+	// It overrides ServiceAnnotationLoadBalancerProxyProtocol for the listed ports.
+	ServiceAnnotationLoadBalancerBackendProtocol = "service.beta.kubernetes.io/cloudstack-load-balancer-backend-protocol"
+
+	// ServiceAnnotationLoadBalancerIPMode sets the ipMode of the load balancer status to "Proxy" or "VIP". It
+	// overrides the mode derived from ServiceAnnotationLoadBalancerProxyProtocol.
+	ServiceAnnotationLoadBalancerIPMode = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-mode"
+
+	// ServiceAnnotationLoadBalancerRuleIDs stores the IDs of the load balancer rules of the service for external
+	// tooling, as a comma-separated list of <protocol>/<port>=<rule ID>, f.e. "tcp/80=<ID>,udp/53=<ID>".
+	ServiceAnnotationLoadBalancerRuleIDs = "service.beta.kubernetes.io/cloudstack-load-balancer-rule-ids"
+
+	// ServiceAnnotationLoadBalancerLastError stores the reason of the last failed reconcile of the load balancer,
+	// f.e. "InsufficientCapacity", see lastErrorReason. It is removed after a successful reconcile.
+	ServiceAnnotationLoadBalancerLastError = "service.beta.kubernetes.io/cloudstack-load-balancer-last-error"
+
+	// ServiceAnnotationLoadBalancerLastErrorTime stores when ServiceAnnotationLoadBalancerLastError first occurred,
+	// in RFC 3339 format.
+	ServiceAnnotationLoadBalancerLastErrorTime = "service.beta.kubernetes.io/cloudstack-load-balancer-last-error-time"
+
+	// ServiceAnnotationLoadBalancerWriteAnnotations is a boolean annotation that, when set to "false", stops the
+	// provider from writing its managed annotations onto the service, which then only reports its IP in the
+	// load balancer status. Services with static NAT always get them, as it depends on them.
+	ServiceAnnotationLoadBalancerWriteAnnotations = "service.beta.kubernetes.io/cloudstack-load-balancer-write-annotations"
+
+	// ServiceAnnotationLoadBalancerStaticNAT is a boolean annotation that, when set to "true", maps the public IP
+	// to the single backend node with static NAT instead of creating load balancer rules.
+	ServiceAnnotationLoadBalancerStaticNAT = "service.beta.kubernetes.io/cloudstack-load-balancer-static-nat"
+
+	// ServiceAnnotationLoadBalancerStaticNATVirtualMachineID stores the ID of the VM the public IP is mapped to
+	// with static NAT, so the mapping is removed when the service stops using static NAT or is deleted.
+	ServiceAnnotationLoadBalancerStaticNATVirtualMachineID = "service.beta.kubernetes.io/cloudstack-load-balancer-static-nat-virtual-machine-id"
+
+	// firewallRuleOwnerTagKey and firewallRuleOwnerTagValue tag the firewall rules created by us,
+	// so only those are deleted when ownedFirewallRulesOnly is set. Both can be configured, see ownerTag.
+	firewallRuleOwnerTagKey   = "created-by"
+	firewallRuleOwnerTagValue = "cloudstack-kubernetes-provider"
+	// ownerTagClusterPlaceholder is replaced by the cluster name in a configured owner tag value.
+	ownerTagClusterPlaceholder = "{cluster}"
+
+	// publicIPResourceType is the CloudStack resource type of public IPs in resource limits.
+	publicIPResourceType = 1
+
+	// The strategies for picking a new public IP. With ipSelectionCloudStack, CloudStack picks the IP.
+	// ipSelectionLowest allocates the lowest free IP of the zone, ipSelectionPool the lowest free IP of a VLAN.
+	ipSelectionCloudStack = "cloudstack"
+	ipSelectionLowest     = "lowest"
+	ipSelectionPool       = "pool"
+
+	// What UpdateLoadBalancer does when no node is left to assign, f.e. during a full rollout of the nodes:
+	// emptyNodesKeep keeps the current hosts of the rules, emptyNodesRemove removes them all.
+	emptyNodesKeep   = "keep"
+	emptyNodesRemove = "remove"
+
+	// Whether a requested IP that has load balancer rules of other services can be used: ipSharingAllow
+	// shares it as long as the ports do not overlap, ipSharingDeny refuses it.
+	ipSharingAllow = "allow"
+	ipSharingDeny  = "deny"
+
+	// The strategies for matching nodes to CloudStack VMs: by the VM ID in the provider ID of the node,
+	// by the short host name, by the VM ID in a node label, or by the InternalIP of the node and the NIC IPs.
+	hostMatchingProviderID = "provider-id"
+	hostMatchingName       = "name"
+	hostMatchingLabel      = "label"
+	hostMatchingIP         = "ip"
+
+	// Tags set on public IPs and firewall rules created for a service, to trace them back to the service.
+	serviceClusterTagKey   = "kubernetes-cluster"
+	serviceNamespaceTagKey = "kubernetes-namespace"
+	serviceNameTagKey      = "kubernetes-service"
+	// firewallRulePortTagKey marks the ICMP firewall rules created by us with the value "icmp".
+	firewallRulePortTagKey = "kubernetes-port"
+
+	// stickinessPolicyName is the name of the stickiness policy that applies the session affinity timeout.
+	stickinessPolicyName = "kubernetes-session-affinity"
+	// stickinessMethodSourceBased is the stickiness method that keeps clients on a host by their IP.
+	stickinessMethodSourceBased = "SourceBased"
+
 	// Used to construct the load balancer name.
-	servicePrefix = "K8s_svc_"
-	lbNameFormat  = "%s%s_%s_%s"
+	servicePrefix        = "K8s_svc_"
+	defaultNameSeparator = "_"
+	// nameHashLength is the number of hexadecimal digits of the hash suffix of load balancer names.
+	nameHashLength = 8
 )
 
 type loadBalancer struct {
@@ -76,22 +259,182 @@ type loadBalancer struct {
 
 	name      string
 	algorithm string
-	hostIDs   []string
-	ipAddr    string
-	ipAddrID  string
-	networkID string
-	projectID string
-	rules     map[string]*cloudstack.LoadBalancerRule
+	// portAlgorithms override algorithm for some ports, by service port.
+	portAlgorithms map[int32]string
+	// ruleCIDRs are the source ranges the rules enforce themselves, by service port. Ports without an
+	// entry leave the source ranges to firewall rules.
+	ruleCIDRs map[int32][]string
+	// releasedRules are the IDs of the load balancer rules being deleted together, whose ports no longer keep
+	// firewall rules spanning port ranges, see firewallRuleNeeded.
+	releasedRules map[string]bool
+	// ipMode is the ipMode of the load balancer status, see getLoadBalancerIPMode.
+	ipMode corev1.LoadBalancerIPMode
+	// portErrors are the PortError* values of ports that are served, but not as configured, by service port. They
+	// are reported in the per-port status of the load balancer.
+	portErrors map[int32]string
+	// firewallRuleCache holds the firewall rules listed per public IP while the ports are reconciled, so ports
+	// whose firewall rules are up-to-date share a single list call. Nil disables it, see listFirewallRules.
+	firewallRuleCache map[string][]*cloudstack.FirewallRule
+	// firewallRuleTagBatch collects the IDs of the firewall rules created during a reconcile by their port tag,
+	// so they are tagged together by flushFirewallRuleTags. Nil tags each rule when it is created.
+	firewallRuleTagBatch map[string][]string
+	// clusterName is the cluster the load balancer belongs to. Resources tagged for other clusters are ignored.
+	clusterName string
+	hostIDs     []string
+	ipAddr      string
+	ipAddrID    string
+	networkID   string
+	projectID   string
+	rules       map[string]*cloudstack.LoadBalancerRule
+
+	// zoneName is the CloudStack zone of the public IP, when reported by the API.
+	zoneName string
+
+	// ownedFirewallRulesOnly limits firewall rule deletions to rules tagged as created by us.
+	ownedFirewallRulesOnly bool
+	// ownerTagKey and ownerTagValue are the tag marking the rules created by us. Empty uses the defaults.
+	ownerTagKey   string
+	ownerTagValue string
+	// previousOwnerTags are owner tags used before, whose rules are ours as well.
+	previousOwnerTags []cloudstack.Tags
+	// keepRangedFirewallRules never deletes firewall rules spanning a port range, see firewallRuleNeeded.
+	keepRangedFirewallRules bool
+	// firewallEvents is called with the reason and message of an event for each firewall rule we create or
+	// delete. Nil emits no events.
+	firewallEvents func(reason, message string)
+
+	// ruleMembers caches the hosts assigned to the rules. Nil disables caching.
+	ruleMembers *ruleMembersCache
+
+	// recreateCooldown defers recreating rules that were recreated recently. Nil disables it.
+	recreateCooldown *ruleRecreateCooldown
+
+	// openFirewall creates rules that open the firewall for all sources, instead of explicit firewall rules.
+	openFirewall bool
+
+	// serviceTags identify the service on the public IPs and firewall rules we create.
+	serviceTags map[string]string
+
+	// propagatedTags are the tags propagated from the service labels and annotations onto the rules we create.
+	propagatedTags map[string]string
+	// propagatedTagKeys are the keys of all propagated tags, also those the service does not set.
+	propagatedTagKeys []string
+
+	// checkCapacity checks the public IP limit before a new IP is associated.
+	checkCapacity bool
+	// capacityReserve is the number of public IPs of the limit that checkCapacity keeps free.
+	capacityReserve int
+
+	// hostBatchSize is the maximum number of hosts assigned to or removed from a rule per API call.
+	// Zero passes all hosts in a single call.
+	hostBatchSize int
+
+	// disableIPAssociation fails instead of associating a new IP or a requested IP that is not allocated.
+	disableIPAssociation bool
+
+	// publicIPVLAN is the name of the VLAN a new IP is allocated from. Empty lets CloudStack pick any VLAN.
+	publicIPVLAN string
+	// ipSelection is the strategy for picking a new IP, one of the ipSelection constants.
+	ipSelection string
+
+	// backendPort selects the private port of the rules.
+	backendPort backendPortMode
+}
+
+// backendPortMode selects the private port of the load balancer rules.
+type backendPortMode string
+
+const (
+	// backendPortNodePort forwards to the node port on all nodes.
+	backendPortNodePort backendPortMode = "node-port"
+	// backendPortServicePort forwards to the service port on the nodes hosting the pods of the service.
+	backendPortServicePort backendPortMode = "service-port"
+	// backendPortTargetPort forwards to the numeric target port on the nodes hosting the pods of the service.
+	backendPortTargetPort backendPortMode = "target-port"
+)
+
+var (
+	// errInsufficientCapacity is returned when allocating a resource would exceed a resource limit.
+	errInsufficientCapacity = errors.New("insufficient capacity")
+
+	// errPublicIPVLANNotFound is returned when the VLAN requested for a new IP has no public IPs in the zone.
+	errPublicIPVLANNotFound = errors.New("public IP VLAN not found")
+
+	// errIPNetworkMismatch is returned when the requested IP belongs to another network than the nodes.
+	errIPNetworkMismatch = errors.New("load balancer IP is in another network")
+
+	// errNoEligibleNodes is returned when no node is left to serve as a backend of the load balancer.
+	errNoEligibleNodes = errors.New("no eligible nodes for load balancer")
+
+	// errNoMatchedHosts is returned when none of the eligible nodes could be matched to a CloudStack VM.
+	errNoMatchedHosts = errors.New("no nodes matched to CloudStack VMs")
+
+	// errIPAssociationDisabled is returned when disable-ip-association is set and an IP would have to be associated.
+	errIPAssociationDisabled = errors.New("IP association disabled")
+
+	// errIPInUse is returned when a requested IP has load balancer rules of another service that conflict with ours.
+	errIPInUse = errors.New("load balancer IP in use by another service")
+
+	// errNewIPInUse is returned when a newly associated IP still has rules of another service.
+	errNewIPInUse = errors.New("new load balancer IP in use by another service")
+
+	// errNewIPCheckFailed is returned when a newly associated IP could not be checked for rules. The IP is still
+	// associated, and is to be given up with discardNewIP.
+	errNewIPCheckFailed = errors.New("check of new load balancer IP failed")
+
+	// errRuleRecreateDeferred is returned when a rule must be recreated, but was recreated within the
+	// rule-recreate-cooldown.
+	errRuleRecreateDeferred = errors.New("load balancer rule recreated recently")
+
+	// errStaleFirewallRules is returned when the wanted firewall rule is in place, but old rules could not be deleted.
+	errStaleFirewallRules = errors.New("stale firewall rules left")
+
+	// errFirewallNotSupported is returned when require-firewall is set and the network has no Firewall service.
+	errFirewallNotSupported = errors.New("firewall not supported")
+
+	// errProtocolNotAllowed is returned when a port of the service uses a protocol outside allowed-protocols.
+	errProtocolNotAllowed = errors.New("protocol not allowed")
+
+	// errServiceListerNotSet is returned when the services sharing an IP are needed before SetInformers was called.
+	errServiceListerNotSet = errors.New("service lister not set")
+
+	// errNetworkWithoutPublicIPs is returned when public IPs cannot be associated with the requested network.
+	errNetworkWithoutPublicIPs = errors.New("network cannot have public IPs")
+
+	// errLoadBalancerRulesLeft is returned when rules of a deleted load balancer are still listed.
+	errLoadBalancerRulesLeft = errors.New("load balancer rules left after deletion")
+
+	// errHostsInDifferentNetworks is returned when the nodes of a load balancer are attached to different networks.
+	errHostsInDifferentNetworks = errors.New("found hosts that belong to different networks")
+
+	// ipReleaseBackoff is the backoff between the attempts to release a public IP. Steps is the number of attempts.
+	ipReleaseBackoff = wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.5, Steps: 3}
+)
+
+// serviceTagKeys are the keys of the tags we set on the resources of a service, which configured tags must not use.
+var serviceTagKeys = []string{serviceClusterTagKey, serviceNamespaceTagKey, serviceNameTagKey, firewallRulePortTagKey}
+
+// newServiceTags returns the tags that identify the service on the CloudStack resources we create for it.
+func newServiceTags(clusterName string, service *corev1.Service) map[string]string {
+	return map[string]string{
+		serviceClusterTagKey:   clusterName,
+		serviceNamespaceTagKey: service.Namespace,
+		serviceNameTagKey:      service.Name,
+	}
 }
 
 // GetLoadBalancer returns whether the specified load balancer exists, and if so, what its status is.
 func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service) (*corev1.LoadBalancerStatus, bool, error) {
 	klog.V(4).InfoS("GetLoadBalancer", "cluster", clusterName, "service", klog.KObj(service))
 
+	// Load balancers of services we don't manage never exist as far as we are concerned.
+	if !cs.isLoadBalancerManaged(service) {
+		return nil, false, nil
+	}
+
 	// Get the load balancer details and existing rules.
 	name := cs.GetLoadBalancerName(ctx, clusterName, service)
-	legacyName := cs.getLoadBalancerLegacyName(ctx, clusterName, service)
-	lb, err := cs.getLoadBalancer(service, name, legacyName)
+	lb, err := cs.getLoadBalancer(ctx, clusterName, service, name, cs.getLoadBalancerFallbackNames(ctx, clusterName, service)...)
 	if err != nil {
 		return nil, false, err
 	}
@@ -114,38 +457,161 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 	klog.V(4).InfoS("EnsureLoadBalancer", "cluster", clusterName, "service", klog.KObj(service))
 	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
 
+	// ImplementedElsewhere makes the service controller skip the service entirely,
+	// leaving its status to the controller that does manage the load balancer.
+	if !cs.isLoadBalancerManaged(service) {
+		klog.V(4).Infof("Service %s is not managed by the CloudStack load balancer, ignoring", serviceName)
+
+		return nil, cloudprovider.ImplementedElsewhere
+	}
+
 	if len(service.Spec.Ports) == 0 {
 		return nil, errors.New("requested load balancer with no ports")
 	}
 
+	// Overlapping reconciles of the same service would race on its rules and IP.
+	defer cs.serviceLocks.lock(service.Namespace + "/" + service.Name)()
+	cs.ignoreManagedAnnotations(service)
+
+	// Runs last, so the other deferred functions see the original error.
+	defer func() { err = cs.transientRetryError(service, err) }()
+
 	// Patch the service with new/updated annotations if needed after EnsureLoadBalancer finishes.
 	patcher := newServicePatcher(cs.kclient, service)
-	defer func() { err = patcher.Patch(ctx, err) }()
+	defer func() {
+		if cs.writesAnnotations(service) {
+			err = patcher.Patch(ctx, err)
+		}
+	}()
+
+	// Runs before the patch, so the error is persisted together with the other annotations.
+	defer func() { recordLastError(service, err) }()
+
+	defer func() { cs.recordAPIRecovery(service, err) }()
+
+	if cs.reconcileEvents {
+		start, apiCalls := time.Now(), &atomic.Int64{}
+		ctx = withAPICallCounter(ctx, apiCalls)
+		defer func() { cs.recordReconcileEvent(service, time.Since(start), apiCalls.Load(), err) }()
+	}
+
+	// Settings are read from the service merged with the cloud-config annotation defaults,
+	// while our own annotations are written to the service itself so they get patched.
+	annotated := cs.withAnnotationDefaults(service)
+
+	if isInternalLoadBalancer(annotated) {
+		return cs.ensureInternalLoadBalancer(ctx, clusterName, service, nodes)
+	}
 
 	// Get the load balancer details and existing rules.
 	name := cs.GetLoadBalancerName(ctx, clusterName, service)
-	legacyName := cs.getLoadBalancerLegacyName(ctx, clusterName, service)
-	lb, err := cs.getLoadBalancer(service, name, legacyName)
+	fallbackNames := cs.getLoadBalancerFallbackNames(ctx, clusterName, service)
+	lb, err := cs.getLoadBalancer(ctx, clusterName, service, name, fallbackNames...)
 	if err != nil {
 		return nil, err
 	}
 
+	cs.setLoadBalancerTags(lb, clusterName, service)
+	cs.setFirewallRuleEvents(lb, service)
+	defer func() { cs.recordInstanceSyncHosts(clusterName, service, lb.hostIDs, err) }()
+	lb.publicIPVLAN = getStringFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerPublicIPVLAN, cs.ipPool)
+	lb.ipSelection = cs.ipSelection
+
 	// Set the load balancer algorithm.
-	switch service.Spec.SessionAffinity {
-	case corev1.ServiceAffinityNone:
-		lb.algorithm = "roundrobin"
-	case corev1.ServiceAffinityClientIP:
-		lb.algorithm = "source"
-	default:
-		return nil, fmt.Errorf("unsupported load balancer affinity: %v", service.Spec.SessionAffinity)
+	lb.algorithm, err = getLoadBalancerAlgorithm(annotated, cs.defaultAlgorithm)
+	if err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerAlgorithm", err.Error())
+
+		return nil, err
 	}
+	lb.portAlgorithms, err = getPortAlgorithms(annotated)
+	if err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerAlgorithm", err.Error())
 
-	// Verify that all the hosts belong to the same network, and retrieve their ID's.
-	lb.hostIDs, lb.networkID, err = cs.verifyHosts(nodes)
+		return nil, err
+	}
+
+	lb.backendPort, err = getBackendPortMode(annotated)
+	if err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerBackendPort", err.Error())
+
+		return nil, err
+	}
+
+	if err := checkBackendProtocols(annotated); err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerBackendProtocol", err.Error())
+
+		return nil, err
+	}
+
+	lb.ipMode, err = getLoadBalancerIPMode(annotated)
 	if err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerIPMode", err.Error())
+
+		return nil, err
+	}
+
+	if err := checkAllowedProtocols(annotated, cs.allowedProtocols); err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "ProtocolNotAllowed", err.Error())
+
 		return nil, err
 	}
 
+	if lb.backendPort != backendPortNodePort {
+		if nodes, err = cs.podHostingNodes(ctx, service, nodes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Verify that all the hosts belong to the same network, and retrieve their ID's.
+	network := getStringFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerNetwork, "")
+	hosts, err := cs.verifyHostsInNetwork(ctx, nodes, network)
+	if err != nil {
+		if errors.Is(err, errNoEligibleNodes) {
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "NoEligibleNodes", err.Error())
+		}
+
+		return nil, cs.networkMismatchError(service, err)
+	}
+	cs.resetNetworkMismatch(service)
+	lb.hostIDs, lb.networkID = hosts.hostIDs, hosts.networkID
+
+	if isStaticNAT(annotated) {
+		if err := cs.checkStaticNATBackend(lb, service); err != nil {
+			return nil, err
+		}
+	}
+
+	// The network of the first NIC always has the IP, a requested network is checked before an IP is associated.
+	if network != "" {
+		if err := lb.checkNetworkPublicIPs(); err != nil {
+			if errors.Is(err, errNetworkWithoutPublicIPs) {
+				cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerNetwork", err.Error())
+			}
+
+			return nil, err
+		}
+	}
+
+	if provider := getStringFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerProvider, ""); provider != "" {
+		if err := lb.checkLoadBalancerProvider(provider); err != nil {
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerProviderUnavailable", err.Error())
+
+			return nil, err
+		}
+	}
+
+	// Without the Firewall service the source ranges cannot be enforced, so nothing is created at all.
+	if cs.requireFirewall {
+		if err := lb.checkFirewallSupported(); err != nil {
+			if errors.Is(err, errFirewallNotSupported) {
+				cs.eventRecorder.Event(service, corev1.EventTypeWarning, "FirewallNotSupported", err.Error())
+			}
+
+			return nil, err
+		}
+	}
+
 	// Resolve the desired IP: annotation takes precedence, spec.LoadBalancerIP is fallback.
 	desiredIP := getLoadBalancerAddress(service)
 
@@ -163,9 +629,85 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 			}
 		}
 
+		// An IP that a failed reconcile associated before it created any rule is not found by name, and
+		// without the annotation it would leak. A requested IP is always found by its address instead.
+		if !lb.hasLoadBalancerIP() && desiredIP == "" && cs.recoverLeakedIPs {
+			found, lookupErr := lb.lookupLeakedPublicIPAddress()
+			if lookupErr != nil {
+				klog.Warningf("Error looking up leaked IP of service %s: %v", serviceName, lookupErr)
+			} else if found {
+				msg := fmt.Sprintf("Recovered IP address %s that was allocated for service %s without load balancer rules", lb.ipAddr, serviceName)
+				cs.eventRecorder.Event(service, corev1.EventTypeNormal, "RecoveredLoadBalancerIP", msg)
+				klog.Info(msg)
+			}
+		}
+
+		// A recreated service can reuse the IP that was retained for its previous incarnation.
+		if !lb.hasLoadBalancerIP() && desiredIP == "" && cs.reuseServiceIP {
+			found, lookupErr := lb.lookupServicePublicIPAddress()
+			if lookupErr != nil {
+				klog.Warningf("Error looking up retained IP of service %s: %v", serviceName, lookupErr)
+			} else if found {
+				msg := fmt.Sprintf("Reusing retained IP address %s of a previous incarnation of service %s", lb.ipAddr, serviceName)
+				cs.eventRecorder.Event(service, corev1.EventTypeNormal, "ReusedLoadBalancerIP", msg)
+				klog.Info(msg)
+			}
+		}
+
 		if !lb.hasLoadBalancerIP() {
+			// Without IP association, only an IP that is requested and already allocated can be used.
+			if desiredIP == "" && cs.disableIPAssociation {
+				err := fmt.Errorf("%w: service %s must request an allocated IP with spec.loadBalancerIP or the %s annotation",
+					errIPAssociationDisabled, serviceName, ServiceAnnotationLoadBalancerAddress)
+				cs.eventRecorder.Event(service, corev1.EventTypeWarning, "IPAssociationDisabled", err.Error())
+
+				return nil, err
+			}
+
 			// Create or retrieve the load balancer IP.
 			if err := lb.getLoadBalancerIP(desiredIP); err != nil {
+				if errors.Is(err, errNewIPCheckFailed) {
+					err = lb.discardNewIP(err, func() error {
+						// Unlike a deletion, a discarded IP is not released again by a later attempt.
+						releaseErr := lb.releaseLoadBalancerIPWithRetry(ctx)
+						if releaseErr != nil {
+							cs.reportLeakedIP(lb, service, releaseErr)
+						}
+
+						return releaseErr
+					})
+				}
+
+				switch {
+				case errors.Is(err, errIPAssociationDisabled):
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "IPAssociationDisabled", err.Error())
+				case errors.Is(err, errInsufficientCapacity):
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InsufficientCapacity", err.Error())
+				case errors.Is(err, errIPNetworkMismatch):
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerIPNetworkMismatch", err.Error())
+				case errors.Is(err, errPublicIPVLANNotFound):
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "PublicIPVLANNotFound", err.Error())
+				case errors.Is(err, errNewIPInUse):
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "NewLoadBalancerIPInUse", err.Error())
+				}
+
+				// A new IP that could not be released is recorded, so the next reconcile uses it instead of leaking it.
+				if lb.hasLoadBalancerIP() {
+					setServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, lb.ipAddr)
+					setServiceAnnotation(service, ServiceAnnotationLoadBalancerID, lb.ipAddrID)
+				}
+
+				return nil, err
+			}
+		}
+
+		// Rules of other services on a requested IP are only found by the IP, not by the name of our rules.
+		if desiredIP != "" {
+			if err := lb.checkPublicIPConflict(service, cs.ipSharing); err != nil {
+				if errors.Is(err, errIPInUse) {
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerIPInUse", err.Error())
+				}
+
 				return nil, err
 			}
 		}
@@ -187,19 +729,148 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 	setServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, lb.ipAddr)
 	setServiceAnnotation(service, ServiceAnnotationLoadBalancerID, lb.ipAddrID)
 	setServiceAnnotation(service, ServiceAnnotationLoadBalancerNetworkID, lb.networkID)
+	cs.annotateZone(service, lb.zoneName)
+
+	// The IP is annotated above even when its family is wrong, so it is not leaked once the service is deleted.
+	if err := checkLoadBalancerIPFamily(service, lb.ipAddr); err != nil {
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "IPFamilyMismatch", err.Error())
+
+		return nil, err
+	}
+
+	// The firewall rules created below share their tags, so they are tagged with a single call at the end.
+	lb.firewallRuleTagBatch = map[string][]string{}
+	defer func() {
+		if tagErr := lb.flushFirewallRuleTags(); tagErr != nil {
+			status, err = nil, errors.Join(err, tagErr)
+		}
+	}()
+
+	if isStaticNAT(annotated) {
+		return cs.ensureStaticNAT(ctx, lb, service, annotated)
+	}
+
+	// Load balancer rules cannot be created while the IP is still mapped with static NAT.
+	if err := cs.deleteStaticNAT(lb, service); err != nil {
+		return nil, err
+	}
+
+	if err := cs.forceRecreateLoadBalancerRules(lb, service); err != nil {
+		return nil, err
+	}
+
+	// Rules found under the name of an older naming scheme are renamed instead of recreated. Rules found by
+	// their tags may be named by any scheme, so the names of their load balancers are taken from the rules.
+	if err := lb.renameLoadBalancerRules(name, append(fallbackNames, lb.ruleLoadBalancerNames(service.Spec.Ports)...)); err != nil {
+		return nil, err
+	}
+
+	// The stickiness policies are only reconciled when enabled, and not on networks that cannot have them.
+	reconcileStickiness := cs.sessionAffinityTimeout
+	affinityTimeout := getSessionAffinityTimeout(service)
+	if reconcileStickiness && affinityTimeout > 0 {
+		supported, err := lb.isSourceStickinessSupported()
+		if err != nil {
+			return nil, err
+		}
+		if !supported {
+			msg := fmt.Sprintf("Session affinity timeout of service %s is ignored because the load balancer of network %s does not support %s stickiness",
+				serviceName, lb.networkID, stickinessMethodSourceBased)
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "SessionAffinityTimeoutIgnored", msg)
+			klog.Warning(msg)
+			reconcileStickiness = false
+		}
+	}
 
+	// The network is the same for all ports, so it is only looked up once.
+	var lbNetwork *cloudstack.Network
+	var networkCount int
+	var networkErr error
+	if len(service.Spec.Ports) > 0 {
+		lbNetwork, networkCount, networkErr = lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	}
+
+	var firewallSupported bool
+	// cidrsSupported is set when the load balancer rules enforce their CIDR list, see loadBalancerSupportsCIDRs.
+	var cidrsSupported bool
+	// sourceRangesUnenforced is set when the service has source ranges that neither the firewall nor the rules enforce.
+	var sourceRangesUnenforced bool
+	var ruleIDs []string
+	// sourceRangesIgnored is set when the service has source ranges that open-firewall does not enforce.
+	var sourceRangesIgnored bool
+	// recreateWait is how long the rules that were not recreated because of the rule-recreate-cooldown must wait.
+	var recreateWait time.Duration
+	// staleFirewallRules is set when old firewall rules of a port could not be deleted, see errStaleFirewallRules.
+	var staleFirewallRules bool
+	// firewallSkipped is set when the firewall rules were skipped because of skip-firewall-on-network-error.
+	var firewallSkipped bool
+	lb.ruleCIDRs = make(map[int32][]string)
+	lb.portErrors = make(map[int32]string)
+	lb.firewallRuleCache = make(map[string][]*cloudstack.FirewallRule)
 	for _, port := range service.Spec.Ports {
 		// Construct the protocol name first, we need it a few times
-		protocol := ProtocolFromServicePort(port, service)
+		protocol := ProtocolFromServicePort(port, annotated)
 		if protocol == LoadBalancerProtocolInvalid {
 			return nil, fmt.Errorf("unsupported load balancer protocol: %v", port.Protocol)
 		}
 
 		// All ports have their own load balancer rule, so add the port to lbName to keep the names unique.
-		lbRuleName := fmt.Sprintf("%s-%s-%d", lb.name, protocol, port.Port)
+		lbRuleName := LoadBalancerRuleName(lb.name, protocol, port.Port)
+
+		lbSourceRanges, err := getLoadBalancerSourceRanges(annotated, cs.defaultSourceRanges[protocol.IPProtocol()])
+		if err != nil {
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerSourceRanges", err.Error())
+
+			return nil, err
+		}
+
+		skipFirewall := false
+		switch {
+		case networkErr == nil:
+			firewallSupported = isFirewallSupported(lbNetwork.Service)
+			cidrsSupported = loadBalancerSupportsCIDRs(lbNetwork.Service)
+		case networkCount == 0:
+			return nil, fmt.Errorf("could not find network with ID %s: %w", lb.networkID, networkErr)
+		// A negative count means the API call itself failed, which is usually transient.
+		case networkCount < 0 && cs.skipFirewallOnNetworkError:
+			msg := fmt.Sprintf("Skipping firewall rules of load balancer rule %s, failed to get network with ID %s: %v", lbRuleName, lb.networkID, networkErr)
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "FirewallRulesSkipped", msg)
+			klog.Warning(msg)
+			skipFirewall = true
+			firewallSkipped = true
+			lb.portErrors[port.Port] = PortErrorFirewallRulesSkipped
+		case networkCount < 0 && cs.assumeFirewallOnNetworkError:
+			// Should the network not support firewall rules after all, creating them fails the reconcile.
+			msg := fmt.Sprintf("Assuming network %s supports firewall rules for load balancer rule %s, failed to get the network: %v", lb.networkID, lbRuleName, networkErr)
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "FirewallSupportAssumed", msg)
+			klog.Warning(msg)
+			firewallSupported = true
+		default:
+			return nil, fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, networkErr)
+		}
+
+		// Without the Firewall service, the rule enforces the source ranges itself if its provider supports
+		// that. While the network is unknown, the CIDRs of an existing rule are left alone.
+		delete(lb.ruleCIDRs, port.Port)
+		switch {
+		case skipFirewall || firewallSupported:
+		case cidrsSupported:
+			lb.ruleCIDRs[port.Port] = lbSourceRanges.StringSlice()
+		case !isAllowAll(lbSourceRanges.StringSlice()):
+			sourceRangesUnenforced = true
+		}
 
 		// If the load balancer rule exists and is up-to-date, we move on to the next rule.
 		lbRule, needsUpdate, err := lb.checkLoadBalancerRule(lbRuleName, port, protocol)
+		if errors.Is(err, errRuleRecreateDeferred) {
+			// The rule keeps its old values until the cooldown passed, the other ports are reconciled as usual.
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerRuleRecreateDeferred", err.Error())
+			klog.Warning(err)
+			delete(lb.rules, lbRuleName)
+			recreateWait = max(recreateWait, lb.recreateCooldown.remaining(lb.recreateCooldownKey(protocol, port.Port)))
+
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -207,7 +878,7 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 		if lbRule != nil { //nolint:nestif
 			if needsUpdate {
 				klog.V(4).Infof("Updating load balancer rule: %v", lbRuleName)
-				if err := lb.updateLoadBalancerRule(lbRuleName, protocol); err != nil {
+				if err := lb.updateLoadBalancerRule(lbRuleName, port, protocol); err != nil {
 					return nil, err
 				}
 			} else {
@@ -218,9 +889,25 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 				return nil, err
 			}
 
+			lb.reconcilePropagatedTags(lbRule.Id, "LoadBalancer", lbRule.Tags)
+
 			// Delete the rule from the map, to prevent it being deleted.
 			delete(lb.rules, lbRuleName)
+		} else if oldRule := lb.findProtocolSwitchRule(port, protocol); oldRule != nil {
+			klog.V(4).Infof("Switching load balancer rule %v to protocol %v: %v", oldRule.Name, protocol, lbRuleName)
+			lbRule, err = lb.switchLoadBalancerRuleProtocol(oldRule, lbRuleName, port, protocol)
+			if err != nil {
+				return nil, err
+			}
 		} else {
+			if protocol == LoadBalancerProtocolUDP {
+				if err := lb.checkUDPSupported(); err != nil {
+					cs.eventRecorder.Event(service, corev1.EventTypeWarning, "UDPNotSupported", err.Error())
+
+					return nil, err
+				}
+			}
+
 			klog.V(4).Infof("Creating load balancer rule: %v", lbRuleName)
 			lbRule, err = lb.createLoadBalancerRule(lbRuleName, port, protocol)
 			if err != nil {
@@ -231,1108 +918,4037 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 			if err = lb.assignHostsToRule(lbRule, lb.hostIDs); err != nil {
 				return nil, err
 			}
+			lb.rememberRuleMembers(lbRule, lb.hostIDs)
 		}
+		ruleIDs = append(ruleIDs, fmt.Sprintf("%s/%d=%s", protocol.IPProtocol(), port.Port, lbRule.Id))
 
-		network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
-		if err != nil {
-			if count == 0 {
-				return nil, fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		if reconcileStickiness {
+			if err := lb.reconcileStickinessPolicy(lbRule, affinityTimeout); err != nil {
+				return nil, err
 			}
-
-			return nil, fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
 		}
 
-		lbSourceRanges, err := getLoadBalancerSourceRanges(service)
-		if err != nil {
-			return nil, err
+		if skipFirewall {
+			continue
 		}
 
-		if lbRule != nil && isFirewallSupported(network.Service) {
+		if firewallSupported && cs.openFirewall {
+			klog.V(4).Infof("Firewall of load balancer rule %v is opened by CloudStack", lbRuleName)
+			sourceRangesIgnored = sourceRangesIgnored || !isAllowAll(lbSourceRanges.StringSlice())
+		} else if lbRule != nil && firewallSupported {
 			klog.V(4).Infof("Creating firewall rules for load balancer rule: %v (%v:%v:%v)", lbRuleName, protocol, lbRule.Publicip, port.Port)
 			if _, err := lb.updateFirewallRule(lbRule.Publicipid, int(port.Port), protocol, lbSourceRanges.StringSlice()); err != nil {
-				return nil, err
+				if !errors.Is(err, errStaleFirewallRules) {
+					return nil, err
+				}
+				cs.warnStaleFirewallRules(service, err)
+				lb.portErrors[port.Port] = PortErrorStaleFirewallRules
+				staleFirewallRules = true
 			}
-		} else {
-			msg := fmt.Sprintf("LoadBalancerSourceRanges are ignored for Service %s because this CloudStack network does not support it", serviceName)
-			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerSourceRangesIgnored", msg)
-			klog.Warning(msg)
+		} else if cidrsSupported {
+			klog.V(4).Infof("Source ranges of load balancer rule %v are enforced by the rule: %v", lbRuleName, lbSourceRanges.StringSlice())
 		}
 	}
 
+	lb.firewallRuleCache = nil
+
+	if sourceRangesUnenforced {
+		msg := fmt.Sprintf("LoadBalancerSourceRanges are ignored for Service %s because this CloudStack network does not support it", serviceName)
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "LoadBalancerSourceRangesIgnored", msg)
+		klog.Warning(msg)
+	}
+
+	if sourceRangesIgnored {
+		msg := fmt.Sprintf("Source ranges of service %s are ignored, the firewall of its load balancer rules is opened for all sources by open-firewall", serviceName)
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "SourceRangesIgnored", msg)
+		klog.Warning(msg)
+	}
+
+	// The IDs change when rules are recreated, f.e. to switch protocols, so they are written on every reconcile.
+	slices.Sort(ruleIDs)
+	setServiceAnnotation(service, ServiceAnnotationLoadBalancerRuleIDs, strings.Join(ruleIDs, ","))
+
 	// Cleanup any rules that are now still in the rules map, as they are no longer needed.
+	// A rule that fails to be cleaned up does not stop the cleanup of the others.
+	var cleanupErrors []error
 	for _, lbRule := range lb.rules {
-		protocol := ProtocolFromLoadBalancer(lbRule.Protocol)
-		if protocol == LoadBalancerProtocolInvalid {
-			return nil, fmt.Errorf("error parsing protocol %v: %w", lbRule.Protocol, err)
-		}
-		port, err := strconv.ParseInt(lbRule.Publicport, 10, 32)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing port %s: %w", lbRule.Publicport, err)
+		klog.V(4).Infof("Deleting obsolete load balancer rule: %v", lbRule.Name)
+		if err := lb.deleteLoadBalancerRuleAndFirewall(lbRule); err != nil {
+			cleanupErrors = append(cleanupErrors, err)
 		}
+	}
+	if len(cleanupErrors) > 0 {
+		return nil, errors.Join(cleanupErrors...)
+	}
 
-		klog.V(4).Infof("Deleting firewall rules associated with load balancer rule: %v (%v:%v:%v)", lbRule.Name, protocol, lbRule.Publicip, port)
-		if _, err := lb.deleteFirewallRule(lbRule.Publicipid, int(port), protocol); err != nil {
+	if firewallSupported {
+		if err := cs.reconcileICMPFirewallRules(lb, service, annotated); err != nil {
 			return nil, err
 		}
+	}
 
-		klog.V(4).Infof("Deleting obsolete load balancer rule: %v", lbRule.Name)
-		if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
-			return nil, err
-		}
+	if recreateWait > 0 {
+		return nil, cloudproviderapi.NewRetryError(fmt.Sprintf("load balancer rules of service %s were recreated recently, retrying in %v", serviceName, recreateWait), recreateWait)
+	}
+
+	// Ports whose firewall rules were left stale or skipped carry the reason in their status, which is written
+	// before the service is requeued to retry the firewall rules.
+	if staleFirewallRules {
+		return nil, cs.requeuePortErrors(ctx, service, lb.generateLoadBalancerStatus(annotated), staleFirewallRulesError(service))
+	}
+
+	// Neither the firewall rules of the ports nor the ICMP rules were reconciled.
+	if firewallSkipped {
+		return nil, cs.requeuePortErrors(ctx, service, lb.generateLoadBalancerStatus(annotated), firewallRulesSkippedError(service))
 	}
 
-	return lb.generateLoadBalancerStatus(service), nil
+	return lb.generateLoadBalancerStatus(annotated), nil
 }
 
-// UpdateLoadBalancer updates hosts under the specified load balancer.
-func (cs *CSCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) error {
-	klog.V(4).InfoS("UpdateLoadBalancer", "cluster", clusterName, "service", klog.KObj(service))
+// writesAnnotations returns false if the managed annotations of the service are not to be written, see
+// ServiceAnnotationLoadBalancerWriteAnnotations. They are then still set on the service while it is reconciled,
+// but never persisted.
+func (cs *CSCloud) writesAnnotations(service *corev1.Service) bool {
+	annotated := cs.withAnnotationDefaults(service)
 
-	// Get the load balancer details and existing rules.
-	name := cs.GetLoadBalancerName(ctx, clusterName, service)
-	legacyName := cs.getLoadBalancerLegacyName(ctx, clusterName, service)
-	lb, err := cs.getLoadBalancer(service, name, legacyName)
-	if err != nil {
-		return err
+	return isStaticNAT(annotated) || getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerWriteAnnotations, true)
+}
+
+// ignoreManagedAnnotations removes the managed annotations from the service when they are not written, see
+// writesAnnotations. Annotations left from before writing was disabled are never updated again, so they would
+// point the lookups at an IP or network the load balancer may no longer use.
+func (cs *CSCloud) ignoreManagedAnnotations(service *corev1.Service) {
+	if cs.writesAnnotations(service) {
+		return
 	}
 
-	// Verify that all the hosts belong to the same network, and retrieve their ID's.
-	lb.hostIDs, _, err = cs.verifyHosts(nodes)
-	if err != nil {
-		return err
+	for _, key := range managedServiceAnnotations {
+		deleteServiceAnnotation(service, key)
+	}
+}
+
+// forceRecreateLoadBalancerRules deletes all rules of the load balancer when the force-recreate nonce of the
+// service changed, so they are created again by EnsureLoadBalancer. The nonce is recorded as processed once
+// the rules are deleted, so a failure to create them again does not delete them over and over.
+func (cs *CSCloud) forceRecreateLoadBalancerRules(lb *loadBalancer, service *corev1.Service) error {
+	nonce := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerForceRecreate, "")
+	if nonce == "" || nonce == getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerForceRecreateProcessed, "") {
+		return nil
+	}
+
+	// Without the processed annotation, the rules would be recreated on every reconcile.
+	if !cs.writesAnnotations(service) {
+		msg := fmt.Sprintf("Not recreating the load balancer rules of service %s/%s, %s is %q so the nonce cannot be recorded as processed",
+			service.Namespace, service.Name, ServiceAnnotationLoadBalancerWriteAnnotations, "false")
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "ForceRecreateIgnored", msg)
+		klog.Warning(msg)
+
+		return nil
 	}
 
+	msg := fmt.Sprintf("Recreating %d load balancer rule(s) for service %s/%s", len(lb.rules), service.Namespace, service.Name)
+	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "RecreatingLoadBalancerRules", msg)
+	klog.Info(msg)
+
+	var errs []error
 	for _, lbRule := range lb.rules {
-		if err := lb.reconcileHostsForRule(lbRule, lb.hostIDs); err != nil {
-			return err
+		if err := lb.deleteLoadBalancerRuleAndFirewall(lbRule); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	setServiceAnnotation(service, ServiceAnnotationLoadBalancerForceRecreateProcessed, nonce)
 
 	return nil
 }
 
-// isFirewallSupported checks whether a CloudStack network supports the Firewall service.
-func isFirewallSupported(services []cloudstack.NetworkServiceInternal) bool {
-	for _, svc := range services {
-		if svc.Name == "Firewall" {
-			return true
+// reconcileICMPFirewallRules creates or removes the ICMP firewall rules on the load balancer IP, depending on the
+// ServiceAnnotationLoadBalancerAllowICMP and ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded annotations.
+func (cs *CSCloud) reconcileICMPFirewallRules(lb *loadBalancer, service, annotated *corev1.Service) error {
+	var rules []icmpFirewallRule
+	if getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerAllowICMP, false) {
+		icmpSourceRanges, err := getICMPSourceRanges(annotated)
+		if err != nil {
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerSourceRanges", err.Error())
+
+			return err
 		}
+		rules = append(rules, icmpFirewallRule{icmpType: -1, icmpCode: -1, cidrs: icmpSourceRanges.StringSlice()})
 	}
 
-	return false
-}
+	// Fragmentation needed messages are sent by any router on the path, so they are allowed from everywhere.
+	if getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded, cs.allowICMPFragmentationNeeded) {
+		rules = append(rules, icmpFirewallRule{icmpType: icmpTypeDestinationUnreachable, icmpCode: icmpCodeFragmentationNeeded, cidrs: []string{defaultAllowedCIDR}})
+	}
 
-// EnsureLoadBalancerDeleted deletes the specified load balancer if it exists, returning
-// nil if the load balancer specified either didn't exist or was successfully deleted.
-func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *corev1.Service) (err error) {
-	klog.V(4).InfoS("EnsureLoadBalancerDeleted", "cluster", clusterName, "service", klog.KObj(service))
+	// The rules are looked up even when none of the annotations is set, as removing an annotation or disabling
+	// allow-icmp-fragmentation-needed in the cloud config must remove the rule it created.
+	if len(rules) == 0 {
+		if _, err := lb.deleteICMPFirewallRules(lb.ipAddrID); err != nil {
+			return err
+		}
 
-	// Patch the service to remove annotations after EnsureLoadBalancerDeleted finishes.
-	patcher := newServicePatcher(cs.kclient, service)
-	defer func() { err = patcher.Patch(ctx, err) }()
+		return nil
+	}
 
-	// Get the load balancer details and existing rules.
-	name := cs.GetLoadBalancerName(ctx, clusterName, service)
-	legacyName := cs.getLoadBalancerLegacyName(ctx, clusterName, service)
-	lb, err := cs.getLoadBalancer(service, name, legacyName)
-	if err != nil {
+	klog.V(4).Infof("Reconciling ICMP firewall rules for load balancer: %v (%v)", lb.name, lb.ipAddr)
+	if _, err := lb.updateICMPFirewallRules(lb.ipAddrID, rules); err != nil {
 		return err
 	}
 
-	// If no rules exist, the load balancer doesn't exist. However, an IP may have been
-	// orphaned from a previous partial failure. Check the service annotation for cleanup.
-	if len(lb.rules) == 0 {
-		klog.V(4).Infof("No load balancer rules found for service, checking annotation for orphaned IP")
-
-		if err := cs.releaseOrphanedIPIfNeeded(lb, service); err != nil {
-			return err
-		}
+	return nil
+}
 
-		// If the service is not marked for deletion (f.e. when switching from type
-		// LoadBalancer to ClusterIP), remove our annotations.
-		if service.DeletionTimestamp.IsZero() {
-			deleteLoadBalancerAnnotations(service)
-		}
+// recordReconcileEvent emits an event with the duration and number of CloudStack API calls of a reconcile.
+// The calls are counted in the context of the reconcile, so those of concurrent reconciles are not included.
+func (cs *CSCloud) recordReconcileEvent(service *corev1.Service, duration time.Duration, apiCalls int64, err error) {
+	// Calls that were not made while the API is unavailable would make every reconcile report a failure.
+	if errors.Is(err, errCloudStackUnavailable) {
+		return
+	}
 
-		return nil
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
 	}
 
-	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
-	var deletionErrors []error
+	cs.eventRecorder.Eventf(service, corev1.EventTypeNormal, "LoadBalancerReconciled",
+		"Load balancer reconcile %s after %v with %d CloudStack API calls", result, duration.Round(time.Millisecond), apiCalls)
+}
 
-	// Delete all firewall rules and load balancer rules
-	for _, lbRule := range lb.rules {
-		klog.V(4).Infof("Processing deletion of load balancer rule: %v", lbRule.Name)
+// recordAPIRecovery emits an event on the service of the first successful reconcile after the CloudStack API
+// was unavailable, so there is a single event for the whole outage.
+func (cs *CSCloud) recordAPIRecovery(service *corev1.Service, err error) {
+	if err != nil || cs.apiHealth == nil || !cs.apiHealth.takeRecovered() {
+		return
+	}
 
-		// Parse protocol
-		protocol := ProtocolFromLoadBalancer(lbRule.Protocol)
-		if protocol == LoadBalancerProtocolInvalid {
-			err := fmt.Errorf("error parsing protocol %v for rule %v", lbRule.Protocol, lbRule.Name)
-			klog.Errorf("%v", err)
-			deletionErrors = append(deletionErrors, err)
-			// Continue to delete other rules even if this one fails
-			continue
-		}
+	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "CloudStackAPIRecovered", "The CloudStack API is available again, load balancers are reconciled as usual")
+}
 
-		// Parse port
-		port, err := strconv.ParseInt(lbRule.Publicport, 10, 32)
-		if err != nil {
-			err := fmt.Errorf("error parsing port %s for rule %v: %w", lbRule.Publicport, lbRule.Name, err)
-			klog.Errorf("%v", err)
-			deletionErrors = append(deletionErrors, err)
-			// Continue to delete other rules even if this one fails
-			continue
-		}
+// warnStaleFirewallRules reports old firewall rules that could not be deleted after the wanted rule was created.
+// As the wanted rule is in place, the other ports are still reconciled; the service is then requeued to delete
+// the old rules, see staleFirewallRulesError.
+func (cs *CSCloud) warnStaleFirewallRules(service *corev1.Service, err error) {
+	msg := fmt.Sprintf("Old firewall rules of service %s/%s could not be deleted and may still allow traffic: %v", service.Namespace, service.Name, err)
+	cs.eventRecorder.Event(service, corev1.EventTypeWarning, "StaleFirewallRules", msg)
+	klog.Warning(msg)
+}
 
-		// Delete firewall rules first
-		klog.V(4).Infof("Deleting firewall rules for load balancer rule: %v (IP:%v, Port:%d, Protocol:%v)",
-			lbRule.Name, lbRule.Publicip, port, protocol)
-		if _, err := lb.deleteFirewallRule(lbRule.Publicipid, int(port), protocol); err != nil {
-			err := fmt.Errorf("error deleting firewall rules for rule %v: %w", lbRule.Name, err)
-			klog.Errorf("%v", err)
-			deletionErrors = append(deletionErrors, err)
-			// Continue to delete the load balancer rule even if firewall deletion fails
-		}
+// staleFirewallRulesError requeues a service whose reconcile finished while old firewall rules are left, so
+// their deletion is retried without waiting for the next change of the service.
+func staleFirewallRulesError(service *corev1.Service) error {
+	return cloudproviderapi.NewRetryError(fmt.Sprintf("%v of service %s/%s, retrying in %v",
+		errStaleFirewallRules, service.Namespace, service.Name, staleFirewallRulesRetryDelay), staleFirewallRulesRetryDelay)
+}
 
-		// Delete load balancer rule
-		klog.V(4).Infof("Deleting load balancer rule: %v", lbRule.Name)
-		if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
-			err := fmt.Errorf("error deleting load balancer rule %v: %w", lbRule.Name, err)
-			klog.Errorf("%v", err)
-			deletionErrors = append(deletionErrors, err)
-			// Continue to attempt IP cleanup even if this rule deletion fails
-		}
+// firewallRulesSkippedError requeues a service whose firewall rules were skipped, so they are configured once
+// the network can be fetched again instead of on the next change of the service.
+func firewallRulesSkippedError(service *corev1.Service) error {
+	return cloudproviderapi.NewRetryError(fmt.Sprintf("firewall rules of service %s/%s were skipped, retrying in %v",
+		service.Namespace, service.Name, firewallRulesSkippedRetryDelay), firewallRulesSkippedRetryDelay)
+}
+
+// requeuePortErrors writes the status with the errors of the ports before the service is requeued with err, as
+// the service controller does not write the status of a failed reconcile. A failed write is only logged, the
+// status is written by the next successful reconcile.
+func (cs *CSCloud) requeuePortErrors(ctx context.Context, service *corev1.Service, status *corev1.LoadBalancerStatus, err error) error {
+	if perr := patchLoadBalancerStatus(ctx, cs.kclient, service, status); perr != nil {
+		klog.Warningf("Error writing the port status of service %s/%s: %v", service.Namespace, service.Name, perr)
 	}
 
-	// Delete the public IP address if appropriate
-	if lb.ipAddr != "" { //nolint:nestif
-		klog.V(4).Infof("Processing public IP deletion for load balancer: IP=%v, ID=%v", lb.ipAddr, lb.ipAddrID)
+	return err
+}
 
-		// Check if we should release the IP
-		shouldReleaseIP, err := cs.shouldReleaseLoadBalancerIP(lb, service)
-		switch {
-		case err != nil:
-			err := fmt.Errorf("error determining if IP should be released: %w", err)
-			klog.Errorf("%v", err)
-			deletionErrors = append(deletionErrors, err)
-		case shouldReleaseIP:
-			klog.V(4).Infof("Releasing load balancer IP: %v", lb.ipAddr)
-			if err := lb.releaseLoadBalancerIP(); err != nil {
-				err := fmt.Errorf("error releasing load balancer IP %v: %w", lb.ipAddr, err)
-				klog.Errorf("%v", err)
-				deletionErrors = append(deletionErrors, err)
-			} else {
-				msg := fmt.Sprintf("Released load balancer IP %s for service %s", lb.ipAddr, serviceName)
-				cs.eventRecorder.Event(service, corev1.EventTypeNormal, "ReleasedLoadBalancerIP", msg)
-				klog.Info(msg)
-			}
-		default:
-			klog.V(4).Infof("Load balancer IP %v is in use by other services, keeping it allocated", lb.ipAddr)
+// lastErrorReasons are the reasons recorded for errors wrapping a sentinel error. Where the error is also
+// reported with a warning event, its reason is the same.
+var lastErrorReasons = []struct {
+	err    error
+	reason string
+}{
+	{errCloudStackUnavailable, "CloudStackUnavailable"},
+	{errInsufficientCapacity, "InsufficientCapacity"},
+	{errPublicIPVLANNotFound, "PublicIPVLANNotFound"},
+	{errIPNetworkMismatch, "LoadBalancerIPNetworkMismatch"},
+	{errNoEligibleNodes, "NoEligibleNodes"},
+	{errNoMatchedHosts, "NoMatchedHosts"},
+	{errIPAssociationDisabled, "IPAssociationDisabled"},
+	{errIPInUse, "LoadBalancerIPInUse"},
+	{errNewIPInUse, "NewLoadBalancerIPInUse"},
+	{errFirewallNotSupported, "FirewallNotSupported"},
+	{errProtocolNotAllowed, "ProtocolNotAllowed"},
+	{errNetworkWithoutPublicIPs, "InvalidLoadBalancerNetwork"},
+	{errHostsInDifferentNetworks, "HostsInDifferentNetworks"},
+}
+
+// lastErrorReason returns a reason for err that does not change with the details of the error, like IDs or the
+// message of the CloudStack API, so a service that keeps failing for the same reason is not patched on every retry.
+func lastErrorReason(err error) string {
+	for _, r := range lastErrorReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
 		}
 	}
 
-	// Return aggregated errors if any occurred
-	if len(deletionErrors) > 0 {
-		msg := fmt.Sprintf("Encountered %d error(s) while deleting load balancer for service %s", len(deletionErrors), serviceName)
-		klog.Warningf("%s: %v", msg, deletionErrors)
-		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "DeletingLoadBalancerFailed", msg)
-
-		// Return the first error or a combined error message
-		return fmt.Errorf("load balancer deletion completed with errors: %w", deletionErrors[0])
+	var retryErr *cloudproviderapi.RetryError
+	switch {
+	case errors.As(err, &retryErr):
+		return "Requeued"
+	case transientRetryClass(err) == retryClassCapacity:
+		return "InsufficientCapacity"
+	case transientRetryClass(err) == retryClassUnavailable:
+		return "CloudStackUnavailable"
 	}
 
-	// If the service is not marked for deletion (f.e. when switching from type
-	// LoadBalancer to ClusterIP), remove our annotations.
-	if service.DeletionTimestamp.IsZero() {
-		deleteLoadBalancerAnnotations(service)
+	return "ReconcileFailed"
+}
+
+// recordLastError records the reason of a failed reconcile in the last-error annotations of the service, or
+// removes them after a successful reconcile. The annotations are only changed when the reason changes, so a
+// service that keeps failing is not patched, and thereby reconciled again, on every retry. The details of the
+// error are reported with events and logs.
+func recordLastError(service *corev1.Service, err error) {
+	if err == nil {
+		deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerLastError)
+		deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerLastErrorTime)
+
+		return
 	}
 
-	msg := "Successfully deleted load balancer for service " + serviceName
-	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "DeletedLoadBalancer", msg)
-	klog.Info(msg)
+	reason := lastErrorReason(err)
+	if getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLastError, "") == reason &&
+		getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLastErrorTime, "") != "" {
+		return
+	}
 
-	return nil
+	setServiceAnnotation(service, ServiceAnnotationLoadBalancerLastError, reason)
+	setServiceAnnotation(service, ServiceAnnotationLoadBalancerLastErrorTime, time.Now().UTC().Format(time.RFC3339))
 }
 
-// shouldReleaseLoadBalancerIP determines whether the public IP should be released.
-func (cs *CSCloud) shouldReleaseLoadBalancerIP(lb *loadBalancer, service *corev1.Service) (bool, error) {
-	// If the keep-ip annotation is set to true, don't release the IP.
-	// The user is responsible for managing the lifecycle of kept IPs.
-	if getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerKeepIP, false) {
-		klog.V(4).Infof("IP %v has keep-ip annotation set, not releasing", lb.ipAddr)
+// UpdateLoadBalancer updates hosts under the specified load balancer.
+func (cs *CSCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (err error) {
+	klog.V(4).InfoS("UpdateLoadBalancer", "cluster", clusterName, "service", klog.KObj(service))
 
-		return false, nil
+	if !cs.isLoadBalancerManaged(service) {
+		return cloudprovider.ImplementedElsewhere
 	}
 
-	// Check if this IP is used by other load balancer rules (other services)
-	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
-	p.SetPublicipid(lb.ipAddrID)
-	p.SetListall(true)
-	if lb.projectID != "" {
-		p.SetProjectid(lb.projectID)
+	// Serialize with EnsureLoadBalancer and other updates of the service.
+	defer cs.serviceLocks.lock(service.Namespace + "/" + service.Name)()
+	cs.ignoreManagedAnnotations(service)
+
+	// Internal load balancers have no rules, their status is only updated by EnsureLoadBalancer.
+	if isInternalLoadBalancer(cs.withAnnotationDefaults(service)) {
+		return nil
 	}
 
-	otherRules, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	defer func() { cs.recordAPIRecovery(service, err) }()
+
+	// Get the load balancer details and existing rules.
+	name := cs.GetLoadBalancerName(ctx, clusterName, service)
+	lb, err := cs.getLoadBalancer(ctx, clusterName, service, name, cs.getLoadBalancerFallbackNames(ctx, clusterName, service)...)
 	if err != nil {
-		return false, fmt.Errorf("error checking for other load balancer rules using IP %v: %w", lb.ipAddr, err)
+		return err
 	}
+	defer func() { cs.recordInstanceSyncHosts(clusterName, service, lb.hostIDs, err) }()
 
-	// If other rules exist, this IP is in use by other services
-	if otherRules.Count > 0 {
-		klog.V(4).Infof("IP %v has %d other load balancer rule(s) in use, not releasing", lb.ipAddr, otherRules.Count)
-
-		return false, nil
+	// Direct-to-pod load balancers only forward to the nodes hosting the pods of the service.
+	backendPort, err := getBackendPortMode(cs.withAnnotationDefaults(service))
+	if err != nil {
+		return err
+	}
+	if backendPort != backendPortNodePort {
+		if nodes, err = cs.podHostingNodes(ctx, service, nodes); err != nil {
+			return err
+		}
 	}
 
-	// IP is safe to release - it's either controller-allocated or no longer in use
-	klog.V(4).Infof("IP %v is no longer in use and safe to release", lb.ipAddr)
+	// Verify that all the hosts belong to the same network, and retrieve their ID's.
+	hosts, err := cs.verifyHostsInNetwork(ctx, nodes, getStringFromServiceAnnotation(cs.withAnnotationDefaults(service), ServiceAnnotationLoadBalancerNetwork, ""))
+	if errors.Is(err, errNoEligibleNodes) || errors.Is(err, errNoMatchedHosts) {
+		return cs.updateLoadBalancerWithoutNodes(lb, service, err)
+	}
+	if err != nil {
+		return cs.networkMismatchError(service, err)
+	}
+	cs.resetNetworkMismatch(service)
+	lb.hostIDs = hosts.hostIDs
+
+	// A static NAT mapping has no rules, it follows the backend node instead.
+	if isStaticNAT(cs.withAnnotationDefaults(service)) {
+		lb.ipAddr = getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, "")
+		lb.ipAddrID, lb.networkID = getLoadBalancerID(service), hosts.networkID
+		if lb.ipAddrID == "" {
+			// EnsureLoadBalancer did not get as far as allocating the IP yet.
+			return nil
+		}
 
-	return true, nil
-}
+		return cs.reconcileStaticNATTarget(lb, service)
+	}
 
-// releaseOrphanedIPIfNeeded checks the service annotation for an orphaned IP and releases it if appropriate.
-// This handles the case where all LB rules were successfully deleted but IP release failed on a prior attempt.
-func (cs *CSCloud) releaseOrphanedIPIfNeeded(lb *loadBalancer, service *corev1.Service) error {
-	annotatedIP := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, "")
-	if annotatedIP == "" {
-		return nil
+	// The firewall rules are left to EnsureLoadBalancer, which the service controller calls for every change
+	// of the service, including its annotations.
+	for _, lbRule := range lb.rules {
+		if err := lb.reconcileHostsForRule(lbRule, lb.hostIDs); err != nil {
+			return err
+		}
 	}
 
-	found, lookupErr := lb.lookupPublicIPAddress(annotatedIP)
-	if lookupErr != nil {
-		klog.Warningf("Error looking up annotated IP %v during delete: %v", annotatedIP, lookupErr)
+	return nil
+}
 
-		return nil
-	}
+// updateLoadBalancerWithoutNodes handles an update without any node to assign, which is expected while all nodes
+// are replaced. Rather than failing, the hosts of the rules are kept or removed depending on empty-nodes. The
+// static NAT mapping of a service is always kept, as it cannot exist without a VM.
+func (cs *CSCloud) updateLoadBalancerWithoutNodes(lb *loadBalancer, service *corev1.Service, err error) error {
+	if cs.emptyNodes != emptyNodesRemove || isStaticNAT(cs.withAnnotationDefaults(service)) {
+		msg := fmt.Sprintf("%v; keeping the current hosts of the load balancer", err)
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "NoEligibleNodes", msg)
+		klog.Warning(msg)
 
-	if !found {
 		return nil
 	}
 
-	shouldRelease, shouldErr := cs.shouldReleaseLoadBalancerIP(lb, service)
-	if shouldErr != nil {
-		klog.Warningf("Error checking if annotated IP %v should be released: %v", annotatedIP, shouldErr)
+	msg := fmt.Sprintf("%v; removing all hosts from the load balancer", err)
+	cs.eventRecorder.Event(service, corev1.EventTypeWarning, "NoEligibleNodes", msg)
+	klog.Warning(msg)
 
-		return nil
+	var errs []error
+	for _, lbRule := range lb.rules {
+		if err := lb.reconcileHostsForRule(lbRule, nil); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	if !shouldRelease {
-		klog.V(4).Infof("Annotated IP %v should not be released (keep-ip set or has other rules)", annotatedIP)
+	return errors.Join(errs...)
+}
 
-		return nil
+// setLoadBalancerTags sets the tags that identify the service on the resources the load balancer creates.
+func (cs *CSCloud) setLoadBalancerTags(lb *loadBalancer, clusterName string, service *corev1.Service) {
+	lb.serviceTags = newServiceTags(clusterName, service)
+	lb.propagatedTags = cs.propagatedServiceTags(service)
+	for _, tag := range cs.propagatedTags {
+		lb.propagatedTagKeys = append(lb.propagatedTagKeys, tag.tagKey)
 	}
+}
 
-	if releaseErr := lb.releaseLoadBalancerIP(); releaseErr != nil {
-		return fmt.Errorf("error releasing orphaned load balancer IP %v: %w", annotatedIP, releaseErr)
+// setFirewallRuleEvents makes the load balancer emit an event on the service for every firewall rule it creates
+// or deletes, when firewall-rule-events is enabled. The events form an audit trail of the access to the service.
+func (cs *CSCloud) setFirewallRuleEvents(lb *loadBalancer, service *corev1.Service) {
+	if !cs.firewallRuleEvents {
+		return
 	}
 
-	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
-	msg := fmt.Sprintf("Released orphaned load balancer IP %s for service %s", annotatedIP, serviceName)
-	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "ReleasedOrphanedIP", msg)
-	klog.Info(msg)
-
-	return nil
+	lb.firewallEvents = func(reason, message string) {
+		cs.eventRecorder.Event(service, corev1.EventTypeNormal, reason, message)
+	}
 }
 
-// GetLoadBalancerName returns the name of the LoadBalancer.
-func (cs *CSCloud) GetLoadBalancerName(_ context.Context, clusterName string, service *corev1.Service) string {
-	return Sprintf255(lbNameFormat, servicePrefix, clusterName, service.Namespace, service.Name)
-}
+// getLoadBalancerAlgorithm returns the algorithm for the load balancer rules of the service. Without the
+// algorithm annotation, it is derived from the session affinity: client IP affinity needs "source", while
+// services without affinity use defaultAlgorithm, or "roundrobin" when it is empty.
+func getLoadBalancerAlgorithm(service *corev1.Service, defaultAlgorithm string) (string, error) {
+	if algorithm := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerAlgorithm, ""); algorithm != "" {
+		if err := checkLoadBalancerAlgorithm(algorithm); err != nil {
+			return "", err
+		}
 
-// getLoadBalancerLegacyName returns the legacy load balancer name for backward compatibility.
-func (cs *CSCloud) getLoadBalancerLegacyName(_ context.Context, _ string, service *corev1.Service) string {
-	return cloudprovider.DefaultLoadBalancerName(service)
+		return algorithm, nil
+	}
+
+	switch service.Spec.SessionAffinity {
+	case "", corev1.ServiceAffinityNone:
+		if defaultAlgorithm != "" {
+			return defaultAlgorithm, nil
+		}
+
+		return "roundrobin", nil
+	case corev1.ServiceAffinityClientIP:
+		return "source", nil
+	default:
+		return "", fmt.Errorf("unsupported load balancer affinity: %v", service.Spec.SessionAffinity)
+	}
 }
 
-// filterRulesByPrefix returns only the rules whose Name starts with the given prefix.
-// This is needed because CloudStack's SetKeyword uses LIKE %keyword% matching,
-// which can return rules belonging to other services with overlapping name substrings.
-func filterRulesByPrefix(rules []*cloudstack.LoadBalancerRule, prefix string) []*cloudstack.LoadBalancerRule {
-	var filtered []*cloudstack.LoadBalancerRule
-	for _, rule := range rules {
-		if strings.HasPrefix(rule.Name, prefix) {
-			filtered = append(filtered, rule)
+// getLoadBalancerIPMode returns the ipMode of the load balancer status. Without the ip-mode annotation, it is
+// Proxy when the proxy protocol is enabled, so kube-proxy does not inject an iptables bypass that skips the
+// load balancer and its PROXY header, and VIP otherwise.
+// https://github.com/kubernetes/enhancements/tree/master/keps/sig-network/1860-kube-proxy-IP-node-binding
+func getLoadBalancerIPMode(service *corev1.Service) (corev1.LoadBalancerIPMode, error) {
+	if mode := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPMode, ""); mode != "" {
+		switch ipMode := corev1.LoadBalancerIPMode(mode); ipMode {
+		case corev1.LoadBalancerIPModeProxy, corev1.LoadBalancerIPModeVIP:
+			return ipMode, nil
+		default:
+			return "", fmt.Errorf("unsupported load balancer IP mode %q, must be %s or %s", mode, corev1.LoadBalancerIPModeProxy, corev1.LoadBalancerIPModeVIP)
 		}
 	}
 
-	return filtered
+	if getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerProxyProtocol, false) {
+		return corev1.LoadBalancerIPModeProxy, nil
+	}
+
+	return corev1.LoadBalancerIPModeVIP, nil
 }
 
-// getLoadBalancer tries to find the load balancer using ID-based lookup first (if annotations
-// are present), then falls back to the keyword-based name lookup.
-func (cs *CSCloud) getLoadBalancer(service *corev1.Service, name, legacyName string) (*loadBalancer, error) {
-	if ipAddrID := getLoadBalancerID(service); ipAddrID != "" {
-		networkID := getLoadBalancerNetworkID(service)
-		klog.V(4).Infof("Attempting ID-based load balancer lookup: ipAddrID=%v, networkID=%v", ipAddrID, networkID)
+// checkLoadBalancerAlgorithm returns an error for an algorithm that CloudStack load balancer rules do not support.
+func checkLoadBalancerAlgorithm(algorithm string) error {
+	switch algorithm {
+	case "roundrobin", "leastconn", "source":
+		return nil
+	default:
+		return fmt.Errorf("unsupported load balancer algorithm %q, must be one of roundrobin, leastconn or source", algorithm)
+	}
+}
 
-		lb, err := cs.getLoadBalancerByID(name, ipAddrID, networkID)
-		if err != nil {
-			return nil, err
+// getPortAlgorithms parses the port algorithm annotation, a comma-separated list of <port>=<algorithm>, into the
+// algorithms by service port. Ports are matched by number or name, and must be ports of the service.
+func getPortAlgorithms(service *corev1.Service) (map[int32]string, error) {
+	value := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerPortAlgorithm, "")
+	if value == "" {
+		return nil, nil
+	}
+
+	algorithms := make(map[int32]string)
+	for entry := range strings.SplitSeq(value, ",") {
+		portValue, algorithm, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || portValue == "" {
+			return nil, fmt.Errorf("invalid port algorithm %q: must be <port>=<algorithm>", entry)
 		}
 
-		if len(lb.rules) > 0 {
-			return lb, nil
+		i := slices.IndexFunc(service.Spec.Ports, func(p corev1.ServicePort) bool {
+			return p.Name == portValue || strconv.Itoa(int(p.Port)) == portValue
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("algorithm set for port %s, which is not a port of the service", portValue)
+		}
+		if err := checkLoadBalancerAlgorithm(algorithm); err != nil {
+			return nil, fmt.Errorf("invalid algorithm for port %s: %w", portValue, err)
 		}
 
-		klog.V(4).Infof("ID-based lookup returned no rules, falling back to name-based lookup")
+		port := service.Spec.Ports[i].Port
+		if other, ok := algorithms[port]; ok && other != algorithm {
+			return nil, fmt.Errorf("conflicting algorithms %s and %s for port %d", other, algorithm, port)
+		}
+		algorithms[port] = algorithm
 	}
 
-	return cs.getLoadBalancerByName(name, legacyName)
+	return algorithms, nil
 }
 
-// getLoadBalancerByName retrieves the IP address and ID and all the existing rules it can find.
-func (cs *CSCloud) getLoadBalancerByName(name, legacyName string) (*loadBalancer, error) {
-	lb := &loadBalancer{
-		CloudStackClient: cs.client,
-		name:             name,
-		projectID:        cs.projectID,
-		rules:            make(map[string]*cloudstack.LoadBalancerRule),
-	}
-
-	p := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
-	p.SetKeyword(lb.name)
-	p.SetListall(true)
+// isInternalLoadBalancer returns whether the service asks for an internal load balancer. A requested IP,
+// including the address annotation of an existing public load balancer, takes precedence.
+func isInternalLoadBalancer(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerInternal, false) && getLoadBalancerAddress(service) == ""
+}
 
-	if cs.projectID != "" {
-		p.SetProjectid(cs.projectID)
+// ensureInternalLoadBalancer deletes the public load balancer the service may still have, and returns a status
+// with the internal IPs of the load balancer nodes. kube-proxy forwards traffic to these IPs and the service
+// ports to the service, so the service can be reached from within the network without a public IP.
+func (cs *CSCloud) ensureInternalLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (*corev1.LoadBalancerStatus, error) {
+	if err := cs.deleteLoadBalancer(ctx, clusterName, service); err != nil {
+		return nil, err
 	}
 
-	l, err := cs.client.LoadBalancer.ListLoadBalancerRules(p)
+	status, err := internalLoadBalancerStatus(cs.filterLoadBalancerNodes(nodes))
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving load balancer rules: %w", err)
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "NoEligibleNodes", err.Error())
+
+		return nil, err
 	}
 
-	// Filter keyword results to exact prefix matches. CloudStack's SetKeyword uses
-	// LIKE %keyword% matching, so searching for "foo" can also return "foobar" rules.
-	filtered := filterRulesByPrefix(l.LoadBalancerRules, lb.name+"-")
+	return status, nil
+}
 
-	// If no rules were found, check the legacy name.
-	if len(filtered) == 0 { //nolint:nestif
-		if len(legacyName) > 0 {
-			p.SetKeyword(legacyName)
-			l, err = cs.client.LoadBalancer.ListLoadBalancerRules(p)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving load balancer rules: %w", err)
-			}
-			legacyFiltered := filterRulesByPrefix(l.LoadBalancerRules, legacyName+"-")
-			if len(legacyFiltered) > 0 {
-				lb.name = legacyName
-				filtered = legacyFiltered
+// internalLoadBalancerStatus returns a status with the internal IPs of the nodes, in a stable order.
+func internalLoadBalancerStatus(nodes []*corev1.Node) (*corev1.LoadBalancerStatus, error) {
+	var ips []string
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type == corev1.NodeInternalIP && !slices.Contains(ips, address.Address) {
+				ips = append(ips, address.Address)
 			}
-		} else {
-			return lb, nil
 		}
 	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%w: none of the %d node(s) has an internal IP", errNoEligibleNodes, len(nodes))
+	}
+	slices.Sort(ips)
 
-	for _, lbRule := range filtered {
-		lb.rules[lbRule.Name] = lbRule
+	ipMode := corev1.LoadBalancerIPModeVIP
+	status := &corev1.LoadBalancerStatus{}
+	for _, ip := range ips {
+		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: ip, IPMode: &ipMode})
+	}
 
-		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
-			klog.Warningf("Load balancer %v has rules associated with different IP's: %v, %v", lb.name, lb.ipAddr, lbRule.Publicip)
+	return status, nil
+}
+
+// getBackendPortMode returns the backend port mode of the service. With "target-port", all ports must
+// have a numeric target port, as named ports differ per pod.
+func getBackendPortMode(service *corev1.Service) (backendPortMode, error) {
+	mode := backendPortMode(getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerBackendPort, string(backendPortNodePort)))
+	switch mode {
+	case backendPortNodePort, backendPortServicePort:
+		return mode, nil
+	case backendPortTargetPort:
+		for _, port := range service.Spec.Ports {
+			if port.TargetPort.Type == intstr.String {
+				return "", fmt.Errorf("backend port %q does not support the named target port %q of port %d", mode, port.TargetPort.StrVal, port.Port)
+			}
 		}
 
-		lb.ipAddr = lbRule.Publicip
-		lb.ipAddrID = lbRule.Publicipid
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported load balancer backend port %q, must be one of %s, %s or %s", mode, backendPortNodePort, backendPortServicePort, backendPortTargetPort)
 	}
+}
 
-	klog.V(4).Infof("Load balancer %v contains %d rule(s)", lb.name, len(lb.rules))
+// privatePort returns the port the rule of the service port forwards to on the hosts.
+func (lb *loadBalancer) privatePort(port corev1.ServicePort) int {
+	switch lb.backendPort {
+	case backendPortServicePort:
+		return int(port.Port)
+	case backendPortTargetPort:
+		// The target port defaults to the service port.
+		if port.TargetPort.IntVal > 0 {
+			return int(port.TargetPort.IntVal)
+		}
 
-	return lb, nil
+		return int(port.Port)
+	default:
+		return int(port.NodePort)
+	}
 }
 
-// getLoadBalancerByID retrieves load balancer rules by public IP ID and network ID.
-// This is more reliable than keyword-based search as it uses exact ID matching.
-func (cs *CSCloud) getLoadBalancerByID(name, ipAddrID, networkID string) (*loadBalancer, error) {
-	lb := &loadBalancer{
-		CloudStackClient: cs.client,
-		name:             name,
-		projectID:        cs.projectID,
-		rules:            make(map[string]*cloudstack.LoadBalancerRule),
+// podHostingNodes returns the nodes with a ready endpoint of the service, according to its EndpointSlices.
+// When no node hosts a ready pod, f.e. while the service is rolled out, all nodes are returned so the
+// load balancer can still be created in their network.
+func (cs *CSCloud) podHostingNodes(ctx context.Context, service *corev1.Service, nodes []*corev1.Node) ([]*corev1.Node, error) {
+	endpointSlices, err := cs.kclient.DiscoveryV1().EndpointSlices(service.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + service.Name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the endpoints of service %s/%s: %w", service.Namespace, service.Name, err)
 	}
 
-	p := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
-	p.SetPublicipid(ipAddrID)
-	p.SetListall(true)
+	hosting := map[string]bool{}
+	for _, slice := range endpointSlices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName != nil && (endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready) {
+				hosting[*endpoint.NodeName] = true
+			}
+		}
+	}
 
-	if networkID != "" {
-		p.SetNetworkid(networkID)
+	var filtered []*corev1.Node
+	for _, node := range nodes {
+		if hosting[node.Name] {
+			filtered = append(filtered, node)
+		}
 	}
+	if len(filtered) == 0 {
+		klog.V(2).Infof("No node hosts a ready pod of service %s/%s, using all nodes", service.Namespace, service.Name)
 
-	if cs.projectID != "" {
-		p.SetProjectid(cs.projectID)
+		return nodes, nil
 	}
 
-	l, err := cs.client.LoadBalancer.ListLoadBalancerRules(p)
-	if err != nil {
-		return nil, fmt.Errorf("error retrieving load balancer rules by IP ID %v: %w", ipAddrID, err)
+	return filtered, nil
+}
+
+// checkLoadBalancerIPFamily returns an error if the family of the load balancer IP is not one of the
+// IP families of the service. This happens when the network offering only provides IPs of the other family.
+func checkLoadBalancerIPFamily(service *corev1.Service, ip string) error {
+	if len(service.Spec.IPFamilies) == 0 {
+		return nil
 	}
 
-	filtered := filterRulesByPrefix(l.LoadBalancerRules, lb.name+"-")
-	for _, lbRule := range filtered {
-		lb.rules[lbRule.Name] = lbRule
+	var family corev1.IPFamily
+	switch utilnet.IPFamilyOfString(ip) {
+	case utilnet.IPv4:
+		family = corev1.IPv4Protocol
+	case utilnet.IPv6:
+		family = corev1.IPv6Protocol
+	default:
+		return fmt.Errorf("load balancer IP %q is not a valid IP address", ip)
+	}
 
-		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
-			klog.Warningf("Load balancer %v has rules associated with different IP's: %v, %v", lb.name, lb.ipAddr, lbRule.Publicip)
+	for _, f := range service.Spec.IPFamilies {
+		if f == family {
+			return nil
 		}
-
-		lb.ipAddr = lbRule.Publicip
-		lb.ipAddrID = lbRule.Publicipid
-		lb.networkID = lbRule.Networkid
 	}
 
-	klog.V(4).Infof("Load balancer %v (by ID %v) contains %d rule(s)", lb.name, ipAddrID, len(lb.rules))
+	return fmt.Errorf("load balancer IP %s is an %s address, but the service requests IP families %v; check the IP families supported by the network offering", ip, family, service.Spec.IPFamilies)
+}
 
-	return lb, nil
+// isLoadBalancerManaged returns false if the service opted out of load balancer management by this provider.
+func (cs *CSCloud) isLoadBalancerManaged(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(cs.withAnnotationDefaults(service), ServiceAnnotationLoadBalancerManaged, true)
 }
 
-// verifyHosts verifies if all hosts belong to the same network, and returns the host ID's and network ID.
-// During rolling upgrades some nodes may not yet have a corresponding VM in CloudStack, so we tolerate
-// partial matches: as long as at least one node can be resolved we return the matched set and log
-// warnings for the nodes we could not find.
-func (cs *CSCloud) verifyHosts(nodes []*corev1.Node) ([]string, string, error) {
-	hostNames := map[string]bool{}
-	// providerVMIDs maps CloudStack VM IDs extracted from node.Spec.ProviderID
-	// so we can match by ID in addition to name.
-	providerVMIDs := map[string]bool{}
-	for _, node := range nodes {
-		// node.Name can be an FQDN as well, and CloudStack VM names aren't
-		// To match, we need to Split the domain part off here, if present
-		hostNames[strings.Split(strings.ToLower(node.Name), ".")[0]] = true
+// isFirewallSupported checks whether a CloudStack network supports the Firewall service.
+func isFirewallSupported(services []cloudstack.NetworkServiceInternal) bool {
+	for _, svc := range services {
+		if svc.Name == "Firewall" {
+			return true
+		}
+	}
 
-		// Also extract the VM ID from the ProviderID for a more reliable match.
-		if node.Spec.ProviderID != "" {
-			if id, _, err := instanceIDFromProviderID(node.Spec.ProviderID); err == nil {
-				providerVMIDs[id] = true
-			}
+	return false
+}
+
+// EnsureLoadBalancerDeleted deletes the specified load balancer if it exists, returning
+// nil if the load balancer specified either didn't exist or was successfully deleted.
+func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *corev1.Service) (err error) {
+	klog.V(4).InfoS("EnsureLoadBalancerDeleted", "cluster", clusterName, "service", klog.KObj(service))
+
+	if !cs.isLoadBalancerManaged(service) {
+		return cloudprovider.ImplementedElsewhere
+	}
+
+	// Serialize with reconciles of the service that may still be running.
+	defer cs.serviceLocks.lock(service.Namespace + "/" + service.Name)()
+	cs.ignoreManagedAnnotations(service)
+
+	// Patch the service to remove annotations after EnsureLoadBalancerDeleted finishes.
+	patcher := newServicePatcher(cs.kclient, service)
+	defer func() {
+		if cs.writesAnnotations(service) {
+			err = patcher.Patch(ctx, err)
 		}
+	}()
+
+	cs.resetNetworkMismatch(service)
+	cs.resetTransientRetry(service)
+	if cs.instanceSync != nil {
+		cs.instanceSync.forget(service.Namespace + "/" + service.Name)
 	}
 
-	// Fetch all VMs using pagination to avoid missing VMs when the project has many instances.
-	allVMs, err := cs.listAllVirtualMachines()
+	return cs.deleteLoadBalancer(ctx, clusterName, service)
+}
+
+// deleteLoadBalancer deletes the rules of the load balancer of the service and releases its IP when appropriate.
+// Unless the service is being deleted, our annotations are removed from it; the caller patches the service.
+func (cs *CSCloud) deleteLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service) error {
+	annotated := cs.withAnnotationDefaults(service)
+
+	// Get the load balancer details and existing rules.
+	name := cs.GetLoadBalancerName(ctx, clusterName, service)
+	lb, err := cs.getLoadBalancer(ctx, clusterName, service, name, cs.getLoadBalancerFallbackNames(ctx, clusterName, service)...)
 	if err != nil {
-		return nil, "", fmt.Errorf("error retrieving list of hosts: %w", err)
+		return err
 	}
 
-	var hostIDs []string
-	var networkID string
-	matchedNames := map[string]bool{}
-	var skippedNoNIC []string
+	// The tags keep the firewall rules of other services that share the IP.
+	lb.serviceTags = newServiceTags(clusterName, service)
+	cs.setFirewallRuleEvents(lb, service)
 
-	// Check if the virtual machine is in the hosts slice, then add the corresponding ID.
-	for _, vm := range allVMs {
-		nameMatch := hostNames[strings.ToLower(vm.Name)]
-		idMatch := providerVMIDs[vm.Id]
-		if nameMatch || idMatch {
-			if len(vm.Nic) == 0 {
-				klog.Warningf("Skipping VM %v (id: %v) as it contains no active network interfaces (may still be provisioning)", vm.Name, vm.Id)
-				skippedNoNIC = append(skippedNoNIC, vm.Name)
-				// Skip VM's without any active network interfaces. This happens during rollout f.e.
-				continue
-			}
-			if networkID != "" && networkID != vm.Nic[0].Networkid {
-				return nil, "", errors.New("found hosts that belong to different networks")
+	// If no rules exist, the load balancer doesn't exist. However, an IP may have been
+	// orphaned from a previous partial failure. Check the service annotation for cleanup.
+	if len(lb.rules) == 0 {
+		klog.V(4).Infof("No load balancer rules found for service, checking annotation for orphaned IP")
+
+		// A static NAT mapping has no rules, so it is removed before the IP is released.
+		if err := cs.deleteStaticNAT(lb, service); err != nil {
+			return err
+		}
+
+		if err := cs.releaseOrphanedIPIfNeeded(ctx, lb, annotated); err != nil {
+			return err
+		}
+
+		// If the service is not marked for deletion (f.e. when switching from type
+		// LoadBalancer to ClusterIP), remove our annotations.
+		if service.DeletionTimestamp.IsZero() {
+			deleteLoadBalancerAnnotations(service)
+		}
+
+		return nil
+	}
+
+	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+	var deletionErrors []error
+
+	// The rules are removed from lb.rules once they are deleted, so they are remembered for the verification.
+	deletedRules := slices.Collect(maps.Values(lb.rules))
+
+	if cs.orderedTeardown {
+		deletionErrors = lb.deleteRulesOrdered()
+	} else {
+		// Resources are deleted before the resources they depend on, so CloudStack never refuses a deletion
+		// because the resource is still in use: per rule its firewall rules, its stickiness policy and the
+		// rule itself, then the ICMP firewall rules of the IP and finally the IP.
+		for _, lbRule := range lb.rules {
+			klog.V(4).Infof("Processing deletion of load balancer rule: %v", lbRule.Name)
+			if err := lb.deleteLoadBalancerRuleAndFirewall(lbRule); err != nil {
+				// Continue to delete the other rules even if this one fails
+				deletionErrors = append(deletionErrors, err)
 			}
+		}
 
-			networkID = vm.Nic[0].Networkid
-			hostIDs = append(hostIDs, vm.Id)
-			matchedNames[strings.ToLower(vm.Name)] = true
+		// Delete the ICMP firewall rules created for ServiceAnnotationLoadBalancerAllowICMP and ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded
+		if lb.ipAddrID != "" {
+			klog.V(4).Infof("Deleting ICMP firewall rules for load balancer: %v (IP:%v)", lb.name, lb.ipAddr)
+			if _, err := lb.deleteICMPFirewallRules(lb.ipAddrID); err != nil {
+				err := fmt.Errorf("error deleting ICMP firewall rules for load balancer %v: %w", lb.name, err)
+				klog.Errorf("%v", err)
+				deletionErrors = append(deletionErrors, err)
+			}
 		}
 	}
 
-	// Log warnings for nodes that could not be matched — this is expected during rolling upgrades.
-	var unmatchedNodes []string
-	for _, node := range nodes {
-		shortName := strings.Split(strings.ToLower(node.Name), ".")[0]
-		if !matchedNames[shortName] {
-			unmatchedNodes = append(unmatchedNodes, node.Name)
+	// Delete the public IP address if appropriate. While resources on the IP may be left, the IP is kept
+	// and released by a later attempt.
+	if lb.ipAddr != "" && len(deletionErrors) > 0 {
+		klog.Warningf("Not releasing load balancer IP %v as not all of its resources were deleted", lb.ipAddr)
+	} else if lb.ipAddr != "" { //nolint:nestif
+		klog.V(4).Infof("Processing public IP deletion for load balancer: IP=%v, ID=%v", lb.ipAddr, lb.ipAddrID)
+
+		// Check if we should release the IP
+		shouldReleaseIP, err := cs.shouldReleaseLoadBalancerIP(lb, annotated)
+		switch {
+		case err != nil:
+			err := fmt.Errorf("error determining if IP should be released: %w", err)
+			klog.Errorf("%v", err)
+			deletionErrors = append(deletionErrors, err)
+		case shouldReleaseIP:
+			klog.V(4).Infof("Releasing load balancer IP: %v", lb.ipAddr)
+			if err := lb.releaseLoadBalancerIPWithRetry(ctx); err != nil {
+				err := fmt.Errorf("error releasing load balancer IP %v: %w", lb.ipAddr, err)
+				klog.Errorf("%v", err)
+				deletionErrors = append(deletionErrors, err)
+			} else {
+				msg := fmt.Sprintf("Released load balancer IP %s for service %s", lb.ipAddr, serviceName)
+				cs.eventRecorder.Event(service, corev1.EventTypeNormal, "ReleasedLoadBalancerIP", msg)
+				klog.Info(msg)
+			}
+		default:
+			klog.V(4).Infof("Keeping load balancer IP %v allocated", lb.ipAddr)
 		}
 	}
-	if len(unmatchedNodes) > 0 {
-		klog.Warningf("Could not match %d node(s) to CloudStack VMs (may be provisioning or terminating): %v", len(unmatchedNodes), unmatchedNodes)
+
+	// A deletion is only reported as done once no rule is left, so the service controller retries until then,
+	// f.e. after a type change to ClusterIP, which it does not retry once the finalizer is removed.
+	if len(deletionErrors) == 0 {
+		if err := lb.verifyRulesDeleted(deletedRules); err != nil {
+			klog.Errorf("%v", err)
+			deletionErrors = append(deletionErrors, err)
+		}
 	}
-	if len(skippedNoNIC) > 0 {
-		klog.Warningf("Skipped %d VM(s) with no NICs (still provisioning): %v", len(skippedNoNIC), skippedNoNIC)
+
+	// Return aggregated errors if any occurred
+	if len(deletionErrors) > 0 {
+		msg := fmt.Sprintf("Encountered %d error(s) while deleting load balancer for service %s", len(deletionErrors), serviceName)
+		klog.Warningf("%s: %v", msg, deletionErrors)
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "DeletingLoadBalancerFailed", msg)
+
+		return fmt.Errorf("load balancer deletion completed with errors: %w", errors.Join(deletionErrors...))
 	}
 
-	if len(hostIDs) == 0 || len(networkID) == 0 {
-		return nil, "", fmt.Errorf("could not match any of the %d node(s) to VMs in CloudStack (unmatched: %v, skipped-no-nic: %v)",
-			len(nodes), unmatchedNodes, skippedNoNIC)
+	// If the service is not marked for deletion (f.e. when switching from type
+	// LoadBalancer to ClusterIP), remove our annotations.
+	if service.DeletionTimestamp.IsZero() {
+		deleteLoadBalancerAnnotations(service)
 	}
 
-	klog.V(4).Infof("Matched %d of %d nodes to CloudStack VMs", len(hostIDs), len(nodes))
+	msg := "Successfully deleted load balancer for service " + serviceName
+	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "DeletedLoadBalancer", msg)
+	klog.Info(msg)
 
-	return hostIDs, networkID, nil
+	return nil
 }
 
-// listAllVirtualMachines retrieves all VMs using pagination to handle large projects.
-func (cs *CSCloud) listAllVirtualMachines() ([]*cloudstack.VirtualMachine, error) {
-	var allVMs []*cloudstack.VirtualMachine
-
-	page := 1
-	pageSize := 500
-
-	for {
-		p := cs.client.VirtualMachine.NewListVirtualMachinesParams()
+// verifyRulesDeleted returns an error wrapping errLoadBalancerRulesLeft when CloudStack still lists any of the
+// deleted rules. The rules are looked up by their ID, as the IP they were found by may have been released, and
+// a lookup by name would also find the rules of a service whose name starts with the name of ours.
+func (lb *loadBalancer) verifyRulesDeleted(rules []*cloudstack.LoadBalancerRule) error {
+	var left []string
+	for _, lbRule := range rules {
+		p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+		p.SetId(lbRule.Id)
 		p.SetListall(true)
-		p.SetDetails([]string{"min", "nics"})
-		p.SetPage(page)
-		p.SetPagesize(pageSize)
-
-		if cs.projectID != "" {
-			p.SetProjectid(cs.projectID)
+		if lb.projectID != "" {
+			p.SetProjectid(lb.projectID)
 		}
 
-		l, err := cs.client.VirtualMachine.ListVirtualMachines(p)
+		l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list virtual machines: %w", err)
+			return fmt.Errorf("error verifying the deletion of load balancer rule %v: %w", lbRule.Name, err)
 		}
+		if l.Count > 0 {
+			left = append(left, lbRule.Name)
+		}
+	}
 
-		allVMs = append(allVMs, l.VirtualMachines...)
+	if len(left) > 0 {
+		slices.Sort(left)
 
-		// If we got fewer results than the page size, we've reached the last page.
-		if len(l.VirtualMachines) < pageSize {
-			break
-		}
-		page++
+		return fmt.Errorf("%w: %v", errLoadBalancerRulesLeft, left)
 	}
 
-	return allVMs, nil
+	return nil
 }
 
-// hasLoadBalancerIP returns true if we have a load balancer address and ID.
-func (lb *loadBalancer) hasLoadBalancerIP() bool {
-	return lb.ipAddr != "" && lb.ipAddrID != ""
-}
+// shouldReleaseLoadBalancerIP determines whether the public IP should be released. An IP that is shared by
+// several services is only released by the last of them, so it is kept while other services have rules on it
+// or still use it, f.e. because they request the same IP and did not create their rules yet.
+func (cs *CSCloud) shouldReleaseLoadBalancerIP(lb *loadBalancer, service *corev1.Service) (bool, error) {
+	// The IP lifecycle is managed outside the provider, never release any IP.
+	if cs.disableIPRelease {
+		klog.Infof("IP release is disabled, not releasing IP %v", lb.ipAddr)
 
-// getLoadBalancerIP retrieves an existing IP or associates a new IP.
-func (lb *loadBalancer) getLoadBalancerIP(loadBalancerIP string) error {
-	if loadBalancerIP != "" {
-		return lb.getPublicIPAddress(loadBalancerIP)
+		return false, nil
 	}
 
-	return lb.associatePublicIPAddress()
-}
+	// If the keep-ip annotation is set to true, don't release the IP.
+	// The user is responsible for managing the lifecycle of kept IPs.
+	if getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerKeepIP, false) {
+		klog.V(4).Infof("IP %v has keep-ip annotation set, not releasing", lb.ipAddr)
 
-// lookupPublicIPAddress checks whether the given IP address is already allocated in CloudStack.
-// If found and allocated, it sets lb.ipAddr and lb.ipAddrID and returns (true, nil).
-// If not found or not allocated, it returns (false, nil) without modifying lb state.
-// Unlike getPublicIPAddress, this method does NOT call associatePublicIPAddress for unallocated IPs.
-func (lb *loadBalancer) lookupPublicIPAddress(ip string) (bool, error) {
-	p := lb.Address.NewListPublicIpAddressesParams()
-	p.SetIpaddress(ip)
-	p.SetAllocatedonly(true)
-	p.SetListall(true)
+		return false, nil
+	}
 
+	// Check if this IP is used by other load balancer rules (other services)
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(lb.ipAddrID)
+	p.SetListall(true)
 	if lb.projectID != "" {
 		p.SetProjectid(lb.projectID)
 	}
 
-	l, err := lb.Address.ListPublicIpAddresses(p)
+	otherRules, err := lb.LoadBalancer.ListLoadBalancerRules(p)
 	if err != nil {
-		return false, fmt.Errorf("error looking up IP address %v: %w", ip, err)
+		return false, fmt.Errorf("error checking for other load balancer rules using IP %v: %w", lb.ipAddr, err)
 	}
 
-	if l.Count != 1 {
+	// If other rules exist, this IP is in use by other services
+	if otherRules.Count > 0 {
+		klog.V(4).Infof("IP %v has %d other load balancer rule(s) in use, not releasing", lb.ipAddr, otherRules.Count)
+
 		return false, nil
 	}
 
-	lb.ipAddr = l.PublicIpAddresses[0].Ipaddress
-	lb.ipAddrID = l.PublicIpAddresses[0].Id
+	sharing, err := cs.servicesSharingIP(service, lb.ipAddr, lb.ipAddrID)
+	if err != nil {
+		return false, err
+	}
+	if len(sharing) > 0 {
+		klog.V(4).Infof("IP %v is shared with service(s) %v, not releasing", lb.ipAddr, sharing)
 
-	return true, nil
-}
+		return false, nil
+	}
 
-// getPublicIPAddressID retrieves the ID of the given IP, and sets the address and its ID.
-func (lb *loadBalancer) getPublicIPAddress(loadBalancerIP string) error {
-	klog.V(4).Infof("Retrieve load balancer IP details: %v", loadBalancerIP)
+	// IP is safe to release - it's either controller-allocated or no longer in use
+	klog.V(4).Infof("IP %v is no longer in use and safe to release", lb.ipAddr)
 
-	p := lb.Address.NewListPublicIpAddressesParams()
-	p.SetIpaddress(loadBalancerIP)
-	p.SetAllocatedonly(false)
-	p.SetListall(true)
+	return true, nil
+}
 
-	if lb.projectID != "" {
-		p.SetProjectid(lb.projectID)
+// servicesSharingIP returns the other load balancer services that use the public IP, as namespace/name.
+// Services that are being deleted are skipped, they keep the IP only as long as they have rules on it.
+func (cs *CSCloud) servicesSharingIP(service *corev1.Service, ipAddr, ipAddrID string) ([]string, error) {
+	if cs.serviceLister == nil {
+		return nil, fmt.Errorf("error listing services sharing IP %v: %w", ipAddr, errServiceListerNotSet)
 	}
-
-	l, err := lb.Address.ListPublicIpAddresses(p)
+	services, err := cs.serviceLister.List(labels.Everything())
 	if err != nil {
-		return fmt.Errorf("error retrieving IP address: %w", err)
-	}
-
-	if l.Count != 1 {
-		return fmt.Errorf("could not find IP address %v. Found %d addresses", loadBalancerIP, l.Count)
+		return nil, fmt.Errorf("error listing services sharing IP %v: %w", ipAddr, err)
 	}
 
-	lb.ipAddr = l.PublicIpAddresses[0].Ipaddress
-	lb.ipAddrID = l.PublicIpAddresses[0].Id
+	var sharing []string
+	for _, other := range services {
+		if other.Namespace == service.Namespace && other.Name == service.Name {
+			continue
+		}
+		if other.Spec.Type != corev1.ServiceTypeLoadBalancer || !other.DeletionTimestamp.IsZero() || !cs.isLoadBalancerManaged(other) {
+			continue
+		}
 
-	// If the IP Address is not allocated then associate it
-	if l.PublicIpAddresses[0].Allocated == "" {
-		return lb.associatePublicIPAddress()
+		uses := getLoadBalancerID(other) == ipAddrID || getLoadBalancerAddress(other) == ipAddr
+		for _, ingress := range other.Status.LoadBalancer.Ingress {
+			uses = uses || ingress.IP == ipAddr
+		}
+		if uses {
+			sharing = append(sharing, other.Namespace+"/"+other.Name)
+		}
 	}
 
-	return nil
+	return sharing, nil
 }
 
-// associatePublicIPAddress associates a new IP and sets the address and its ID.
-func (lb *loadBalancer) associatePublicIPAddress() error {
-	klog.V(4).Infof("Allocate new IP for load balancer: %v", lb.name)
-	// If a network belongs to a VPC, the IP address needs to be associated with
-	// the VPC instead of with the network.
-	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
-	if err != nil {
-		if count == 0 {
-			return fmt.Errorf("could not find network %v", lb.networkID)
-		}
+// releaseOrphanedIPIfNeeded checks the service annotation for an orphaned IP and releases it if appropriate.
+// This handles the case where all LB rules were successfully deleted but IP release failed on a prior attempt.
+// When the annotations are not written, the IP is found by its service tags instead.
+func (cs *CSCloud) releaseOrphanedIPIfNeeded(ctx context.Context, lb *loadBalancer, service *corev1.Service) error {
+	annotatedIP := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, "")
 
-		return fmt.Errorf("error retrieving network: %w", err)
+	var found bool
+	var lookupErr error
+	switch {
+	case annotatedIP != "":
+		found, lookupErr = lb.lookupPublicIPAddress(annotatedIP)
+	case !cs.writesAnnotations(service):
+		// Without the annotations, the IP is only known by the service tags of tagPublicIPAddress.
+		found, lookupErr = lb.lookupTaggedPublicIPAddress()
+		annotatedIP = lb.ipAddr
+	default:
+		return nil
 	}
+	if lookupErr != nil {
+		klog.Warningf("Error looking up orphaned IP during delete: %v", lookupErr)
 
-	p := lb.Address.NewAssociateIpAddressParams()
+		return nil
+	}
 
-	if network.Vpcid != "" {
-		p.SetVpcid(network.Vpcid)
-	} else {
-		p.SetNetworkid(lb.networkID)
+	if !found {
+		return nil
 	}
 
-	if lb.projectID != "" {
-		p.SetProjectid(lb.projectID)
+	shouldRelease, shouldErr := cs.shouldReleaseLoadBalancerIP(lb, service)
+	if shouldErr != nil {
+		klog.Warningf("Error checking if annotated IP %v should be released: %v", annotatedIP, shouldErr)
+
+		return nil
 	}
 
-	if lb.ipAddr != "" {
-		p.SetIpaddress(lb.ipAddr)
+	if !shouldRelease {
+		klog.V(4).Infof("Annotated IP %v should not be released (keep-ip set or has other rules)", annotatedIP)
+
+		return nil
 	}
 
-	// Associate a new IP address
-	r, err := lb.Address.AssociateIpAddress(p)
-	if err != nil {
-		return fmt.Errorf("error associating new IP address: %w", err)
+	if releaseErr := lb.releaseLoadBalancerIPWithRetry(ctx); releaseErr != nil {
+		return fmt.Errorf("error releasing orphaned load balancer IP %v: %w", annotatedIP, releaseErr)
 	}
 
-	lb.ipAddr = r.Ipaddress
-	lb.ipAddrID = r.Id
+	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+	msg := fmt.Sprintf("Released orphaned load balancer IP %s for service %s", annotatedIP, serviceName)
+	cs.eventRecorder.Event(service, corev1.EventTypeNormal, "ReleasedOrphanedIP", msg)
+	klog.Info(msg)
 
 	return nil
 }
 
-// releasePublicIPAddress releases an associated IP.
-func (lb *loadBalancer) releaseLoadBalancerIP() error {
-	p := lb.Address.NewDisassociateIpAddressParams(lb.ipAddrID)
+// GetLoadBalancerName returns the name of the LoadBalancer.
+func (cs *CSCloud) GetLoadBalancerName(_ context.Context, clusterName string, service *corev1.Service) string {
+	return cs.nameScheme.LoadBalancerName(clusterName, service)
+}
 
-	if _, err := lb.Address.DisassociateIpAddress(p); err != nil {
-		return fmt.Errorf("error releasing load balancer IP %v: %w", lb.ipAddr, err)
+// LoadBalancerName returns the name of the load balancer of the service, as used by EnsureLoadBalancer
+// with the default naming scheme. The name is truncated to 255 characters.
+func LoadBalancerName(clusterName string, service *corev1.Service) string {
+	return NameScheme{}.LoadBalancerName(clusterName, service)
+}
+
+// NameScheme configures how load balancer names are built from the cluster, namespace and service name.
+// Empty fields use the defaults, so the zero value is the default scheme.
+type NameScheme struct {
+	// Prefix is put in front of the name, "K8s_svc_" by default.
+	Prefix string
+	// Separator separates the cluster, namespace and service name, "_" by default.
+	Separator string
+	// HashSuffix appends a hash of the cluster, namespace and service name. It keeps names that were
+	// truncated unique, and stops a service from matching the rules of a service whose name starts
+	// with its own name followed by a "-".
+	HashSuffix bool
+}
+
+// LoadBalancerName returns the name of the load balancer of the service. The name is truncated to 255
+// characters, but with HashSuffix the hash is always kept.
+func (n NameScheme) LoadBalancerName(clusterName string, service *corev1.Service) string {
+	prefix, separator := n.Prefix, n.Separator
+	if prefix == "" {
+		prefix = servicePrefix
+	}
+	if separator == "" {
+		separator = defaultNameSeparator
+	}
+
+	name := prefix + strings.Join([]string{clusterName, service.Namespace, service.Name}, separator)
+	if !n.HashSuffix {
+		return Sprintf255("%s", name)
+	}
+
+	sum := sha256.Sum256([]byte(clusterName + "/" + service.Namespace + "/" + service.Name))
+	suffix := separator + hex.EncodeToString(sum[:])[:nameHashLength]
+
+	return Sprintf255("%s", name[:min(len(name), 255-len(suffix))]) + suffix
+}
+
+// validate returns an error when names of the scheme could match the rules of other load balancers. Rule
+// names are the load balancer name followed by "-", and legacy names are "a" followed by hexadecimal digits.
+func (n NameScheme) validate() error {
+	if strings.Contains(n.Prefix, "-") || strings.Contains(n.Separator, "-") {
+		return errors.New("the load balancer name-prefix and name-separator must not contain \"-\"")
+	}
+	if n.Prefix != "" && strings.Trim(n.Prefix, "0123456789abcdef") == "" {
+		return fmt.Errorf("the load balancer name-prefix %q could collide with legacy names, it must contain a character other than 0-9 and a-f", n.Prefix)
 	}
 
 	return nil
 }
 
-// checkLoadBalancerRule checks if the rule already exists and if it does, if it can be updated. If
-// it does exist but cannot be updated, it will delete the existing rule so it can be created again.
-func (lb *loadBalancer) checkLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) (*cloudstack.LoadBalancerRule, bool, error) {
-	lbRule, ok := lb.rules[lbRuleName]
-	if !ok {
-		return nil, false, nil
+// LoadBalancerRuleName returns the name of the load balancer rule for a port of the load balancer
+// named lbName. The protocol is that of ProtocolFromServicePort for the port and its service. It takes
+// the name of the load balancer rather than the service, as the rules are also looked up under the names
+// of older naming schemes, see LoadBalancerRuleNames for the names of a service.
+func LoadBalancerRuleName(lbName string, protocol LoadBalancerProtocol, port int32) string {
+	return fmt.Sprintf("%s-%s-%d", lbName, protocol, port)
+}
+
+// LoadBalancerRuleNames returns the names of the load balancer rules of the ports of the service, in the
+// order of its ports, as used by EnsureLoadBalancer with the default naming scheme.
+func LoadBalancerRuleNames(clusterName string, service *corev1.Service) []string {
+	return NameScheme{}.LoadBalancerRuleNames(clusterName, service)
+}
+
+// LoadBalancerRuleNames returns the names of the load balancer rules of the ports of the service, in the
+// order of its ports. Ports EnsureLoadBalancer rejects, f.e. SCTP ports, are left out. The annotation
+// defaults of the cloud config are not applied, so the service must carry the proxy protocol annotation
+// itself.
+func (n NameScheme) LoadBalancerRuleNames(clusterName string, service *corev1.Service) []string {
+	lbName := n.LoadBalancerName(clusterName, service)
+
+	names := make([]string, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		protocol := ProtocolFromServicePort(port, service)
+		if protocol == LoadBalancerProtocolInvalid {
+			continue
+		}
+		names = append(names, LoadBalancerRuleName(lbName, protocol, port.Port))
 	}
 
-	// Check if any of the values we cannot update (those that require a new load balancer rule) are changed.
-	if lbRule.Publicip == lb.ipAddr && lbRule.Privateport == strconv.Itoa(int(port.NodePort)) && lbRule.Publicport == strconv.Itoa(int(port.Port)) {
-		updateAlgo := lbRule.Algorithm != lb.algorithm
-		updateProto := lbRule.Protocol != protocol.CSProtocol()
+	return names
+}
 
-		return lbRule, updateAlgo || updateProto, nil
+// ruleForPort returns the rule of the port. Rules that still have the name of an older naming scheme are
+// matched by the protocol and port at the end of their name, as they are only renamed by EnsureLoadBalancer.
+func (lb *loadBalancer) ruleForPort(protocol LoadBalancerProtocol, port int32) (*cloudstack.LoadBalancerRule, bool) {
+	if lbRule, ok := lb.rules[LoadBalancerRuleName(lb.name, protocol, port)]; ok {
+		return lbRule, true
 	}
 
-	// Delete the load balancer rule so we can create a new one using the new values.
-	if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
-		return nil, false, err
+	suffix := LoadBalancerRuleName("", protocol, port)
+	for ruleName, lbRule := range lb.rules {
+		if strings.HasSuffix(ruleName, suffix) {
+			return lbRule, true
+		}
 	}
 
-	return nil, false, nil
+	return nil, false
 }
 
-// updateLoadBalancerRule updates a load balancer rule.
-func (lb *loadBalancer) updateLoadBalancerRule(lbRuleName string, protocol LoadBalancerProtocol) error {
-	lbRule := lb.rules[lbRuleName]
+// getLoadBalancerFallbackNames returns the names the load balancer of the service may have been created
+// with before: the name of the default naming scheme when another scheme is configured, and the legacy name.
+func (cs *CSCloud) getLoadBalancerFallbackNames(ctx context.Context, clusterName string, service *corev1.Service) []string {
+	return []string{
+		LoadBalancerName(clusterName, service),
+		cs.getLoadBalancerLegacyName(ctx, clusterName, service),
+	}
+}
 
-	p := lb.LoadBalancer.NewUpdateLoadBalancerRuleParams(lbRule.Id)
-	p.SetAlgorithm(lb.algorithm)
-	p.SetProtocol(protocol.CSProtocol())
+// getLoadBalancerLegacyName returns the legacy load balancer name for backward compatibility.
+func (cs *CSCloud) getLoadBalancerLegacyName(_ context.Context, _ string, service *corev1.Service) string {
+	return cloudprovider.DefaultLoadBalancerName(service)
+}
 
-	_, err := lb.LoadBalancer.UpdateLoadBalancerRule(p)
-	if err != nil {
-		return fmt.Errorf("failed to update loadbalancer rule with ID %s: %w", lbRule.Id, err)
+// filterRulesByPrefix returns only the rules whose Name starts with the given prefix.
+// This is needed because CloudStack's SetKeyword uses LIKE %keyword% matching,
+// which can return rules belonging to other services with overlapping name substrings.
+func filterRulesByPrefix(rules []*cloudstack.LoadBalancerRule, prefix string) []*cloudstack.LoadBalancerRule {
+	var filtered []*cloudstack.LoadBalancerRule
+	for _, rule := range rules {
+		if strings.HasPrefix(rule.Name, prefix) {
+			filtered = append(filtered, rule)
+		}
 	}
 
-	return nil
+	return filtered
 }
 
-// createLoadBalancerRule creates a new load balancer rule and returns its ID.
-func (lb *loadBalancer) createLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) (*cloudstack.LoadBalancerRule, error) {
-	p := lb.LoadBalancer.NewCreateLoadBalancerRuleParams(
-		lb.algorithm,
-		lbRuleName,
-		int(port.NodePort),
-		int(port.Port),
-	)
+// parseLoadBalancerRuleName returns the port of a rule named by LoadBalancerRuleName for the load balancer
+// lbName, or false if the name is not the name of a rule of that load balancer for a protocol and port.
+func parseLoadBalancerRuleName(ruleName, lbName string) (int32, bool) {
+	suffix, ok := strings.CutPrefix(ruleName, lbName+"-")
+	if !ok {
+		return 0, false
+	}
+	i := strings.LastIndex(suffix, "-")
+	if i < 0 || suffix[:i] == "" || ProtocolFromLoadBalancer(suffix[:i]) == LoadBalancerProtocolInvalid {
+		return 0, false
+	}
+	port, err := strconv.ParseInt(suffix[i+1:], 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, false
+	}
 
-	p.SetNetworkid(lb.networkID)
-	p.SetPublicipid(lb.ipAddrID)
+	return int32(port), true
+}
 
-	p.SetProtocol(protocol.CSProtocol())
+// ownsRule returns true if the rule is a rule of the load balancer lbName of the service. The name of a load
+// balancer without a hash is a prefix of the rule names of a service whose name starts with the name of ours
+// followed by a "-", so matching the prefix is not enough: rules tagged with a service must be tagged with
+// ours, and untagged rules, f.e. those created before rules were tagged, must be named after a protocol and
+// port. With ports, untagged rules must be named after one of them.
+func (lb *loadBalancer) ownsRule(lbRule *cloudstack.LoadBalancerRule, lbName string, ports []corev1.ServicePort) bool {
+	if !strings.HasPrefix(lbRule.Name, lbName+"-") || lb.belongsToOtherCluster(lbRule.Tags) {
+		return false
+	}
+	if slices.ContainsFunc(lbRule.Tags, func(tag cloudstack.Tags) bool { return tag.Key == serviceNameTagKey }) {
+		return !lb.belongsToOtherService(lbRule.Tags)
+	}
 
-	// Do not open the firewall implicitly, we always create explicit firewall rules
-	p.SetOpenfirewall(false)
+	port, ok := parseLoadBalancerRuleName(lbRule.Name, lbName)
 
-	// Create a new load balancer rule.
-	r, err := lb.LoadBalancer.CreateLoadBalancerRule(p)
-	if err != nil {
-		return nil, fmt.Errorf("error creating load balancer rule %v: %w", lbRuleName, err)
+	return ok && (ports == nil || slices.ContainsFunc(ports, func(p corev1.ServicePort) bool { return p.Port == port }))
+}
+
+// ownedRules returns the rules of the load balancer lbName, see ownsRule.
+func (lb *loadBalancer) ownedRules(rules []*cloudstack.LoadBalancerRule, lbName string, ports []corev1.ServicePort) []*cloudstack.LoadBalancerRule {
+	var owned []*cloudstack.LoadBalancerRule
+	for _, lbRule := range filterRulesByPrefix(rules, lbName+"-") {
+		if !lb.ownsRule(lbRule, lbName, ports) {
+			klog.V(4).Infof("Ignoring load balancer rule %v, it belongs to another service", lbRule.Name)
+
+			continue
+		}
+		owned = append(owned, lbRule)
 	}
 
-	lbRule := &cloudstack.LoadBalancerRule{
-		Id:          r.Id,
-		Algorithm:   r.Algorithm,
-		Cidrlist:    r.Cidrlist,
-		Name:        r.Name,
-		Networkid:   r.Networkid,
-		Privateport: r.Privateport,
-		Publicport:  r.Publicport,
-		Publicip:    r.Publicip,
-		Publicipid:  r.Publicipid,
-		Protocol:    r.Protocol,
+	return owned
+}
+
+// addTaggedRules adds the rules tagged with the service that are named after a port without a rule among the
+// found ones. Rules named by a scheme that is neither the configured one nor one of the fallback names, f.e.
+// after a custom scheme was changed to another one, are only found this way. Without found rules, the name of
+// the load balancer is taken from the tagged rules.
+func (lb *loadBalancer) addTaggedRules(found, rules []*cloudstack.LoadBalancerRule, ports []corev1.ServicePort) []*cloudstack.LoadBalancerRule {
+	var missing []corev1.ServicePort
+	for _, port := range ports {
+		if !rulesCoverPorts(found, []corev1.ServicePort{port}) {
+			missing = append(missing, port)
+		}
 	}
 
-	return lbRule, nil
+	for _, lbRule := range rules {
+		if len(lb.serviceTags) == 0 || !hasTags(lbRule.Tags, lb.serviceTags) {
+			continue
+		}
+		name, ok := ruleLoadBalancerName(lbRule.Name, missing)
+		if !ok || slices.ContainsFunc(found, func(r *cloudstack.LoadBalancerRule) bool { return r.Id == lbRule.Id }) {
+			continue
+		}
+
+		if len(found) == 0 {
+			lb.name = name
+		}
+		klog.V(4).Infof("Found load balancer rule %v by the tags of the service", lbRule.Name)
+		found = append(found, lbRule)
+	}
+
+	return found
 }
 
-// deleteLoadBalancerRule deletes a load balancer rule.
-func (lb *loadBalancer) deleteLoadBalancerRule(lbRule *cloudstack.LoadBalancerRule) error {
-	p := lb.LoadBalancer.NewDeleteLoadBalancerRuleParams(lbRule.Id)
+// ruleLoadBalancerNames returns the names of the load balancers the rules are named after, see
+// ruleLoadBalancerName.
+func (lb *loadBalancer) ruleLoadBalancerNames(ports []corev1.ServicePort) []string {
+	var names []string
+	for ruleName := range lb.rules {
+		if name, ok := ruleLoadBalancerName(ruleName, ports); ok && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
 
-	if _, err := lb.LoadBalancer.DeleteLoadBalancerRule(p); err != nil {
-		return fmt.Errorf("error deleting load balancer rule %v: %w", lbRule.Name, err)
+	return names
+}
+
+// ruleLoadBalancerName returns the name of the load balancer of a rule named by LoadBalancerRuleName for one of
+// the ports, whatever the naming scheme of the load balancer.
+func ruleLoadBalancerName(ruleName string, ports []corev1.ServicePort) (string, bool) {
+	for _, port := range ports {
+		for _, protocol := range []LoadBalancerProtocol{LoadBalancerProtocolTCP, LoadBalancerProtocolUDP, LoadBalancerProtocolTCPProxy} {
+			if lbName, ok := strings.CutSuffix(ruleName, LoadBalancerRuleName("", protocol, port.Port)); ok && lbName != "" {
+				return lbName, true
+			}
+		}
 	}
 
-	// Delete the rule from the map as it no longer exists
-	delete(lb.rules, lbRule.Name)
+	return "", false
+}
 
-	return nil
+// rulesCoverPorts returns true if every port has a rule named after it.
+func rulesCoverPorts(rules []*cloudstack.LoadBalancerRule, ports []corev1.ServicePort) bool {
+	for _, port := range ports {
+		if !slices.ContainsFunc(rules, func(lbRule *cloudstack.LoadBalancerRule) bool {
+			_, ok := ruleLoadBalancerName(lbRule.Name, []corev1.ServicePort{port})
+
+			return ok
+		}) {
+			return false
+		}
+	}
+
+	return true
 }
 
-// reconcileHostsForRule ensures the load balancer rule has exactly the expected set of hosts.
-// It lists the current members, computes the difference, and assigns new hosts before removing
-// old ones so the rule always has backends during rolling upgrades.
-func (lb *loadBalancer) reconcileHostsForRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
-	p := lb.LoadBalancer.NewListLoadBalancerRuleInstancesParams(lbRule.Id)
+// hasTags returns true if all the wanted tags are among the tags.
+func hasTags(tags []cloudstack.Tags, want map[string]string) bool {
+	for key, value := range want {
+		if !slices.ContainsFunc(tags, func(tag cloudstack.Tags) bool { return tag.Key == key && tag.Value == value }) {
+			return false
+		}
+	}
 
-	l, err := lb.LoadBalancer.ListLoadBalancerRuleInstances(p)
-	if err != nil {
-		return fmt.Errorf("error retrieving associated instances: %w", err)
+	return true
+}
+
+// servicePorts returns the ports of the service, or nil without a service.
+func servicePorts(service *corev1.Service) []corev1.ServicePort {
+	if service == nil {
+		return nil
 	}
 
-	assign, remove := symmetricDifference(hostIDs, l.LoadBalancerRuleInstances)
+	return service.Spec.Ports
+}
 
-	klog.V(4).Infof("Reconcile hosts for rule %v: %d host(s) to assign, %d host(s) to remove (wanted: %v, current: %d instances)",
-		lbRule.Name, len(assign), len(remove), hostIDs, len(l.LoadBalancerRuleInstances))
+// getLoadBalancer tries to find the load balancer using ID-based lookup first (if annotations
+// are present), then falls back to the keyword-based name lookup.
+func (cs *CSCloud) getLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, name string, fallbackNames ...string) (*loadBalancer, error) {
+	if ipAddrID := getLoadBalancerID(service); ipAddrID != "" {
+		networkID := getLoadBalancerNetworkID(service)
+		klog.V(4).Infof("Attempting ID-based load balancer lookup: ipAddrID=%v, networkID=%v", ipAddrID, networkID)
 
-	if len(assign) > 0 {
-		klog.V(4).Infof("Assigning new hosts (%v) to load balancer rule: %v", assign, lbRule.Name)
-		if err := lb.assignHostsToRule(lbRule, assign); err != nil {
-			return fmt.Errorf("error assigning new hosts to rule %v (old hosts preserved): %w", lbRule.Name, err)
+		lb, err := cs.getLoadBalancerByID(ctx, clusterName, service, name, ipAddrID, networkID, fallbackNames...)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(lb.rules) > 0 {
+			return lb, nil
 		}
+
+		klog.V(4).Infof("ID-based lookup returned no rules, falling back to name-based lookup")
 	}
 
-	if len(remove) > 0 {
-		klog.V(4).Infof("Removing old hosts (%v) from load balancer rule: %v", remove, lbRule.Name)
-		if err := lb.removeHostsFromRule(lbRule, remove); err != nil {
-			return err
+	return cs.getLoadBalancerByName(ctx, clusterName, service, name, fallbackNames...)
+}
+
+// getLoadBalancerByName retrieves the IP address and ID and all the existing rules it can find.
+// The rules under the fallbackNames are included as well, so all rules are found after an interrupted rename.
+// When there are no rules with the name, the first of the fallbackNames that has rules is used.
+// Without a service, the rules under the fallbackNames are only checked by their names.
+func (cs *CSCloud) getLoadBalancerByName(ctx context.Context, clusterName string, service *corev1.Service, name string, fallbackNames ...string) (*loadBalancer, error) {
+	lb := &loadBalancer{
+		CloudStackClient: cs.reconcileClient(ctx),
+		name:             name,
+		clusterName:      clusterName,
+		projectID:        cs.projectID,
+		rules:            make(map[string]*cloudstack.LoadBalancerRule),
+
+		ownedFirewallRulesOnly:  cs.ownedFirewallRulesOnly,
+		keepRangedFirewallRules: cs.keepRangedFirewallRules,
+		ruleMembers:             cs.ruleMembers,
+		recreateCooldown:        cs.recreateCooldown,
+		openFirewall:            cs.openFirewall,
+		checkCapacity:           cs.capacityCheck,
+		capacityReserve:         cs.capacityReserve,
+		hostBatchSize:           cs.hostBatchSize,
+		disableIPAssociation:    cs.disableIPAssociation,
+	}
+	lb.ownerTagKey, lb.ownerTagValue = cs.ownerTag(clusterName)
+	lb.previousOwnerTags = cs.previousOwnerTagsOf(clusterName)
+	if service != nil {
+		lb.serviceTags = newServiceTags(clusterName, service)
+	}
+
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetKeyword(lb.name)
+	p.SetListall(true)
+
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving load balancer rules: %w", err)
+	}
+
+	// Filter keyword results to the rules of this service. CloudStack's SetKeyword uses LIKE %keyword%
+	// matching, so searching for "foo" can also return "foobar" and "foo-tcp" rules.
+	filtered := lb.ownedRules(l.LoadBalancerRules, lb.name, nil)
+
+	// Check the names of older naming schemes as well, f.e. the legacy name.
+	for _, fallbackName := range fallbackNames {
+		if fallbackName == "" || fallbackName == name {
+			continue
+		}
+
+		p.SetKeyword(fallbackName)
+		l, err = lb.LoadBalancer.ListLoadBalancerRules(p)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving load balancer rules: %w", err)
+		}
+		// The rules under the names of other schemes are only taken for the ports of the service.
+		fallbackFiltered := lb.ownedRules(l.LoadBalancerRules, fallbackName, servicePorts(service))
+		if len(filtered) == 0 && len(fallbackFiltered) > 0 {
+			lb.name = fallbackName
+		}
+		filtered = append(filtered, fallbackFiltered...)
+	}
+
+	// The rules of ports without a rule may still be named by a scheme that was configured before, so they are
+	// looked up by their tags.
+	if service != nil && !rulesCoverPorts(filtered, service.Spec.Ports) {
+		p.ResetKeyword()
+		p.SetTags(lb.serviceTags)
+		l, err = lb.LoadBalancer.ListLoadBalancerRules(p)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving load balancer rules: %w", err)
+		}
+		filtered = lb.addTaggedRules(filtered, l.LoadBalancerRules, service.Spec.Ports)
+	}
+
+	for _, lbRule := range filtered {
+		if lb.belongsToOtherCluster(lbRule.Tags) {
+			klog.V(4).Infof("Ignoring load balancer rule %v of another cluster", lbRule.Name)
+
+			continue
+		}
+		lb.rules[lbRule.Name] = lbRule
+
+		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
+			klog.Warningf("Load balancer %v has rules associated with different IP's: %v, %v", lb.name, lb.ipAddr, lbRule.Publicip)
+		}
+
+		lb.ipAddr = lbRule.Publicip
+		lb.ipAddrID = lbRule.Publicipid
+		lb.zoneName = lbRule.Zonename
+	}
+
+	klog.V(4).Infof("Load balancer %v contains %d rule(s)", lb.name, len(lb.rules))
+
+	return lb, nil
+}
+
+// getLoadBalancerByID retrieves load balancer rules by public IP ID and network ID.
+// This is more reliable than keyword-based search as it uses exact ID matching.
+// The rules of the IP are matched by name like in getLoadBalancerByName.
+func (cs *CSCloud) getLoadBalancerByID(ctx context.Context, clusterName string, service *corev1.Service, name, ipAddrID, networkID string, fallbackNames ...string) (*loadBalancer, error) {
+	lb := &loadBalancer{
+		CloudStackClient: cs.reconcileClient(ctx),
+		name:             name,
+		clusterName:      clusterName,
+		projectID:        cs.projectID,
+		rules:            make(map[string]*cloudstack.LoadBalancerRule),
+
+		ownedFirewallRulesOnly:  cs.ownedFirewallRulesOnly,
+		keepRangedFirewallRules: cs.keepRangedFirewallRules,
+		ruleMembers:             cs.ruleMembers,
+		recreateCooldown:        cs.recreateCooldown,
+		openFirewall:            cs.openFirewall,
+		checkCapacity:           cs.capacityCheck,
+		capacityReserve:         cs.capacityReserve,
+		hostBatchSize:           cs.hostBatchSize,
+		disableIPAssociation:    cs.disableIPAssociation,
+	}
+	lb.ownerTagKey, lb.ownerTagValue = cs.ownerTag(clusterName)
+	lb.previousOwnerTags = cs.previousOwnerTagsOf(clusterName)
+	if service != nil {
+		lb.serviceTags = newServiceTags(clusterName, service)
+	}
+
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(ipAddrID)
+	p.SetListall(true)
+
+	if networkID != "" {
+		p.SetNetworkid(networkID)
+	}
+
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving load balancer rules by IP ID %v: %w", ipAddrID, err)
+	}
+
+	// As all rules of the IP are listed anyway, rules under the fallback names are included even when there are
+	// rules with the name, so the rules that were not renamed yet are still found after an interrupted rename.
+	filtered := lb.ownedRules(l.LoadBalancerRules, lb.name, nil)
+	for _, fallbackName := range fallbackNames {
+		if fallbackName == "" || fallbackName == name {
+			continue
+		}
+		// The rules under the names of other schemes are only taken for the ports of the service.
+		fallbackFiltered := lb.ownedRules(l.LoadBalancerRules, fallbackName, servicePorts(service))
+		if len(filtered) == 0 && len(fallbackFiltered) > 0 {
+			lb.name = fallbackName
+		}
+		filtered = append(filtered, fallbackFiltered...)
+	}
+	if service != nil {
+		filtered = lb.addTaggedRules(filtered, l.LoadBalancerRules, service.Spec.Ports)
+	}
+	for _, lbRule := range filtered {
+		if lb.belongsToOtherCluster(lbRule.Tags) {
+			klog.V(4).Infof("Ignoring load balancer rule %v of another cluster", lbRule.Name)
+
+			continue
+		}
+		lb.rules[lbRule.Name] = lbRule
+
+		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
+			klog.Warningf("Load balancer %v has rules associated with different IP's: %v, %v", lb.name, lb.ipAddr, lbRule.Publicip)
+		}
+
+		lb.ipAddr = lbRule.Publicip
+		lb.ipAddrID = lbRule.Publicipid
+		lb.zoneName = lbRule.Zonename
+		lb.networkID = lbRule.Networkid
+	}
+
+	klog.V(4).Infof("Load balancer %v (by ID %v) contains %d rule(s)", lb.name, ipAddrID, len(lb.rules))
+
+	return lb, nil
+}
+
+// verifyHostsResult is the outcome of matching nodes to CloudStack VMs.
+type verifyHostsResult struct {
+	// hostIDs are the IDs of the VMs of the matched nodes.
+	hostIDs []string
+	// networkID is the network all matched VMs are attached to.
+	networkID string
+	// skippedNodes have a VM without active network interfaces, which happens while it is provisioned.
+	skippedNodes []string
+	// inactiveNodes have a VM in a state outside host-vm-states, f.e. Stopped or Error.
+	inactiveNodes []string
+	// unmatchedNodes have no VM in CloudStack, f.e. because it is still being created or already deleted.
+	unmatchedNodes []string
+	// unattachedNodes have a VM without a NIC in the network passed to verifyHostsInNetwork.
+	unattachedNodes []string
+}
+
+// verifyHosts verifies if all hosts belong to the same network, and returns the host ID's and network ID.
+// During rolling upgrades some nodes may not yet have a corresponding VM in CloudStack, so we tolerate
+// partial matches: as long as at least one node can be resolved we return the matched set, together
+// with the nodes we skipped or could not find.
+func (cs *CSCloud) verifyHosts(ctx context.Context, nodes []*corev1.Node) (*verifyHostsResult, error) {
+	return cs.verifyHostsInNetwork(ctx, nodes, "")
+}
+
+// verifyHostsInNetwork is verifyHosts for nodes with NICs in several networks. The nodes are matched through
+// their NIC in the network with the ID or name network, and nodes without a NIC in it are skipped. An empty
+// network uses the NIC the nodes are matched by, see nodeMatcher.
+func (cs *CSCloud) verifyHostsInNetwork(ctx context.Context, nodes []*corev1.Node, network string) (*verifyHostsResult, error) {
+	// Rather than creating rules without hosts, fail when there is no node to assign.
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: no nodes were passed by the service controller, check whether the nodes are Ready "+
+			"and not labeled node.kubernetes.io/exclude-from-external-load-balancers", errNoEligibleNodes)
+	}
+	eligible := cs.filterLoadBalancerNodes(nodes)
+	if len(eligible) == 0 {
+		return nil, fmt.Errorf("%w: none of the %d node(s) match the load balancer node-selector %q", errNoEligibleNodes, len(nodes), cs.nodeSelector)
+	}
+	nodes = eligible
+
+	matcher := cs.newNodeMatcher(nodes)
+
+	// Fetch all VMs using pagination to avoid missing VMs when the project has many instances.
+	// The VM of a node that just joined may not be listed or lack its NIC for a short while,
+	// so the list is fetched again a configurable number of times until all nodes are found, or ctx is done.
+	var allVMs []*cloudstack.VirtualMachine
+	for attempt := 0; ; attempt++ {
+		var err error
+		allVMs, err = cs.listLoadBalancerVirtualMachines(ctx, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving list of hosts: %w", err)
+		}
+		if attempt >= cs.verifyHostsRetries || matcher.covers(allVMs) {
+			break
+		}
+
+		klog.V(2).Infof("Not all nodes have a CloudStack VM with a network interface yet, retrying in %v (%d/%d)",
+			cs.verifyHostsRetryDelay, attempt+1, cs.verifyHostsRetries)
+		if cs.vmCache != nil {
+			cs.vmCache.invalidate(cs.projectID)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error waiting for the VMs of all nodes: %w", ctx.Err())
+		case <-time.After(cs.verifyHostsRetryDelay):
+		}
+	}
+
+	result := &verifyHostsResult{}
+	matchedNodes := map[string]bool{}
+	skippedNodes := map[string]bool{}
+	inactiveNodes := map[string]bool{}
+	unattachedNodes := map[string]bool{}
+	// networkNodes collects the nodes of each network, to report them when the nodes span networks.
+	networkNodes := map[string][]string{}
+
+	// Check if the virtual machine is in the hosts slice, then add the corresponding ID.
+	for _, vm := range allVMs {
+		nodeName, nic, ok := matcher.match(vm)
+		if !ok {
+			continue
+		}
+
+		// A VM that is stopped or failed would receive traffic it cannot serve.
+		if cs.hostVMStates != nil && !slices.ContainsFunc(cs.hostVMStates, func(state string) bool { return strings.EqualFold(state, vm.State) }) {
+			klog.Warningf("Skipping VM %v (id: %v) as it is in state %q, not in host-vm-states %v", vm.Name, vm.Id, vm.State, cs.hostVMStates)
+			inactiveNodes[nodeName] = true
+
+			continue
+		}
+
+		if len(vm.Nic) == 0 {
+			klog.Warningf("Skipping VM %v (id: %v) as it contains no active network interfaces (may still be provisioning)", vm.Name, vm.Id)
+			skippedNodes[nodeName] = true
+			// Skip VM's without any active network interfaces. This happens during rollout f.e.
+			continue
+		}
+		if network != "" {
+			if nic = nicInNetwork(vm, network); nic == nil {
+				klog.Warningf("Skipping VM %v (id: %v) as it has no network interface in network %v", vm.Name, vm.Id, network)
+				unattachedNodes[nodeName] = true
+
+				continue
+			}
+		}
+		networkNodes[nic.Networkid] = append(networkNodes[nic.Networkid], nodeName)
+		if result.networkID == "" {
+			result.networkID = nic.Networkid
+		}
+
+		result.hostIDs = append(result.hostIDs, vm.Id)
+		matchedNodes[nodeName] = true
+	}
+
+	if len(networkNodes) > 1 {
+		networks := make([]string, 0, len(networkNodes))
+		for _, networkID := range slices.Sorted(maps.Keys(networkNodes)) {
+			networks = append(networks, fmt.Sprintf("network %s: %s", networkID, strings.Join(networkNodes[networkID], ", ")))
+		}
+		klog.Warningf("Nodes of the load balancer are attached to %d networks: %s", len(networkNodes), strings.Join(networks, "; "))
+
+		return nil, fmt.Errorf("%w (%s)", errHostsInDifferentNetworks, strings.Join(networks, "; "))
+	}
+
+	for _, node := range nodes {
+		switch {
+		case matchedNodes[node.Name]:
+		case skippedNodes[node.Name]:
+			result.skippedNodes = append(result.skippedNodes, node.Name)
+		case inactiveNodes[node.Name]:
+			result.inactiveNodes = append(result.inactiveNodes, node.Name)
+		case unattachedNodes[node.Name]:
+			result.unattachedNodes = append(result.unattachedNodes, node.Name)
+		default:
+			result.unmatchedNodes = append(result.unmatchedNodes, node.Name)
+		}
+	}
+
+	// Log warnings for nodes that could not be matched — this is expected during rolling upgrades.
+	if len(result.unmatchedNodes) > 0 {
+		klog.Warningf("Could not match %d node(s) to CloudStack VMs (may be provisioning or terminating): %v", len(result.unmatchedNodes), result.unmatchedNodes)
+	}
+	if len(result.skippedNodes) > 0 {
+		klog.Warningf("Skipped %d node(s) with VMs without NICs (still provisioning): %v", len(result.skippedNodes), result.skippedNodes)
+	}
+	if len(result.inactiveNodes) > 0 {
+		klog.Warningf("Skipped %d node(s) with VMs outside host-vm-states %v: %v", len(result.inactiveNodes), cs.hostVMStates, result.inactiveNodes)
+	}
+	if len(result.unattachedNodes) > 0 {
+		klog.Warningf("Skipped %d node(s) with VMs without a NIC in network %v: %v", len(result.unattachedNodes), network, result.unattachedNodes)
+	}
+
+	if len(result.hostIDs) == 0 || len(result.networkID) == 0 {
+		return nil, fmt.Errorf("%w: could not match any of the %d node(s) to VMs in CloudStack (unmatched: %v, skipped-no-nic: %v, skipped-state: %v, skipped-network: %v)",
+			errNoMatchedHosts, len(nodes), result.unmatchedNodes, result.skippedNodes, result.inactiveNodes, result.unattachedNodes)
+	}
+
+	klog.V(4).Infof("Matched %d of %d nodes to CloudStack VMs", len(result.hostIDs), len(nodes))
+
+	return result, nil
+}
+
+// networkMismatchError returns err, unless it is errHostsInDifferentNetworks and network-mismatch-retry-delay is set.
+// The service is then requeued after that delay with a RetryError, f.e. while nodes are migrated to another network,
+// until its nodes have been in different networks for network-mismatch-timeout.
+func (cs *CSCloud) networkMismatchError(service *corev1.Service, err error) error {
+	if !errors.Is(err, errHostsInDifferentNetworks) || cs.networkMismatchRetryDelay == 0 {
+		return err
+	}
+
+	key := service.Namespace + "/" + service.Name
+	cs.networkMismatchMu.Lock()
+	defer cs.networkMismatchMu.Unlock()
+
+	since, ok := cs.networkMismatchSince[key]
+	if !ok {
+		if cs.networkMismatchSince == nil {
+			cs.networkMismatchSince = make(map[string]time.Time)
+		}
+		since = time.Now()
+		cs.networkMismatchSince[key] = since
+	}
+	if cs.networkMismatchTimeout > 0 && time.Since(since) >= cs.networkMismatchTimeout {
+		return fmt.Errorf("nodes are still in different networks after %v: %w", cs.networkMismatchTimeout, err)
+	}
+
+	return cloudproviderapi.NewRetryError(fmt.Sprintf("%v, retrying in %v", err, cs.networkMismatchRetryDelay), cs.networkMismatchRetryDelay)
+}
+
+// resetNetworkMismatch forgets that the nodes of the service were in different networks.
+func (cs *CSCloud) resetNetworkMismatch(service *corev1.Service) {
+	cs.networkMismatchMu.Lock()
+	defer cs.networkMismatchMu.Unlock()
+
+	delete(cs.networkMismatchSince, service.Namespace+"/"+service.Name)
+}
+
+// filterLoadBalancerNodes returns the nodes that are eligible as load balancer backends.
+func (cs *CSCloud) filterLoadBalancerNodes(nodes []*corev1.Node) []*corev1.Node {
+	if cs.nodeSelector == nil || cs.nodeSelector.Empty() {
+		return nodes
+	}
+
+	eligible := make([]*corev1.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if cs.nodeSelector.Matches(labels.Set(node.Labels)) {
+			eligible = append(eligible, node)
+		} else {
+			klog.V(4).Infof("Node %v does not match the load balancer node selector %q, skipping", node.Name, cs.nodeSelector)
+		}
+	}
+
+	return eligible
+}
+
+// listLoadBalancerVirtualMachines returns all VMs, served from the VM list cache when it is enabled.
+// A cached list that lacks a usable VM for any of the given nodes is considered stale and refreshed,
+// so newly added nodes are picked up without waiting for the cache to expire.
+func (cs *CSCloud) listLoadBalancerVirtualMachines(ctx context.Context, nodes []*corev1.Node) ([]*cloudstack.VirtualMachine, error) {
+	listAll := func() ([]*cloudstack.VirtualMachine, error) { return cs.listAllVirtualMachines(ctx) }
+	if cs.vmCache == nil {
+		return listAll()
+	}
+
+	allVMs, cached, err := cs.vmCache.get(cs.projectID, listAll)
+	if err != nil || !cached || cs.newNodeMatcher(nodes).covers(allVMs) {
+		return allVMs, err
+	}
+
+	klog.V(4).Infof("Cached VM list is missing nodes, refreshing it")
+	cs.vmCache.invalidate(cs.projectID)
+	allVMs, _, err = cs.vmCache.get(cs.projectID, listAll)
+
+	return allVMs, err
+}
+
+// nodeMatcher matches CloudStack VMs to nodes with the host-matching strategies, in order.
+type nodeMatcher struct {
+	strategies []string
+	// byName, byVMID, byLabel and byIP map the short host names, the VM IDs from the provider IDs,
+	// the VM IDs from the host-matching-label and the InternalIPs of the nodes to the node names.
+	byName  map[string]string
+	byVMID  map[string]string
+	byLabel map[string]string
+	byIP    map[string]string
+	nodes   []*corev1.Node
+}
+
+// newNodeMatcher indexes the nodes for the configured host-matching strategies.
+func (cs *CSCloud) newNodeMatcher(nodes []*corev1.Node) *nodeMatcher {
+	m := &nodeMatcher{
+		strategies: cs.hostMatching,
+		byName:     map[string]string{},
+		byVMID:     map[string]string{},
+		byLabel:    map[string]string{},
+		byIP:       map[string]string{},
+		nodes:      nodes,
+	}
+	if m.strategies == nil {
+		m.strategies = []string{hostMatchingProviderID, hostMatchingName}
+	}
+
+	for _, node := range nodes {
+		// node.Name can be an FQDN as well, and CloudStack VM names aren't
+		// To match, we need to Split the domain part off here, if present
+		m.byName[strings.Split(strings.ToLower(node.Name), ".")[0]] = node.Name
+
+		if node.Spec.ProviderID != "" {
+			if id, _, err := instanceIDFromProviderID(node.Spec.ProviderID); err == nil {
+				m.byVMID[id] = node.Name
+			}
+		}
+		if id := node.Labels[cs.hostMatchingLabel]; cs.hostMatchingLabel != "" && id != "" {
+			m.byLabel[id] = node.Name
+		}
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != corev1.NodeInternalIP {
+				continue
+			}
+			if ip, err := netip.ParseAddr(addr.Address); err == nil {
+				m.byIP[ip.String()] = node.Name
+			}
+		}
+	}
+
+	return m
+}
+
+// match returns the node of a VM with active network interfaces and the interface to balance to.
+// That is the interface with the InternalIP of the node when matched by IP, and the first one otherwise.
+func (m *nodeMatcher) match(vm *cloudstack.VirtualMachine) (string, *cloudstack.Nic, bool) {
+	var first *cloudstack.Nic
+	if len(vm.Nic) > 0 {
+		first = &vm.Nic[0]
+	}
+
+	for _, strategy := range m.strategies {
+		switch strategy {
+		case hostMatchingProviderID:
+			if name, ok := m.byVMID[vm.Id]; ok {
+				return name, first, true
+			}
+		case hostMatchingName:
+			if name, ok := m.byName[strings.ToLower(vm.Name)]; ok {
+				return name, first, true
+			}
+		case hostMatchingLabel:
+			if name, ok := m.byLabel[vm.Id]; ok {
+				return name, first, true
+			}
+		case hostMatchingIP:
+			for i := range vm.Nic {
+				for _, addr := range []string{vm.Nic[i].Ipaddress, vm.Nic[i].Ip6address} {
+					ip, err := netip.ParseAddr(addr)
+					if err != nil {
+						continue
+					}
+					if name, ok := m.byIP[ip.String()]; ok {
+						return name, &vm.Nic[i], true
+					}
+				}
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// nicInNetwork returns the NIC of the VM in the network with the ID or name network, or nil if it has none.
+func nicInNetwork(vm *cloudstack.VirtualMachine, network string) *cloudstack.Nic {
+	for i := range vm.Nic {
+		if vm.Nic[i].Networkid == network || vm.Nic[i].Networkname == network {
+			return &vm.Nic[i]
+		}
+	}
+
+	return nil
+}
+
+// covers returns true if every node has a VM with an active network interface in the list.
+func (m *nodeMatcher) covers(vms []*cloudstack.VirtualMachine) bool {
+	matched := map[string]bool{}
+	for _, vm := range vms {
+		if len(vm.Nic) == 0 {
+			continue
+		}
+		if name, _, ok := m.match(vm); ok {
+			matched[name] = true
+		}
+	}
+
+	for _, node := range m.nodes {
+		if !matched[node.Name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listAllVirtualMachines retrieves all VMs using pagination to handle large projects.
+func (cs *CSCloud) listAllVirtualMachines(ctx context.Context) ([]*cloudstack.VirtualMachine, error) {
+	var allVMs []*cloudstack.VirtualMachine
+
+	page := 1
+	pageSize := 500
+
+	client := cs.reconcileClient(ctx)
+	for {
+		p := client.VirtualMachine.NewListVirtualMachinesParams()
+		p.SetListall(true)
+		p.SetDetails([]string{"min", "nics"})
+		p.SetPage(page)
+		p.SetPagesize(pageSize)
+
+		if cs.projectID != "" {
+			p.SetProjectid(cs.projectID)
+		}
+
+		l, err := client.VirtualMachine.ListVirtualMachines(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list virtual machines: %w", err)
+		}
+
+		allVMs = append(allVMs, l.VirtualMachines...)
+
+		// If we got fewer results than the page size, we've reached the last page.
+		if len(l.VirtualMachines) < pageSize {
+			break
+		}
+		page++
+	}
+
+	return allVMs, nil
+}
+
+// hasLoadBalancerIP returns true if we have a load balancer address and ID.
+func (lb *loadBalancer) hasLoadBalancerIP() bool {
+	return lb.ipAddr != "" && lb.ipAddrID != ""
+}
+
+// getLoadBalancerIP retrieves an existing IP or associates a new IP.
+func (lb *loadBalancer) getLoadBalancerIP(loadBalancerIP string) error {
+	if loadBalancerIP != "" {
+		return lb.getPublicIPAddress(loadBalancerIP)
+	}
+
+	return lb.associatePublicIPAddress()
+}
+
+// lookupPublicIPAddress checks whether the given IP address is already allocated in CloudStack.
+// If found and allocated, it sets lb.ipAddr and lb.ipAddrID and returns (true, nil).
+// If not found or not allocated, it returns (false, nil) without modifying lb state.
+// Unlike getPublicIPAddress, this method does NOT call associatePublicIPAddress for unallocated IPs.
+func (lb *loadBalancer) lookupPublicIPAddress(ip string) (bool, error) {
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetIpaddress(ip)
+	p.SetAllocatedonly(true)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return false, fmt.Errorf("error looking up IP address %v: %w", ip, err)
+	}
+
+	if l.Count != 1 {
+		return false, nil
+	}
+
+	if lb.belongsToOtherCluster(l.PublicIpAddresses[0].Tags) {
+		klog.Warningf("Not recovering IP %v, it is tagged for another cluster", ip)
+
+		return false, nil
+	}
+
+	lb.ipAddr = l.PublicIpAddresses[0].Ipaddress
+	lb.ipAddrID = l.PublicIpAddresses[0].Id
+	lb.zoneName = l.PublicIpAddresses[0].Zonename
+
+	return true, nil
+}
+
+// lookupTaggedPublicIPAddress looks for the allocated IP tagged with the service. Unlike
+// lookupServicePublicIPAddress, the network of the IP is not checked, as it is used to find the IP to release.
+// If exactly one is found, it sets lb.ipAddr and lb.ipAddrID and returns (true, nil).
+func (lb *loadBalancer) lookupTaggedPublicIPAddress() (bool, error) {
+	ips, err := lb.listPublicIPsByServiceTags()
+	if err != nil {
+		return false, err
+	}
+
+	if len(ips) != 1 {
+		return false, nil
+	}
+
+	lb.ipAddr = ips[0].Ipaddress
+	lb.ipAddrID = ips[0].Id
+	lb.zoneName = ips[0].Zonename
+
+	return true, nil
+}
+
+// listPublicIPsByServiceTags lists the allocated IPs tagged with the service.
+func (lb *loadBalancer) listPublicIPsByServiceTags() ([]*cloudstack.PublicIpAddress, error) {
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetTags(lb.serviceTags)
+	p.SetAllocatedonly(true)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up IP addresses of the service: %w", err)
+	}
+
+	return l.PublicIpAddresses, nil
+}
+
+// lookupServicePublicIPAddress looks for an allocated IP tagged with the service, f.e. one that was
+// kept when a previous incarnation of the service was deleted. If an IP in the network of the nodes
+// is found, it sets lb.ipAddr and lb.ipAddrID and returns (true, nil).
+func (lb *loadBalancer) lookupServicePublicIPAddress() (bool, error) {
+	ips, err := lb.listPublicIPsByServiceTags()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ip := range ips {
+		if err := lb.checkPublicIPNetwork(ip); err != nil {
+			klog.V(4).Infof("Not reusing IP %v: %v", ip.Ipaddress, err)
+
+			continue
+		}
+
+		lb.ipAddr = ip.Ipaddress
+		lb.ipAddrID = ip.Id
+		lb.zoneName = ip.Zonename
+		recordPublicIPOperation(publicIPOperationReuse, lb.projectID)
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// lookupLeakedPublicIPAddress looks for an allocated IP tagged with the service that has no load balancer rules,
+// f.e. because a previous reconcile failed between associating the IP and creating the rules. IPs with static
+// NAT or outside the network of the nodes are skipped. If one is found, it sets lb.ipAddr and lb.ipAddrID and
+// returns (true, nil).
+func (lb *loadBalancer) lookupLeakedPublicIPAddress() (bool, error) {
+	ips, err := lb.listPublicIPsByServiceTags()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ip := range ips {
+		if ip.Isstaticnat {
+			continue
+		}
+
+		rp := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+		rp.SetPublicipid(ip.Id)
+		rp.SetListall(true)
+		if lb.projectID != "" {
+			rp.SetProjectid(lb.projectID)
+		}
+
+		rules, err := lb.LoadBalancer.ListLoadBalancerRules(rp)
+		if err != nil {
+			return false, fmt.Errorf("error listing load balancer rules of IP %v: %w", ip.Ipaddress, err)
+		}
+		if rules.Count > 0 {
+			klog.V(4).Infof("Not recovering IP %v: it has %d load balancer rule(s)", ip.Ipaddress, rules.Count)
+
+			continue
+		}
+
+		if err := lb.checkPublicIPNetwork(ip); err != nil {
+			klog.V(4).Infof("Not recovering IP %v: %v", ip.Ipaddress, err)
+
+			continue
+		}
+
+		lb.ipAddr = ip.Ipaddress
+		lb.ipAddrID = ip.Id
+		lb.zoneName = ip.Zonename
+		recordPublicIPOperation(publicIPOperationReuse, lb.projectID)
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// getPublicIPAddressID retrieves the ID of the given IP, and sets the address and its ID.
+func (lb *loadBalancer) getPublicIPAddress(loadBalancerIP string) error {
+	klog.V(4).Infof("Retrieve load balancer IP details: %v", loadBalancerIP)
+
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetIpaddress(loadBalancerIP)
+	p.SetAllocatedonly(false)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving IP address: %w", err)
+	}
+
+	if l.Count != 1 {
+		return fmt.Errorf("could not find IP address %v. Found %d addresses", loadBalancerIP, l.Count)
+	}
+
+	lb.ipAddr = l.PublicIpAddresses[0].Ipaddress
+	lb.ipAddrID = l.PublicIpAddresses[0].Id
+	lb.zoneName = l.PublicIpAddresses[0].Zonename
+
+	// If the IP Address is not allocated then associate it
+	if l.PublicIpAddresses[0].Allocated == "" {
+		return lb.associatePublicIPAddress()
+	}
+
+	if lb.belongsToOtherCluster(l.PublicIpAddresses[0].Tags) {
+		return fmt.Errorf("IP address %v is in use by the load balancer of another cluster", loadBalancerIP)
+	}
+
+	if err := lb.checkPublicIPNetwork(l.PublicIpAddresses[0]); err != nil {
+		return err
+	}
+
+	recordPublicIPOperation(publicIPOperationReuse, lb.projectID)
+
+	return nil
+}
+
+// checkPublicIPConflict returns an error wrapping errIPInUse when the public IP has load balancer rules of
+// another service that conflict with the ports of the service. With ipSharingDeny, every rule of another
+// service conflicts, otherwise only a rule for the same protocol and public port.
+func (lb *loadBalancer) checkPublicIPConflict(service *corev1.Service, ipSharing string) error {
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(lb.ipAddrID)
+	p.SetListall(true)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return fmt.Errorf("error listing load balancer rules of public IP %v: %w", lb.ipAddr, err)
+	}
+
+	for _, rule := range l.LoadBalancerRules {
+		if lb.ownsRule(rule, lb.name, nil) {
+			continue
+		}
+
+		if ipSharing == ipSharingDeny {
+			return fmt.Errorf("%w: IP %v has load balancer rule %v, and ip-sharing is %q", errIPInUse, lb.ipAddr, rule.Name, ipSharingDeny)
+		}
+
+		for _, port := range service.Spec.Ports {
+			if rule.Publicport == strconv.Itoa(int(port.Port)) &&
+				ProtocolFromLoadBalancer(rule.Protocol).IPProtocol() == ProtocolFromServicePort(port, service).IPProtocol() {
+				return fmt.Errorf("%w: IP %v already has load balancer rule %v for %v port %d", errIPInUse, lb.ipAddr, rule.Name, port.Protocol, port.Port)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkNetworkPublicIPs returns an error wrapping errNetworkWithoutPublicIPs when public IPs cannot be associated
+// with the network of the load balancer. Only isolated networks and the tiers of a VPC can have them.
+func (lb *loadBalancer) checkNetworkPublicIPs() error {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+
+	if network.Vpcid == "" && !strings.EqualFold(network.Type, "Isolated") {
+		return fmt.Errorf("%w: network %s (%s) is of type %s, only isolated networks and VPC tiers can have a load balancer IP",
+			errNetworkWithoutPublicIPs, network.Name, network.Id, network.Type)
+	}
+
+	return nil
+}
+
+// checkPublicIPNetwork returns an error wrapping errIPNetworkMismatch when an allocated IP is associated
+// with another network or VPC than the network of the nodes, as load balancer rules cannot be created on it.
+func (lb *loadBalancer) checkPublicIPNetwork(ip *cloudstack.PublicIpAddress) error {
+	if ip.Vpcid != "" {
+		network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+		if err != nil {
+			if count == 0 {
+				return fmt.Errorf("could not find network %v", lb.networkID)
+			}
+
+			return fmt.Errorf("error retrieving network: %w", err)
+		}
+
+		if network.Vpcid != ip.Vpcid {
+			return fmt.Errorf("%w: IP %v belongs to VPC %v, but the nodes are in network %v outside of that VPC",
+				errIPNetworkMismatch, ip.Ipaddress, ip.Vpcname, network.Name)
+		}
+
+		return nil
+	}
+
+	if ip.Associatednetworkid != "" && ip.Associatednetworkid != lb.networkID {
+		return fmt.Errorf("%w: IP %v is associated with network %v, but the nodes are in network %v",
+			errIPNetworkMismatch, ip.Ipaddress, ip.Associatednetworkname, lb.networkID)
+	}
+
+	return nil
+}
+
+// associatePublicIPAddress associates a new IP and sets the address and its ID.
+func (lb *loadBalancer) associatePublicIPAddress() error {
+	if lb.disableIPAssociation {
+		if lb.ipAddr != "" {
+			return fmt.Errorf("%w: IP %v is not allocated", errIPAssociationDisabled, lb.ipAddr)
+		}
+
+		return fmt.Errorf("%w: not allocating a new IP for load balancer %v", errIPAssociationDisabled, lb.name)
+	}
+
+	klog.V(4).Infof("Allocate new IP for load balancer: %v", lb.name)
+
+	if lb.checkCapacity {
+		if err := lb.checkPublicIPCapacity(); err != nil {
+			return err
+		}
+	}
+
+	// If a network belongs to a VPC, the IP address needs to be associated with
+	// the VPC instead of with the network.
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find network %v", lb.networkID)
+		}
+
+		return fmt.Errorf("error retrieving network: %w", err)
+	}
+
+	p := lb.Address.NewAssociateIpAddressParams()
+
+	if network.Vpcid != "" {
+		p.SetVpcid(network.Vpcid)
+	} else {
+		p.SetNetworkid(lb.networkID)
+	}
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	if lb.ipAddr != "" {
+		p.SetIpaddress(lb.ipAddr)
+	} else if lb.publicIPVLAN != "" || lb.ipSelection == ipSelectionLowest {
+		ip, err := lb.freePublicIP(network.Zoneid)
+		if err != nil {
+			return err
+		}
+		p.SetIpaddress(ip)
+	}
+
+	// Associate a new IP address
+	r, err := lb.Address.AssociateIpAddress(p)
+	if err != nil {
+		return fmt.Errorf("error associating new IP address: %w", err)
+	}
+
+	lb.ipAddr = r.Ipaddress
+	lb.ipAddrID = r.Id
+	lb.zoneName = r.Zonename
+
+	recordPublicIPOperation(publicIPOperationAllocate, lb.projectID)
+
+	// The IP is tagged before it is checked, so it is found by the tags of the service should the check fail.
+	lb.tagPublicIPAddress()
+
+	// Rarely, CloudStack hands out an IP that still has rules, which we would otherwise adopt.
+	if err := lb.deleteStaleRulesOfNewIP(r.Id, r.Ipaddress); err != nil {
+		return fmt.Errorf("%w: %w", errNewIPCheckFailed, err)
+	}
+
+	return nil
+}
+
+// discardNewIP gives up a newly associated IP that failed its check with err, see errNewIPCheckFailed. An IP with
+// rules of another service is untagged and kept, as releasing it would delete those rules. Any other IP is released
+// with release, so it does not leak; should that fail too, the IP is left in lb.ipAddr for the caller to record on
+// the service.
+func (lb *loadBalancer) discardNewIP(err error, release func() error) error {
+	if errors.Is(err, errNewIPInUse) {
+		lb.untagPublicIPAddress()
+		lb.ipAddr, lb.ipAddrID, lb.zoneName = "", "", ""
+
+		return err
+	}
+
+	if releaseErr := release(); releaseErr != nil {
+		return errors.Join(err, releaseErr)
+	}
+	lb.ipAddr, lb.ipAddrID, lb.zoneName = "", "", ""
+
+	return err
+}
+
+// deleteStaleRulesOfNewIP checks a newly associated IP for load balancer and firewall rules. Stale rules of this
+// load balancer are deleted. Rules of other services return an error wrapping errNewIPInUse, so the IP is not
+// used; it is not released either, as it is still in use. Untagged firewall rules are reconciled like on any IP.
+func (lb *loadBalancer) deleteStaleRulesOfNewIP(ipAddrID, ipAddr string) error {
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(ipAddrID)
+	p.SetListall(true)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return fmt.Errorf("error checking new IP %v for load balancer rules: %w", ipAddr, err)
+	}
+
+	var foreign []string
+	var stale []*cloudstack.LoadBalancerRule
+	for _, rule := range l.LoadBalancerRules {
+		if lb.ownsRule(rule, lb.name, nil) {
+			stale = append(stale, rule)
+		} else {
+			foreign = append(foreign, "load balancer rule "+rule.Name)
+		}
+	}
+
+	firewallRules, err := lb.listFirewallRules(ipAddrID)
+	if err != nil {
+		return fmt.Errorf("error checking new IP %v for firewall rules: %w", ipAddr, err)
+	}
+
+	var staleFirewallRules []*cloudstack.FirewallRule
+	for _, rule := range firewallRules {
+		switch {
+		case lb.belongsToOtherCluster(rule.Tags) || lb.belongsToOtherService(rule.Tags):
+			foreign = append(foreign, "firewall rule "+ruleToString(rule))
+		case len(lb.serviceTags) > 0 && slices.ContainsFunc(rule.Tags, func(tag cloudstack.Tags) bool { return tag.Key == serviceNameTagKey }):
+			staleFirewallRules = append(staleFirewallRules, rule)
+		}
+	}
+
+	if len(foreign) > 0 {
+		return fmt.Errorf("%w: new IP %v has %s", errNewIPInUse, ipAddr, strings.Join(foreign, ", "))
+	}
+
+	var errs []error
+	for _, rule := range stale {
+		klog.Warningf("Deleting stale load balancer rule %v on new IP %v", rule.Name, ipAddr)
+		if err := lb.deleteLoadBalancerRule(rule); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, rule := range staleFirewallRules {
+		klog.Warningf("Deleting stale firewall rule %v on new IP %v", ruleToString(rule), ipAddr)
+		if _, err := lb.Firewall.DeleteFirewallRule(lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)); err != nil {
+			errs = append(errs, fmt.Errorf("error deleting stale firewall rule %v: %w", rule.Id, err))
+		} else {
+			lb.recordFirewallRuleChange(false, rule)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// freePublicIP returns the lowest free public IP of the zone, in the VLAN named publicIPVLAN if set. It returns an
+// error wrapping errPublicIPVLANNotFound when the zone has no IPs in that VLAN, and one wrapping
+// errInsufficientCapacity when all of them are allocated.
+func (lb *loadBalancer) freePublicIP(zoneID string) (string, error) {
+	ips, err := lb.listZonePublicIPs(zoneID)
+	if err != nil {
+		if lb.publicIPVLAN == "" {
+			return "", err
+		}
+
+		return "", fmt.Errorf("error listing public IPs of VLAN %v: %w", lb.publicIPVLAN, err)
+	}
+
+	found := false
+	var free *cloudstack.PublicIpAddress
+	var freeAddr netip.Addr
+	for _, ip := range ips {
+		if lb.publicIPVLAN != "" && ip.Vlanname != lb.publicIPVLAN {
+			continue
+		}
+		found = true
+		if ip.State != "Free" {
+			continue
+		}
+		addr, err := netip.ParseAddr(ip.Ipaddress)
+		if err != nil {
+			continue
+		}
+		if free == nil || addr.Less(freeAddr) {
+			free, freeAddr = ip, addr
+		}
+	}
+
+	if free != nil {
+		klog.V(4).Infof("Allocating IP %v of VLAN %v (%v) for load balancer %v", free.Ipaddress, free.Vlanname, free.Vlanid, lb.name)
+
+		return free.Ipaddress, nil
+	}
+
+	if lb.publicIPVLAN == "" {
+		return "", fmt.Errorf("%w: zone %s has no free public IPs", errInsufficientCapacity, zoneID)
+	}
+	if !found {
+		return "", fmt.Errorf("%w: zone %s has no public IPs in VLAN %s", errPublicIPVLANNotFound, zoneID, lb.publicIPVLAN)
+	}
+
+	return "", fmt.Errorf("%w: all public IPs of VLAN %s are allocated", errInsufficientCapacity, lb.publicIPVLAN)
+}
+
+// listZonePublicIPs lists all public IPs of the zone, free or not. A zone easily has more IPs than CloudStack
+// returns at once, so they are listed page by page like in listFirewallRules.
+func (lb *loadBalancer) listZonePublicIPs(zoneID string) ([]*cloudstack.PublicIpAddress, error) {
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetAllocatedonly(false)
+	p.SetForvirtualnetwork(true)
+	p.SetZoneid(zoneID)
+	p.SetPagesize(publicIPsPageSize)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	var ips []*cloudstack.PublicIpAddress
+	var count int
+	for page := 1; ; page++ {
+		p.SetPage(page)
+		l, err := lb.Address.ListPublicIpAddresses(p)
+		if err != nil {
+			return nil, fmt.Errorf("error listing public IPs of zone %v: %w", zoneID, err)
+		}
+		ips = append(ips, l.PublicIpAddresses...)
+		count = l.Count
+
+		// If we got fewer results than the page size, we've reached the last page.
+		if len(l.PublicIpAddresses) < publicIPsPageSize || len(ips) >= count {
+			break
+		}
+	}
+
+	if len(ips) < count {
+		return nil, fmt.Errorf("error listing public IPs of zone %v: listed %d of %d IPs", zoneID, len(ips), count)
+	}
+
+	return ips, nil
+}
+
+// checkPublicIPCapacity returns an error wrapping errInsufficientCapacity when the account or project
+// has no public IPs left to allocate, or no more than capacityReserve, so we fail before any resource of the
+// load balancer is created. The number of public IPs left is exposed as a metric.
+func (lb *loadBalancer) checkPublicIPCapacity() error {
+	lp := lb.Limit.NewListResourceLimitsParams()
+	lp.SetResourcetype(publicIPResourceType)
+	if lb.projectID != "" {
+		lp.SetProjectid(lb.projectID)
+	}
+
+	limits, err := lb.Limit.ListResourceLimits(lp)
+	if err != nil {
+		return fmt.Errorf("error retrieving public IP limit: %w", err)
+	}
+
+	// A negative maximum means the number of public IPs is unlimited.
+	limit := int64(-1)
+	for _, l := range limits.ResourceLimits {
+		if l.Resourcetype == strconv.Itoa(publicIPResourceType) {
+			limit = l.Max
+		}
+	}
+	if limit < 0 {
+		forgetPublicIPHeadroom(lb.projectID)
+
+		return nil
+	}
+
+	ap := lb.Address.NewListPublicIpAddressesParams()
+	ap.SetAllocatedonly(true)
+	if lb.projectID != "" {
+		ap.SetProjectid(lb.projectID)
+	}
+
+	ips, err := lb.Address.ListPublicIpAddresses(ap)
+	if err != nil {
+		return fmt.Errorf("error retrieving allocated public IPs: %w", err)
+	}
+
+	headroom := limit - int64(ips.Count)
+	recordPublicIPHeadroom(lb.projectID, headroom)
+
+	if headroom <= 0 {
+		return fmt.Errorf("%w: allocating a public IP for load balancer %v would exceed the public IP limit of %d, %d are in use",
+			errInsufficientCapacity, lb.name, limit, ips.Count)
+	}
+	if headroom <= int64(lb.capacityReserve) {
+		return fmt.Errorf("%w: allocating a public IP for load balancer %v is paused, %d of the public IP limit of %d are left and %d are reserved",
+			errInsufficientCapacity, lb.name, headroom, limit, lb.capacityReserve)
+	}
+
+	return nil
+}
+
+// tagPublicIPAddress tags a newly allocated IP with the service it was allocated for. The tags
+// are only informational, so a failure is logged instead of failing the allocation.
+func (lb *loadBalancer) tagPublicIPAddress() {
+	if len(lb.serviceTags) == 0 {
+		return
+	}
+
+	p := lb.Resourcetags.NewCreateTagsParams([]string{lb.ipAddrID}, "PublicIpAddress", lb.serviceTags)
+	if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+		klog.Warningf("Error tagging load balancer IP %v: %v", lb.ipAddr, err)
+	}
+}
+
+// untagPublicIPAddress removes the service tags of tagPublicIPAddress from the IP, so it is no longer found as an
+// IP of the service.
+func (lb *loadBalancer) untagPublicIPAddress() {
+	if len(lb.serviceTags) == 0 {
+		return
+	}
+
+	p := lb.Resourcetags.NewDeleteTagsParams([]string{lb.ipAddrID}, "PublicIpAddress")
+	p.SetTags(lb.serviceTags)
+	if _, err := lb.Resourcetags.DeleteTags(p); err != nil {
+		klog.Warningf("Error untagging IP %v: %v", lb.ipAddr, err)
+	}
+}
+
+// releasePublicIPAddress releases an associated IP.
+func (lb *loadBalancer) releaseLoadBalancerIP() error {
+	p := lb.Address.NewDisassociateIpAddressParams(lb.ipAddrID)
+
+	if _, err := lb.Address.DisassociateIpAddress(p); err != nil {
+		return fmt.Errorf("error releasing load balancer IP %v: %w", lb.ipAddr, err)
+	}
+
+	recordPublicIPOperation(publicIPOperationRelease, lb.projectID)
+
+	return nil
+}
+
+// releaseLoadBalancerIPWithRetry releases the public IP of the load balancer, retrying transient errors with a
+// jittered backoff until ctx is done. Other errors, f.e. an IP that still has rules, are not retried.
+func (lb *loadBalancer) releaseLoadBalancerIPWithRetry(ctx context.Context) error {
+	attempts := 0
+	var err error
+	backoffErr := wait.ExponentialBackoffWithContext(ctx, ipReleaseBackoff, func(context.Context) (bool, error) {
+		attempts++
+		if err = lb.releaseLoadBalancerIP(); err == nil {
+			return true, nil
+		}
+		if !isTransientError(err) {
+			return false, err
+		}
+		klog.Warningf("Attempt %d to release load balancer IP %v failed: %v", attempts, lb.ipAddr, err)
+
+		return false, nil
+	})
+	if backoffErr == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = errors.Join(backoffErr, err)
+	}
+
+	return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
+
+// reportLeakedIP reports an IP that could not be released and is not retried either, so it leaks. The failure is
+// counted and a warning event is emitted on the service, to let operators release the IP manually.
+func (cs *CSCloud) reportLeakedIP(lb *loadBalancer, service *corev1.Service, err error) {
+	recordPublicIPOperation(publicIPOperationReleaseFailed, lb.projectID)
+	msg := fmt.Sprintf("Failed to release load balancer IP %s (ID %s), it must be released manually: %v", lb.ipAddr, lb.ipAddrID, err)
+	cs.eventRecorder.Event(service, corev1.EventTypeWarning, "ReleasingLoadBalancerIPFailed", msg)
+	klog.Warning(msg)
+}
+
+// deleteLoadBalancerRuleAndFirewall deletes the firewall rules of a load balancer rule and then the rule itself,
+// which deletes its stickiness policy as well. If the protocol or public port of the rule cannot be parsed, its
+// firewall rules are skipped, but the rule is still deleted. All errors are logged and returned together.
+func (lb *loadBalancer) deleteLoadBalancerRuleAndFirewall(lbRule *cloudstack.LoadBalancerRule) error {
+	errs := []error{lb.deleteRuleFirewallRules(lbRule), lb.deleteRule(lbRule)}
+
+	return errors.Join(errs...)
+}
+
+// deleteRuleFirewallRules deletes the firewall rules of the public port of a load balancer rule. Errors are logged.
+func (lb *loadBalancer) deleteRuleFirewallRules(lbRule *cloudstack.LoadBalancerRule) error {
+	var err error
+
+	protocol := ProtocolFromLoadBalancer(lbRule.Protocol)
+	port, perr := strconv.ParseInt(lbRule.Publicport, 10, 32)
+	switch {
+	case protocol == LoadBalancerProtocolInvalid:
+		err = fmt.Errorf("error parsing protocol %q for rule %v, skipping its firewall rules", lbRule.Protocol, lbRule.Name)
+	case perr != nil:
+		err = fmt.Errorf("error parsing port %q for rule %v, skipping its firewall rules: %w", lbRule.Publicport, lbRule.Name, perr)
+	default:
+		klog.V(4).Infof("Deleting firewall rules for load balancer rule: %v (IP:%v, Port:%d, Protocol:%v)",
+			lbRule.Name, lbRule.Publicip, port, protocol)
+		if _, ferr := lb.deleteFirewallRule(lbRule.Publicipid, int(port), protocol); ferr != nil {
+			err = fmt.Errorf("error deleting firewall rules for rule %v: %w", lbRule.Name, ferr)
+		}
+	}
+
+	if err != nil {
+		klog.Errorf("%v", err)
+	}
+
+	return err
+}
+
+// deleteRule deletes a load balancer rule. Its stickiness policy is not deleted first: CloudStack revokes the
+// stickiness and health check policies of a rule together with the rule. Errors are logged.
+func (lb *loadBalancer) deleteRule(lbRule *cloudstack.LoadBalancerRule) error {
+	klog.V(4).Infof("Deleting load balancer rule: %v", lbRule.Name)
+	err := lb.deleteLoadBalancerRule(lbRule)
+	if err != nil {
+		klog.Errorf("%v", err)
+	}
+
+	return err
+}
+
+// deleteRulesOrdered tears the load balancer down in phases, each across all of its rules: first all firewall
+// rules of the IP are deleted, so no new traffic is allowed in, then the hosts are removed from the rules, and
+// then the rules are deleted. A phase is only started when the previous one succeeded completely, so the load
+// balancer is never left with backends reachable through a rule that is half deleted. The errors of the failed
+// phase are returned.
+func (lb *loadBalancer) deleteRulesOrdered() []error {
+	names := slices.Sorted(maps.Keys(lb.rules))
+
+	// All rules go away, so their ports do not keep firewall rules spanning port ranges.
+	lb.releasedRules = make(map[string]bool, len(names))
+	for _, name := range names {
+		lb.releasedRules[lb.rules[name].Id] = true
+	}
+	defer func() { lb.releasedRules = nil }()
+
+	var errs []error
+	for _, name := range names {
+		if err := lb.deleteRuleFirewallRules(lb.rules[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if lb.ipAddrID != "" {
+		klog.V(4).Infof("Deleting ICMP firewall rules for load balancer: %v (IP:%v)", lb.name, lb.ipAddr)
+		if _, err := lb.deleteICMPFirewallRules(lb.ipAddrID); err != nil {
+			err := fmt.Errorf("error deleting ICMP firewall rules for load balancer %v: %w", lb.name, err)
+			klog.Errorf("%v", err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		klog.Warningf("Not removing the hosts of load balancer %v as its firewall rules could not all be deleted", lb.name)
+
+		return errs
+	}
+
+	for _, name := range names {
+		lbRule := lb.rules[name]
+		klog.V(4).Infof("Removing all hosts from load balancer rule: %v", lbRule.Name)
+		// The cache may be stale, the rule must really be empty before it is deleted.
+		lb.invalidateRuleMembers(lbRule)
+		if err := lb.reconcileHostsForRule(lbRule, nil); err != nil {
+			err := fmt.Errorf("error removing hosts from load balancer rule %v: %w", lbRule.Name, err)
+			klog.Errorf("%v", err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		klog.Warningf("Not deleting the rules of load balancer %v as their hosts could not all be removed", lb.name)
+
+		return errs
+	}
+
+	for _, name := range names {
+		if err := lb.deleteRule(lb.rules[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// checkLoadBalancerRule checks if the rule already exists and if it does, if it can be updated. If
+// it does exist but cannot be updated, it will delete the existing rule so it can be created again.
+func (lb *loadBalancer) checkLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) (*cloudstack.LoadBalancerRule, bool, error) {
+	lbRule, ok := lb.rules[lbRuleName]
+	if !ok {
+		return nil, false, nil
+	}
+
+	// Check if any of the values we cannot update (those that require a new load balancer rule) are changed.
+	if lbRule.Publicip == lb.ipAddr && lbRule.Privateport == strconv.Itoa(lb.privatePort(port)) && lbRule.Publicport == strconv.Itoa(int(port.Port)) &&
+		lb.ruleCIDRsMatch(lbRule, port) {
+		updateAlgo := lbRule.Algorithm != lb.portAlgorithm(port)
+		updateProto := lbRule.Protocol != protocol.CSProtocol()
+
+		return lbRule, updateAlgo || updateProto, nil
+	}
+
+	// A rule that was recreated recently is left alone, so a flapping service does not keep dropping its connections.
+	// Not when its private port changed though: the old port, f.e. a released node port, is no longer served on the
+	// hosts, so keeping the rule would black-hole its traffic until the cooldown passed.
+	if lb.recreateCooldown != nil && lbRule.Privateport == strconv.Itoa(lb.privatePort(port)) {
+		if wait := lb.recreateCooldown.remaining(lb.recreateCooldownKey(protocol, port.Port)); wait > 0 {
+			return lbRule, false, fmt.Errorf("%w: not recreating %v for another %v", errRuleRecreateDeferred, lbRuleName, wait.Round(time.Second))
+		}
+	}
+
+	// Delete the load balancer rule so we can create a new one using the new values.
+	if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
+		return nil, false, err
+	}
+	if lb.recreateCooldown != nil {
+		lb.recreateCooldown.record(lb.recreateCooldownKey(protocol, port.Port))
+	}
+
+	return nil, false, nil
+}
+
+// recreateCooldownKey returns the key of the rule of the port in the recreate cooldown. Unlike the name of the
+// rule, it does not depend on the naming scheme, so the cooldown still applies after the rule was renamed.
+func (lb *loadBalancer) recreateCooldownKey(protocol LoadBalancerProtocol, port int32) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%d", lb.serviceTags[serviceClusterTagKey], lb.serviceTags[serviceNamespaceTagKey],
+		lb.serviceTags[serviceNameTagKey], protocol, port)
+}
+
+// ruleCIDRsMatch returns false when the rule enforces other source ranges than the port should. The CIDR list
+// of a rule cannot be updated, so the rule is recreated then. Rules of ports without rule CIDRs always match,
+// as do rules that are listed without a CIDR list: CloudStack versions that do not keep the CIDR list of a rule
+// list it empty, which would otherwise recreate the rule on every reconcile.
+func (lb *loadBalancer) ruleCIDRsMatch(lbRule *cloudstack.LoadBalancerRule, port corev1.ServicePort) bool {
+	cidrs, ok := lb.ruleCIDRs[port.Port]
+	if !ok || strings.TrimSpace(lbRule.Cidrlist) == "" {
+		return true
+	}
+	if len(cidrs) == 0 {
+		cidrs = []string{defaultAllowedCIDR}
+	}
+
+	return compareStringSlice(parseCIDRList(lbRule.Cidrlist), cidrs)
+}
+
+// isAllowAll returns true for a list of source ranges that allows all clients.
+func isAllowAll(cidrs []string) bool {
+	return len(cidrs) == 0 || (len(cidrs) == 1 && cidrs[0] == defaultAllowedCIDR)
+}
+
+// renameLoadBalancerRules renames the rules that were found under one of the oldNames, f.e. after the naming
+// scheme changed, so they match the given name. Unlike creating them again under the new name, this keeps the
+// rules, their hosts and firewall rules in place. A rename that fails is retried on the next reconcile.
+func (lb *loadBalancer) renameLoadBalancerRules(name string, oldNames []string) error {
+	for ruleName, lbRule := range lb.rules {
+		if strings.HasPrefix(ruleName, name+"-") {
+			continue
+		}
+
+		for _, oldName := range oldNames {
+			if oldName == "" || oldName == name || !strings.HasPrefix(ruleName, oldName+"-") {
+				continue
+			}
+
+			// After an interrupted rename, the port may have a rule under both names. The old one is then
+			// left under its name, so it is deleted as obsolete.
+			newRuleName := name + strings.TrimPrefix(ruleName, oldName)
+			if _, ok := lb.rules[newRuleName]; ok {
+				klog.Warningf("Not renaming load balancer rule %v, there already is a rule %v", ruleName, newRuleName)
+
+				break
+			}
+			klog.V(4).Infof("Renaming load balancer rule %v to %v", ruleName, newRuleName)
+
+			p := lb.LoadBalancer.NewUpdateLoadBalancerRuleParams(lbRule.Id)
+			p.SetName(newRuleName)
+			if _, err := lb.LoadBalancer.UpdateLoadBalancerRule(p); err != nil {
+				return fmt.Errorf("failed to rename load balancer rule %v to %v: %w", ruleName, newRuleName, err)
+			}
+
+			delete(lb.rules, ruleName)
+			lbRule.Name = newRuleName
+			lb.rules[newRuleName] = lbRule
+
+			break
+		}
+	}
+	lb.name = name
+
+	return nil
+}
+
+// updateLoadBalancerRule updates the algorithm and protocol of a load balancer rule.
+func (lb *loadBalancer) updateLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) error {
+	lbRule := lb.rules[lbRuleName]
+
+	p := lb.LoadBalancer.NewUpdateLoadBalancerRuleParams(lbRule.Id)
+	p.SetAlgorithm(lb.portAlgorithm(port))
+	p.SetProtocol(protocol.CSProtocol())
+
+	_, err := lb.LoadBalancer.UpdateLoadBalancerRule(p)
+	if err != nil {
+		return fmt.Errorf("failed to update loadbalancer rule with ID %s: %w", lbRule.Id, err)
+	}
+
+	return nil
+}
+
+// portAlgorithm returns the algorithm of the rule of a port: its override of the port algorithm annotation,
+// or else the algorithm of the service.
+func (lb *loadBalancer) portAlgorithm(port corev1.ServicePort) string {
+	if algorithm, ok := lb.portAlgorithms[port.Port]; ok {
+		return algorithm
+	}
+
+	return lb.algorithm
+}
+
+// createLoadBalancerRule creates a new load balancer rule and returns its ID.
+func (lb *loadBalancer) createLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) (*cloudstack.LoadBalancerRule, error) {
+	p := lb.LoadBalancer.NewCreateLoadBalancerRuleParams(
+		lb.portAlgorithm(port),
+		lbRuleName,
+		lb.privatePort(port),
+		int(port.Port),
+	)
+
+	p.SetNetworkid(lb.networkID)
+	p.SetPublicipid(lb.ipAddrID)
+
+	p.SetProtocol(protocol.CSProtocol())
+
+	// Unless configured otherwise, the firewall is not opened implicitly, as we create explicit firewall rules.
+	p.SetOpenfirewall(lb.openFirewall)
+
+	// Rules that are open to all get no CIDR list, like those in networks with the Firewall service.
+	if cidrs, ok := lb.ruleCIDRs[port.Port]; ok && !isAllowAll(cidrs) {
+		p.SetCidrlist(cidrs)
+	}
+
+	// Create a new load balancer rule.
+	r, err := lb.LoadBalancer.CreateLoadBalancerRule(p)
+	if err != nil {
+		return nil, fmt.Errorf("error creating load balancer rule %v: %w", lbRuleName, err)
+	}
+
+	lbRule := &cloudstack.LoadBalancerRule{
+		Id:          r.Id,
+		Algorithm:   r.Algorithm,
+		Cidrlist:    r.Cidrlist,
+		Name:        r.Name,
+		Networkid:   r.Networkid,
+		Privateport: r.Privateport,
+		Publicport:  r.Publicport,
+		Publicip:    r.Publicip,
+		Publicipid:  r.Publicipid,
+		Protocol:    r.Protocol,
+	}
+
+	lb.tagLoadBalancerRule(lbRule)
+
+	return lbRule, nil
+}
+
+// tagLoadBalancerRule tags a newly created rule with the service it was created for, so rules of
+// other clusters in the same project can be told apart. A failure is logged instead of failing the rule.
+func (lb *loadBalancer) tagLoadBalancerRule(lbRule *cloudstack.LoadBalancerRule) {
+	tags := map[string]string{}
+	maps.Copy(tags, lb.serviceTags)
+	maps.Copy(tags, lb.propagatedTags)
+	if len(tags) == 0 {
+		return
+	}
+
+	p := lb.Resourcetags.NewCreateTagsParams([]string{lbRule.Id}, "LoadBalancer", tags)
+	if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+		klog.Warningf("Error tagging load balancer rule %v: %v", lbRule.Name, err)
+	}
+}
+
+// checkLoadBalancerProvider returns an error if the Lb service of the network is not provided by the given provider.
+func (lb *loadBalancer) checkLoadBalancerProvider(provider string) error {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+
+	var available []string
+	for _, svc := range network.Service {
+		if svc.Name != "Lb" {
+			continue
+		}
+		for _, p := range svc.Provider {
+			if strings.EqualFold(p.Name, provider) {
+				return nil
+			}
+			available = append(available, p.Name)
+		}
+	}
+
+	if len(available) == 0 {
+		return fmt.Errorf("load balancer provider %s is not available: network %s does not offer a load balancer", provider, network.Id)
+	}
+
+	return fmt.Errorf("load balancer provider %s is not available: the offering of network %s uses %v", provider, network.Id, available)
+}
+
+// checkFirewallSupported returns an error wrapping errFirewallNotSupported if the network of the load balancer
+// does not offer the Firewall service, f.e. a VPC tier, which uses network ACLs instead.
+func (lb *loadBalancer) checkFirewallSupported() error {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+
+	if !isFirewallSupported(network.Service) {
+		return fmt.Errorf("%w: network %s does not offer the Firewall service, so the source ranges of load balancer %s cannot be enforced",
+			errFirewallNotSupported, network.Id, lb.name)
+	}
+
+	return nil
+}
+
+// checkUDPSupported returns an error if the load balancer provider of the network does not support UDP.
+// The VPC virtual router f.e. may accept a UDP rule without ever forwarding the return traffic, so the
+// rule is refused up front instead. Networks that do not report their supported protocols are accepted.
+func (lb *loadBalancer) checkUDPSupported() error {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+
+	supported, ok := loadBalancerSupportedProtocols(network.Service)
+	if !ok || slices.Contains(supported, ProtoUDP) {
+		return nil
+	}
+
+	if network.Vpcid != "" {
+		return fmt.Errorf("the load balancer of VPC %s (network %s) does not support UDP, only %v; use a VPC offering with a UDP capable load balancer provider",
+			network.Vpcid, network.Id, supported)
+	}
+
+	return fmt.Errorf("the load balancer of network %s does not support UDP, only %v", network.Id, supported)
+}
+
+// cidrListProviders are the load balancer providers that enforce the CIDR list of a load balancer rule.
+var cidrListProviders = []string{"VirtualRouter", "VpcVirtualRouter"}
+
+// loadBalancerSupportsCIDRs returns true if the Lb service of the network is provided by one of the
+// cidrListProviders. Other providers accept the CIDR list of a rule, but allow all clients anyway.
+func loadBalancerSupportsCIDRs(services []cloudstack.NetworkServiceInternal) bool {
+	for _, svc := range services {
+		if svc.Name != "Lb" {
+			continue
+		}
+		for _, provider := range svc.Provider {
+			if slices.Contains(cidrListProviders, provider.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// loadBalancerSupportedProtocols returns the protocols from the SupportedProtocols capability of
+// the Lb service, and false if the network does not report it.
+func loadBalancerSupportedProtocols(services []cloudstack.NetworkServiceInternal) ([]string, bool) {
+	for _, svc := range services {
+		if svc.Name != "Lb" {
+			continue
+		}
+		for _, capability := range svc.Capability {
+			if capability.Name != "SupportedProtocols" {
+				continue
+			}
+			var supported []string
+			for _, protocol := range strings.Split(capability.Value, ",") {
+				if protocol = strings.ToLower(strings.TrimSpace(protocol)); protocol != "" {
+					supported = append(supported, protocol)
+				}
+			}
+
+			return supported, true
+		}
+	}
+
+	return nil, false
+}
+
+// getSessionAffinityTimeout returns the ClientIP session affinity timeout of the service in seconds,
+// or 0 when the service has no ClientIP session affinity.
+func getSessionAffinityTimeout(service *corev1.Service) int32 {
+	if service.Spec.SessionAffinity != corev1.ServiceAffinityClientIP {
+		return 0
+	}
+
+	cfg := service.Spec.SessionAffinityConfig
+	if cfg == nil || cfg.ClientIP == nil || cfg.ClientIP.TimeoutSeconds == nil {
+		return 0
+	}
+
+	return *cfg.ClientIP.TimeoutSeconds
+}
+
+// isSourceStickinessSupported returns true if the SupportedStickinessMethods capability of the Lb
+// service of the network contains the source based stickiness method.
+func (lb *loadBalancer) isSourceStickinessSupported() (bool, error) {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return false, fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return false, fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+
+	for _, svc := range network.Service {
+		if svc.Name != "Lb" {
+			continue
+		}
+		for _, capability := range svc.Capability {
+			if capability.Name != "SupportedStickinessMethods" {
+				continue
+			}
+			var methods []struct {
+				Methodname string `json:"methodname"`
+			}
+			if err := json.Unmarshal([]byte(capability.Value), &methods); err != nil {
+				return false, fmt.Errorf("error parsing the stickiness methods of network %s: %w", lb.networkID, err)
+			}
+			for _, method := range methods {
+				if method.Methodname == stickinessMethodSourceBased {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// reconcileStickinessPolicy makes sure the rule has a source based stickiness policy that expires after
+// the given timeout, or removes our policy when the timeout is 0. Other stickiness policies are left alone.
+func (lb *loadBalancer) reconcileStickinessPolicy(lbRule *cloudstack.LoadBalancerRule, timeoutSeconds int32) error {
+	p := lb.LoadBalancer.NewListLBStickinessPoliciesParams()
+	p.SetLbruleid(lbRule.Id)
+
+	l, err := lb.LoadBalancer.ListLBStickinessPolicies(p)
+	if err != nil {
+		return fmt.Errorf("error listing stickiness policies of rule %v: %w", lbRule.Name, err)
+	}
+
+	expire := fmt.Sprintf("%ds", timeoutSeconds)
+	for _, policies := range l.LBStickinessPolicies {
+		for _, policy := range policies.Stickinesspolicy {
+			if policy.Name != stickinessPolicyName {
+				continue
+			}
+			if timeoutSeconds > 0 && policy.Methodname == stickinessMethodSourceBased && policy.Params["expire"] == expire {
+				return nil
+			}
+
+			klog.V(4).Infof("Deleting stickiness policy %v of load balancer rule: %v", policy.Id, lbRule.Name)
+			if _, err := lb.LoadBalancer.DeleteLBStickinessPolicy(lb.LoadBalancer.NewDeleteLBStickinessPolicyParams(policy.Id)); err != nil {
+				return fmt.Errorf("error deleting stickiness policy of rule %v: %w", lbRule.Name, err)
+			}
+		}
+	}
+
+	if timeoutSeconds == 0 {
+		return nil
+	}
+
+	klog.V(4).Infof("Creating stickiness policy with expire %v for load balancer rule: %v", expire, lbRule.Name)
+	cp := lb.LoadBalancer.NewCreateLBStickinessPolicyParams(lbRule.Id, stickinessMethodSourceBased, stickinessPolicyName)
+	cp.SetParam(map[string]string{"expire": expire})
+	if _, err := lb.LoadBalancer.CreateLBStickinessPolicy(cp); err != nil {
+		return fmt.Errorf("error creating stickiness policy for rule %v: %w", lbRule.Name, err)
+	}
+
+	return nil
+}
+
+// findProtocolSwitchRule returns an existing rule that serves the same public port with a different
+// protocol on the same IP protocol, f.e. a "tcp" rule when "tcp-proxy" is wanted. As the protocol is
+// part of the rule name, such a rule is not found by checkLoadBalancerRule.
+func (lb *loadBalancer) findProtocolSwitchRule(port corev1.ServicePort, protocol LoadBalancerProtocol) *cloudstack.LoadBalancerRule {
+	for _, lbRule := range lb.rules {
+		ruleProtocol := ProtocolFromLoadBalancer(lbRule.Protocol)
+		if ruleProtocol != protocol && ruleProtocol.IPProtocol() == protocol.IPProtocol() &&
+			lbRule.Publicip == lb.ipAddr && lbRule.Publicport == strconv.Itoa(int(port.Port)) {
+			return lbRule
+		}
+	}
+
+	return nil
+}
+
+// switchLoadBalancerRuleProtocol switches oldRule to the given protocol. Like renameLoadBalancerRules, the rule
+// is updated in place with its new protocol and name, which keeps its hosts and the port served. CloudStack
+// rejects a second rule on the same public port, so when the update is refused, the old rule is deleted before
+// the new one is created, which interrupts traffic to the port for a moment. A transient error keeps the old
+// rule instead. The firewall rules are left alone, as the IP protocol is unchanged.
+func (lb *loadBalancer) switchLoadBalancerRuleProtocol(oldRule *cloudstack.LoadBalancerRule, lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol) (*cloudstack.LoadBalancerRule, error) {
+	p := lb.LoadBalancer.NewUpdateLoadBalancerRuleParams(oldRule.Id)
+	p.SetName(lbRuleName)
+	p.SetAlgorithm(lb.portAlgorithm(port))
+	p.SetProtocol(protocol.CSProtocol())
+
+	_, err := lb.LoadBalancer.UpdateLoadBalancerRule(p)
+	if err == nil {
+		// Delete the rule from the map under its old name, to prevent it being deleted.
+		delete(lb.rules, oldRule.Name)
+		oldRule.Name, oldRule.Algorithm, oldRule.Protocol = lbRuleName, lb.portAlgorithm(port), protocol.CSProtocol()
+
+		if err := lb.reconcileHostsForRule(oldRule, lb.hostIDs); err != nil {
+			return nil, err
+		}
+		lb.reconcilePropagatedTags(oldRule.Id, "LoadBalancer", oldRule.Tags)
+
+		return oldRule, nil
+	}
+	if isTransientError(err) {
+		return nil, fmt.Errorf("failed to switch load balancer rule %v to protocol %v: %w", oldRule.Name, protocol, err)
+	}
+
+	klog.Warningf("Could not switch load balancer rule %v to protocol %v in place, replacing it instead: %v", oldRule.Name, protocol, err)
+	if err := lb.deleteLoadBalancerRule(oldRule); err != nil {
+		return nil, err
+	}
+
+	lbRule, err := lb.createLoadBalancerRule(lbRuleName, port, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(4).Infof("Assigning hosts (%v) to load balancer rule: %v", lb.hostIDs, lbRuleName)
+	if err := lb.assignHostsToRule(lbRule, lb.hostIDs); err != nil {
+		return nil, err
+	}
+
+	return lbRule, nil
+}
+
+// deleteLoadBalancerRule deletes a load balancer rule.
+func (lb *loadBalancer) deleteLoadBalancerRule(lbRule *cloudstack.LoadBalancerRule) error {
+	p := lb.LoadBalancer.NewDeleteLoadBalancerRuleParams(lbRule.Id)
+
+	// The cached hosts are dropped even when the deletion failed, as the rule may be gone or emptied anyway.
+	lb.invalidateRuleMembers(lbRule)
+	if _, err := lb.LoadBalancer.DeleteLoadBalancerRule(p); err != nil {
+		return fmt.Errorf("error deleting load balancer rule %v: %w", lbRule.Name, err)
+	}
+
+	// Delete the rule from the map as it no longer exists
+	delete(lb.rules, lbRule.Name)
+
+	return nil
+}
+
+// reconcileHostsForRule ensures the load balancer rule has exactly the expected set of hosts.
+// It lists the current members, computes the difference, and assigns new hosts before removing
+// old ones so the rule always has backends during rolling upgrades.
+func (lb *loadBalancer) reconcileHostsForRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
+	current, err := lb.listRuleMembers(lbRule)
+	if err != nil {
+		return err
+	}
+
+	assign, remove := symmetricDifference(hostIDs, current)
+
+	klog.V(4).Infof("Reconcile hosts for rule %v: %d host(s) to assign, %d host(s) to remove (wanted: %v, current: %d instances)",
+		lbRule.Name, len(assign), len(remove), hostIDs, len(current))
+
+	if len(assign) > 0 {
+		klog.V(4).Infof("Assigning new hosts (%v) to load balancer rule: %v", assign, lbRule.Name)
+		if err := lb.assignHostsToRule(lbRule, assign); err != nil {
+			lb.invalidateRuleMembers(lbRule)
+
+			return fmt.Errorf("error assigning new hosts to rule %v (old hosts preserved): %w", lbRule.Name, err)
+		}
+	}
+
+	if len(remove) > 0 {
+		klog.V(4).Infof("Removing old hosts (%v) from load balancer rule: %v", remove, lbRule.Name)
+		if err := lb.removeHostsFromRule(lbRule, remove); err != nil {
+			lb.invalidateRuleMembers(lbRule)
+
+			return err
+		}
+	}
+
+	lb.rememberRuleMembers(lbRule, hostIDs)
+
+	return nil
+}
+
+// listRuleMembers returns the instances assigned to the load balancer rule. When the rule members
+// cache is enabled and knows the rule, the instances are taken from the cache instead of CloudStack.
+func (lb *loadBalancer) listRuleMembers(lbRule *cloudstack.LoadBalancerRule) ([]*cloudstack.VirtualMachine, error) {
+	if lb.ruleMembers != nil {
+		if hostIDs, ok := lb.ruleMembers.get(lbRule.Id); ok {
+			instances := make([]*cloudstack.VirtualMachine, 0, len(hostIDs))
+			for _, hostID := range hostIDs {
+				instances = append(instances, &cloudstack.VirtualMachine{Id: hostID})
+			}
+
+			return instances, nil
+		}
+	}
+
+	return lb.listRuleInstances(lbRule)
+}
+
+// listRuleInstances returns the instances CloudStack reports as assigned to the load balancer rule.
+func (lb *loadBalancer) listRuleInstances(lbRule *cloudstack.LoadBalancerRule) ([]*cloudstack.VirtualMachine, error) {
+	p := lb.LoadBalancer.NewListLoadBalancerRuleInstancesParams(lbRule.Id)
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRuleInstances(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving associated instances: %w", err)
+	}
+
+	return l.LoadBalancerRuleInstances, nil
+}
+
+// rememberRuleMembers caches the hosts that are now assigned to the rule.
+func (lb *loadBalancer) rememberRuleMembers(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) {
+	if lb.ruleMembers != nil {
+		lb.ruleMembers.set(lbRule.Id, hostIDs)
+	}
+}
+
+// invalidateRuleMembers drops the cached instances of the rule, so the next reconcile lists them again.
+func (lb *loadBalancer) invalidateRuleMembers(lbRule *cloudstack.LoadBalancerRule) {
+	if lb.ruleMembers != nil {
+		lb.ruleMembers.invalidate(lbRule.Id)
+	}
+}
+
+// assignHostsToRule assigns hosts to a load balancer rule.
+// The hosts are assigned in batches of hostBatchSize, see hostBatches.
+func (lb *loadBalancer) assignHostsToRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
+	var errs []error
+	for batch := range lb.hostBatches(hostIDs) {
+		p := lb.LoadBalancer.NewAssignToLoadBalancerRuleParams(lbRule.Id)
+		p.SetVirtualmachineids(batch)
+
+		if _, err := lb.LoadBalancer.AssignToLoadBalancerRule(p); err != nil {
+			errs = append(errs, fmt.Errorf("error assigning hosts to load balancer rule %v: %w", lbRule.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeHostsFromRule removes hosts from a load balancer rule.
+// The hosts are removed in batches of hostBatchSize, see hostBatches.
+func (lb *loadBalancer) removeHostsFromRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
+	var errs []error
+	for batch := range lb.hostBatches(hostIDs) {
+		p := lb.LoadBalancer.NewRemoveFromLoadBalancerRuleParams(lbRule.Id)
+		p.SetVirtualmachineids(batch)
+
+		if _, err := lb.LoadBalancer.RemoveFromLoadBalancerRule(p); err != nil {
+			errs = append(errs, fmt.Errorf("error removing hosts from load balancer rule %v: %w", lbRule.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// hostBatches splits host IDs into batches of at most hostBatchSize, so a single API request does not grow
+// beyond the request size limits on big clusters. A batch size of 0 passes all hosts in one batch.
+func (lb *loadBalancer) hostBatches(hostIDs []string) iter.Seq[[]string] {
+	if lb.hostBatchSize <= 0 || len(hostIDs) <= lb.hostBatchSize {
+		return func(yield func([]string) bool) {
+			yield(hostIDs)
+		}
+	}
+
+	return slices.Chunk(hostIDs, lb.hostBatchSize)
+}
+
+// generateLoadBalancerStatus returns the LoadBalancerStatus based on various service annotations.
+func (lb *loadBalancer) generateLoadBalancerStatus(service *corev1.Service) *corev1.LoadBalancerStatus {
+	status := &corev1.LoadBalancerStatus{}
+	// If hostname is explicitly set using service annotation
+	// Workaround for https://github.com/kubernetes/kubernetes/issues/66607
+	if hostname := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname, ""); hostname != "" {
+		status.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname, Ports: lb.portStatus(service)}}
+
+		return status
+	}
+
+	ipMode := lb.ipMode
+	if ipMode == "" {
+		ipMode = corev1.LoadBalancerIPModeVIP
+	}
+	// Default to IP
+	status.Ingress = []corev1.LoadBalancerIngress{{
+		IP:     lb.ipAddr,
+		IPMode: &ipMode,
+		Ports:  lb.portStatus(service),
+	}}
+
+	return status
+}
+
+// portStatus returns the status of each port of the service, with the value of portErrors as its error.
+func (lb *loadBalancer) portStatus(service *corev1.Service) []corev1.PortStatus {
+	ports := make([]corev1.PortStatus, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		status := corev1.PortStatus{Port: port.Port, Protocol: port.Protocol}
+		if status.Protocol == "" {
+			status.Protocol = corev1.ProtocolTCP
+		}
+		if reason, ok := lb.portErrors[port.Port]; ok {
+			status.Error = &reason
+		}
+		ports = append(ports, status)
+	}
+
+	return ports
+}
+
+// symmetricDifference returns the symmetric difference between the old (existing) and new (wanted) host ID's.
+func symmetricDifference(hostIDs []string, lbInstances []*cloudstack.VirtualMachine) ([]string, []string) {
+	newIDs := make(map[string]bool)
+	for _, hostID := range hostIDs {
+		newIDs[hostID] = true
+	}
+
+	var remove []string //nolint:prealloc
+	for _, instance := range lbInstances {
+		if instance == nil {
+			continue
+		}
+
+		if newIDs[instance.Id] {
+			delete(newIDs, instance.Id)
+
+			continue
+		}
+
+		remove = append(remove, instance.Id)
+	}
+
+	var assign []string //nolint:prealloc
+	for hostID := range newIDs {
+		assign = append(assign, hostID)
+	}
+
+	return assign, remove
+}
+
+// compareStringSlice compares two unsorted slices of strings without sorting them first.
+//
+// The slices are equal if and only if both contain the same number of every unique element.
+//
+// Thanks to: https://stackoverflow.com/a/36000696
+func compareStringSlice(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	// create a map of string -> int
+	diff := make(map[string]int, len(x))
+	for _, _x := range x {
+		// 0 value for int is 0, so just increment a counter for the string
+		diff[_x]++
+	}
+	for _, _y := range y {
+		// If the string _y is not in diff bail out early
+		if _, ok := diff[_y]; !ok {
+			return false
+		}
+		diff[_y]--
+		if diff[_y] == 0 {
+			delete(diff, _y)
+		}
+	}
+
+	return len(diff) == 0
+}
+
+func ruleToString(rule *cloudstack.FirewallRule) string {
+	ls := &strings.Builder{}
+	if rule == nil {
+		ls.WriteString("nil")
+	} else {
+		switch rule.Protocol {
+		case ProtoTCP:
+			fallthrough
+		case ProtoUDP:
+			fmt.Fprintf(ls, "{[%s] -> %s:[%d-%d] (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Startport, rule.Endport, rule.Protocol)
+		case ProtoICMP:
+			fmt.Fprintf(ls, "{[%s] -> %s [%d,%d] (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Icmptype, rule.Icmpcode, rule.Protocol)
+		default:
+			fmt.Fprintf(ls, "{[%s] -> %s (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Protocol)
+		}
+	}
+
+	return ls.String()
+}
+
+func rulesToString(rules []*cloudstack.FirewallRule) string {
+	if len(rules) == 0 {
+		return "none"
+	}
+
+	ls := &strings.Builder{}
+	first := true
+	for _, rule := range rules {
+		if first {
+			first = false
+		} else {
+			ls.WriteString(", ")
+		}
+		ls.WriteString(ruleToString(rule))
+	}
+
+	return ls.String()
+}
+
+func rulesMapToString(rules map[*cloudstack.FirewallRule]bool) string {
+	if len(rules) == 0 {
+		return "none"
+	}
+
+	ls := &strings.Builder{}
+	first := true
+	for rule := range rules {
+		if first {
+			first = false
+		} else {
+			ls.WriteString(", ")
+		}
+		ls.WriteString(ruleToString(rule))
+	}
+
+	return ls.String()
+}
+
+// firewallRuleCIDRs returns the CIDR list of a firewall rule. CloudStack allows all sources when
+// the list is empty, so that is returned as the allow-all CIDR instead of a single empty CIDR.
+func firewallRuleCIDRs(rule *cloudstack.FirewallRule) []string {
+	return parseCIDRList(rule.Cidrlist)
+}
+
+// parseCIDRList splits the CIDR list of a CloudStack rule. An empty list allows all clients.
+func parseCIDRList(cidrlist string) []string {
+	cidrs := strings.FieldsFunc(cidrlist, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(cidrs) == 0 {
+		return []string{defaultAllowedCIDR}
+	}
+
+	return cidrs
+}
+
+// updateFirewallRule creates a firewall rule for a load balancer rule
+//
+// Returns true if the firewall rule was created or updated.
+func (lb *loadBalancer) updateFirewallRule(publicIPID string, publicPort int, protocol LoadBalancerProtocol, allowedCIDRs []string) (bool, error) {
+	// Default to allow-all if no allowed CIDRs are defined.
+	if len(allowedCIDRs) == 0 {
+		allowedCIDRs = []string{defaultAllowedCIDR}
+	}
+
+	firewallRules, err := lb.listFirewallRules(publicIPID)
+	if err != nil {
+		return false, err
+	}
+	klog.V(4).Infof("Existing firewall rules for %v: %v", lb.ipAddr, rulesToString(firewallRules))
+
+	// find all rules whose proto+port range covers the port
+	// a map may or may not be faster, but is a bit easier to understand
+	filtered := make(map[*cloudstack.FirewallRule]bool)
+	for _, rule := range firewallRules {
+		if firewallRuleCovers(rule, protocol, publicPort) {
+			filtered[rule] = true
+		}
+	}
+	klog.V(4).Infof("Matching rules for %v: %v", lb.ipAddr, rulesMapToString(filtered))
+
+	// determine if we already have a rule with matching cidrs
+	var match *cloudstack.FirewallRule
+	for rule := range filtered {
+		if compareStringSlice(firewallRuleCIDRs(rule), allowedCIDRs) {
+			klog.V(4).Infof("Found identical rule: %v", ruleToString(rule))
+			match = rule
+
+			break
+		}
+	}
+
+	if match != nil {
+		// no need to create a new rule - but prevent deletion of the matching rule
+		delete(filtered, match)
+		if lb.ownsFirewallRule(match) {
+			lb.reconcilePropagatedTags(match.Id, "FirewallRule", match.Tags)
+		}
+	}
+
+	// leave the rules of other tools alone, and port ranges that other ports still need
+	for rule := range filtered {
+		if !lb.ownsFirewallRule(rule) {
+			klog.V(4).Infof("Keeping firewall rule %v, it was not created by us", ruleToString(rule))
+			delete(filtered, rule)
+
+			continue
+		}
+		needed, err := lb.firewallRuleNeeded(rule, firewallRules, publicIPID, publicPort, protocol)
+		if err != nil {
+			return false, err
+		}
+		if needed {
+			delete(filtered, rule)
+		}
+	}
+
+	// The rules of the IP change, so the next port lists them again.
+	if match == nil || len(filtered) > 0 {
+		delete(lb.firewallRuleCache, publicIPID)
+	}
+
+	// delete all other rules that didn't match the CIDR list
+	// do this first to prevent CS rule conflict errors
+	klog.V(4).Infof("Firewall rules to be deleted for %v: %v", lb.ipAddr, rulesMapToString(filtered))
+	var deleteErrs []error
+	for rule := range filtered {
+		p := lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)
+		if _, err = lb.Firewall.DeleteFirewallRule(p); err != nil {
+			// report the error, but keep on deleting the other rules
+			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
+			deleteErrs = append(deleteErrs, fmt.Errorf("error deleting old firewall rule %v allowing %v: %w", rule.Id, rule.Cidrlist, err))
+		} else {
+			lb.recordFirewallRuleChange(false, rule)
+		}
+	}
+
+	// create new rule if necessary
+	if match == nil {
+		// no rule found, create a new one
+		p := lb.Firewall.NewCreateFirewallRuleParams(publicIPID, protocol.IPProtocol())
+		p.SetCidrlist(allowedCIDRs)
+		p.SetStartport(publicPort)
+		p.SetEndport(publicPort)
+		r, err := lb.Firewall.CreateFirewallRule(p)
+		if err != nil {
+			// return immediately if we can't create the new rule
+			return false, errors.Join(fmt.Errorf("error creating new firewall rule for public IP %v, proto %v, port %v, allowed %v: %w", publicIPID, protocol, publicPort, allowedCIDRs, err), errors.Join(deleteErrs...))
+		}
+		lb.recordFirewallRuleChange(true, &cloudstack.FirewallRule{
+			Id: r.Id, Protocol: protocol.IPProtocol(), Startport: publicPort, Endport: publicPort,
+			Cidrlist: strings.Join(allowedCIDRs, ","), Ipaddress: lb.ipAddr,
+		})
+		if err := lb.tagFirewallRule(r.Id, ""); err != nil {
+			return false, err
+		}
+	}
+
+	changed := match == nil || len(filtered) > 0
+
+	// The wanted rule is in place, only old rules are left over.
+	if len(deleteErrs) > 0 {
+		return changed, fmt.Errorf("%w: %w", errStaleFirewallRules, errors.Join(deleteErrs...))
+	}
+
+	return changed, nil
+}
+
+// deleteFirewallRule deletes the firewall rule associated with the ip:port:protocol combo
+//
+// returns true when corresponding rules were deleted.
+func (lb *loadBalancer) deleteFirewallRule(publicIPID string, publicPort int, protocol LoadBalancerProtocol) (bool, error) { //nolint:unparam
+	firewallRules, err := lb.listFirewallRules(publicIPID)
+	if err != nil {
+		return false, err
+	}
+
+	// filter by proto:port, keeping port ranges that other ports still need
+	filtered := make([]*cloudstack.FirewallRule, 0, 1)
+	for _, rule := range firewallRules {
+		if !firewallRuleCovers(rule, protocol, publicPort) || !lb.ownsFirewallRule(rule) {
+			continue
+		}
+		needed, err := lb.firewallRuleNeeded(rule, firewallRules, publicIPID, publicPort, protocol)
+		if err != nil {
+			return false, err
+		}
+		if !needed {
+			filtered = append(filtered, rule)
+		}
+	}
+
+	if len(filtered) > 0 {
+		delete(lb.firewallRuleCache, publicIPID)
+	}
+
+	// delete all rules
+	var errs error
+	deleted := false
+	for _, rule := range filtered {
+		p := lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)
+		_, err = lb.Firewall.DeleteFirewallRule(p)
+		if err != nil {
+			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
+			errs = errors.Join(errs, fmt.Errorf("error deleting old firewall rule %v: %w", rule.Id, err))
+		} else {
+			lb.recordFirewallRuleChange(false, rule)
+			deleted = true
+		}
+	}
+
+	return deleted, errs
+}
+
+// recordFirewallRuleChange emits a firewallEvents event for a firewall rule that was created or deleted.
+func (lb *loadBalancer) recordFirewallRuleChange(created bool, rule *cloudstack.FirewallRule) {
+	if lb.firewallEvents == nil {
+		return
+	}
+
+	reason, action := "DeletedFirewallRule", "Deleted"
+	if created {
+		reason, action = "CreatedFirewallRule", "Created"
+	}
+	lb.firewallEvents(reason, fmt.Sprintf("%s firewall rule %s %s", action, rule.Id, ruleToString(rule)))
+}
+
+// firewallRuleCovers returns true if the protocol of a firewall rule matches and its port range includes the port.
+func firewallRuleCovers(rule *cloudstack.FirewallRule, protocol LoadBalancerProtocol, port int) bool {
+	return rule.Protocol == protocol.IPProtocol() && rule.Startport <= port && port <= rule.Endport
+}
+
+// firewallRuleNeeded returns true if a firewall rule spanning a port range still admits the traffic of another
+// port than publicPort, which has a load balancer rule on the IP but no firewall rule of its own. Such a rule is
+// only deleted once the last port it covers is gone or has its own rule. The load balancer rules in releasedRules
+// are about to be deleted, so their ports do not count. With keepRangedFirewallRules, rules spanning a port
+// range are always needed.
+func (lb *loadBalancer) firewallRuleNeeded(rule *cloudstack.FirewallRule, firewallRules []*cloudstack.FirewallRule, publicIPID string, publicPort int, protocol LoadBalancerProtocol) (bool, error) {
+	if rule.Startport == rule.Endport {
+		return false, nil
+	}
+	if lb.keepRangedFirewallRules {
+		klog.Infof("Keeping firewall rule %v spanning ports %d-%d for port %d, keep-ranged-firewall-rules is set", rule.Id, rule.Startport, rule.Endport, publicPort)
+
+		return true, nil
+	}
+
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(publicIPID)
+	p.SetListall(true)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return false, fmt.Errorf("error listing load balancer rules of public IP %v to check firewall rule %v: %w", publicIPID, rule.Id, err)
+	}
+
+	for _, lbRule := range l.LoadBalancerRules {
+		port, err := strconv.Atoi(lbRule.Publicport)
+		if err != nil || port == publicPort || lb.releasedRules[lbRule.Id] ||
+			ProtocolFromLoadBalancer(lbRule.Protocol).IPProtocol() != protocol.IPProtocol() || !firewallRuleCovers(rule, protocol, port) {
+			continue
+		}
+
+		ownRule := slices.ContainsFunc(firewallRules, func(other *cloudstack.FirewallRule) bool {
+			return other.Protocol == rule.Protocol && other.Startport == port && other.Endport == port
+		})
+		if !ownRule {
+			klog.Infof("Keeping firewall rule %v spanning ports %d-%d, it still covers port %d of load balancer rule %v", rule.Id, rule.Startport, rule.Endport, port, lbRule.Name)
+
+			return true, nil
+		}
+	}
+
+	klog.Infof("Deleting firewall rule %v spanning ports %d-%d, no other port relies on it", rule.Id, rule.Startport, rule.Endport)
+
+	return false, nil
+}
+
+// belongsToOtherCluster returns true if the tags of a resource name another cluster than ours. Untagged
+// resources, f.e. those created before they were tagged, may belong to any cluster.
+func (lb *loadBalancer) belongsToOtherCluster(tags []cloudstack.Tags) bool {
+	if lb.clusterName == "" {
+		return false
+	}
+
+	for _, tag := range tags {
+		if tag.Key == serviceClusterTagKey {
+			return tag.Value != lb.clusterName
+		}
+	}
+
+	return false
+}
+
+// belongsToOtherService returns true if the tags of a resource name another service than ours, f.e. a
+// firewall rule of another service that shares the public IP. Untagged resources may belong to any service.
+func (lb *loadBalancer) belongsToOtherService(tags []cloudstack.Tags) bool {
+	if len(lb.serviceTags) == 0 {
+		return false
+	}
+
+	for _, tag := range tags {
+		if (tag.Key == serviceNamespaceTagKey || tag.Key == serviceNameTagKey) && tag.Value != lb.serviceTags[tag.Key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ownsFirewallRule returns true if we may delete the firewall rule. Unless ownedFirewallRulesOnly
+// is set, that is every rule on the IP that is not tagged for another cluster or service.
+func (lb *loadBalancer) ownsFirewallRule(rule *cloudstack.FirewallRule) bool {
+	if lb.belongsToOtherCluster(rule.Tags) || lb.belongsToOtherService(rule.Tags) {
+		return false
+	}
+	if !lb.ownedFirewallRulesOnly {
+		return true
+	}
+
+	key, value := lb.ownerTag()
+	for _, tag := range rule.Tags {
+		if tag.Key == key && tag.Value == value {
+			return true
+		}
+		if slices.ContainsFunc(lb.previousOwnerTags, func(previous cloudstack.Tags) bool {
+			return tag.Key == previous.Key && tag.Value == previous.Value
+		}) {
+			return true
 		}
 	}
 
-	return nil
+	return false
 }
 
-// assignHostsToRule assigns hosts to a load balancer rule.
-func (lb *loadBalancer) assignHostsToRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
-	p := lb.LoadBalancer.NewAssignToLoadBalancerRuleParams(lbRule.Id)
-	p.SetVirtualmachineids(hostIDs)
-
-	if _, err := lb.LoadBalancer.AssignToLoadBalancerRule(p); err != nil {
-		return fmt.Errorf("error assigning hosts to load balancer rule %v: %w", lbRule.Name, err)
+// ownsICMPFirewallRule returns true if the ICMP firewall rule was created for this load balancer, as told by the
+// port tag of tagFirewallRule, or the owner tag with owned-firewall-rules-only. Unlike the rules of the ports,
+// ICMP rules are often created by hand, f.e. to allow ping for monitoring, so untagged ones are never deleted.
+func (lb *loadBalancer) ownsICMPFirewallRule(rule *cloudstack.FirewallRule) bool {
+	if !lb.ownsFirewallRule(rule) {
+		return false
+	}
+	if lb.ownedFirewallRulesOnly {
+		return true
 	}
 
-	return nil
+	return len(lb.serviceTags) > 0 && slices.ContainsFunc(rule.Tags, func(tag cloudstack.Tags) bool {
+		return tag.Key == firewallRulePortTagKey && tag.Value == ProtoICMP
+	})
 }
 
-// removeHostsFromRule removes hosts from a load balancer rule.
-func (lb *loadBalancer) removeHostsFromRule(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) error {
-	p := lb.LoadBalancer.NewRemoveFromLoadBalancerRuleParams(lbRule.Id)
-	p.SetVirtualmachineids(hostIDs)
-
-	if _, err := lb.LoadBalancer.RemoveFromLoadBalancerRule(p); err != nil {
-		return fmt.Errorf("error removing hosts from load balancer rule %v: %w", lbRule.Name, err)
+// ownerTag returns the key and value of the tag marking the firewall rules created by us.
+func (lb *loadBalancer) ownerTag() (string, string) {
+	key, value := lb.ownerTagKey, lb.ownerTagValue
+	if key == "" {
+		key = firewallRuleOwnerTagKey
+	}
+	if value == "" {
+		value = firewallRuleOwnerTagValue
 	}
 
-	return nil
+	return key, value
 }
 
-// generateLoadBalancerStatus returns the LoadBalancerStatus based on various service annotations.
-func (lb *loadBalancer) generateLoadBalancerStatus(service *corev1.Service) *corev1.LoadBalancerStatus {
-	status := &corev1.LoadBalancerStatus{}
-	// If hostname is explicitly set using service annotation
-	// Workaround for https://github.com/kubernetes/kubernetes/issues/66607
-	if hostname := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname, ""); hostname != "" {
-		status.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname}}
+// ownerTag returns the key and value of the tag marking the firewall rules created by us for the cluster, with
+// ownerTagClusterPlaceholder in the configured value replaced by the cluster name.
+func (cs *CSCloud) ownerTag(clusterName string) (string, string) {
+	return cs.ownerTagKey, strings.ReplaceAll(cs.ownerTagValue, ownerTagClusterPlaceholder, clusterName)
+}
 
-		return status
+// previousOwnerTagsOf returns the previous owner tags for the cluster, with ownerTagClusterPlaceholder in their
+// values replaced by the cluster name like in ownerTag.
+func (cs *CSCloud) previousOwnerTagsOf(clusterName string) []cloudstack.Tags {
+	tags := make([]cloudstack.Tags, 0, len(cs.previousOwnerTags))
+	for _, tag := range cs.previousOwnerTags {
+		tags = append(tags, cloudstack.Tags{Key: tag.Key, Value: strings.ReplaceAll(tag.Value, ownerTagClusterPlaceholder, clusterName)})
 	}
 
-	ipMode := corev1.LoadBalancerIPModeVIP
-	if getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerProxyProtocol, false) {
-		// Set the LoadBalancerIPMode to Proxy to prevent kube-proxy from injecting an iptables bypass.
-		// https://github.com/kubernetes/enhancements/tree/master/keps/sig-network/1860-kube-proxy-IP-node-binding
-		ipMode = corev1.LoadBalancerIPModeProxy
+	return tags
+}
+
+// tagFirewallRule tags a firewall rule we created with the service it was created for, and marks it as ours
+// when ownedFirewallRulesOnly is set. CloudStack firewall rules have no description, so the tags are the only
+// way to trace them back to the service. Only ICMP rules get a port tag, which marks them as created by us, see
+// ownsICMPFirewallRule; the rules of the ports carry their port themselves. While firewallRuleTagBatch is set,
+// the rule is tagged later by flushFirewallRuleTags.
+func (lb *loadBalancer) tagFirewallRule(id, port string) error {
+	if lb.firewallRuleTagBatch != nil {
+		lb.firewallRuleTagBatch[port] = append(lb.firewallRuleTagBatch[port], id)
+
+		return nil
 	}
-	// Default to IP
-	status.Ingress = []corev1.LoadBalancerIngress{{
-		IP:     lb.ipAddr,
-		IPMode: &ipMode,
-	}}
 
-	return status
+	return lb.tagFirewallRules([]string{id}, port)
 }
 
-// symmetricDifference returns the symmetric difference between the old (existing) and new (wanted) host ID's.
-func symmetricDifference(hostIDs []string, lbInstances []*cloudstack.VirtualMachine) ([]string, []string) {
-	newIDs := make(map[string]bool)
-	for _, hostID := range hostIDs {
-		newIDs[hostID] = true
+// flushFirewallRuleTags tags the firewall rules collected in firewallRuleTagBatch, with one call for the rules
+// of the ports and one for the ICMP rules, and stops batching.
+func (lb *loadBalancer) flushFirewallRuleTags() error {
+	batch := lb.firewallRuleTagBatch
+	lb.firewallRuleTagBatch = nil
+
+	var errs []error
+	for _, port := range slices.Sorted(maps.Keys(batch)) {
+		if err := lb.tagFirewallRules(batch[port], port); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	var remove []string //nolint:prealloc
-	for _, instance := range lbInstances {
-		if instance == nil {
-			continue
+	return errors.Join(errs...)
+}
+
+// tagFirewallRules tags firewall rules we created, see tagFirewallRule. If owned rules cannot be tagged they are
+// deleted again, as they would never be cleaned up otherwise.
+func (lb *loadBalancer) tagFirewallRules(ids []string, port string) error {
+	tags := map[string]string{}
+	if len(lb.serviceTags) > 0 {
+		maps.Copy(tags, lb.serviceTags)
+		if port != "" {
+			tags[firewallRulePortTagKey] = port
 		}
+	}
+	maps.Copy(tags, lb.propagatedTags)
+	if lb.ownedFirewallRulesOnly {
+		key, value := lb.ownerTag()
+		tags[key] = value
+	}
+	if len(tags) == 0 {
+		return nil
+	}
 
-		if newIDs[instance.Id] {
-			delete(newIDs, instance.Id)
+	p := lb.Resourcetags.NewCreateTagsParams(ids, "FirewallRule", tags)
+	if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+		if !lb.ownedFirewallRulesOnly {
+			klog.Warningf("Error tagging firewall rules %v: %v", ids, err)
 
-			continue
+			return nil
 		}
 
-		remove = append(remove, instance.Id)
-	}
+		for _, id := range ids {
+			if _, derr := lb.Firewall.DeleteFirewallRule(lb.Firewall.NewDeleteFirewallRuleParams(id)); derr != nil {
+				klog.Errorf("Error deleting untagged firewall rule %v: %v", id, derr)
+			}
+		}
 
-	var assign []string //nolint:prealloc
-	for hostID := range newIDs {
-		assign = append(assign, hostID)
+		return fmt.Errorf("error tagging firewall rules %v: %w", ids, err)
 	}
 
-	return assign, remove
+	return nil
 }
 
-// compareStringSlice compares two unsorted slices of strings without sorting them first.
-//
-// The slices are equal if and only if both contain the same number of every unique element.
-//
-// Thanks to: https://stackoverflow.com/a/36000696
-func compareStringSlice(x, y []string) bool {
-	if len(x) != len(y) {
-		return false
-	}
-	// create a map of string -> int
-	diff := make(map[string]int, len(x))
-	for _, _x := range x {
-		// 0 value for int is 0, so just increment a counter for the string
-		diff[_x]++
+// firewallRulesPageSize is the number of firewall rules listed per page.
+const firewallRulesPageSize = 500
+
+// publicIPsPageSize is the number of public IPs listed per page.
+const publicIPsPageSize = 500
+
+// listFirewallRules returns all firewall rules on the public IP. Shared IPs can have more rules than CloudStack
+// returns at once, so they are listed page by page. Missing a rule would make us create a duplicate, so an
+// error is returned when fewer rules were listed than CloudStack reports.
+func (lb *loadBalancer) listFirewallRules(publicIPID string) ([]*cloudstack.FirewallRule, error) {
+	if rules, ok := lb.firewallRuleCache[publicIPID]; ok {
+		return rules, nil
 	}
-	for _, _y := range y {
-		// If the string _y is not in diff bail out early
-		if _, ok := diff[_y]; !ok {
-			return false
-		}
-		diff[_y]--
-		if diff[_y] == 0 {
-			delete(diff, _y)
-		}
+
+	p := lb.Firewall.NewListFirewallRulesParams()
+	p.SetIpaddressid(publicIPID)
+	p.SetListall(true)
+	p.SetPagesize(firewallRulesPageSize)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
 	}
 
-	return len(diff) == 0
-}
+	var rules []*cloudstack.FirewallRule
+	var count int
+	for page := 1; ; page++ {
+		p.SetPage(page)
+		r, err := lb.Firewall.ListFirewallRules(p)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching firewall rules for public IP %v: %w", publicIPID, err)
+		}
+		rules = append(rules, r.FirewallRules...)
+		count = r.Count
 
-func ruleToString(rule *cloudstack.FirewallRule) string {
-	ls := &strings.Builder{}
-	if rule == nil {
-		ls.WriteString("nil")
-	} else {
-		switch rule.Protocol {
-		case ProtoTCP:
-			fallthrough
-		case ProtoUDP:
-			fmt.Fprintf(ls, "{[%s] -> %s:[%d-%d] (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Startport, rule.Endport, rule.Protocol)
-		case ProtoICMP:
-			fmt.Fprintf(ls, "{[%s] -> %s [%d,%d] (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Icmptype, rule.Icmpcode, rule.Protocol)
-		default:
-			fmt.Fprintf(ls, "{[%s] -> %s (%s)}", rule.Cidrlist, rule.Ipaddress, rule.Protocol)
+		// If we got fewer results than the page size, we've reached the last page.
+		if len(r.FirewallRules) < firewallRulesPageSize || len(rules) >= count {
+			break
 		}
 	}
 
-	return ls.String()
-}
-
-func rulesToString(rules []*cloudstack.FirewallRule) string {
-	if len(rules) == 0 {
-		return "none"
+	if len(rules) < count {
+		return nil, fmt.Errorf("error fetching firewall rules for public IP %v: listed %d of %d rules", publicIPID, len(rules), count)
 	}
 
-	ls := &strings.Builder{}
-	first := true
-	for _, rule := range rules {
-		if first {
-			first = false
-		} else {
-			ls.WriteString(", ")
-		}
-		ls.WriteString(ruleToString(rule))
+	if lb.firewallRuleCache != nil {
+		lb.firewallRuleCache[publicIPID] = rules
 	}
 
-	return ls.String()
+	return rules, nil
 }
 
-func rulesMapToString(rules map[*cloudstack.FirewallRule]bool) string {
-	if len(rules) == 0 {
-		return "none"
+// listICMPFirewallRules returns the ICMP firewall rules on the public IP.
+func (lb *loadBalancer) listICMPFirewallRules(publicIPID string) ([]*cloudstack.FirewallRule, error) {
+	firewallRules, err := lb.listFirewallRules(publicIPID)
+	if err != nil {
+		return nil, err
 	}
 
-	ls := &strings.Builder{}
-	first := true
-	for rule := range rules {
-		if first {
-			first = false
-		} else {
-			ls.WriteString(", ")
+	var rules []*cloudstack.FirewallRule
+	for _, rule := range firewallRules {
+		if rule.Protocol == ProtoICMP {
+			rules = append(rules, rule)
 		}
-		ls.WriteString(ruleToString(rule))
 	}
 
-	return ls.String()
+	return rules, nil
 }
 
-// updateFirewallRule creates a firewall rule for a load balancer rule
+// icmpFirewallRule is an ICMP firewall rule on the load balancer IP. A type and code of -1 allow all ICMP.
+type icmpFirewallRule struct {
+	icmpType int
+	icmpCode int
+	cidrs    []string
+}
+
+// updateICMPFirewallRules makes sure the public IP has exactly the given ICMP firewall rules.
 //
-// Returns true if the firewall rule was created or updated.
-func (lb *loadBalancer) updateFirewallRule(publicIPID string, publicPort int, protocol LoadBalancerProtocol, allowedCIDRs []string) (bool, error) {
-	// Default to allow-all if no allowed CIDRs are defined.
-	if len(allowedCIDRs) == 0 {
-		allowedCIDRs = []string{defaultAllowedCIDR}
+// Returns true if a firewall rule was created or deleted.
+func (lb *loadBalancer) updateICMPFirewallRules(publicIPID string, desired []icmpFirewallRule) (bool, error) {
+	for i := range desired {
+		// Default to allow-all if no allowed CIDRs are defined.
+		if len(desired[i].cidrs) == 0 {
+			desired[i].cidrs = []string{defaultAllowedCIDR}
+		}
 	}
 
-	p := lb.Firewall.NewListFirewallRulesParams()
-	p.SetIpaddressid(publicIPID)
-	p.SetListall(true)
-	if lb.projectID != "" {
-		p.SetProjectid(lb.projectID)
-	}
-	r, err := lb.Firewall.ListFirewallRules(p)
+	rules, err := lb.listICMPFirewallRules(publicIPID)
 	if err != nil {
-		return false, fmt.Errorf("error fetching firewall rules for public IP %v: %w", publicIPID, err)
-	}
-	klog.V(4).Infof("Existing firewall rules for %v: %v", lb.ipAddr, rulesToString(r.FirewallRules))
-
-	// find all rules that have a matching proto+port
-	// a map may or may not be faster, but is a bit easier to understand
-	filtered := make(map[*cloudstack.FirewallRule]bool)
-	for _, rule := range r.FirewallRules {
-		if rule.Protocol == protocol.IPProtocol() && rule.Startport == publicPort && rule.Endport == publicPort {
-			filtered[rule] = true
-		}
+		return false, err
 	}
-	klog.V(4).Infof("Matching rules for %v: %v", lb.ipAddr, rulesMapToString(filtered))
+	klog.V(4).Infof("Existing ICMP firewall rules for %v: %v", lb.ipAddr, rulesToString(rules))
 
-	// determine if we already have a rule with matching cidrs
-	var match *cloudstack.FirewallRule
-	for rule := range filtered {
-		cidrlist := strings.Split(rule.Cidrlist, ",")
-		if compareStringSlice(cidrlist, allowedCIDRs) {
+	matched := make([]bool, len(desired))
+	var obsolete []*cloudstack.FirewallRule
+	for _, rule := range rules {
+		i := slices.IndexFunc(desired, func(d icmpFirewallRule) bool {
+			return rule.Icmptype == d.icmpType && rule.Icmpcode == d.icmpCode && compareStringSlice(firewallRuleCIDRs(rule), d.cidrs)
+		})
+		if i >= 0 && !matched[i] {
 			klog.V(4).Infof("Found identical rule: %v", ruleToString(rule))
-			match = rule
+			matched[i] = true
 
-			break
+			continue
 		}
-	}
+		if !lb.ownsICMPFirewallRule(rule) {
+			klog.V(4).Infof("Keeping firewall rule %v, it was not created by us", ruleToString(rule))
 
-	if match != nil {
-		// no need to create a new rule - but prevent deletion of the matching rule
-		delete(filtered, match)
+			continue
+		}
+		obsolete = append(obsolete, rule)
 	}
 
-	// delete all other rules that didn't match the CIDR list
-	// do this first to prevent CS rule conflict errors
-	klog.V(4).Infof("Firewall rules to be deleted for %v: %v", lb.ipAddr, rulesMapToString(filtered))
+	// delete the rules that didn't match first to prevent CS rule conflict errors
 	var deleteErr error
-	for rule := range filtered {
+	for _, rule := range obsolete {
 		p := lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)
 		if _, err = lb.Firewall.DeleteFirewallRule(p); err != nil {
 			// report the error, but keep on deleting the other rules
 			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
 			deleteErr = err
+		} else {
+			lb.recordFirewallRuleChange(false, rule)
 		}
 	}
 
-	// create new rule if necessary
-	if match == nil {
-		// no rule found, create a new one
-		p := lb.Firewall.NewCreateFirewallRuleParams(publicIPID, protocol.IPProtocol())
-		p.SetCidrlist(allowedCIDRs)
-		p.SetStartport(publicPort)
-		p.SetEndport(publicPort)
-		if _, err = lb.Firewall.CreateFirewallRule(p); err != nil {
-			// return immediately if we can't create the new rule
-			return false, fmt.Errorf("error creating new firewall rule for public IP %v, proto %v, port %v, allowed %v: %w", publicIPID, protocol, publicPort, allowedCIDRs, err)
+	created := false
+	for i, d := range desired {
+		if matched[i] {
+			continue
+		}
+
+		p := lb.Firewall.NewCreateFirewallRuleParams(publicIPID, ProtoICMP)
+		p.SetCidrlist(d.cidrs)
+		p.SetIcmptype(d.icmpType)
+		p.SetIcmpcode(d.icmpCode)
+		r, err := lb.Firewall.CreateFirewallRule(p)
+		if err != nil {
+			return false, fmt.Errorf("error creating new ICMP firewall rule [%d,%d] for public IP %v, allowed %v: %w", d.icmpType, d.icmpCode, publicIPID, d.cidrs, err)
 		}
+		lb.recordFirewallRuleChange(true, &cloudstack.FirewallRule{
+			Id: r.Id, Protocol: ProtoICMP, Icmptype: d.icmpType, Icmpcode: d.icmpCode,
+			Cidrlist: strings.Join(d.cidrs, ","), Ipaddress: lb.ipAddr,
+		})
+		if err := lb.tagFirewallRule(r.Id, ProtoICMP); err != nil {
+			return false, err
+		}
+		created = true
 	}
 
-	changed := match == nil || len(filtered) > 0
+	changed := created || len(obsolete) > 0
 
 	return changed, deleteErr
 }
 
-// deleteFirewallRule deletes the firewall rule associated with the ip:port:protocol combo
+// deleteICMPFirewallRules deletes the ICMP firewall rules of the load balancer on the public IP, see
+// ownsICMPFirewallRule.
 //
 // returns true when corresponding rules were deleted.
-func (lb *loadBalancer) deleteFirewallRule(publicIPID string, publicPort int, protocol LoadBalancerProtocol) (bool, error) { //nolint:unparam
-	p := lb.Firewall.NewListFirewallRulesParams()
-	p.SetIpaddressid(publicIPID)
-	p.SetListall(true)
-	if lb.projectID != "" {
-		p.SetProjectid(lb.projectID)
-	}
-	r, err := lb.Firewall.ListFirewallRules(p)
+func (lb *loadBalancer) deleteICMPFirewallRules(publicIPID string) (bool, error) {
+	rules, err := lb.listICMPFirewallRules(publicIPID)
 	if err != nil {
-		return false, fmt.Errorf("error fetching firewall rules for public IP %v: %w", publicIPID, err)
-	}
-
-	// filter by proto:port
-	filtered := make([]*cloudstack.FirewallRule, 0, 1)
-	for _, rule := range r.FirewallRules {
-		if rule.Protocol == protocol.IPProtocol() && rule.Startport == publicPort && rule.Endport == publicPort {
-			filtered = append(filtered, rule)
-		}
+		return false, err
 	}
 
-	// delete all rules
 	var errs error
 	deleted := false
-	for _, rule := range filtered {
+	for _, rule := range rules {
+		if !lb.ownsICMPFirewallRule(rule) {
+			continue
+		}
 		p := lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)
-		_, err = lb.Firewall.DeleteFirewallRule(p)
-		if err != nil {
+		if _, err := lb.Firewall.DeleteFirewallRule(p); err != nil {
 			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
 			errs = errors.Join(errs, fmt.Errorf("error deleting old firewall rule %v: %w", rule.Id, err))
 		} else {
+			lb.recordFirewallRuleChange(false, rule)
 			deleted = true
 		}
 	}
@@ -1340,16 +4956,33 @@ func (lb *loadBalancer) deleteFirewallRule(publicIPID string, publicPort int, pr
 	return deleted, errs
 }
 
+// getICMPSourceRanges returns the CIDRs allowed to send ICMP to the load balancer, taken from the
+// ServiceAnnotationLoadBalancerICMPSourceRanges annotation or else the source ranges of the service.
+func getICMPSourceRanges(service *corev1.Service) (utilnet.IPNetSet, error) {
+	val := strings.TrimSpace(getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerICMPSourceRanges, ""))
+	if val == "" {
+		return getLoadBalancerSourceRanges(service, nil)
+	}
+
+	ipnets, err := parseSourceRanges(strings.Split(val, ","))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s is not valid. Expecting a comma-separated list of source IP ranges. For example, 10.0.0.0/24,192.168.2.0/24. Error msg: %w", ServiceAnnotationLoadBalancerICMPSourceRanges, val, err)
+	}
+
+	return ipnets, nil
+}
+
 // getLoadBalancerSourceRanges first tries to parse and verify loadBalancerSourceRanges field from a Service object.
 // If the field is not specified in the Service, try to parse and verify the AnnotationLoadBalancerSourceRangesKey annotation from a service,
-// extracting the source ranges to allow. If the annotation is not present either, return a default (allow-all) value.
-func getLoadBalancerSourceRanges(service *corev1.Service) (utilnet.IPNetSet, error) {
+// extracting the source ranges to allow. If the annotation is not present either, return defaultRanges, or a
+// default (allow-all) value when those are empty.
+func getLoadBalancerSourceRanges(service *corev1.Service, defaultRanges []string) (utilnet.IPNetSet, error) {
 	var ipnets utilnet.IPNetSet
 	var err error
 	// if SourceRange field is specified, ignore sourceRange annotation
 	if len(service.Spec.LoadBalancerSourceRanges) > 0 {
 		specs := service.Spec.LoadBalancerSourceRanges
-		ipnets, err = utilnet.ParseIPNets(specs...)
+		ipnets, err = parseSourceRanges(specs)
 		if err != nil {
 			return nil, fmt.Errorf("service.Spec.LoadBalancerSourceRanges: %v is not valid. Expecting a list of IP ranges. For example, 10.0.0.0/24. Error msg: %w", specs, err)
 		}
@@ -1357,12 +4990,32 @@ func getLoadBalancerSourceRanges(service *corev1.Service) (utilnet.IPNetSet, err
 		val := service.Annotations[corev1.AnnotationLoadBalancerSourceRangesKey]
 		val = strings.TrimSpace(val)
 		if val == "" {
+			if len(defaultRanges) > 0 {
+				return parseSourceRanges(defaultRanges)
+			}
 			val = defaultAllowedCIDR
 		}
 		specs := strings.Split(val, ",")
-		ipnets, err = utilnet.ParseIPNets(specs...)
+		ipnets, err = parseSourceRanges(specs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is not valid. Expecting a comma-separated list of source IP ranges. For example, 10.0.0.0/24,192.168.2.0/24. Error msg: %w", corev1.AnnotationLoadBalancerSourceRangesKey, val, err)
+		}
+	}
+
+	return ipnets, nil
+}
+
+// parseSourceRanges parses the CIDRs one by one, so that an error names the exact entry
+// (and its 1-based position in the list) that is malformed.
+func parseSourceRanges(specs []string) (utilnet.IPNetSet, error) {
+	ipnets := make(utilnet.IPNetSet, len(specs))
+	for i, spec := range specs {
+		ipnet, err := utilnet.ParseIPNets(spec)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %s is not valid. Expecting a comma-separated list of source IP ranges. For example, 10.0.0.0/24,192.168.2.0/24", corev1.AnnotationLoadBalancerSourceRangesKey, val)
+			return nil, fmt.Errorf("entry %d (%q) is not a valid CIDR: %w", i+1, strings.TrimSpace(spec), err)
+		}
+		for k, v := range ipnet {
+			ipnets[k] = v
 		}
 	}
 
@@ -1435,6 +5088,27 @@ func getLoadBalancerNetworkID(service *corev1.Service) string {
 	return getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerNetworkID, "")
 }
 
+// withAnnotationDefaults returns the service with the cloud-config annotation defaults merged in
+// underneath its own annotations. The given service is never modified, so the defaults are not
+// persisted by the service patcher.
+func (cs *CSCloud) withAnnotationDefaults(service *corev1.Service) *corev1.Service {
+	if len(cs.annotationDefaults) == 0 {
+		return service
+	}
+
+	annotated := service.DeepCopy()
+	if annotated.Annotations == nil {
+		annotated.Annotations = make(map[string]string, len(cs.annotationDefaults))
+	}
+	for key, value := range cs.annotationDefaults {
+		if _, ok := annotated.Annotations[key]; !ok {
+			annotated.Annotations[key] = value
+		}
+	}
+
+	return annotated
+}
+
 // setServiceAnnotation is used to create/set or update an annotation on the Service object.
 func setServiceAnnotation(service *corev1.Service, key, value string) {
 	if service.Annotations == nil {
@@ -1451,12 +5125,45 @@ func deleteServiceAnnotation(service *corev1.Service, key string) {
 	delete(service.Annotations, key)
 }
 
+// annotateZone records the zone of the load balancer on the service when the zone-annotation option is enabled.
+// The annotation is left untouched when the zone is unknown, and removed when the option is disabled.
+func (cs *CSCloud) annotateZone(service *corev1.Service, zone string) {
+	if !cs.zoneAnnotation {
+		deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerZone)
+
+		return
+	}
+
+	if zone != "" {
+		setServiceAnnotation(service, ServiceAnnotationLoadBalancerZone, zone)
+	}
+}
+
+// managedServiceAnnotations are the annotations that only the provider sets, marked "(Managed)" in the docs.
+var managedServiceAnnotations = []string{
+	ServiceAnnotationLoadBalancerID,
+	ServiceAnnotationLoadBalancerNetworkID,
+	ServiceAnnotationLoadBalancerZone,
+	ServiceAnnotationLoadBalancerForceRecreateProcessed,
+	ServiceAnnotationLoadBalancerStaticNATVirtualMachineID,
+	ServiceAnnotationLoadBalancerRuleIDs,
+	ServiceAnnotationLoadBalancerLastError,
+	ServiceAnnotationLoadBalancerLastErrorTime,
+}
+
 // deleteLoadBalancerAnnotations removes all CloudStack load balancer annotations from the service.
 func deleteLoadBalancerAnnotations(service *corev1.Service) {
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerProxyProtocol)
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerIPMode)
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress)
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerKeepIP)
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerID)
 	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerNetworkID)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerZone)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerForceRecreateProcessed)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNATVirtualMachineID)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerRuleIDs)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerLastError)
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerLastErrorTime)
 }
@@ -20,17 +20,38 @@
 package cloudstack
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"github.com/google/go-cmp/cmp"
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	cloudprovider "k8s.io/cloud-provider"
+	cloudproviderapi "k8s.io/cloud-provider/api"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/ptr"
 )
 
 func TestCompareStringSlice(t *testing.T) {
@@ -497,6 +518,328 @@ func TestCheckLoadBalancerRule(t *testing.T) {
 			t.Fatalf("expected rule entry to be removed from map")
 		}
 	})
+
+	t.Run("recreate within the cooldown is deferred", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		cooldown := newRuleRecreateCooldown(5 * time.Minute)
+		now := time.Now()
+		cooldown.now = func() time.Time { return now }
+
+		// Only the first and the third recreate delete the rule.
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-id").Return(&cloudstack.DeleteLoadBalancerRuleParams{}).Times(2)
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil).Times(2)
+
+		oldRule := &cloudstack.LoadBalancerRule{
+			Id:          "rule-id",
+			Name:        "rule",
+			Publicip:    "1.1.1.1",
+			Privateport: "30000",
+			Publicport:  "8080",
+			Algorithm:   "roundrobin",
+			Protocol:    LoadBalancerProtocolTCP.CSProtocol(),
+		}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			ipAddr:           "1.1.1.1",
+			recreateCooldown: cooldown,
+			rules:            map[string]*cloudstack.LoadBalancerRule{"rule": oldRule},
+		}
+		port := corev1.ServicePort{Port: 80, NodePort: 30000, Protocol: corev1.ProtocolTCP}
+
+		if rule, _, err := lb.checkLoadBalancerRule("rule", port, LoadBalancerProtocolTCP); err != nil || rule != nil {
+			t.Fatalf("rule = %v, err = %v, want the rule to be deleted", rule, err)
+		}
+
+		// The spec flaps back a minute later, so the recreated rule does not match again.
+		now = now.Add(time.Minute)
+		lb.rules["rule"] = oldRule
+		rule, needsUpdate, err := lb.checkLoadBalancerRule("rule", port, LoadBalancerProtocolTCP)
+		if !errors.Is(err, errRuleRecreateDeferred) {
+			t.Fatalf("err = %v, want errRuleRecreateDeferred", err)
+		}
+		if rule != oldRule || needsUpdate {
+			t.Errorf("rule = %v, needsUpdate = %v, want the old rule to be kept", rule, needsUpdate)
+		}
+		if _, exists := lb.rules["rule"]; !exists {
+			t.Errorf("expected the deferred rule to stay in the map")
+		}
+
+		// The cooldown follows the port, so it still applies after the rule was renamed.
+		delete(lb.rules, "rule")
+		lb.rules["renamed"] = oldRule
+		if _, _, err := lb.checkLoadBalancerRule("renamed", port, LoadBalancerProtocolTCP); !errors.Is(err, errRuleRecreateDeferred) {
+			t.Fatalf("err = %v after the rename, want errRuleRecreateDeferred", err)
+		}
+		delete(lb.rules, "renamed")
+		lb.rules["rule"] = oldRule
+
+		// Once the cooldown passed, the rule is recreated again.
+		now = now.Add(4 * time.Minute)
+		if rule, _, err := lb.checkLoadBalancerRule("rule", port, LoadBalancerProtocolTCP); err != nil || rule != nil {
+			t.Fatalf("rule = %v, err = %v, want the rule to be deleted after the cooldown", rule, err)
+		}
+	})
+
+	t.Run("rule with a changed node port is not deferred", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		cooldown := newRuleRecreateCooldown(5 * time.Minute)
+
+		// The old node port is no longer served, so the rule is recreated even within the cooldown.
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-id").Return(&cloudstack.DeleteLoadBalancerRuleParams{}).Times(2)
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil).Times(2)
+
+		oldRule := &cloudstack.LoadBalancerRule{
+			Id:          "rule-id",
+			Name:        "rule",
+			Publicip:    "1.1.1.1",
+			Privateport: "30000",
+			Publicport:  "80",
+			Algorithm:   "roundrobin",
+			Protocol:    LoadBalancerProtocolTCP.CSProtocol(),
+		}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			ipAddr:           "1.1.1.1",
+			recreateCooldown: cooldown,
+			rules:            map[string]*cloudstack.LoadBalancerRule{"rule": oldRule},
+		}
+		port := corev1.ServicePort{Port: 80, NodePort: 30001, Protocol: corev1.ProtocolTCP}
+
+		for range 2 {
+			lb.rules["rule"] = oldRule
+			if rule, _, err := lb.checkLoadBalancerRule("rule", port, LoadBalancerProtocolTCP); err != nil || rule != nil {
+				t.Fatalf("rule = %v, err = %v, want the rule to be deleted", rule, err)
+			}
+		}
+	})
+
+	t.Run("service port backend compares the service port", func(t *testing.T) {
+		lb := &loadBalancer{
+			ipAddr:      "1.1.1.1",
+			algorithm:   "roundrobin",
+			backendPort: backendPortServicePort,
+			rules: map[string]*cloudstack.LoadBalancerRule{
+				"rule": {
+					Id:          "rule-id",
+					Name:        "rule",
+					Publicip:    "1.1.1.1",
+					Privateport: "80",
+					Publicport:  "80",
+					Algorithm:   "roundrobin",
+					Protocol:    LoadBalancerProtocolTCP.CSProtocol(),
+				},
+			},
+		}
+		port := corev1.ServicePort{Port: 80, NodePort: 30000, Protocol: corev1.ProtocolTCP}
+
+		rule, needsUpdate, err := lb.checkLoadBalancerRule("rule", port, LoadBalancerProtocolTCP)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rule == nil || needsUpdate {
+			t.Fatalf("rule = %v, needsUpdate = %v, want the rule to be up-to-date", rule, needsUpdate)
+		}
+	})
+}
+
+func TestRenameLoadBalancerRules(t *testing.T) {
+	const (
+		name        = "K8s_svc_c_ns_foo_1a2b3c4d"
+		defaultName = "K8s_svc_c_ns_foo"
+		legacyName  = "a1b2c3d4"
+	)
+
+	t.Run("renames rules of older naming schemes in place", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		renamed := map[string]string{}
+		mockLB.EXPECT().NewUpdateLoadBalancerRuleParams(gomock.Any()).DoAndReturn(func(id string) *cloudstack.UpdateLoadBalancerRuleParams {
+			p := &cloudstack.UpdateLoadBalancerRuleParams{}
+			p.SetId(id)
+
+			return p
+		}).Times(2)
+		mockLB.EXPECT().UpdateLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.UpdateLoadBalancerRuleParams) (*cloudstack.UpdateLoadBalancerRuleResponse, error) {
+			id, _ := p.GetId()
+			newName, _ := p.GetName()
+			renamed[id] = newName
+
+			return &cloudstack.UpdateLoadBalancerRuleResponse{}, nil
+		}).Times(2)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             defaultName,
+			rules: map[string]*cloudstack.LoadBalancerRule{
+				name + "-tcp-80":         {Id: "rule-1", Name: name + "-tcp-80"},
+				defaultName + "-tcp-443": {Id: "rule-2", Name: defaultName + "-tcp-443"},
+				legacyName + "-udp-53":   {Id: "rule-3", Name: legacyName + "-udp-53"},
+			},
+		}
+
+		if err := lb.renameLoadBalancerRules(name, []string{defaultName, legacyName}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := map[string]string{"rule-2": name + "-tcp-443", "rule-3": name + "-udp-53"}
+		if !maps.Equal(renamed, want) {
+			t.Errorf("renamed = %v, want %v", renamed, want)
+		}
+		if lb.name != name {
+			t.Errorf("lb.name = %q, want %q", lb.name, name)
+		}
+		for _, ruleName := range []string{name + "-tcp-80", name + "-tcp-443", name + "-udp-53"} {
+			if lbRule, ok := lb.rules[ruleName]; !ok || lbRule.Name != ruleName {
+				t.Errorf("rule %q missing or misnamed: %v", ruleName, lbRule)
+			}
+		}
+		if len(lb.rules) != 3 {
+			t.Errorf("lb.rules has %d entries, want 3", len(lb.rules))
+		}
+	})
+
+	t.Run("failed rename keeps the old name", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-1").Return(&cloudstack.UpdateLoadBalancerRuleParams{})
+		mockLB.EXPECT().UpdateLoadBalancerRule(gomock.Any()).Return(nil, errors.New("API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             defaultName,
+			rules: map[string]*cloudstack.LoadBalancerRule{
+				defaultName + "-tcp-80": {Id: "rule-1", Name: defaultName + "-tcp-80"},
+			},
+		}
+
+		if err := lb.renameLoadBalancerRules(name, []string{defaultName}); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if _, ok := lb.rules[defaultName+"-tcp-80"]; !ok || lb.name != defaultName {
+			t.Errorf("rules = %v, name = %q, want the rule under its old name", lb.rules, lb.name)
+		}
+	})
+
+	t.Run("old rule of a port with a renamed rule is left for deletion", func(t *testing.T) {
+		lb := &loadBalancer{
+			name: defaultName,
+			rules: map[string]*cloudstack.LoadBalancerRule{
+				name + "-tcp-80":        {Id: "rule-1", Name: name + "-tcp-80"},
+				defaultName + "-tcp-80": {Id: "rule-2", Name: defaultName + "-tcp-80"},
+			},
+		}
+
+		if err := lb.renameLoadBalancerRules(name, []string{defaultName}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lbRule := lb.rules[name+"-tcp-80"]; lbRule == nil || lbRule.Id != "rule-1" {
+			t.Errorf("rule %q = %v, want rule-1", name+"-tcp-80", lbRule)
+		}
+		if _, ok := lb.rules[defaultName+"-tcp-80"]; !ok {
+			t.Errorf("rule %q was dropped, want it kept under its old name", defaultName+"-tcp-80")
+		}
+	})
+
+	t.Run("no calls when the names match", func(t *testing.T) {
+		lb := &loadBalancer{
+			name: name,
+			rules: map[string]*cloudstack.LoadBalancerRule{
+				name + "-tcp-80": {Id: "rule-1", Name: name + "-tcp-80"},
+			},
+		}
+
+		if err := lb.renameLoadBalancerRules(name, []string{defaultName, legacyName}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestGetLoadBalancerByIDInterruptedRename(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+		Count: 2,
+		LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+			{Name: "lb.c.ns.foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			{Name: "K8s_svc_c_ns_foo-tcp-443", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+		},
+	}, nil)
+
+	cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+
+	lb, err := cs.getLoadBalancerByID(t.Context(), "c", nil, "lb.c.ns.foo", "ip-1", "", "K8s_svc_c_ns_foo", "a1b2c3d4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lb.name != "lb.c.ns.foo" {
+		t.Errorf("lb.name = %q, want %q", lb.name, "lb.c.ns.foo")
+	}
+	if len(lb.rules) != 2 {
+		t.Errorf("found %d rules, want both the renamed and the not yet renamed rule", len(lb.rules))
+	}
+}
+
+func TestGetLoadBalancerByServiceTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	tags := func(name string) []cloudstack.Tags {
+		return []cloudstack.Tags{
+			{Key: serviceClusterTagKey, Value: "c"}, {Key: serviceNamespaceTagKey, Value: "ns"}, {Key: serviceNameTagKey, Value: name},
+		}
+	}
+
+	// The rules were named by an earlier custom scheme, so neither the name nor the fallback name finds them.
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	tagParams := &cloudstack.ListLoadBalancerRulesParams{}
+	gomock.InOrder(
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(tagParams),
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil).Times(2),
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 3,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Id: "rule-1", Name: "old.c.ns.foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1", Tags: tags("foo")},
+				{Id: "rule-2", Name: "old.c.ns.foo-tcp-8080", Publicip: "1.2.3.4", Publicipid: "ip-1", Tags: tags("foo")},
+				{Id: "rule-3", Name: "old.c.ns.bar-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2", Tags: tags("bar")},
+			},
+		}, nil),
+	)
+
+	cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+	foo := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+	}
+
+	lb, err := cs.getLoadBalancerByName(t.Context(), "c", foo, "new.c.ns.foo", "K8s_svc_c_ns_foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := tagParams.GetTags(); !maps.Equal(got, newServiceTags("c", foo)) {
+		t.Errorf("listed rules by tags %v, want the service tags", got)
+	}
+	if got := slices.Sorted(maps.Keys(lb.rules)); !slices.Equal(got, []string{"old.c.ns.foo-tcp-80"}) {
+		t.Errorf("rules = %v, want only the rule of the port of foo", got)
+	}
+	if lb.name != "old.c.ns.foo" || lb.ipAddrID != "ip-1" {
+		t.Errorf("lb.name = %q, lb.ipAddrID = %q, want the name and IP of the tagged rule", lb.name, lb.ipAddrID)
+	}
+	if got := lb.ruleLoadBalancerNames(foo.Spec.Ports); !slices.Equal(got, []string{"old.c.ns.foo"}) {
+		t.Errorf("ruleLoadBalancerNames() = %v, want the old name to rename the rule from", got)
+	}
 }
 
 func TestRuleToString(t *testing.T) {
@@ -802,6 +1145,9 @@ func TestGetPublicIPAddress(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		listParams := &cloudstack.ListPublicIpAddressesParams{}
 		resp := &cloudstack.ListPublicIpAddressesResponse{
 			Count: 1,
@@ -836,8 +1182,10 @@ func TestGetPublicIPAddress(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 			ipAddr:    "203.0.113.1",
@@ -997,6 +1345,9 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		networkResp := &cloudstack.Network{
 			Id:      "net-123",
 			Vpcid:   "",
@@ -1017,8 +1368,10 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 		}
@@ -1041,6 +1394,9 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		networkResp := &cloudstack.Network{
 			Id:      "net-123",
 			Vpcid:   "vpc-456",
@@ -1061,8 +1417,10 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 		}
@@ -1172,6 +1530,9 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		networkResp := &cloudstack.Network{
 			Id:      "net-123",
 			Vpcid:   "",
@@ -1192,8 +1553,10 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 			projectID: "proj-123",
@@ -1206,72 +1569,607 @@ func TestAssociatePublicIPAddress(t *testing.T) {
 	})
 }
 
-func TestReleaseLoadBalancerIP(t *testing.T) {
-	t.Run("successful release", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
-
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		disassociateParams := &cloudstack.DisassociateIpAddressParams{}
+func TestCheckPublicIPCapacity(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int64
+		allocated int
+		reserve   int
+		wantErr   string
+	}{
+		{name: "unlimited", limit: -1},
+		{name: "below the limit", limit: 5, allocated: 3},
+		{name: "limit reached", limit: 5, allocated: 5, wantErr: "limit of 5, 5 are in use"},
+		{name: "above the reserve", limit: 5, allocated: 2, reserve: 2},
+		{name: "reserve reached", limit: 5, allocated: 3, reserve: 2, wantErr: "is paused, 2 of the public IP limit of 5 are left and 2 are reserved"},
+	}
 
-		gomock.InOrder(
-			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-123").Return(disassociateParams),
-			mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
-		)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLimit := cloudstack.NewMockLimitServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+			limitParams := &cloudstack.ListResourceLimitsParams{}
+			mockLimit.EXPECT().NewListResourceLimitsParams().Return(limitParams)
+			mockLimit.EXPECT().ListResourceLimits(limitParams).Return(&cloudstack.ListResourceLimitsResponse{
+				Count:          1,
+				ResourceLimits: []*cloudstack.ResourceLimit{{Resourcetype: "1", Max: tt.limit, Projectid: "proj-1"}},
+			}, nil)
+			if tt.limit >= 0 {
+				mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+				mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{Count: tt.allocated}, nil)
+			}
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-			},
-			ipAddrID: "ip-123",
-			ipAddr:   "203.0.113.1",
-		}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Limit: mockLimit, Address: mockAddress},
+				name:             "test-lb",
+				projectID:        "proj-1",
+				capacityReserve:  tt.reserve,
+			}
 
-		err := lb.releaseLoadBalancerIP()
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-	})
+			err := lb.checkPublicIPCapacity()
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				if !errors.Is(err, errInsufficientCapacity) {
+					t.Errorf("error = %v, want it to wrap errInsufficientCapacity", err)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %q, want it to contain %q", err.Error(), tt.wantErr)
+				}
+			}
+			if tt.limit >= 0 {
+				headroom, err := testutil.GetGaugeMetricValue(publicIPHeadroom.WithLabelValues("proj-1"))
+				if err != nil {
+					t.Fatalf("failed to read gauge: %v", err)
+				}
+				if want := float64(tt.limit) - float64(tt.allocated); headroom != want {
+					t.Errorf("headroom = %v, want %v", headroom, want)
+				}
+			}
+			if resourceType, _ := limitParams.GetResourcetype(); resourceType != publicIPResourceType {
+				t.Errorf("resource type = %d, want %d", resourceType, publicIPResourceType)
+			}
+		})
+	}
 
-	t.Run("error releasing IP", func(t *testing.T) {
+	t.Run("no IP is associated when the limit is reached", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
+		mockLimit := cloudstack.NewMockLimitServiceIface(ctrl)
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		disassociateParams := &cloudstack.DisassociateIpAddressParams{}
-		apiErr := errors.New("disassociate API error")
-
-		gomock.InOrder(
-			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-123").Return(disassociateParams),
-			mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(nil, apiErr),
-		)
+		mockLimit.EXPECT().NewListResourceLimitsParams().Return(&cloudstack.ListResourceLimitsParams{})
+		mockLimit.EXPECT().ListResourceLimits(gomock.Any()).Return(&cloudstack.ListResourceLimitsResponse{
+			Count:          1,
+			ResourceLimits: []*cloudstack.ResourceLimit{{Resourcetype: "1", Max: 1}},
+		}, nil)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{Count: 1}, nil)
 
 		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-			},
-			ipAddrID: "ip-123",
-			ipAddr:   "203.0.113.1",
+			CloudStackClient: &cloudstack.CloudStackClient{Limit: mockLimit, Address: mockAddress},
+			name:             "test-lb",
+			checkCapacity:    true,
 		}
 
-		err := lb.releaseLoadBalancerIP()
-		if err == nil {
-			t.Fatalf("expected error")
-		}
-		if !strings.Contains(err.Error(), "error releasing load balancer IP") {
-			t.Errorf("error message = %q, want to contain 'error releasing load balancer IP'", err.Error())
+		if err := lb.associatePublicIPAddress(); !errors.Is(err, errInsufficientCapacity) {
+			t.Fatalf("error = %v, want errInsufficientCapacity", err)
 		}
 	})
 }
 
-func TestGetLoadBalancerIP(t *testing.T) {
-	t.Run("IP specified - retrieve existing", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
+func TestCheckPublicIPNetwork(t *testing.T) {
+	tests := []struct {
+		name        string
+		ip          *cloudstack.PublicIpAddress
+		nodeVPCID   string
+		wantErr     bool
+		wantNetwork bool
+	}{
+		{
+			name: "IP in the nodes network",
+			ip:   &cloudstack.PublicIpAddress{Ipaddress: "203.0.113.1", Associatednetworkid: "net-1"},
+		},
+		{
+			name: "IP not associated with a network",
+			ip:   &cloudstack.PublicIpAddress{Ipaddress: "203.0.113.1"},
+		},
+		{
+			name:    "IP in another network",
+			ip:      &cloudstack.PublicIpAddress{Ipaddress: "203.0.113.1", Associatednetworkid: "net-2"},
+			wantErr: true,
+		},
+		{
+			name:        "IP in the VPC of the nodes",
+			ip:          &cloudstack.PublicIpAddress{Ipaddress: "203.0.113.1", Vpcid: "vpc-1"},
+			nodeVPCID:   "vpc-1",
+			wantNetwork: true,
+		},
+		{
+			name:        "IP in another VPC",
+			ip:          &cloudstack.PublicIpAddress{Ipaddress: "203.0.113.1", Vpcid: "vpc-2"},
+			nodeVPCID:   "vpc-1",
+			wantErr:     true,
+			wantNetwork: true,
+		},
+	}
 
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		listParams := &cloudstack.ListPublicIpAddressesParams{}
-		resp := &cloudstack.ListPublicIpAddressesResponse{
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			if tt.wantNetwork {
+				mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+					Id: "net-1", Name: "nodes", Vpcid: tt.nodeVPCID,
+				}, 1, nil)
+			}
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Network: mockNetwork},
+				networkID:        "net-1",
+			}
+
+			err := lb.checkPublicIPNetwork(tt.ip)
+			if tt.wantErr {
+				if !errors.Is(err, errIPNetworkMismatch) {
+					t.Fatalf("err = %v, want errIPNetworkMismatch", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAssociatePublicIPAddressStaleRules(t *testing.T) {
+	serviceTags := map[string]string{
+		serviceClusterTagKey:   "cluster",
+		serviceNamespaceTagKey: "default",
+		serviceNameTagKey:      "foo",
+	}
+	tags := func(name string) []cloudstack.Tags {
+		return []cloudstack.Tags{
+			{Key: serviceClusterTagKey, Value: "cluster"},
+			{Key: serviceNamespaceTagKey, Value: "default"},
+			{Key: serviceNameTagKey, Value: name},
+		}
+	}
+	listErr := errors.New("list API error")
+
+	tests := []struct {
+		name          string
+		lbRules       []*cloudstack.LoadBalancerRule
+		firewallRules []*cloudstack.FirewallRule
+		// listErr fails listing the firewall rules of the IP, which is then released, failing with releaseErr.
+		listErr    error
+		releaseErr error
+		// deletedRules and deletedFirewallRules are the IDs of the rules that are deleted as stale.
+		deletedRules         []string
+		deletedFirewallRules []string
+		wantErr              error
+		// wantIP is the IP left in lb.ipAddr when wantErr is set.
+		wantIP string
+	}{
+		{name: "IP without rules"},
+		{
+			name:                 "stale rules of the service are deleted",
+			lbRules:              []*cloudstack.LoadBalancerRule{{Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80"}},
+			firewallRules:        []*cloudstack.FirewallRule{{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Tags: tags("foo")}},
+			deletedRules:         []string{"rule-1"},
+			deletedFirewallRules: []string{"fw-1"},
+		},
+		{
+			name:          "untagged firewall rules are left to the reconcile",
+			firewallRules: []*cloudstack.FirewallRule{{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80}},
+		},
+		{
+			name:    "load balancer rule of another service",
+			lbRules: []*cloudstack.LoadBalancerRule{{Id: "rule-1", Name: "K8s_svc_cluster_default_bar-tcp-80"}},
+			wantErr: errNewIPInUse,
+		},
+		{
+			name:    "load balancer rule of a service named foo-tcp",
+			lbRules: []*cloudstack.LoadBalancerRule{{Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-tcp-80"}},
+			wantErr: errNewIPInUse,
+		},
+		{
+			name:          "firewall rule of another service",
+			lbRules:       []*cloudstack.LoadBalancerRule{{Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80"}},
+			firewallRules: []*cloudstack.FirewallRule{{Id: "fw-1", Protocol: "tcp", Startport: 443, Endport: 443, Tags: tags("bar")}},
+			wantErr:       errNewIPInUse,
+		},
+		{
+			name:    "IP is released when its rules cannot be listed",
+			listErr: listErr,
+			wantErr: listErr,
+		},
+		{
+			name:       "IP is kept when it cannot be released",
+			listErr:    listErr,
+			releaseErr: errors.New("release API error"),
+			wantErr:    listErr,
+			wantIP:     "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+			mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+			mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+			mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+				Id: "ip-1", Ipaddress: "10.0.0.1",
+			}, nil)
+
+			listParams := &cloudstack.ListLoadBalancerRulesParams{}
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams)
+			mockLB.EXPECT().ListLoadBalancerRules(listParams).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: len(tt.lbRules), LoadBalancerRules: tt.lbRules,
+			}, nil)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: len(tt.firewallRules), FirewallRules: tt.firewallRules,
+			}, tt.listErr)
+			for _, id := range tt.deletedRules {
+				mockLB.EXPECT().NewDeleteLoadBalancerRuleParams(id).Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+				mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+			}
+			for _, id := range tt.deletedFirewallRules {
+				mockFirewall.EXPECT().NewDeleteFirewallRuleParams(id).Return(&cloudstack.DeleteFirewallRuleParams{})
+				mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+			}
+			// The IP is tagged before it is checked, an IP in use by another service is untagged again.
+			mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, "PublicIpAddress", serviceTags).Return(&cloudstack.CreateTagsParams{})
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil)
+			if errors.Is(tt.wantErr, errNewIPInUse) {
+				mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, "PublicIpAddress").Return(&cloudstack.DeleteTagsParams{})
+				mockTags.EXPECT().DeleteTags(gomock.Any()).Return(&cloudstack.DeleteTagsResponse{}, nil)
+			}
+			if tt.listErr != nil {
+				mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+				mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, tt.releaseErr)
+			}
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{
+					LoadBalancer: mockLB, Address: mockAddress, Network: mockNetwork, Firewall: mockFirewall, Resourcetags: mockTags,
+				},
+				name:        "K8s_svc_cluster_default_foo",
+				clusterName: "cluster",
+				networkID:   "net-1",
+				serviceTags: serviceTags,
+			}
+
+			err := lb.associatePublicIPAddress()
+			if tt.wantErr != nil && !errors.Is(err, errNewIPCheckFailed) {
+				t.Fatalf("associatePublicIPAddress() error = %v, want errNewIPCheckFailed", err)
+			}
+			if errors.Is(err, errNewIPCheckFailed) {
+				err = lb.discardNewIP(err, lb.releaseLoadBalancerIP)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("associatePublicIPAddress() error = %v, want %v", err, tt.wantErr)
+			}
+			if id, _ := listParams.GetPublicipid(); id != "ip-1" {
+				t.Errorf("listed the rules of IP %q, want %q", id, "ip-1")
+			}
+
+			wantIP := "10.0.0.1"
+			if tt.wantErr != nil {
+				wantIP = tt.wantIP
+			}
+			if lb.ipAddr != wantIP {
+				t.Errorf("ipAddr = %q, want %q", lb.ipAddr, wantIP)
+			}
+		})
+	}
+}
+
+func TestTagPublicIPAddress(t *testing.T) {
+	wantTags := map[string]string{
+		serviceClusterTagKey:   "cluster",
+		serviceNamespaceTagKey: "default",
+		serviceNameTagKey:      "foo",
+	}
+
+	t.Run("allocated IP is tagged with the service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-1", Ipaddress: "10.0.0.1",
+		}, nil)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, "PublicIpAddress", wantTags).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Network: mockNetwork, Firewall: mockFirewall, Resourcetags: mockTags},
+			networkID:        "net-1",
+			serviceTags:      wantTags,
+		}
+
+		if err := lb.associatePublicIPAddress(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("tagging failure does not fail the allocation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-1", Ipaddress: "10.0.0.1",
+		}, nil)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(nil, errors.New("tags API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Network: mockNetwork, Firewall: mockFirewall, Resourcetags: mockTags},
+			networkID:        "net-1",
+			serviceTags:      wantTags,
+		}
+
+		if err := lb.associatePublicIPAddress(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lb.ipAddrID != "ip-1" {
+			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-1")
+		}
+	})
+}
+
+func TestReleaseLoadBalancerIP(t *testing.T) {
+	t.Run("successful release", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		disassociateParams := &cloudstack.DisassociateIpAddressParams{}
+
+		gomock.InOrder(
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-123").Return(disassociateParams),
+			mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+			ipAddrID: "ip-123",
+			ipAddr:   "203.0.113.1",
+		}
+
+		err := lb.releaseLoadBalancerIP()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("error releasing IP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		disassociateParams := &cloudstack.DisassociateIpAddressParams{}
+		apiErr := errors.New("disassociate API error")
+
+		gomock.InOrder(
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-123").Return(disassociateParams),
+			mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(nil, apiErr),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+			ipAddrID: "ip-123",
+			ipAddr:   "203.0.113.1",
+		}
+
+		err := lb.releaseLoadBalancerIP()
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "error releasing load balancer IP") {
+			t.Errorf("error message = %q, want to contain 'error releasing load balancer IP'", err.Error())
+		}
+	})
+}
+
+// setupFastIPReleaseBackoff shortens the delay between IP release attempts for the duration of the test.
+func setupFastIPReleaseBackoff(t *testing.T) {
+	t.Helper()
+
+	backoff := ipReleaseBackoff
+	ipReleaseBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Jitter: 0.5, Steps: backoff.Steps}
+	t.Cleanup(func() { ipReleaseBackoff = backoff })
+}
+
+func TestReleaseLoadBalancerIPWithRetry(t *testing.T) {
+	t.Run("transient failure is retried", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		setupFastIPReleaseBackoff(t)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		gomock.InOrder(
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}),
+			mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(nil, &url.Error{Op: "Post", URL: "https://cloudstack/client/api", Err: errors.New("connection reset by peer")}),
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}),
+			mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+		}
+
+		if err := lb.releaseLoadBalancerIPWithRetry(t.Context()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("permanent failure is not retried", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		setupFastIPReleaseBackoff(t)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).
+			Return(nil, errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): release failed"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+		}
+
+		if err := lb.releaseLoadBalancerIPWithRetry(t.Context()); err == nil || !strings.Contains(err.Error(), "release failed") {
+			t.Fatalf("error = %v, want release failed", err)
+		}
+	})
+
+	t.Run("transient failures are retried until the attempts are used up", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		setupFastIPReleaseBackoff(t)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}).Times(ipReleaseBackoff.Steps)
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).
+			Return(nil, errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4250): resource unavailable")).Times(ipReleaseBackoff.Steps)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+		}
+
+		err := lb.releaseLoadBalancerIPWithRetry(t.Context())
+		if err == nil || !strings.Contains(err.Error(), "resource unavailable") {
+			t.Fatalf("error = %v, want resource unavailable", err)
+		}
+		if want := fmt.Sprintf("after %d attempts", ipReleaseBackoff.Steps); !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want %q", err, want)
+		}
+	})
+
+	t.Run("retries stop when the context is done", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		backoff := ipReleaseBackoff
+		ipReleaseBackoff = wait.Backoff{Duration: time.Hour, Steps: backoff.Steps}
+		t.Cleanup(func() { ipReleaseBackoff = backoff })
+
+		ctx, cancel := context.WithCancel(t.Context())
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).DoAndReturn(func(*cloudstack.DisassociateIpAddressParams) (*cloudstack.DisassociateIpAddressResponse, error) {
+			cancel()
+
+			return nil, errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4250): resource unavailable")
+		})
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+		}
+
+		err := lb.releaseLoadBalancerIPWithRetry(ctx)
+		if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "resource unavailable") {
+			t.Fatalf("error = %v, want the cancellation and the last error", err)
+		}
+	})
+}
+
+func TestNetworkMismatchError(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	mismatch := fmt.Errorf("%w (network net-1: node-1; network net-2: node-2)", errHostsInDifferentNetworks)
+
+	t.Run("fatal by default", func(t *testing.T) {
+		cs := &CSCloud{}
+		if err := cs.networkMismatchError(service, mismatch); err != mismatch {
+			t.Errorf("err = %v, want %v", err, mismatch)
+		}
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		cs := &CSCloud{networkMismatchRetryDelay: 30 * time.Second}
+		other := errors.New("other error")
+		if err := cs.networkMismatchError(service, other); err != other {
+			t.Errorf("err = %v, want %v", err, other)
+		}
+	})
+
+	t.Run("requeued until the timeout", func(t *testing.T) {
+		cs := &CSCloud{networkMismatchRetryDelay: 30 * time.Second, networkMismatchTimeout: time.Hour}
+
+		var retryErr *cloudproviderapi.RetryError
+		if err := cs.networkMismatchError(service, mismatch); !errors.As(err, &retryErr) {
+			t.Fatalf("err = %v, want a RetryError", err)
+		}
+		if retryErr.RetryAfter() != 30*time.Second {
+			t.Errorf("retry after = %v, want 30s", retryErr.RetryAfter())
+		}
+
+		cs.networkMismatchSince["default/foo"] = time.Now().Add(-2 * time.Hour)
+		err := cs.networkMismatchError(service, mismatch)
+		if errors.As(err, &retryErr) || !errors.Is(err, errHostsInDifferentNetworks) {
+			t.Errorf("err = %v, want a plain error after the timeout", err)
+		}
+
+		cs.resetNetworkMismatch(service)
+		if err := cs.networkMismatchError(service, mismatch); !errors.As(err, &retryErr) {
+			t.Errorf("err = %v, want a RetryError after the mismatch was resolved", err)
+		}
+	})
+}
+
+func TestGetLoadBalancerIP(t *testing.T) {
+	t.Run("IP specified - retrieve existing", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		resp := &cloudstack.ListPublicIpAddressesResponse{
 			Count: 1,
 			PublicIpAddresses: []*cloudstack.PublicIpAddress{
 				{
@@ -1308,6 +2206,9 @@ func TestGetLoadBalancerIP(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		listParams := &cloudstack.ListPublicIpAddressesParams{}
 		resp := &cloudstack.ListPublicIpAddressesResponse{
 			Count: 1,
@@ -1342,8 +2243,10 @@ func TestGetLoadBalancerIP(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 			ipAddr:    "203.0.113.1",
@@ -1367,6 +2270,9 @@ func TestGetLoadBalancerIP(t *testing.T) {
 
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 		networkResp := &cloudstack.Network{
 			Id:      "net-123",
 			Vpcid:   "",
@@ -1387,8 +2293,10 @@ func TestGetLoadBalancerIP(t *testing.T) {
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-				Network: mockNetwork,
+				Address:      mockAddress,
+				Network:      mockNetwork,
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
 			},
 			networkID: "net-123",
 		}
@@ -1573,7 +2481,7 @@ func TestUpdateLoadBalancerRule(t *testing.T) {
 			},
 		}
 
-		err := lb.updateLoadBalancerRule("test-rule-tcp-80", LoadBalancerProtocolTCP)
+		err := lb.updateLoadBalancerRule("test-rule-tcp-80", corev1.ServicePort{Port: 80}, LoadBalancerProtocolTCP)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -1605,7 +2513,7 @@ func TestUpdateLoadBalancerRule(t *testing.T) {
 			},
 		}
 
-		err := lb.updateLoadBalancerRule("test-rule-tcp-80", LoadBalancerProtocolTCPProxy)
+		err := lb.updateLoadBalancerRule("test-rule-tcp-80", corev1.ServicePort{Port: 80}, LoadBalancerProtocolTCPProxy)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -1691,8 +2599,365 @@ func TestDeleteLoadBalancerRule(t *testing.T) {
 	})
 }
 
-func TestAssignHostsToRule(t *testing.T) {
-	t.Run("successful assignment", func(t *testing.T) {
+func TestDeleteLoadBalancerRuleAndFirewall(t *testing.T) {
+	t.Run("malformed rules are still deleted", func(t *testing.T) {
+		tests := []struct {
+			name string
+			rule *cloudstack.LoadBalancerRule
+		}{
+			{
+				name: "empty public port",
+				rule: &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "bad-port", Protocol: "tcp", Publicport: ""},
+			},
+			{
+				name: "invalid protocol",
+				rule: &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "bad-protocol", Protocol: "bogus", Publicport: "80"},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				t.Cleanup(ctrl.Finish)
+
+				mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+				mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+				deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+
+				mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+				mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+				lb := &loadBalancer{
+					CloudStackClient: &cloudstack.CloudStackClient{
+						LoadBalancer: mockLB,
+						Firewall:     mockFirewall,
+					},
+					rules: map[string]*cloudstack.LoadBalancerRule{tt.rule.Name: tt.rule},
+				}
+
+				if err := lb.deleteLoadBalancerRuleAndFirewall(tt.rule); err == nil {
+					t.Fatalf("expected error")
+				}
+				if _, exists := lb.rules[tt.rule.Name]; exists {
+					t.Errorf("expected rule to be removed from map")
+				}
+			})
+		}
+	})
+
+	t.Run("firewall error does not prevent rule deletion", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("list API error"))
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+		mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "good-rule", Protocol: "tcp", Publicport: "80", Publicipid: "ip-1"}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
+			},
+			rules: map[string]*cloudstack.LoadBalancerRule{rule.Name: rule},
+		}
+
+		err := lb.deleteLoadBalancerRuleAndFirewall(rule)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "error deleting firewall rules") {
+			t.Errorf("error message = %q, want to contain 'error deleting firewall rules'", err.Error())
+		}
+		if _, exists := lb.rules[rule.Name]; exists {
+			t.Errorf("expected rule to be removed from map")
+		}
+	})
+
+	t.Run("stickiness policy deleted by CloudStack with the rule", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+
+		// No listLBStickinessPolicies or deleteLBStickinessPolicy calls.
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+		mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "good-rule", Protocol: "tcp", Publicport: "80", Publicipid: "ip-1"}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
+			},
+			rules: map[string]*cloudstack.LoadBalancerRule{rule.Name: rule},
+		}
+
+		if err := lb.deleteLoadBalancerRuleAndFirewall(rule); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, exists := lb.rules[rule.Name]; exists {
+			t.Errorf("expected rule to be removed from map")
+		}
+	})
+}
+
+func TestDeleteRulesOrdered(t *testing.T) {
+	newRules := func() map[string]*cloudstack.LoadBalancerRule {
+		return map[string]*cloudstack.LoadBalancerRule{
+			"rule-a": {Id: "rule-a", Name: "rule-a", Protocol: "tcp", Publicport: "80", Publicipid: "ip-1"},
+			"rule-b": {Id: "rule-b", Name: "rule-b", Protocol: "tcp", Publicport: "443", Publicipid: "ip-1"},
+		}
+	}
+	firewallRules := &cloudstack.ListFirewallRulesResponse{Count: 3, FirewallRules: []*cloudstack.FirewallRule{
+		{Id: "fw-80", Protocol: "tcp", Startport: 80, Endport: 80},
+		{Id: "fw-443", Protocol: "tcp", Startport: 443, Endport: 443},
+		{Id: "fw-icmp", Protocol: ProtoICMP, Tags: []cloudstack.Tags{{Key: firewallRulePortTagKey, Value: ProtoICMP}}},
+	}}
+	serviceTags := map[string]string{serviceNameTagKey: "web"}
+
+	t.Run("firewall rules, then hosts, then rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(3)
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(firewallRules, nil).Times(3)
+
+		var firewallPhase []any
+		for _, id := range []string{"fw-80", "fw-443", "fw-icmp"} {
+			params := &cloudstack.DeleteFirewallRuleParams{}
+			firewallPhase = append(firewallPhase,
+				mockFirewall.EXPECT().NewDeleteFirewallRuleParams(id).Return(params),
+				mockFirewall.EXPECT().DeleteFirewallRule(params).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+			)
+		}
+
+		var hostsPhase []any
+		for _, id := range []string{"rule-a", "rule-b"} {
+			removeParams := &cloudstack.RemoveFromLoadBalancerRuleParams{}
+			hostsPhase = append(hostsPhase,
+				mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams(id).Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+				mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+					Count:                     1,
+					LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+				}, nil),
+				mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams(id).Return(removeParams),
+				mockLB.EXPECT().RemoveFromLoadBalancerRule(removeParams).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil),
+			)
+		}
+
+		var rulesPhase []any
+		for _, id := range []string{"rule-a", "rule-b"} {
+			deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+			rulesPhase = append(rulesPhase,
+				mockLB.EXPECT().NewDeleteLoadBalancerRuleParams(id).Return(deleteParams),
+				mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil),
+			)
+		}
+
+		gomock.InOrder(slices.Concat(firewallPhase, hostsPhase, rulesPhase)...)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Firewall: mockFirewall},
+			name:             "lb",
+			ipAddrID:         "ip-1",
+			rules:            newRules(),
+			serviceTags:      serviceTags,
+		}
+		if errs := lb.deleteRulesOrdered(); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if len(lb.rules) != 0 {
+			t.Errorf("rules = %v, want all deleted", lb.rules)
+		}
+	})
+
+	t.Run("hosts are kept when a firewall rule cannot be deleted", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(3)
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(firewallRules, nil).Times(3)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleParams{}).Times(3)
+		gomock.InOrder(
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(nil, errors.New("API error")),
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil).Times(2),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Firewall: mockFirewall},
+			name:             "lb",
+			ipAddrID:         "ip-1",
+			rules:            newRules(),
+			serviceTags:      serviceTags,
+		}
+		errs := lb.deleteRulesOrdered()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "error deleting firewall rules for rule rule-a") {
+			t.Fatalf("errors = %v, want the firewall error of rule-a", errs)
+		}
+		if len(lb.rules) != 2 {
+			t.Errorf("rules = %v, want both kept", lb.rules)
+		}
+	})
+
+	t.Run("rules are kept when hosts cannot be removed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(3)
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil).Times(3)
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}).Times(2)
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     1,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+		}, nil).Times(2)
+		mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.RemoveFromLoadBalancerRuleParams{}).Times(2)
+		gomock.InOrder(
+			mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil),
+			mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).Return(nil, errors.New("API error")),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Firewall: mockFirewall},
+			name:             "lb",
+			ipAddrID:         "ip-1",
+			rules:            newRules(),
+			serviceTags:      serviceTags,
+		}
+		errs := lb.deleteRulesOrdered()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "error removing hosts from load balancer rule rule-b") {
+			t.Fatalf("errors = %v, want the host removal error of rule-b", errs)
+		}
+		if len(lb.rules) != 2 {
+			t.Errorf("rules = %v, want both kept", lb.rules)
+		}
+	})
+}
+
+func TestForceRecreateLoadBalancerRules(t *testing.T) {
+	newService := func(nonce, processed string) *corev1.Service {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{}}}
+		if nonce != "" {
+			service.Annotations[ServiceAnnotationLoadBalancerForceRecreate] = nonce
+		}
+		if processed != "" {
+			service.Annotations[ServiceAnnotationLoadBalancerForceRecreateProcessed] = processed
+		}
+
+		return service
+	}
+	newRule := func() *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "web-tcp-80", Protocol: "tcp", Publicport: "80", Publicipid: "ip-1"}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		nonce     string
+		processed string
+	}{
+		{name: "no nonce"},
+		{name: "nonce already processed", nonce: "1", processed: "1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := newRule()
+			lb := &loadBalancer{rules: map[string]*cloudstack.LoadBalancerRule{rule.Name: rule}}
+			cs := &CSCloud{eventRecorder: record.NewFakeRecorder(10)}
+
+			if err := cs.forceRecreateLoadBalancerRules(lb, newService(tt.nonce, tt.processed)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(lb.rules) != 1 {
+				t.Errorf("rules = %v, want the rule to be kept", lb.rules)
+			}
+		})
+	}
+
+	t.Run("new nonce deletes all rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+		mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		rule := newRule()
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Firewall: mockFirewall},
+			rules:            map[string]*cloudstack.LoadBalancerRule{rule.Name: rule},
+		}
+		recorder := record.NewFakeRecorder(10)
+		cs := &CSCloud{eventRecorder: recorder}
+		service := newService("2", "1")
+
+		if err := cs.forceRecreateLoadBalancerRules(lb, service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(lb.rules) != 0 {
+			t.Errorf("rules = %v, want all rules deleted", lb.rules)
+		}
+		if got := service.Annotations[ServiceAnnotationLoadBalancerForceRecreateProcessed]; got != "2" {
+			t.Errorf("processed nonce = %q, want %q", got, "2")
+		}
+		if event := <-recorder.Events; !strings.Contains(event, "RecreatingLoadBalancerRules") {
+			t.Errorf("event = %q, want RecreatingLoadBalancerRules", event)
+		}
+	})
+
+	t.Run("failed deletion leaves the nonce unprocessed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+		mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(nil, errors.New("delete failed"))
+
+		rule := newRule()
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Firewall: mockFirewall},
+			rules:            map[string]*cloudstack.LoadBalancerRule{rule.Name: rule},
+		}
+		cs := &CSCloud{eventRecorder: record.NewFakeRecorder(10)}
+		service := newService("2", "1")
+
+		if err := cs.forceRecreateLoadBalancerRules(lb, service); err == nil {
+			t.Fatalf("expected error")
+		}
+		if got := service.Annotations[ServiceAnnotationLoadBalancerForceRecreateProcessed]; got != "1" {
+			t.Errorf("processed nonce = %q, want %q", got, "1")
+		}
+	})
+}
+
+func TestAssignHostsToRule(t *testing.T) {
+	t.Run("successful assignment", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
@@ -1782,6 +3047,51 @@ func TestAssignHostsToRule(t *testing.T) {
 			t.Fatalf("unexpected error: %v", err)
 		}
 	})
+	t.Run("batched assignment", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		hostIDs := make([]string, 25)
+		for i := range hostIDs {
+			hostIDs[i] = fmt.Sprintf("vm-%d", i)
+		}
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-123").DoAndReturn(func(string) *cloudstack.AssignToLoadBalancerRuleParams {
+			return &cloudstack.AssignToLoadBalancerRuleParams{}
+		}).Times(3)
+
+		var batches [][]string
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.AssignToLoadBalancerRuleParams) (*cloudstack.AssignToLoadBalancerRuleResponse, error) {
+			ids, _ := p.GetVirtualmachineids()
+			batches = append(batches, ids)
+			if len(batches) == 2 {
+				return nil, errors.New("assign API error")
+			}
+
+			return &cloudstack.AssignToLoadBalancerRuleResponse{}, nil
+		}).Times(3)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			hostBatchSize: 10,
+		}
+
+		rule := &cloudstack.LoadBalancerRule{
+			Id:   "rule-123",
+			Name: "test-rule",
+		}
+
+		// A failing batch does not stop the remaining batches.
+		if err := lb.assignHostsToRule(rule, hostIDs); err == nil || !strings.Contains(err.Error(), "error assigning hosts") {
+			t.Errorf("error = %v, want the error of the second batch", err)
+		}
+		if want := [][]string{hostIDs[:10], hostIDs[10:20], hostIDs[20:]}; !slices.EqualFunc(batches, want, slices.Equal) {
+			t.Errorf("batches = %v, want %v", batches, want)
+		}
+	})
 }
 
 func TestRemoveHostsFromRule(t *testing.T) {
@@ -1875,6 +3185,67 @@ func TestRemoveHostsFromRule(t *testing.T) {
 			t.Fatalf("unexpected error: %v", err)
 		}
 	})
+	t.Run("batched removal", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		hostIDs := make([]string, 12)
+		for i := range hostIDs {
+			hostIDs[i] = fmt.Sprintf("vm-%d", i)
+		}
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams("rule-123").DoAndReturn(func(string) *cloudstack.RemoveFromLoadBalancerRuleParams {
+			return &cloudstack.RemoveFromLoadBalancerRuleParams{}
+		}).Times(2)
+
+		var batches [][]string
+		mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.RemoveFromLoadBalancerRuleParams) (*cloudstack.RemoveFromLoadBalancerRuleResponse, error) {
+			ids, _ := p.GetVirtualmachineids()
+			batches = append(batches, ids)
+
+			return &cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil
+		}).Times(2)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			hostBatchSize: 10,
+		}
+
+		rule := &cloudstack.LoadBalancerRule{
+			Id:   "rule-123",
+			Name: "test-rule",
+		}
+
+		if err := lb.removeHostsFromRule(rule, hostIDs); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := [][]string{hostIDs[:10], hostIDs[10:]}; !slices.EqualFunc(batches, want, slices.Equal) {
+			t.Errorf("batches = %v, want %v", batches, want)
+		}
+	})
+}
+
+func TestFirewallRuleCIDRs(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidrlist string
+		want     []string
+	}{
+		{name: "empty", cidrlist: "", want: []string{defaultAllowedCIDR}},
+		{name: "single", cidrlist: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{name: "multiple with spaces", cidrlist: "10.0.0.0/8, 192.168.0.0/16", want: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firewallRuleCIDRs(&cloudstack.FirewallRule{Cidrlist: tt.cidrlist}); !slices.Equal(got, tt.want) {
+				t.Errorf("firewallRuleCIDRs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
 }
 
 func TestUpdateFirewallRule(t *testing.T) {
@@ -1917,31 +3288,20 @@ func TestUpdateFirewallRule(t *testing.T) {
 		}
 	})
 
-	t.Run("rule already exists - no change", func(t *testing.T) {
+	t.Run("rule with empty CIDR list matches allow-all", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
-		listParams := &cloudstack.ListFirewallRulesParams{}
 		listResp := &cloudstack.ListFirewallRulesResponse{
 			Count: 1,
 			FirewallRules: []*cloudstack.FirewallRule{
-				{
-					Id:          "fw-123",
-					Protocol:    "tcp",
-					Startport:   80,
-					Endport:     80,
-					Cidrlist:    "10.0.0.0/8",
-					Ipaddress:   "203.0.113.1",
-					Ipaddressid: "ip-123",
-				},
+				{Id: "fw-123", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "", Ipaddressid: "ip-123"},
 			},
 		}
 
-		gomock.InOrder(
-			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
-			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
-		)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
@@ -1950,16 +3310,16 @@ func TestUpdateFirewallRule(t *testing.T) {
 			ipAddr: "203.0.113.1",
 		}
 
-		updated, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"})
+		updated, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, nil)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		if updated {
-			t.Errorf("updated = true, want false (nothing changed)")
+			t.Errorf("updated = true, want false")
 		}
 	})
 
-	t.Run("update existing rule - CIDR change", func(t *testing.T) {
+	t.Run("rule already exists - no change", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
@@ -1973,7 +3333,49 @@ func TestUpdateFirewallRule(t *testing.T) {
 					Protocol:    "tcp",
 					Startport:   80,
 					Endport:     80,
-					Cidrlist:    "192.168.0.0/16",
+					Cidrlist:    "10.0.0.0/8",
+					Ipaddress:   "203.0.113.1",
+					Ipaddressid: "ip-123",
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Firewall: mockFirewall,
+			},
+			ipAddr: "203.0.113.1",
+		}
+
+		updated, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if updated {
+			t.Errorf("updated = true, want false (nothing changed)")
+		}
+	})
+
+	t.Run("update existing rule - CIDR change", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		listResp := &cloudstack.ListFirewallRulesResponse{
+			Count: 1,
+			FirewallRules: []*cloudstack.FirewallRule{
+				{
+					Id:          "fw-123",
+					Protocol:    "tcp",
+					Startport:   80,
+					Endport:     80,
+					Cidrlist:    "192.168.0.0/16",
 					Ipaddress:   "203.0.113.1",
 					Ipaddressid: "ip-123",
 				},
@@ -2168,1652 +3570,7242 @@ func TestUpdateFirewallRule(t *testing.T) {
 		if !strings.Contains(err.Error(), "delete API error") {
 			t.Fatalf("expected deletion error, got: %v", err)
 		}
+		if !errors.Is(err, errStaleFirewallRules) {
+			t.Errorf("error = %v, want errStaleFirewallRules as the new rule was created", err)
+		}
 		if !updated {
 			t.Errorf("updated = false, want true")
 		}
 	})
-}
 
-func TestDeleteFirewallRule(t *testing.T) {
-	t.Run("delete matching rule", func(t *testing.T) {
+	t.Run("error deleting rule and creating rule", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
-		listParams := &cloudstack.ListFirewallRulesParams{}
-		listResp := &cloudstack.ListFirewallRulesResponse{
-			Count: 1,
-			FirewallRules: []*cloudstack.FirewallRule{
-				{
-					Id:          "fw-123",
-					Protocol:    "tcp",
-					Startport:   80,
-					Endport:     80,
-					Ipaddressid: "ip-123",
-				},
-			},
-		}
-
-		deleteParams := &cloudstack.DeleteFirewallRuleParams{}
-
 		gomock.InOrder(
-			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
-			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
-			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-123").Return(deleteParams),
-			mockFirewall.EXPECT().DeleteFirewallRule(deleteParams).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1,
+				FirewallRules: []*cloudstack.FirewallRule{
+					{Id: "fw-123", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "192.168.0.0/16", Ipaddressid: "ip-123"},
+				},
+			}, nil),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-123").Return(&cloudstack.DeleteFirewallRuleParams{}),
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(nil, errors.New("delete API error")),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(&cloudstack.CreateFirewallRuleParams{}),
+			mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(nil, errors.New("create API error")),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				Firewall: mockFirewall,
 			},
+			ipAddr: "203.0.113.1",
 		}
 
-		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
+		_, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"})
+		if err == nil {
+			t.Fatalf("expected error")
 		}
-		if !deleted {
-			t.Errorf("deleted = false, want true")
+		if errors.Is(err, errStaleFirewallRules) {
+			t.Errorf("error = %v, must not be errStaleFirewallRules when the new rule was not created", err)
+		}
+		if !strings.Contains(err.Error(), "create API error") || !strings.Contains(err.Error(), "delete API error") {
+			t.Errorf("error = %v, want both the create and the delete error", err)
 		}
 	})
+}
 
-	t.Run("no matching rules", func(t *testing.T) {
+func TestICMPFirewallRules(t *testing.T) {
+	icmpRule := func(id, cidrs string) *cloudstack.FirewallRule {
+		return &cloudstack.FirewallRule{
+			Id: id, Protocol: "icmp", Icmptype: -1, Icmpcode: -1, Cidrlist: cidrs,
+			Tags: []cloudstack.Tags{{Key: firewallRulePortTagKey, Value: ProtoICMP}},
+		}
+	}
+	serviceTags := map[string]string{serviceNameTagKey: "web"}
+	tcpRule := &cloudstack.FirewallRule{Id: "fw-tcp", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR}
+
+	t.Run("create ICMP rule", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
-		listParams := &cloudstack.ListFirewallRulesParams{}
-		listResp := &cloudstack.ListFirewallRulesResponse{
-			Count:         0,
-			FirewallRules: []*cloudstack.FirewallRule{},
-		}
-
+		createParams := &cloudstack.CreateFirewallRuleParams{}
 		gomock.InOrder(
-			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
-			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1, FirewallRules: []*cloudstack.FirewallRule{tcpRule},
+			}, nil),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "icmp").Return(createParams),
+			mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-icmp"}, nil),
 		)
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Firewall: mockFirewall,
-			},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}}
 
-		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
+		updated, err := lb.updateICMPFirewallRules("ip-123", []icmpFirewallRule{{icmpType: -1, icmpCode: -1, cidrs: []string{"10.0.0.0/8"}}})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if deleted {
-			t.Errorf("deleted = true, want false")
+		if !updated {
+			t.Errorf("updated = false, want true")
+		}
+		if icmpType, _ := createParams.GetIcmptype(); icmpType != -1 {
+			t.Errorf("icmptype = %d, want -1", icmpType)
+		}
+		if cidrs, _ := createParams.GetCidrlist(); !compareStringSlice(cidrs, []string{"10.0.0.0/8"}) {
+			t.Errorf("cidrlist = %v, want [10.0.0.0/8]", cidrs)
 		}
 	})
 
-	t.Run("error listing rules", func(t *testing.T) {
+	t.Run("ICMP rule up-to-date", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
-		listParams := &cloudstack.ListFirewallRulesParams{}
-		apiErr := errors.New("list API error")
-
-		gomock.InOrder(
-			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
-			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, apiErr),
-		)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2, FirewallRules: []*cloudstack.FirewallRule{tcpRule, icmpRule("fw-icmp", "10.0.0.0/8")},
+		}, nil)
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Firewall: mockFirewall,
-			},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}, serviceTags: serviceTags}
 
-		_, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
-		if err == nil {
-			t.Fatalf("expected error")
+		updated, err := lb.updateICMPFirewallRules("ip-123", []icmpFirewallRule{{icmpType: -1, icmpCode: -1, cidrs: []string{"10.0.0.0/8"}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-		if !strings.Contains(err.Error(), "error fetching firewall rules") {
-			t.Errorf("error message = %q, want to contain 'error fetching firewall rules'", err.Error())
+		if updated {
+			t.Errorf("updated = true, want false")
 		}
 	})
 
-	t.Run("error deleting rule", func(t *testing.T) {
+	t.Run("ICMP rule with other source ranges is replaced", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
-		listParams := &cloudstack.ListFirewallRulesParams{}
-		listResp := &cloudstack.ListFirewallRulesResponse{
-			Count: 1,
-			FirewallRules: []*cloudstack.FirewallRule{
-				{
-					Id:          "fw-123",
-					Protocol:    "tcp",
-					Startport:   80,
-					Endport:     80,
-					Ipaddressid: "ip-123",
-				},
-			},
-		}
-
-		deleteParams := &cloudstack.DeleteFirewallRuleParams{}
-		deleteErr := errors.New("delete API error")
-
 		gomock.InOrder(
-			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
-			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
-			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-123").Return(deleteParams),
-			mockFirewall.EXPECT().DeleteFirewallRule(deleteParams).Return(nil, deleteErr),
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1, FirewallRules: []*cloudstack.FirewallRule{icmpRule("fw-icmp", defaultAllowedCIDR)},
+			}, nil),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-icmp").Return(&cloudstack.DeleteFirewallRuleParams{}),
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "icmp").Return(&cloudstack.CreateFirewallRuleParams{}),
+			mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-icmp-2"}, nil),
 		)
 
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"fw-icmp-2"}, "FirewallRule", gomock.Any()).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil)
+
 		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Firewall: mockFirewall,
-			},
+			CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall, Resourcetags: mockTags},
+			serviceTags:      serviceTags,
 		}
 
-		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
-		// Should return false if deletion failed
-		if deleted {
-			t.Errorf("deleted = true, want false")
-		}
-		if !errors.Is(err, deleteErr) {
-			t.Errorf("error = %v, want %v", err, deleteErr)
+		if _, err := lb.updateICMPFirewallRules("ip-123", []icmpFirewallRule{{icmpType: -1, icmpCode: -1, cidrs: []string{"10.0.0.0/8"}}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
-}
 
-func TestVerifyHosts(t *testing.T) {
-	t.Run("all hosts in same network", func(t *testing.T) {
+	t.Run("delete only touches ICMP rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 2,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-				{
-					Id:   "vm-2",
-					Name: "node-2",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-			},
-		}
-
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
-
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
-		}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2, FirewallRules: []*cloudstack.FirewallRule{tcpRule, icmpRule("fw-icmp", defaultAllowedCIDR)},
+		}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-icmp").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}, serviceTags: serviceTags}
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
+		deleted, err := lb.deleteICMPFirewallRules("ip-123")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if len(hostIDs) != 2 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 2)
-		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
+		if !deleted {
+			t.Errorf("deleted = false, want true")
 		}
 	})
 
-	t.Run("hosts in different networks", func(t *testing.T) {
+	t.Run("untagged ICMP rule is kept", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 2,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-				{
-					Id:   "vm-2",
-					Name: "node-2",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-456"},
-					},
-				},
-			},
-		}
-
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
-
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
-		}
+		// f.e. a rule created by hand to allow ping for monitoring.
+		untagged := &cloudstack.FirewallRule{Id: "fw-ping", Protocol: "icmp", Icmptype: 8, Icmpcode: 0, Cidrlist: "10.1.0.0/16"}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2, FirewallRules: []*cloudstack.FirewallRule{untagged, icmpRule("fw-icmp", defaultAllowedCIDR)},
+		}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-icmp").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}, serviceTags: serviceTags}
 
-		_, _, err := cs.verifyHosts(nodes)
-		if err == nil {
-			t.Fatalf("expected error")
-		}
-		if !strings.Contains(err.Error(), "different networks") {
-			t.Errorf("error message = %q, want to contain 'different networks'", err.Error())
+		if _, err := lb.deleteICMPFirewallRules("ip-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("no matching hosts", func(t *testing.T) {
+	t.Run("fragmentation needed rule next to the all types rule", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count:           0,
-			VirtualMachines: []*cloudstack.VirtualMachine{},
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		createParams := &cloudstack.CreateFirewallRuleParams{}
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1, FirewallRules: []*cloudstack.FirewallRule{icmpRule("fw-icmp", "10.0.0.0/8")},
+			}, nil),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "icmp").Return(createParams),
+			mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-pmtud"}, nil),
+		)
+
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}}
+
+		updated, err := lb.updateICMPFirewallRules("ip-123", []icmpFirewallRule{
+			{icmpType: -1, icmpCode: -1, cidrs: []string{"10.0.0.0/8"}},
+			{icmpType: icmpTypeDestinationUnreachable, icmpCode: icmpCodeFragmentationNeeded},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !updated {
+			t.Errorf("updated = false, want true")
 		}
+		icmpType, _ := createParams.GetIcmptype()
+		icmpCode, _ := createParams.GetIcmpcode()
+		if icmpType != 3 || icmpCode != 4 {
+			t.Errorf("icmptype/icmpcode = %d/%d, want 3/4", icmpType, icmpCode)
+		}
+		if cidrs, _ := createParams.GetCidrlist(); !compareStringSlice(cidrs, []string{defaultAllowedCIDR}) {
+			t.Errorf("cidrlist = %v, want [%s]", cidrs, defaultAllowedCIDR)
+		}
+	})
+}
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+func TestReconcileICMPFirewallRules(t *testing.T) {
+	pmtudRule := &cloudstack.FirewallRule{
+		Id: "fw-pmtud", Protocol: "icmp", Icmptype: 3, Icmpcode: 4, Cidrlist: defaultAllowedCIDR,
+		Tags: []cloudstack.Tags{{Key: firewallRulePortTagKey, Value: ProtoICMP}},
+	}
+	allowRule := &cloudstack.FirewallRule{
+		Id: "fw-icmp", Protocol: "icmp", Icmptype: -1, Icmpcode: -1, Cidrlist: defaultAllowedCIDR,
+		Tags: []cloudstack.Tags{{Key: firewallRulePortTagKey, Value: ProtoICMP}},
+	}
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
+	tests := []struct {
+		name        string
+		configured  bool
+		annotations map[string]string
+		existing    *cloudstack.FirewallRule
+		wantRule    bool
+	}{
+		{name: "disabled by default", existing: pmtudRule},
+		{name: "enabled by the config", configured: true, existing: pmtudRule, wantRule: true},
+		{name: "enabled by the annotation", annotations: map[string]string{ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded: "true"}, existing: pmtudRule, wantRule: true},
+		{name: "annotation overrides the config", configured: true, annotations: map[string]string{ServiceAnnotationLoadBalancerAllowICMPFragmentationNeeded: "false"}, existing: pmtudRule},
+		{name: "allow-icmp annotation removed", existing: allowRule},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			// The rule exists; it is kept when wanted and deleted otherwise, also when none of the ICMP
+			// annotations is set.
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1, FirewallRules: []*cloudstack.FirewallRule{tt.existing},
+			}, nil)
+			if !tt.wantRule {
+				mockFirewall.EXPECT().NewDeleteFirewallRuleParams(tt.existing.Id).Return(&cloudstack.DeleteFirewallRuleParams{})
+				mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+			}
+
+			cs := &CSCloud{allowICMPFragmentationNeeded: tt.configured, eventRecorder: record.NewFakeRecorder(10)}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall},
+				ipAddrID:         "ip-123",
+				serviceTags:      map[string]string{serviceNameTagKey: "web"},
+			}
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+
+			if err := cs.reconcileICMPFirewallRules(lb, service, service); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetICMPSourceRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "defaults to allow-all",
+			want: []string{defaultAllowedCIDR},
+		},
+		{
+			name:        "falls back to service source ranges",
+			annotations: map[string]string{corev1.AnnotationLoadBalancerSourceRangesKey: "10.0.0.0/8"},
+			want:        []string{"10.0.0.0/8"},
+		},
+		{
+			name: "separate ICMP source ranges",
+			annotations: map[string]string{
+				corev1.AnnotationLoadBalancerSourceRangesKey:  "10.0.0.0/8",
+				ServiceAnnotationLoadBalancerICMPSourceRanges: "192.168.0.0/16, 172.16.0.0/12",
 			},
-		}
+			want: []string{"192.168.0.0/16", "172.16.0.0/12"},
+		},
+		{
+			name:        "invalid ICMP source ranges",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerICMPSourceRanges: "192.168.0.0/16,nope"},
+			wantErr:     true,
+		},
+	}
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-		}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
 
-		_, _, err := cs.verifyHosts(nodes)
-		if err == nil {
-			t.Fatalf("expected error")
+			got, err := getICMPSourceRanges(service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getICMPSourceRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !compareStringSlice(got.StringSlice(), tt.want) {
+				t.Errorf("getICMPSourceRanges() = %v, want %v", got.StringSlice(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTagFirewallRule(t *testing.T) {
+	serviceTags := map[string]string{
+		serviceClusterTagKey:   "cluster",
+		serviceNamespaceTagKey: "default",
+		serviceNameTagKey:      "foo",
+	}
+
+	t.Run("new rule is tagged with the service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(&cloudstack.CreateFirewallRuleParams{})
+		mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-new"}, nil)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"fw-new"}, "FirewallRule", map[string]string{
+			serviceClusterTagKey:    "cluster",
+			serviceNamespaceTagKey:  "default",
+			serviceNameTagKey:       "foo",
+			firewallRuleOwnerTagKey: firewallRuleOwnerTagValue,
+		}).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient:       &cloudstack.CloudStackClient{Firewall: mockFirewall, Resourcetags: mockTags},
+			ownedFirewallRulesOnly: true,
+			serviceTags:            serviceTags,
 		}
-		if !strings.Contains(err.Error(), "could not match any") {
-			t.Errorf("error message = %q, want to contain 'could not match any'", err.Error())
+		if _, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCPProxy, []string{defaultAllowedCIDR}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("FQDN node names", func(t *testing.T) {
+	t.Run("tagging failure keeps the rule when ownership is not tracked", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 1,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-			},
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"fw-1"}, "FirewallRule", gomock.Any()).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(nil, errors.New("tags API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall, Resourcetags: mockTags},
+			serviceTags:      serviceTags,
+		}
+		if err := lb.tagFirewallRule("fw-1", ProtoICMP); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
+	})
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+	t.Run("batched rules are tagged with one call per port tag", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
-		}
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		gomock.InOrder(
+			mockTags.EXPECT().NewCreateTagsParams([]string{"fw-80", "fw-443"}, "FirewallRule", serviceTags).Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"fw-icmp", "fw-frag"}, "FirewallRule", map[string]string{
+				serviceClusterTagKey:   "cluster",
+				serviceNamespaceTagKey: "default",
+				serviceNameTagKey:      "foo",
+				firewallRulePortTagKey: ProtoICMP,
+			}).Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1.example.com"}},
+		lb := &loadBalancer{
+			CloudStackClient:     &cloudstack.CloudStackClient{Resourcetags: mockTags},
+			serviceTags:          serviceTags,
+			firewallRuleTagBatch: map[string][]string{},
 		}
-
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
+		for _, r := range []struct{ id, port string }{{"fw-80", ""}, {"fw-icmp", ProtoICMP}, {"fw-443", ""}, {"fw-frag", ProtoICMP}} {
+			if err := lb.tagFirewallRule(r.id, r.port); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 		}
-		if len(hostIDs) != 1 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 1)
+		if err := lb.flushFirewallRuleTags(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
+		if lb.firewallRuleTagBatch != nil {
+			t.Errorf("expected batching to stop after the flush")
 		}
 	})
 
-	t.Run("case-insensitive matching", func(t *testing.T) {
+	t.Run("batched owned rules are deleted when tagging fails", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 1,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "NODE-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-			},
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"fw-80", "fw-443"}, "FirewallRule", gomock.Any()).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(nil, errors.New("tags API error"))
+		for _, id := range []string{"fw-80", "fw-443"} {
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams(id).Return(&cloudstack.DeleteFirewallRuleParams{})
 		}
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil).Times(2)
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
-
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
+		lb := &loadBalancer{
+			CloudStackClient:       &cloudstack.CloudStackClient{Firewall: mockFirewall, Resourcetags: mockTags},
+			ownedFirewallRulesOnly: true,
+			firewallRuleTagBatch:   map[string][]string{"": {"fw-80", "fw-443"}},
 		}
-
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		if err := lb.flushFirewallRuleTags(); err == nil || !strings.Contains(err.Error(), "tags API error") {
+			t.Fatalf("error = %v, want the tagging error", err)
 		}
+	})
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
-		if err != nil {
+	t.Run("nothing to tag", func(t *testing.T) {
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{}}
+		if err := lb.tagFirewallRule("fw-1", "tcp/80"); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if len(hostIDs) != 1 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 1)
-		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
-		}
 	})
+}
 
-	t.Run("partial match during rolling upgrade - some nodes not yet in CloudStack", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
+func TestOwnedFirewallRulesOnly(t *testing.T) {
+	ownerTags := []cloudstack.Tags{{Key: firewallRuleOwnerTagKey, Value: firewallRuleOwnerTagValue}}
+	foreignRule := &cloudstack.FirewallRule{Id: "fw-foreign", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "192.168.0.0/16"}
+	ownedRule := &cloudstack.FirewallRule{Id: "fw-owned", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "172.16.0.0/12", Tags: ownerTags}
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		// Only node-1 exists in CloudStack; node-2 is still being provisioned.
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 1,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-			},
+	newLB := func(mockFirewall *cloudstack.MockFirewallServiceIface, mockTags *cloudstack.MockResourcetagsServiceIface) *loadBalancer {
+		return &loadBalancer{
+			CloudStackClient:       &cloudstack.CloudStackClient{Firewall: mockFirewall, Resourcetags: mockTags},
+			ipAddr:                 "203.0.113.1",
+			ownedFirewallRulesOnly: true,
 		}
+	}
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+	t.Run("foreign rules are kept and the new rule is tagged", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
-		}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 2, FirewallRules: []*cloudstack.FirewallRule{foreignRule, ownedRule},
+			}, nil),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-owned").Return(&cloudstack.DeleteFirewallRuleParams{}),
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(&cloudstack.CreateFirewallRuleParams{}),
+			mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-new"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"fw-new"}, "FirewallRule", map[string]string{firewallRuleOwnerTagKey: firewallRuleOwnerTagValue}).
+				Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}}, // Not yet in CloudStack
+		if _, err := newLB(mockFirewall, mockTags).updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
+	})
 
-		// Should succeed with partial match - only node-1 matched
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
+	t.Run("identical foreign rule is reused", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 1, FirewallRules: []*cloudstack.FirewallRule{foreignRule},
+		}, nil)
+
+		updated, err := newLB(mockFirewall, nil).updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"192.168.0.0/16"})
 		if err != nil {
-			t.Fatalf("unexpected error (should tolerate partial match): %v", err)
-		}
-		if len(hostIDs) != 1 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 1)
-		}
-		if hostIDs[0] != "vm-1" {
-			t.Errorf("hostIDs[0] = %q, want %q", hostIDs[0], "vm-1")
+			t.Fatalf("unexpected error: %v", err)
 		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
+		if updated {
+			t.Errorf("updated = true, want false")
 		}
 	})
 
-	t.Run("partial match - VM exists but has no NICs yet", func(t *testing.T) {
+	t.Run("rule is deleted again when tagging fails", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 2,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-				{
-					Id:   "vm-2",
-					Name: "node-2",
-					Nic:  []cloudstack.Nic{}, // No NICs yet - still provisioning
-				},
-			},
-		}
-
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil),
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(&cloudstack.CreateFirewallRuleParams{}),
+			mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-new"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(nil, errors.New("tag error")),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-new").Return(&cloudstack.DeleteFirewallRuleParams{}),
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+		)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
+		if _, err := newLB(mockFirewall, mockTags).updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"}); err == nil {
+			t.Fatalf("expected error")
 		}
+	})
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
-		}
+	t.Run("delete only removes owned rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
 
-		// Should succeed with partial match - node-2 skipped due to no NICs
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
-		if err != nil {
-			t.Fatalf("unexpected error (should tolerate VM with no NICs): %v", err)
-		}
-		if len(hostIDs) != 1 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 1)
-		}
-		if hostIDs[0] != "vm-1" {
-			t.Errorf("hostIDs[0] = %q, want %q", hostIDs[0], "vm-1")
-		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2, FirewallRules: []*cloudstack.FirewallRule{foreignRule, ownedRule},
+		}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-owned").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+
+		if _, err := newLB(mockFirewall, nil).deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("match by ProviderID when name does not match", func(t *testing.T) {
+	t.Run("configured owner tag", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 1,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-abc-123",
-					Name: "different-name", // Name does not match node name
-					Nic: []cloudstack.Nic{
-						{Networkid: "net-123"},
-					},
-				},
-			},
+		cs := &CSCloud{ownerTagKey: "managed-by", ownerTagValue: "ccm-{cluster}"}
+		clusterRule := &cloudstack.FirewallRule{
+			Id: "fw-cluster", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "172.16.0.0/12",
+			Tags: []cloudstack.Tags{{Key: "managed-by", Value: "ccm-prod"}},
+		}
+		otherClusterRule := &cloudstack.FirewallRule{
+			Id: "fw-other-cluster", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "100.64.0.0/10",
+			Tags: []cloudstack.Tags{{Key: "managed-by", Value: "ccm-staging"}},
 		}
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+		// Only the rule with the tag of this cluster is deleted, the rule with the default tag is kept as well.
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 3, FirewallRules: []*cloudstack.FirewallRule{ownedRule, clusterRule, otherClusterRule},
+		}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-cluster").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(&cloudstack.CreateFirewallRuleParams{})
+		mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-new"}, nil)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"fw-new"}, "FirewallRule", map[string]string{"managed-by": "ccm-prod"}).
+			Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil)
+
+		lb := newLB(mockFirewall, mockTags)
+		lb.ownerTagKey, lb.ownerTagValue = cs.ownerTag("prod")
+		if _, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rules with a previous owner tag are still owned", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
 
 		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
+			ownerTagKey: "managed-by", ownerTagValue: "ccm-{cluster}",
+			previousOwnerTags: []cloudstack.Tags{{Key: firewallRuleOwnerTagKey, Value: firewallRuleOwnerTagValue}, {Key: "owner", Value: "{cluster}"}},
+		}
+		// Tags listed from CloudStack carry more fields than the key and value.
+		previousRule := &cloudstack.FirewallRule{
+			Id: "fw-previous", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "100.64.0.0/10",
+			Tags: []cloudstack.Tags{{Key: "owner", Value: "prod", Resourceid: "fw-previous", Resourcetype: "FirewallRule"}},
+		}
+		otherClusterRule := &cloudstack.FirewallRule{
+			Id: "fw-other-cluster", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "198.18.0.0/15",
+			Tags: []cloudstack.Tags{{Key: "owner", Value: "staging"}},
 		}
 
-		nodes := []*corev1.Node{
-			{
-				ObjectMeta: metav1.ObjectMeta{Name: "my-node"},
-				Spec: corev1.NodeSpec{
-					ProviderID: "cloudstack:///vm-abc-123", // Matches by VM ID
-				},
-			},
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 4, FirewallRules: []*cloudstack.FirewallRule{foreignRule, ownedRule, previousRule, otherClusterRule},
+		}, nil)
+		for _, id := range []string{"fw-owned", "fw-previous"} {
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams(id).Return(&cloudstack.DeleteFirewallRuleParams{})
 		}
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil).Times(2)
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
-		if err != nil {
+		lb := newLB(mockFirewall, nil)
+		lb.ownerTagKey, lb.ownerTagValue = cs.ownerTag("prod")
+		lb.previousOwnerTags = cs.previousOwnerTagsOf("prod")
+		if _, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if len(hostIDs) != 1 {
-			t.Errorf("hostIDs count = %d, want %d", len(hostIDs), 1)
-		}
-		if hostIDs[0] != "vm-abc-123" {
-			t.Errorf("hostIDs[0] = %q, want %q", hostIDs[0], "vm-abc-123")
-		}
-		if networkID != "net-123" {
-			t.Errorf("networkID = %q, want %q", networkID, "net-123")
-		}
 	})
+}
 
-	t.Run("all VMs have no NICs - should error", func(t *testing.T) {
+func TestListFirewallRules(t *testing.T) {
+	// pageOfRules returns n TCP rules for ports starting at firstPort.
+	pageOfRules := func(firstPort, n int) []*cloudstack.FirewallRule {
+		rules := make([]*cloudstack.FirewallRule, 0, n)
+		for i := range n {
+			port := firstPort + i
+			rules = append(rules, &cloudstack.FirewallRule{
+				Id: fmt.Sprintf("fw-%d", port), Protocol: "tcp", Startport: port, Endport: port, Cidrlist: defaultAllowedCIDR,
+			})
+		}
+
+		return rules
+	}
+
+	t.Run("rules on later pages are matched", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		listParams := &cloudstack.ListVirtualMachinesParams{}
-		listResp := &cloudstack.ListVirtualMachinesResponse{
-			Count: 2,
-			VirtualMachines: []*cloudstack.VirtualMachine{
-				{
-					Id:   "vm-1",
-					Name: "node-1",
-					Nic:  []cloudstack.Nic{},
-				},
-				{
-					Id:   "vm-2",
-					Name: "node-2",
-					Nic:  []cloudstack.Nic{},
-				},
-			},
-		}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams)
+
+		var pages []int
+		mockFirewall.EXPECT().ListFirewallRules(listParams).DoAndReturn(func(p *cloudstack.ListFirewallRulesParams) (*cloudstack.ListFirewallRulesResponse, error) {
+			page, _ := p.GetPage()
+			pages = append(pages, page)
+			if page == 1 {
+				return &cloudstack.ListFirewallRulesResponse{Count: firewallRulesPageSize + 1, FirewallRules: pageOfRules(1000, firewallRulesPageSize)}, nil
+			}
 
-		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
-		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+			return &cloudstack.ListFirewallRulesResponse{Count: firewallRulesPageSize + 1, FirewallRules: pageOfRules(80, 1)}, nil
+		}).Times(2)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				VirtualMachine: mockVM,
-			},
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall},
+			ipAddr:           "203.0.113.1",
 		}
 
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		// The rule for port 80 is on the second page, so no duplicate is created.
+		changed, err := lb.updateFirewallRule("ip-1", 80, LoadBalancerProtocolTCP, []string{defaultAllowedCIDR})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-
-		// Should error - all VMs have no NICs, zero backends
-		_, _, err := cs.verifyHosts(nodes)
-		if err == nil {
-			t.Fatalf("expected error when all VMs have no NICs")
+		if changed {
+			t.Errorf("changed = true, want the rule on the second page to be reused")
 		}
-		if !strings.Contains(err.Error(), "could not match any") {
-			t.Errorf("error message = %q, want to contain 'could not match any'", err.Error())
+		if !slices.Equal(pages, []int{1, 2}) {
+			t.Errorf("listed pages %v, want [1 2]", pages)
+		}
+		if pageSize, _ := listParams.GetPagesize(); pageSize != firewallRulesPageSize {
+			t.Errorf("page size = %d, want %d", pageSize, firewallRulesPageSize)
 		}
 	})
-}
 
-func TestReconcileHostsForRule(t *testing.T) {
-	t.Run("hosts already correct - no-op", func(t *testing.T) {
+	t.Run("truncated listing is an error", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
-
-		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams)
-		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
-			Count: 2,
-			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
-				{Id: "vm-1"},
-				{Id: "vm-2"},
-			},
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 3, FirewallRules: pageOfRules(80, 2),
 		}, nil)
 
 		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-			},
+			CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall},
+			ipAddr:           "203.0.113.1",
 		}
 
-		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
-		err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"})
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
+		// Creating a rule from an incomplete listing could duplicate the missing one.
+		_, err := lb.updateFirewallRule("ip-1", 82, LoadBalancerProtocolTCP, []string{defaultAllowedCIDR})
+		if err == nil || !strings.Contains(err.Error(), "listed 2 of 3 rules") {
+			t.Errorf("err = %v, want to contain 'listed 2 of 3 rules'", err)
 		}
 	})
+}
 
-	t.Run("missing hosts get assigned", func(t *testing.T) {
+func TestDeleteFirewallRule(t *testing.T) {
+	t.Run("delete matching rule", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
-		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		listResp := &cloudstack.ListFirewallRulesResponse{
+			Count: 1,
+			FirewallRules: []*cloudstack.FirewallRule{
+				{
+					Id:          "fw-123",
+					Protocol:    "tcp",
+					Startport:   80,
+					Endport:     80,
+					Ipaddressid: "ip-123",
+				},
+			},
+		}
+
+		deleteParams := &cloudstack.DeleteFirewallRuleParams{}
 
 		gomock.InOrder(
-			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
-			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
-				Count:                     0,
-				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{},
-			}, nil),
-			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
-			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-123").Return(deleteParams),
+			mockFirewall.EXPECT().DeleteFirewallRule(deleteParams).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				Firewall: mockFirewall,
 			},
 		}
 
-		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
-		err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"})
+		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if !deleted {
+			t.Errorf("deleted = false, want true")
+		}
 	})
 
-	t.Run("stale hosts removed and new hosts assigned", func(t *testing.T) {
+	t.Run("no matching rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
-		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
-		removeParams := &cloudstack.RemoveFromLoadBalancerRuleParams{}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		listResp := &cloudstack.ListFirewallRulesResponse{
+			Count:         0,
+			FirewallRules: []*cloudstack.FirewallRule{},
+		}
 
 		gomock.InOrder(
-			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
-			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
-				Count: 2,
-				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
-					{Id: "vm-old-1"},
-					{Id: "vm-old-2"},
-				},
-			}, nil),
-			// Assign new hosts BEFORE removing old ones
-			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
-			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
-			mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams("rule-1").Return(removeParams),
-			mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil),
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				Firewall: mockFirewall,
 			},
 		}
 
-		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
-		err := lb.reconcileHostsForRule(rule, []string{"vm-new-1", "vm-new-2"})
+		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if deleted {
+			t.Errorf("deleted = true, want false")
+		}
 	})
 
-	t.Run("assign failure preserves old hosts", func(t *testing.T) {
+	t.Run("error listing rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
-		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		apiErr := errors.New("list API error")
 
 		gomock.InOrder(
-			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
-			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
-				Count: 1,
-				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
-					{Id: "vm-old"},
-				},
-			}, nil),
-			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
-			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(nil, errors.New("assign API error")),
-			// removeHostsFromRule should NOT be called because assign failed
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, apiErr),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				Firewall: mockFirewall,
 			},
 		}
 
-		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
-		err := lb.reconcileHostsForRule(rule, []string{"vm-new"})
+		_, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
 		if err == nil {
 			t.Fatalf("expected error")
 		}
-		if !strings.Contains(err.Error(), "old hosts preserved") {
-			t.Errorf("error message = %q, want to contain 'old hosts preserved'", err.Error())
+		if !strings.Contains(err.Error(), "error fetching firewall rules") {
+			t.Errorf("error message = %q, want to contain 'error fetching firewall rules'", err.Error())
 		}
 	})
 
-	t.Run("list instances error", func(t *testing.T) {
+	t.Run("error deleting rule", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		listParams := &cloudstack.ListFirewallRulesParams{}
+		listResp := &cloudstack.ListFirewallRulesResponse{
+			Count: 1,
+			FirewallRules: []*cloudstack.FirewallRule{
+				{
+					Id:          "fw-123",
+					Protocol:    "tcp",
+					Startport:   80,
+					Endport:     80,
+					Ipaddressid: "ip-123",
+				},
+			},
+		}
 
-		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams)
-		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(nil, errors.New("API error"))
+		deleteParams := &cloudstack.DeleteFirewallRuleParams{}
+		deleteErr := errors.New("delete API error")
+
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(listParams),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(listResp, nil),
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-123").Return(deleteParams),
+			mockFirewall.EXPECT().DeleteFirewallRule(deleteParams).Return(nil, deleteErr),
+		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				Firewall: mockFirewall,
 			},
 		}
 
-		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
-		err := lb.reconcileHostsForRule(rule, []string{"vm-1"})
-		if err == nil {
-			t.Fatalf("expected error")
+		deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
+		// Should return false if deletion failed
+		if deleted {
+			t.Errorf("deleted = true, want false")
 		}
-		if !strings.Contains(err.Error(), "error retrieving associated instances") {
-			t.Errorf("error message = %q, want to contain 'error retrieving associated instances'", err.Error())
+		if !errors.Is(err, deleteErr) {
+			t.Errorf("error = %v, want %v", err, deleteErr)
 		}
 	})
 }
 
-// --- Fix A tests ---
+func TestGenerateLoadBalancerStatusPorts(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				{Name: "https", Port: 443},
+			},
+		},
+	}
+	lb := &loadBalancer{ipAddr: "10.0.0.1", portErrors: map[int32]string{53: PortErrorStaleFirewallRules}}
+	want := []corev1.PortStatus{
+		{Port: 80, Protocol: corev1.ProtocolTCP},
+		{Port: 53, Protocol: corev1.ProtocolUDP, Error: ptr.To(PortErrorStaleFirewallRules)},
+		{Port: 443, Protocol: corev1.ProtocolTCP},
+	}
+
+	status := lb.generateLoadBalancerStatus(service)
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != "10.0.0.1" {
+		t.Fatalf("status = %+v, want a single ingress with IP 10.0.0.1", status)
+	}
+	if !cmp.Equal(status.Ingress[0].Ports, want) {
+		t.Errorf("port status = %+v, want %+v", status.Ingress[0].Ports, want)
+	}
+
+	service.Annotations = map[string]string{ServiceAnnotationLoadBalancerLoadbalancerHostname: "lb.example.com"}
+	status = lb.generateLoadBalancerStatus(service)
+	if len(status.Ingress) != 1 || status.Ingress[0].Hostname != "lb.example.com" {
+		t.Fatalf("status = %+v, want a single ingress with hostname lb.example.com", status)
+	}
+	if !cmp.Equal(status.Ingress[0].Ports, want) {
+		t.Errorf("port status of hostname = %+v, want %+v", status.Ingress[0].Ports, want)
+	}
+}
+
+func TestFirewallRuleSpanningPorts(t *testing.T) {
+	ranged := &cloudstack.FirewallRule{Id: "fw-range", Protocol: "tcp", Startport: 80, Endport: 81, Cidrlist: "10.0.0.0/8", Ipaddressid: "ip-123"}
+	lbRules := func(ports ...string) *cloudstack.ListLoadBalancerRulesResponse {
+		resp := &cloudstack.ListLoadBalancerRulesResponse{Count: len(ports)}
+		for _, port := range ports {
+			resp.LoadBalancerRules = append(resp.LoadBalancerRules, &cloudstack.LoadBalancerRule{
+				Id: "rule-" + port, Name: "K8s_svc_cluster_default_foo-tcp-" + port, Publicport: port, Protocol: "tcp",
+			})
+		}
+
+		return resp
+	}
 
-func TestFilterRulesByPrefix(t *testing.T) {
 	tests := []struct {
-		name   string
-		rules  []*cloudstack.LoadBalancerRule
-		prefix string
-		want   []string // expected rule names
+		name          string
+		firewallRules []*cloudstack.FirewallRule
+		lbRules       *cloudstack.ListLoadBalancerRulesResponse
+		releasedRules map[string]bool
+		keepRanged    bool
+		wantDeleted   bool
 	}{
 		{
-			name: "exact prefix match",
-			rules: []*cloudstack.LoadBalancerRule{
-				{Name: "K8s_svc_c_ns_foo-tcp-80"},
-				{Name: "K8s_svc_c_ns_foo-tcp-443"},
-			},
-			prefix: "K8s_svc_c_ns_foo-",
-			want:   []string{"K8s_svc_c_ns_foo-tcp-80", "K8s_svc_c_ns_foo-tcp-443"},
+			name:          "kept while another active port needs it",
+			firewallRules: []*cloudstack.FirewallRule{ranged},
+			lbRules:       lbRules("80", "81"),
 		},
 		{
-			name: "filters out superset names",
-			rules: []*cloudstack.LoadBalancerRule{
-				{Name: "K8s_svc_c_ns_foo-tcp-80"},
-				{Name: "K8s_svc_c_ns_foobar-tcp-80"},
+			name:          "deleted when no other active port is in range",
+			firewallRules: []*cloudstack.FirewallRule{ranged},
+			lbRules:       lbRules("80", "82"),
+			wantDeleted:   true,
+		},
+		{
+			name: "deleted when the other port has its own rule",
+			firewallRules: []*cloudstack.FirewallRule{
+				ranged,
+				{Id: "fw-81", Protocol: "tcp", Startport: 81, Endport: 81, Cidrlist: "10.0.0.0/8", Ipaddressid: "ip-123"},
 			},
-			prefix: "K8s_svc_c_ns_foo-",
-			want:   []string{"K8s_svc_c_ns_foo-tcp-80"},
+			lbRules:     lbRules("80", "81"),
+			wantDeleted: true,
 		},
 		{
-			name:   "empty input",
-			rules:  []*cloudstack.LoadBalancerRule{},
-			prefix: "K8s_svc_c_ns_foo-",
-			want:   nil,
+			name:          "deleted when the other port is released as well",
+			firewallRules: []*cloudstack.FirewallRule{ranged},
+			lbRules:       lbRules("80", "81"),
+			releasedRules: map[string]bool{"rule-80": true, "rule-81": true},
+			wantDeleted:   true,
 		},
 		{
-			name: "no matches",
-			rules: []*cloudstack.LoadBalancerRule{
-				{Name: "K8s_svc_c_ns_bar-tcp-80"},
-				{Name: "K8s_svc_c_ns_baz-tcp-80"},
-			},
-			prefix: "K8s_svc_c_ns_foo-",
-			want:   nil,
+			name:          "kept with keep-ranged-firewall-rules",
+			firewallRules: []*cloudstack.FirewallRule{ranged},
+			keepRanged:    true,
 		},
 		{
-			name:   "nil input",
-			rules:  nil,
-			prefix: "K8s_svc_c_ns_foo-",
-			want:   nil,
+			name: "single port rule deleted with keep-ranged-firewall-rules",
+			firewallRules: []*cloudstack.FirewallRule{
+				{Id: "fw-range", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "10.0.0.0/8", Ipaddressid: "ip-123"},
+			},
+			keepRanged:  true,
+			wantDeleted: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := filterRulesByPrefix(tt.rules, tt.prefix)
-			var gotNames []string
-			for _, r := range got {
-				gotNames = append(gotNames, r.Name)
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: len(tt.firewallRules), FirewallRules: tt.firewallRules,
+			}, nil)
+			lbListParams := &cloudstack.ListLoadBalancerRulesParams{}
+			if tt.lbRules != nil {
+				mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(lbListParams)
+				mockLB.EXPECT().ListLoadBalancerRules(lbListParams).Return(tt.lbRules, nil)
 			}
-			if len(gotNames) != len(tt.want) {
-				t.Fatalf("filterRulesByPrefix() returned %d rules, want %d: got %v", len(gotNames), len(tt.want), gotNames)
+			if tt.wantDeleted {
+				mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-range").Return(&cloudstack.DeleteFirewallRuleParams{})
+				mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
 			}
-			for i, name := range gotNames {
-				if name != tt.want[i] {
-					t.Errorf("filterRulesByPrefix()[%d].Name = %q, want %q", i, name, tt.want[i])
-				}
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall, LoadBalancer: mockLB},
+				releasedRules:    tt.releasedRules,
+
+				keepRangedFirewallRules: tt.keepRanged,
+			}
+
+			deleted, err := lb.deleteFirewallRule("ip-123", 80, LoadBalancerProtocolTCP)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			if id, _ := lbListParams.GetPublicipid(); tt.lbRules != nil && id != "ip-123" {
+				t.Errorf("load balancer rules listed for IP %q, want ip-123", id)
 			}
 		})
 	}
-}
 
-func TestGetLoadBalancerByNameFiltering(t *testing.T) {
-	t.Run("keyword results filtered to exact prefix", func(t *testing.T) {
+	t.Run("update keeps a ranged rule another port needs", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRulesParams{}
-
-		// CloudStack returns both "foo" and "foobar" rules due to LIKE matching
-		listResp := &cloudstack.ListLoadBalancerRulesResponse{
-			Count: 2,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{Name: "K8s_svc_c_ns_foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
-				{Name: "K8s_svc_c_ns_foobar-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
-			},
-		}
-
-		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams)
-		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(listResp, nil)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 1, FirewallRules: []*cloudstack.FirewallRule{ranged},
+		}, nil)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(lbRules("80", "81"), nil)
+		createParams := &cloudstack.CreateFirewallRuleParams{}
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-123", "tcp").Return(createParams)
+		mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-80"}, nil)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-			},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall, LoadBalancer: mockLB}}
 
-		lb, err := cs.getLoadBalancerByName("K8s_svc_c_ns_foo", "")
+		updated, err := lb.updateFirewallRule("ip-123", 80, LoadBalancerProtocolTCP, []string{"192.168.0.0/16"})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if len(lb.rules) != 1 {
-			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
-		}
-		if _, ok := lb.rules["K8s_svc_c_ns_foo-tcp-80"]; !ok {
-			t.Errorf("expected rule K8s_svc_c_ns_foo-tcp-80 to be present")
+		if !updated {
+			t.Errorf("updated = false, want true")
 		}
-		if lb.ipAddr != "1.2.3.4" {
-			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "1.2.3.4")
+		if start, _ := createParams.GetStartport(); start != 80 {
+			t.Errorf("created rule starts at port %d, want 80", start)
 		}
 	})
 
-	t.Run("legacy fallback with filtering", func(t *testing.T) {
+	t.Run("update reuses a ranged rule with the same CIDRs", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRulesParams{}
-
-		// First call (modern name) returns foobar rules but NOT foo rules → filtered to 0
-		modernResp := &cloudstack.ListLoadBalancerRulesResponse{
-			Count: 1,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{Name: "K8s_svc_c_ns_foobar-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
-			},
-		}
-
-		// Second call (legacy name) returns matching rule
-		legacyResp := &cloudstack.ListLoadBalancerRulesResponse{
-			Count: 1,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{Name: "a1b2c3d4-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
-			},
-		}
-
-		gomock.InOrder(
-			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
-			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(modernResp, nil),
-			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(legacyResp, nil),
-		)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 1, FirewallRules: []*cloudstack.FirewallRule{ranged},
+		}, nil)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-			},
-		}
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall}}
 
-		lb, err := cs.getLoadBalancerByName("K8s_svc_c_ns_foo", "a1b2c3d4")
+		updated, err := lb.updateFirewallRule("ip-123", 81, LoadBalancerProtocolTCP, []string{"10.0.0.0/8"})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if lb.name != "a1b2c3d4" {
-			t.Errorf("lb.name = %q, want %q", lb.name, "a1b2c3d4")
-		}
-		if len(lb.rules) != 1 {
-			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
-		}
-		if lb.ipAddr != "1.2.3.4" {
-			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "1.2.3.4")
+		if updated {
+			t.Errorf("updated = true, want false")
 		}
 	})
+}
 
-	t.Run("legacy results also filtered", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
+func TestFirewallRuleEvents(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	oldRule := &cloudstack.FirewallRule{Id: "fw-old", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "10.0.0.0/8", Ipaddress: "1.2.3.4"}
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(2)
+			gomock.InOrder(
+				mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+					Count: 1, FirewallRules: []*cloudstack.FirewallRule{oldRule},
+				}, nil),
+				mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+					Count: 1, FirewallRules: []*cloudstack.FirewallRule{
+						{Id: "fw-new", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "192.168.0.0/16", Ipaddress: "1.2.3.4"},
+					},
+				}, nil),
+			)
+			mockFirewall.EXPECT().NewDeleteFirewallRuleParams(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleParams{}).Times(2)
+			mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil).Times(2)
+			mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(&cloudstack.CreateFirewallRuleParams{})
+			mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-new"}, nil)
+
+			recorder := record.NewFakeRecorder(10)
+			cs := &CSCloud{eventRecorder: recorder, firewallRuleEvents: enabled}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Firewall: mockFirewall},
+				ipAddr:           "1.2.3.4",
+			}
+			cs.setFirewallRuleEvents(lb, service)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+			if _, err := lb.updateFirewallRule("ip-1", 80, LoadBalancerProtocolTCP, []string{"192.168.0.0/16"}); err != nil {
+				t.Fatalf("unexpected error updating the firewall rule: %v", err)
+			}
+			if _, err := lb.deleteFirewallRule("ip-1", 80, LoadBalancerProtocolTCP); err != nil {
+				t.Fatalf("unexpected error deleting the firewall rule: %v", err)
+			}
 
-		// First call: no matching rules after filtering
-		modernResp := &cloudstack.ListLoadBalancerRulesResponse{
-			Count:             0,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
-		}
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			var want []string
+			if enabled {
+				want = []string{
+					"Normal DeletedFirewallRule Deleted firewall rule fw-old {[10.0.0.0/8] -> 1.2.3.4:[80-80] (tcp)}",
+					"Normal CreatedFirewallRule Created firewall rule fw-new {[192.168.0.0/16] -> 1.2.3.4:[80-80] (tcp)}",
+					"Normal DeletedFirewallRule Deleted firewall rule fw-new {[192.168.0.0/16] -> 1.2.3.4:[80-80] (tcp)}",
+				}
+			}
+			if !slices.Equal(events, want) {
+				t.Errorf("events = %q, want %q", events, want)
+			}
+		})
+	}
+}
 
-		// Second call (legacy): returns both exact match and superset
-		legacyResp := &cloudstack.ListLoadBalancerRulesResponse{
+func TestCheckPublicIPConflict(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	ownRule := &cloudstack.LoadBalancerRule{Name: "K8s_svc_cluster_default_foo-tcp-80", Publicport: "80", Protocol: "tcp"}
+	otherRule := func(port, protocol string) *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{Name: "K8s_svc_cluster_default_bar-" + protocol + "-" + port, Publicport: port, Protocol: protocol}
+	}
+
+	tests := []struct {
+		name      string
+		rules     []*cloudstack.LoadBalancerRule
+		ipSharing string
+		wantInUse bool
+	}{
+		{name: "no rules", ipSharing: ipSharingAllow},
+		{name: "own rule", rules: []*cloudstack.LoadBalancerRule{ownRule}, ipSharing: ipSharingDeny},
+		{name: "other port shared", rules: []*cloudstack.LoadBalancerRule{otherRule("443", "tcp")}, ipSharing: ipSharingAllow},
+		{name: "other protocol shared", rules: []*cloudstack.LoadBalancerRule{otherRule("80", "udp")}, ipSharing: ipSharingAllow},
+		{name: "same port", rules: []*cloudstack.LoadBalancerRule{otherRule("80", "tcp")}, ipSharing: ipSharingAllow, wantInUse: true},
+		{name: "same port with PROXY protocol", rules: []*cloudstack.LoadBalancerRule{otherRule("80", "tcp-proxy")}, ipSharing: ipSharingAllow, wantInUse: true},
+		{name: "sharing denied", rules: []*cloudstack.LoadBalancerRule{otherRule("443", "tcp")}, ipSharing: ipSharingDeny, wantInUse: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			listParams := &cloudstack.ListLoadBalancerRulesParams{}
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams)
+			mockLB.EXPECT().ListLoadBalancerRules(listParams).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: len(tt.rules), LoadBalancerRules: tt.rules,
+			}, nil)
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+				name:             "K8s_svc_cluster_default_foo",
+				ipAddr:           "10.0.0.1",
+				ipAddrID:         "ip-1",
+			}
+
+			err := lb.checkPublicIPConflict(service, tt.ipSharing)
+			if got := errors.Is(err, errIPInUse); got != tt.wantInUse {
+				t.Errorf("checkPublicIPConflict() = %v, want in use %v", err, tt.wantInUse)
+			}
+			if id, _ := listParams.GetPublicipid(); id != "ip-1" {
+				t.Errorf("load balancer rules listed for IP %q, want ip-1", id)
+			}
+		})
+	}
+}
+
+func TestVerifyHosts(t *testing.T) {
+	t.Run("all hosts in same network", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
 			Count: 2,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{Name: "a1b2-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
-				{Name: "a1b2c3d4-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
+				{
+					Id:   "vm-2",
+					Name: "node-2",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
 			},
 		}
 
-		gomock.InOrder(
-			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
-			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(modernResp, nil),
-			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(legacyResp, nil),
-		)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
 
 		cs := &CSCloud{
 			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				VirtualMachine: mockVM,
 			},
 		}
 
-		lb, err := cs.getLoadBalancerByName("K8s_svc_c_ns_foo", "a1b2")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if lb.name != "a1b2" {
-			t.Errorf("lb.name = %q, want %q", lb.name, "a1b2")
-		}
-		if len(lb.rules) != 1 {
-			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
+		if len(result.hostIDs) != 2 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 2)
 		}
-		if _, ok := lb.rules["a1b2-tcp-80"]; !ok {
-			t.Errorf("expected rule a1b2-tcp-80 to be present")
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
 		}
 	})
-}
-
-// --- Fix B tests ---
 
-func TestLookupPublicIPAddress(t *testing.T) {
-	t.Run("found and allocated", func(t *testing.T) {
+	t.Run("hosts in different networks", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		listParams := &cloudstack.ListPublicIpAddressesParams{}
-		resp := &cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 2,
+			VirtualMachines: []*cloudstack.VirtualMachine{
 				{
-					Id:        "ip-123",
-					Ipaddress: "203.0.113.1",
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
+				{
+					Id:   "vm-2",
+					Name: "node-2",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-456"},
+					},
 				},
 			},
 		}
 
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
 			},
 		}
 
-		found, err := lb.lookupPublicIPAddress("203.0.113.1")
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if !found {
-			t.Fatalf("expected found = true")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
 		}
-		if lb.ipAddr != "203.0.113.1" {
-			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
+
+		_, err := cs.verifyHosts(t.Context(), nodes)
+		if !errors.Is(err, errHostsInDifferentNetworks) {
+			t.Fatalf("err = %v, want %v", err, errHostsInDifferentNetworks)
 		}
-		if lb.ipAddrID != "ip-123" {
-			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-123")
+		if want := "network net-123: node-1; network net-456: node-2"; !strings.Contains(err.Error(), want) {
+			t.Errorf("error message = %q, want to contain %q", err.Error(), want)
 		}
 	})
 
-	t.Run("not found", func(t *testing.T) {
+	t.Run("no matching hosts", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		listParams := &cloudstack.ListPublicIpAddressesParams{}
-		resp := &cloudstack.ListPublicIpAddressesResponse{
-			Count:             0,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{},
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count:           0,
+			VirtualMachines: []*cloudstack.VirtualMachine{},
 		}
 
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
 			},
 		}
 
-		found, err := lb.lookupPublicIPAddress("203.0.113.1")
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if found {
-			t.Fatalf("expected found = false")
-		}
-		if lb.ipAddr != "" {
-			t.Errorf("ipAddr should be empty, got %q", lb.ipAddr)
-		}
-	})
-
-	t.Run("API error", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
-
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		listParams := &cloudstack.ListPublicIpAddressesParams{}
-
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(nil, errors.New("API error"))
-
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
-			},
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
 		}
 
-		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		_, err := cs.verifyHosts(t.Context(), nodes)
 		if err == nil {
 			t.Fatalf("expected error")
 		}
-		if found {
-			t.Fatalf("expected found = false on error")
-		}
-		if !strings.Contains(err.Error(), "error looking up IP address") {
-			t.Errorf("error = %q, want to contain 'error looking up IP address'", err.Error())
+		if !strings.Contains(err.Error(), "could not match any") {
+			t.Errorf("error message = %q, want to contain 'could not match any'", err.Error())
 		}
 	})
 
-	t.Run("project ID propagation", func(t *testing.T) {
+	t.Run("FQDN node names", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		listParams := &cloudstack.ListPublicIpAddressesParams{}
-		resp := &cloudstack.ListPublicIpAddressesResponse{
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
 			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			VirtualMachines: []*cloudstack.VirtualMachine{
 				{
-					Id:        "ip-123",
-					Ipaddress: "203.0.113.1",
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
 				},
 			},
 		}
 
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
 
-		lb := &loadBalancer{
-			CloudStackClient: &cloudstack.CloudStackClient{
-				Address: mockAddress,
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
 			},
-			projectID: "proj-456",
 		}
 
-		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1.example.com"}},
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if !found {
-			t.Fatalf("expected found = true")
+		if len(result.hostIDs) != 1 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 1)
+		}
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
 		}
 	})
-}
-
-// --- Fix C tests ---
-
-// setupGetLoadBalancerByNameEmpty sets up mock expectations for getLoadBalancerByName
-// when it should return an empty result (no matching LB rules). This requires two
-// ListLoadBalancerRules calls: one for the modern name and one for the legacy name.
-func setupGetLoadBalancerByNameEmpty(mockLB *cloudstack.MockLoadBalancerServiceIface) {
-	emptyResp := &cloudstack.ListLoadBalancerRulesResponse{Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{}}
-	// Modern name call
-	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
-	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil)
-	// Legacy name fallback call
-	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil)
-}
 
-func TestEnsureLoadBalancerDeletedOrphanedIP(t *testing.T) {
-	t.Run("orphaned IP released via annotation", func(t *testing.T) {
+	t.Run("case-insensitive matching", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-
-		// getLoadBalancerByName returns no rules (2 ListLoadBalancerRules calls)
-		setupGetLoadBalancerByNameEmpty(mockLB)
-
-		// lookupPublicIPAddress finds the orphaned IP
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
 			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-orphan", Ipaddress: "10.0.0.1"},
-			},
-		}, nil)
-
-		// shouldReleaseLoadBalancerIP: no other rules on this IP
-		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
-		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
-			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
-		}, nil)
-
-		// releaseLoadBalancerIP
-		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-orphan").Return(&cloudstack.DisassociateIpAddressParams{})
-		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
-
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-1",
+					Name: "NODE-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
 				},
 			},
 		}
 
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+
 		cs := &CSCloud{
 			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
+				VirtualMachine: mockVM,
 			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
 		}
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if len(result.hostIDs) != 1 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 1)
+		}
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
+		}
 	})
 
-	t.Run("no annotation returns nil", func(t *testing.T) {
+	t.Run("partial match during rolling upgrade - some nodes not yet in CloudStack", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		setupGetLoadBalancerByNameEmpty(mockLB)
-
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		// Only node-1 exists in CloudStack; node-2 is still being provisioned.
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 1,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
 			},
 		}
 
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+
 		cs := &CSCloud{
 			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
+				VirtualMachine: mockVM,
 			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
 		}
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}}, // Not yet in CloudStack
+		}
+
+		// Should succeed with partial match - only node-1 matched
+		result, err := cs.verifyHosts(t.Context(), nodes)
 		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
+			t.Fatalf("unexpected error (should tolerate partial match): %v", err)
+		}
+		if len(result.hostIDs) != 1 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 1)
+		}
+		if result.hostIDs[0] != "vm-1" {
+			t.Errorf("hostIDs[0] = %q, want %q", result.hostIDs[0], "vm-1")
+		}
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
 		}
 	})
 
-	t.Run("IP already gone returns nil", func(t *testing.T) {
+	t.Run("partial match - VM exists but has no NICs yet", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-
-		setupGetLoadBalancerByNameEmpty(mockLB)
-
-		// lookupPublicIPAddress: not found
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 0, PublicIpAddresses: []*cloudstack.PublicIpAddress{},
-		}, nil)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 2,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
+				{
+					Id:   "vm-2",
+					Name: "node-2",
+					Nic:  []cloudstack.Nic{}, // No NICs yet - still provisioning
+				},
+			},
+		}
+
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
+			},
+		}
+
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		}
+
+		// Should succeed with partial match - node-2 skipped due to no NICs
+		result, err := cs.verifyHosts(t.Context(), nodes)
+		if err != nil {
+			t.Fatalf("unexpected error (should tolerate VM with no NICs): %v", err)
+		}
+		if len(result.hostIDs) != 1 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 1)
+		}
+		if result.hostIDs[0] != "vm-1" {
+			t.Errorf("hostIDs[0] = %q, want %q", result.hostIDs[0], "vm-1")
+		}
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
+		}
+	})
+
+	t.Run("match by ProviderID when name does not match", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 1,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-abc-123",
+					Name: "different-name", // Name does not match node name
+					Nic: []cloudstack.Nic{
+						{Networkid: "net-123"},
+					},
+				},
+			},
+		}
+
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
+			},
+		}
+
+		nodes := []*corev1.Node{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-node"},
+				Spec: corev1.NodeSpec{
+					ProviderID: "cloudstack:///vm-abc-123", // Matches by VM ID
+				},
+			},
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.hostIDs) != 1 {
+			t.Errorf("hostIDs count = %d, want %d", len(result.hostIDs), 1)
+		}
+		if result.hostIDs[0] != "vm-abc-123" {
+			t.Errorf("hostIDs[0] = %q, want %q", result.hostIDs[0], "vm-abc-123")
+		}
+		if result.networkID != "net-123" {
+			t.Errorf("networkID = %q, want %q", result.networkID, "net-123")
+		}
+	})
+
+	t.Run("all VMs have no NICs - should error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listParams := &cloudstack.ListVirtualMachinesParams{}
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 2,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{
+					Id:   "vm-1",
+					Name: "node-1",
+					Nic:  []cloudstack.Nic{},
+				},
+				{
+					Id:   "vm-2",
+					Name: "node-2",
+					Nic:  []cloudstack.Nic{},
+				},
+			},
+		}
+
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
+			},
+		}
+
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		}
+
+		// Should error - all VMs have no NICs, zero backends
+		_, err := cs.verifyHosts(t.Context(), nodes)
+		if err == nil {
+			t.Fatalf("expected error when all VMs have no NICs")
+		}
+		if !strings.Contains(err.Error(), "could not match any") {
+			t.Errorf("error message = %q, want to contain 'could not match any'", err.Error())
+		}
+	})
+
+	t.Run("skipped and unmatched nodes are reported", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 3,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+				{Id: "vm-2", Name: "node-2"},
+				{Id: "vm-4", Name: "renamed", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			},
+		}, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+		}
+
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1.example.com"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-4"}, Spec: corev1.NodeSpec{ProviderID: "cloudstack:///vm-4"}},
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !compareStringSlice(result.hostIDs, []string{"vm-1", "vm-4"}) {
+			t.Errorf("hostIDs = %v, want [vm-1 vm-4]", result.hostIDs)
+		}
+		if !compareStringSlice(result.skippedNodes, []string{"node-2"}) {
+			t.Errorf("skippedNodes = %v, want [node-2]", result.skippedNodes)
+		}
+		if !compareStringSlice(result.unmatchedNodes, []string{"node-3"}) {
+			t.Errorf("unmatchedNodes = %v, want [node-3]", result.unmatchedNodes)
+		}
+	})
+
+	t.Run("VMs outside host-vm-states are skipped", func(t *testing.T) {
+		vms := []*cloudstack.VirtualMachine{
+			{Id: "vm-1", Name: "node-1", State: "Running", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			{Id: "vm-2", Name: "node-2", State: "Stopped", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			{Id: "vm-3", Name: "node-3", State: "Error", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			{Id: "vm-4", Name: "node-4", State: "Migrating", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			{Id: "vm-5", Name: "node-5", State: "Starting", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+		}
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-4"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-5"}},
+		}
+
+		tests := []struct {
+			name         string
+			states       []string
+			wantHostIDs  []string
+			wantInactive []string
+		}{
+			{name: "all states by default", wantHostIDs: []string{"vm-1", "vm-2", "vm-3", "vm-4", "vm-5"}},
+			{name: "running only", states: []string{"Running"}, wantHostIDs: []string{"vm-1"}, wantInactive: []string{"node-2", "node-3", "node-4", "node-5"}},
+			{name: "running and migrating", states: []string{"running", "Migrating"}, wantHostIDs: []string{"vm-1", "vm-4"}, wantInactive: []string{"node-2", "node-3", "node-5"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				t.Cleanup(ctrl.Finish)
+
+				mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+				mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+				mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+					Count: len(vms), VirtualMachines: vms,
+				}, nil)
+
+				cs := &CSCloud{
+					client:       &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+					hostVMStates: tt.states,
+				}
+
+				result, err := cs.verifyHosts(t.Context(), nodes)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !compareStringSlice(result.hostIDs, tt.wantHostIDs) {
+					t.Errorf("hostIDs = %v, want %v", result.hostIDs, tt.wantHostIDs)
+				}
+				if !compareStringSlice(result.inactiveNodes, tt.wantInactive) {
+					t.Errorf("inactiveNodes = %v, want %v", result.inactiveNodes, tt.wantInactive)
+				}
+			})
+		}
+	})
+
+	t.Run("no VM in host-vm-states", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 1,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Name: "node-1", State: "Stopped", Nic: []cloudstack.Nic{{Networkid: "net-123"}}},
+			},
+		}, nil)
+
+		cs := &CSCloud{
+			client:       &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			hostVMStates: []string{"Running"},
+		}
+
+		_, err := cs.verifyHosts(t.Context(), []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+		if err == nil || !strings.Contains(err.Error(), "skipped-state: [node-1]") {
+			t.Errorf("error = %v, want node-1 to be skipped for its state", err)
+		}
+	})
+}
+
+func TestFilterLoadBalancerNodes(t *testing.T) {
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "ingress-1", Labels: map[string]string{"pool": "ingress"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "ingress-2", Labels: map[string]string{"pool": "ingress", "drain": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker-1", Labels: map[string]string{"pool": "workers"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	}
+
+	tests := []struct {
+		name     string
+		selector string
+		want     []string
+	}{
+		{
+			name: "no selector keeps all nodes",
+			want: []string{"ingress-1", "ingress-2", "worker-1", "unlabeled"},
+		},
+		{
+			name:     "include by label",
+			selector: "pool=ingress",
+			want:     []string{"ingress-1", "ingress-2"},
+		},
+		{
+			name:     "exclude by label",
+			selector: "pool=ingress,!drain",
+			want:     []string{"ingress-1"},
+		},
+		{
+			name:     "exclude by value",
+			selector: "pool!=workers",
+			want:     []string{"ingress-1", "ingress-2", "unlabeled"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &CSCloud{}
+			if tt.selector != "" {
+				selector, err := labels.Parse(tt.selector)
+				if err != nil {
+					t.Fatalf("invalid selector: %v", err)
+				}
+				cs.nodeSelector = selector
+			}
+
+			var got []string
+			for _, node := range cs.filterLoadBalancerNodes(nodes) {
+				got = append(got, node.Name)
+			}
+			if !compareStringSlice(got, tt.want) {
+				t.Errorf("filterLoadBalancerNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyHostsMatching(t *testing.T) {
+	vms := []*cloudstack.VirtualMachine{
+		{
+			Id: "vm-1", Name: "i-2-101-VM",
+			Nic: []cloudstack.Nic{{Networkid: "net-1", Ipaddress: "10.1.0.11"}},
+		},
+		{
+			// A multi-NIC VM, whose node has the IP of its second NIC.
+			Id: "vm-2", Name: "i-2-102-VM",
+			Nic: []cloudstack.Nic{
+				{Networkid: "net-storage", Ipaddress: "192.168.0.12"},
+				{Networkid: "net-1", Ipaddress: "10.1.0.12"},
+			},
+		},
+		{
+			Id: "vm-3", Name: "worker-3",
+			Nic: []cloudstack.Nic{{Networkid: "net-1", Ipaddress: "10.1.0.13"}},
+		},
+	}
+	nodes := []*corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-1", Labels: map[string]string{"example.com/vm-id": "vm-1"}},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeExternalIP, Address: "10.1.0.13"},
+				{Type: corev1.NodeInternalIP, Address: "10.1.0.11"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-2"},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.1.0.12"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-3"},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		matching      []string
+		label         string
+		wantHostIDs   []string
+		wantUnmatched []string
+		wantNetworkID string
+	}{
+		{
+			name:          "default matches by name only here",
+			wantHostIDs:   []string{"vm-3"},
+			wantUnmatched: []string{"worker-1", "worker-2"},
+			wantNetworkID: "net-1",
+		},
+		{
+			name:          "ip matches the NIC with the InternalIP of the node",
+			matching:      []string{hostMatchingIP},
+			wantHostIDs:   []string{"vm-1", "vm-2"},
+			wantUnmatched: []string{"worker-3"},
+			wantNetworkID: "net-1",
+		},
+		{
+			name:          "ip then name",
+			matching:      []string{hostMatchingIP, hostMatchingName},
+			wantHostIDs:   []string{"vm-1", "vm-2", "vm-3"},
+			wantNetworkID: "net-1",
+		},
+		{
+			name:          "label",
+			matching:      []string{hostMatchingLabel},
+			label:         "example.com/vm-id",
+			wantHostIDs:   []string{"vm-1"},
+			wantUnmatched: []string{"worker-2", "worker-3"},
+			wantNetworkID: "net-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: len(vms), VirtualMachines: vms,
+			}, nil)
+
+			cs := &CSCloud{
+				client:            &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+				hostMatching:      tt.matching,
+				hostMatchingLabel: tt.label,
+			}
+
+			result, err := cs.verifyHosts(t.Context(), nodes)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(result.hostIDs, tt.wantHostIDs) {
+				t.Errorf("hostIDs = %v, want %v", result.hostIDs, tt.wantHostIDs)
+			}
+			if !slices.Equal(result.unmatchedNodes, tt.wantUnmatched) {
+				t.Errorf("unmatchedNodes = %v, want %v", result.unmatchedNodes, tt.wantUnmatched)
+			}
+			if result.networkID != tt.wantNetworkID {
+				t.Errorf("networkID = %q, want %q", result.networkID, tt.wantNetworkID)
+			}
+		})
+	}
+}
+
+func TestVerifyHostsInNetwork(t *testing.T) {
+	// The nodes have a NIC in the backend network first, and most of them one in the public network as well.
+	vms := []*cloudstack.VirtualMachine{
+		{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{
+			{Networkid: "net-backend", Networkname: "backend"},
+			{Networkid: "net-public", Networkname: "public"},
+		}},
+		{Id: "vm-2", Name: "node-2", Nic: []cloudstack.Nic{
+			{Networkid: "net-backend", Networkname: "backend"},
+			{Networkid: "net-public", Networkname: "public"},
+		}},
+		{Id: "vm-3", Name: "node-3", Nic: []cloudstack.Nic{
+			{Networkid: "net-backend", Networkname: "backend"},
+		}},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+	}
+
+	tests := []struct {
+		name           string
+		network        string
+		wantHostIDs    []string
+		wantUnattached []string
+		wantNetworkID  string
+	}{
+		{
+			name:          "first NIC without a network",
+			wantHostIDs:   []string{"vm-1", "vm-2", "vm-3"},
+			wantNetworkID: "net-backend",
+		},
+		{
+			name:           "network by ID",
+			network:        "net-public",
+			wantHostIDs:    []string{"vm-1", "vm-2"},
+			wantUnattached: []string{"node-3"},
+			wantNetworkID:  "net-public",
+		},
+		{
+			name:           "network by name",
+			network:        "public",
+			wantHostIDs:    []string{"vm-1", "vm-2"},
+			wantUnattached: []string{"node-3"},
+			wantNetworkID:  "net-public",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: len(vms), VirtualMachines: vms,
+			}, nil)
+
+			cs := &CSCloud{client: &cloudstack.CloudStackClient{VirtualMachine: mockVM}}
+
+			result, err := cs.verifyHostsInNetwork(t.Context(), nodes, tt.network)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(result.hostIDs, tt.wantHostIDs) {
+				t.Errorf("hostIDs = %v, want %v", result.hostIDs, tt.wantHostIDs)
+			}
+			if !slices.Equal(result.unattachedNodes, tt.wantUnattached) {
+				t.Errorf("unattachedNodes = %v, want %v", result.unattachedNodes, tt.wantUnattached)
+			}
+			if result.networkID != tt.wantNetworkID {
+				t.Errorf("networkID = %q, want %q", result.networkID, tt.wantNetworkID)
+			}
+		})
+	}
+
+	t.Run("no node in the network", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: len(vms), VirtualMachines: vms,
+		}, nil)
+
+		cs := &CSCloud{client: &cloudstack.CloudStackClient{VirtualMachine: mockVM}}
+
+		if _, err := cs.verifyHostsInNetwork(t.Context(), nodes, "net-other"); !errors.Is(err, errNoMatchedHosts) {
+			t.Errorf("verifyHostsInNetwork() = %v, want %v", err, errNoMatchedHosts)
+		}
+	})
+}
+
+func TestCheckNetworkPublicIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		network *cloudstack.Network
+		wantErr bool
+	}{
+		{name: "isolated", network: &cloudstack.Network{Id: "net-1", Type: "Isolated"}},
+		{name: "VPC tier", network: &cloudstack.Network{Id: "net-1", Type: "Isolated", Vpcid: "vpc-1"}},
+		{name: "shared", network: &cloudstack.Network{Id: "net-1", Type: "Shared"}, wantErr: true},
+		{name: "L2", network: &cloudstack.Network{Id: "net-1", Type: "L2"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(tt.network, 1, nil)
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Network: mockNetwork},
+				networkID:        "net-1",
+			}
+
+			err := lb.checkNetworkPublicIPs()
+			if got := errors.Is(err, errNetworkWithoutPublicIPs); got != tt.wantErr {
+				t.Errorf("checkNetworkPublicIPs() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyHostsVMCache(t *testing.T) {
+	vm := func(id, name string) *cloudstack.VirtualMachine {
+		return &cloudstack.VirtualMachine{Id: id, Name: name, Nic: []cloudstack.Nic{{Networkid: "net-1"}}}
+	}
+	node := func(name string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	t.Run("reconciles within the TTL share one list call", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(2)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1")},
+		}, nil).Times(2)
+
+		now := time.Now()
+		cache := newVMListCache(5 * time.Second)
+		cache.now = func() time.Time { return now }
+		cs := &CSCloud{
+			client:  &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			vmCache: cache,
+		}
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1")}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Once the TTL expired the list is fetched again.
+		now = now.Add(6 * time.Second)
+		if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("cached list missing a node is refreshed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(2)
+		gomock.InOrder(
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1")},
+			}, nil),
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 2, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1"), vm("vm-2", "node-2")},
+			}, nil),
+		)
+
+		cs := &CSCloud{
+			client:  &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			vmCache: newVMListCache(time.Minute),
+		}
+
+		if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		result, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1"), node("node-2")})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !compareStringSlice(result.hostIDs, []string{"vm-1", "vm-2"}) {
+			t.Errorf("hostIDs = %v, want [vm-1 vm-2]", result.hostIDs)
+		}
+	})
+
+	t.Run("failed list is not cached", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(2)
+		gomock.InOrder(
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(nil, errors.New("API error")),
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1")},
+			}, nil),
+		)
+
+		cs := &CSCloud{
+			client:  &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			vmCache: newVMListCache(time.Minute),
+		}
+
+		if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1")}); err == nil {
+			t.Fatalf("expected error")
+		}
+		if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node("node-1")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestVerifyHostsRetry(t *testing.T) {
+	vm := func(id, name string, nics ...cloudstack.Nic) *cloudstack.VirtualMachine {
+		return &cloudstack.VirtualMachine{Id: id, Name: name, Nic: nics}
+	}
+	nic := cloudstack.Nic{Networkid: "net-1"}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+
+	t.Run("retries until the new node has a VM with a NIC", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(3)
+		gomock.InOrder(
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1", nic)},
+			}, nil),
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 2, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1", nic), vm("vm-2", "node-2")},
+			}, nil),
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+				Count: 2, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1", nic), vm("vm-2", "node-2", nic)},
+			}, nil),
+		)
+
+		cs := &CSCloud{
+			client:             &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			verifyHostsRetries: 3,
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !compareStringSlice(result.hostIDs, []string{"vm-1", "vm-2"}) {
+			t.Errorf("hostIDs = %v, want [vm-1 vm-2]", result.hostIDs)
+		}
+	})
+
+	t.Run("partial match is used once retries are exhausted", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(2)
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1", nic)},
+		}, nil).Times(2)
+
+		cs := &CSCloud{
+			client:             &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			verifyHostsRetries: 1,
+		}
+
+		result, err := cs.verifyHosts(t.Context(), nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !compareStringSlice(result.hostIDs, []string{"vm-1"}) {
+			t.Errorf("hostIDs = %v, want [vm-1]", result.hostIDs)
+		}
+	})
+
+	t.Run("node matched by provider ID needs no retry", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "other-name", nic)},
+		}, nil)
+
+		cs := &CSCloud{
+			client:             &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			verifyHostsRetries: 3,
+		}
+
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+			Spec:       corev1.NodeSpec{ProviderID: "cloudstack:///vm-1"},
+		}
+		if _, err := cs.verifyHosts(t.Context(), []*corev1.Node{node}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("waiting stops when the context is done", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).DoAndReturn(func(*cloudstack.ListVirtualMachinesParams) (*cloudstack.ListVirtualMachinesResponse, error) {
+			cancel()
+
+			return &cloudstack.ListVirtualMachinesResponse{Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{vm("vm-1", "node-1", nic)}}, nil
+		})
+
+		cs := &CSCloud{
+			client:                &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+			verifyHostsRetries:    3,
+			verifyHostsRetryDelay: time.Hour,
+		}
+
+		if _, err := cs.verifyHosts(ctx, nodes); !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	})
+}
+
+func TestReconcileHostsForRule(t *testing.T) {
+	t.Run("hosts already correct - no-op", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams)
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count: 2,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
+				{Id: "vm-1"},
+				{Id: "vm-2"},
+			},
+		}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+		err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("missing hosts get assigned", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+				Count:                     0,
+				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{},
+			}, nil),
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
+			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+		err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("stale hosts removed and new hosts assigned", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+		removeParams := &cloudstack.RemoveFromLoadBalancerRuleParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+				Count: 2,
+				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
+					{Id: "vm-old-1"},
+					{Id: "vm-old-2"},
+				},
+			}, nil),
+			// Assign new hosts BEFORE removing old ones
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
+			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+			mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams("rule-1").Return(removeParams),
+			mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+		err := lb.reconcileHostsForRule(rule, []string{"vm-new-1", "vm-new-2"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("assign failure preserves old hosts", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+				Count: 1,
+				LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{
+					{Id: "vm-old"},
+				},
+			}, nil),
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
+			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(nil, errors.New("assign API error")),
+			// removeHostsFromRule should NOT be called because assign failed
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+		err := lb.reconcileHostsForRule(rule, []string{"vm-new"})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "old hosts preserved") {
+			t.Errorf("error message = %q, want to contain 'old hosts preserved'", err.Error())
+		}
+	})
+
+	t.Run("list instances error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(listParams)
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(nil, errors.New("API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+		err := lb.reconcileHostsForRule(rule, []string{"vm-1"})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "error retrieving associated instances") {
+			t.Errorf("error message = %q, want to contain 'error retrieving associated instances'", err.Error())
+		}
+	})
+}
+
+// --- Fix A tests ---
+
+func TestSyncRuleInstances(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1"},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+
+	t.Run("re-assigns a dropped instance", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service)
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
+		cs.instanceSync = newInstanceSync(time.Minute)
+		cs.recordInstanceSyncHosts("cluster", service, []string{"vm-1", "vm-2"}, nil)
+
+		ruleName := cs.GetLoadBalancerName(t.Context(), "cluster", service) + "-tcp-80"
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count:             1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{{Id: "rule-1", Name: ruleName, Publicip: "10.0.0.1", Publicipid: "ip-1"}},
+		}, nil).Times(2)
+
+		// CloudStack lost vm-2, f.e. after it was migrated.
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     1,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+		}, nil)
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").DoAndReturn((&cloudstack.LoadBalancerService{}).NewAssignToLoadBalancerRuleParams)
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.AssignToLoadBalancerRuleParams) (*cloudstack.AssignToLoadBalancerRuleResponse, error) {
+			if ids, _ := p.GetVirtualmachineids(); !slices.Equal(ids, []string{"vm-2"}) {
+				t.Errorf("assigned %v, want [vm-2]", ids)
+			}
+
+			return &cloudstack.AssignToLoadBalancerRuleResponse{}, nil
+		})
+
+		cs.syncRuleInstances()
+
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "Warning RestoredLoadBalancerHosts") || !strings.Contains(event, "vm-2") {
+				t.Errorf("event = %q, want RestoredLoadBalancerHosts for vm-2", event)
+			}
+		default:
+			t.Errorf("expected a RestoredLoadBalancerHosts event")
+		}
+	})
+
+	t.Run("failed reconcile and deleted service are not synced", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		// Any CloudStack call fails the test.
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service)
+		cs.instanceSync = newInstanceSync(time.Minute)
+		cs.recordInstanceSyncHosts("cluster", service, []string{"vm-1"}, nil)
+		cs.recordInstanceSyncHosts("cluster", service, []string{"vm-1"}, errors.New("reconcile failed"))
+
+		deleted := service.DeepCopy()
+		deleted.Name = "deleted"
+		cs.recordInstanceSyncHosts("cluster", deleted, []string{"vm-1"}, nil)
+
+		cs.syncRuleInstances()
+
+		if entries := cs.instanceSync.entries(); len(entries) != 0 {
+			t.Errorf("entries = %v, want none", entries)
+		}
+	})
+}
+
+func TestReconcileHostsForRuleMembersCache(t *testing.T) {
+	rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	cache := newRuleMembersCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+		ruleMembers:      cache,
+	}
+
+	gomock.InOrder(
+		// The first reconcile lists the instances and caches them.
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     1,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+		}, nil),
+		// Adding a node only assigns the new host.
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(&cloudstack.AssignToLoadBalancerRuleParams{}),
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		// A failed assignment drops the cached members.
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(&cloudstack.AssignToLoadBalancerRuleParams{}),
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(nil, errors.New("assign API error")),
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     2,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}, {Id: "vm-2"}},
+		}, nil),
+		// Expired members are listed again.
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     2,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}, {Id: "vm-2"}},
+		}, nil),
+	)
+
+	if err := lb.reconcileHostsForRule(rule, []string{"vm-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2", "vm-3"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := lb.reconcileHostsForRule(rule, []string{"vm-1", "vm-2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRuleMembersCacheEviction(t *testing.T) {
+	cache := newRuleMembersCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.set("rule-1", []string{"vm-1"})
+	cache.set("rule-2", []string{"vm-1"})
+	now = now.Add(30 * time.Second)
+	cache.set("rule-3", []string{"vm-1"})
+
+	// Reading any rule evicts the expired entries of all rules.
+	now = now.Add(45 * time.Second)
+	if _, ok := cache.get("rule-1"); ok {
+		t.Errorf("get() of an expired rule = true, want false")
+	}
+	if got := slices.Sorted(maps.Keys(cache.entries)); !slices.Equal(got, []string{"rule-3"}) {
+		t.Errorf("entries = %v, want only rule-3", got)
+	}
+}
+
+func TestDeleteLoadBalancerRuleInvalidatesMembers(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{name: "deleted"},
+		{name: "deletion failed", err: errors.New("CloudStack API error 530 (CSExceptionErrorCode: 9999): job timed out")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+			mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, tt.err)
+
+			rule := &cloudstack.LoadBalancerRule{Id: "rule-1", Name: "test-rule"}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+				rules:            map[string]*cloudstack.LoadBalancerRule{rule.Name: rule},
+				ruleMembers:      newRuleMembersCache(time.Hour),
+			}
+			lb.rememberRuleMembers(rule, []string{"vm-1"})
+
+			if err := lb.deleteLoadBalancerRule(rule); (err != nil) != (tt.err != nil) {
+				t.Fatalf("deleteLoadBalancerRule() error = %v, want %v", err, tt.err)
+			}
+			if _, ok := lb.ruleMembers.get(rule.Id); ok {
+				t.Errorf("hosts of the rule are still cached")
+			}
+		})
+	}
+}
+
+// BenchmarkUpdateLoadBalancerNodeAdd measures the CloudStack API calls needed to add a node
+// to a load balancer with 50 rules, with and without the rule members cache.
+func BenchmarkUpdateLoadBalancerNodeAdd(b *testing.B) {
+	const numRules = 50
+
+	for _, tt := range []struct {
+		name  string
+		cache bool
+	}{
+		{name: "list members"},
+		{name: "cached members", cache: true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			ctrl := gomock.NewController(b)
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+
+			var calls int
+			members := map[string][]*cloudstack.VirtualMachine{}
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams(gomock.Any()).DoAndReturn(func(id string) *cloudstack.ListLoadBalancerRuleInstancesParams {
+				p := &cloudstack.ListLoadBalancerRuleInstancesParams{}
+				p.SetId(id)
+
+				return p
+			}).AnyTimes()
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).DoAndReturn(func(p *cloudstack.ListLoadBalancerRuleInstancesParams) (*cloudstack.ListLoadBalancerRuleInstancesResponse, error) {
+				calls++
+				id, _ := p.GetId()
+
+				return &cloudstack.ListLoadBalancerRuleInstancesResponse{LoadBalancerRuleInstances: members[id]}, nil
+			}).AnyTimes()
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{}).AnyTimes()
+			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).DoAndReturn(func(*cloudstack.AssignToLoadBalancerRuleParams) (*cloudstack.AssignToLoadBalancerRuleResponse, error) {
+				calls++
+
+				return &cloudstack.AssignToLoadBalancerRuleResponse{}, nil
+			}).AnyTimes()
+			mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.RemoveFromLoadBalancerRuleParams{}).AnyTimes()
+			mockLB.EXPECT().RemoveFromLoadBalancerRule(gomock.Any()).DoAndReturn(func(*cloudstack.RemoveFromLoadBalancerRuleParams) (*cloudstack.RemoveFromLoadBalancerRuleResponse, error) {
+				calls++
+
+				return &cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil
+			}).AnyTimes()
+
+			lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+			if tt.cache {
+				lb.ruleMembers = newRuleMembersCache(time.Hour)
+			}
+
+			rules := make([]*cloudstack.LoadBalancerRule, numRules)
+			for i := range rules {
+				rules[i] = &cloudstack.LoadBalancerRule{Id: fmt.Sprintf("rule-%d", i), Name: fmt.Sprintf("rule-%d", i)}
+				members[rules[i].Id] = []*cloudstack.VirtualMachine{{Id: "vm-1"}}
+				lb.rememberRuleMembers(rules[i], []string{"vm-1"})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Alternate between adding and removing a node, so every iteration changes the membership.
+				hostIDs := []string{"vm-1"}
+				if i%2 == 0 {
+					hostIDs = append(hostIDs, "vm-2")
+				}
+				for _, rule := range rules {
+					if err := lb.reconcileHostsForRule(rule, hostIDs); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+					members[rule.Id] = nil
+					for _, id := range hostIDs {
+						members[rule.Id] = append(members[rule.Id], &cloudstack.VirtualMachine{Id: id})
+					}
+				}
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "api-calls/op")
+		})
+	}
+}
+
+// BenchmarkEnsureLoadBalancerPortChange measures the CloudStack API calls needed to replace one port of a
+// service with 20 ports. Only the rule of the changed port and its firewall rule are created and deleted,
+// the other ports only cost calls that are shared by all ports or needed to check their hosts.
+func BenchmarkEnsureLoadBalancerPortChange(b *testing.B) {
+	const numPorts = 20
+
+	ctrl := gomock.NewController(b)
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+	mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+	// The mocks keep the rules they were asked to create, so every reconcile sees the result of the previous one.
+	var calls int
+	lbRules := map[string]*cloudstack.LoadBalancerRule{}
+	firewallRules := map[string]*cloudstack.FirewallRule{}
+	lbService := &cloudstack.LoadBalancerService{}
+	firewallService := &cloudstack.FirewallService{}
+
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().DoAndReturn(lbService.NewListLoadBalancerRulesParams).AnyTimes()
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).DoAndReturn(func(p *cloudstack.ListLoadBalancerRulesParams) (*cloudstack.ListLoadBalancerRulesResponse, error) {
+		calls++
+		keyword, _ := p.GetKeyword()
+		r := &cloudstack.ListLoadBalancerRulesResponse{}
+		for _, rule := range lbRules {
+			if strings.HasPrefix(rule.Name, keyword+"-") {
+				r.LoadBalancerRules = append(r.LoadBalancerRules, rule)
+			}
+		}
+		r.Count = len(r.LoadBalancerRules)
+
+		return r, nil
+	}).AnyTimes()
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(lbService.NewCreateLoadBalancerRuleParams).AnyTimes()
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.CreateLoadBalancerRuleParams) (*cloudstack.CreateLoadBalancerRuleResponse, error) {
+		calls++
+		algorithm, _ := p.GetAlgorithm()
+		name, _ := p.GetName()
+		privatePort, _ := p.GetPrivateport()
+		publicPort, _ := p.GetPublicport()
+		protocol, _ := p.GetProtocol()
+		r := &cloudstack.CreateLoadBalancerRuleResponse{
+			Id: "rule-" + name, Algorithm: algorithm, Name: name, Networkid: "net-1", Protocol: protocol,
+			Privateport: strconv.Itoa(privatePort), Publicport: strconv.Itoa(publicPort), Publicip: "10.0.0.1", Publicipid: "ip-1",
+		}
+		lbRules[r.Id] = &cloudstack.LoadBalancerRule{
+			Id: r.Id, Algorithm: r.Algorithm, Name: r.Name, Networkid: r.Networkid, Protocol: r.Protocol,
+			Privateport: r.Privateport, Publicport: r.Publicport, Publicip: r.Publicip, Publicipid: r.Publicipid,
+		}
+
+		return r, nil
+	}).AnyTimes()
+	mockLB.EXPECT().NewDeleteLoadBalancerRuleParams(gomock.Any()).DoAndReturn(lbService.NewDeleteLoadBalancerRuleParams).AnyTimes()
+	mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.DeleteLoadBalancerRuleParams) (*cloudstack.DeleteLoadBalancerRuleResponse, error) {
+		calls++
+		id, _ := p.GetId()
+		delete(lbRules, id)
+
+		return &cloudstack.DeleteLoadBalancerRuleResponse{}, nil
+	}).AnyTimes()
+	mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams(gomock.Any()).DoAndReturn(lbService.NewListLoadBalancerRuleInstancesParams).AnyTimes()
+	mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).DoAndReturn(func(*cloudstack.ListLoadBalancerRuleInstancesParams) (*cloudstack.ListLoadBalancerRuleInstancesResponse, error) {
+		calls++
+
+		return &cloudstack.ListLoadBalancerRuleInstancesResponse{LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}}}, nil
+	}).AnyTimes()
+	mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).DoAndReturn(lbService.NewAssignToLoadBalancerRuleParams).AnyTimes()
+	mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).DoAndReturn(func(*cloudstack.AssignToLoadBalancerRuleParams) (*cloudstack.AssignToLoadBalancerRuleResponse, error) {
+		calls++
+
+		return &cloudstack.AssignToLoadBalancerRuleResponse{}, nil
+	}).AnyTimes()
+
+	mockFirewall.EXPECT().NewListFirewallRulesParams().DoAndReturn(firewallService.NewListFirewallRulesParams).AnyTimes()
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).DoAndReturn(func(*cloudstack.ListFirewallRulesParams) (*cloudstack.ListFirewallRulesResponse, error) {
+		calls++
+		r := &cloudstack.ListFirewallRulesResponse{}
+		for _, rule := range firewallRules {
+			r.FirewallRules = append(r.FirewallRules, rule)
+		}
+		r.Count = len(r.FirewallRules)
+
+		return r, nil
+	}).AnyTimes()
+	mockFirewall.EXPECT().NewCreateFirewallRuleParams(gomock.Any(), gomock.Any()).DoAndReturn(firewallService.NewCreateFirewallRuleParams).AnyTimes()
+	mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).DoAndReturn(func(p *cloudstack.CreateFirewallRuleParams) (*cloudstack.CreateFirewallRuleResponse, error) {
+		calls++
+		protocol, _ := p.GetProtocol()
+		port, _ := p.GetStartport()
+		cidrs, _ := p.GetCidrlist()
+		id := fmt.Sprintf("fw-%s-%d", protocol, port)
+		firewallRules[id] = &cloudstack.FirewallRule{
+			Id: id, Protocol: protocol, Startport: port, Endport: port, Cidrlist: strings.Join(cidrs, ","),
+		}
+
+		return &cloudstack.CreateFirewallRuleResponse{Id: id}, nil
+	}).AnyTimes()
+	mockFirewall.EXPECT().NewDeleteFirewallRuleParams(gomock.Any()).DoAndReturn(firewallService.NewDeleteFirewallRuleParams).AnyTimes()
+	mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).DoAndReturn(func(p *cloudstack.DeleteFirewallRuleParams) (*cloudstack.DeleteFirewallRuleResponse, error) {
+		calls++
+		id, _ := p.GetId()
+		delete(firewallRules, id)
+
+		return &cloudstack.DeleteFirewallRuleResponse{}, nil
+	}).AnyTimes()
+
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).AnyTimes()
+	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).DoAndReturn(func(*cloudstack.ListVirtualMachinesParams) (*cloudstack.ListVirtualMachinesResponse, error) {
+		calls++
+
+		return &cloudstack.ListVirtualMachinesResponse{
+			Count:           1,
+			VirtualMachines: []*cloudstack.VirtualMachine{{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1"}}}},
+		}, nil
+	}).AnyTimes()
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).DoAndReturn(func(string, ...cloudstack.OptionFunc) (*cloudstack.Network, int, error) {
+		calls++
+
+		return &cloudstack.Network{Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}}}, 1, nil
+	}).AnyTimes()
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{}).AnyTimes()
+	mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).DoAndReturn(func(*cloudstack.AssociateIpAddressParams) (*cloudstack.AssociateIpAddressResponse, error) {
+		calls++
+
+		return &cloudstack.AssociateIpAddressResponse{Id: "ip-1", Ipaddress: "10.0.0.1"}, nil
+	}).AnyTimes()
+	mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+	mockTags.EXPECT().CreateTags(gomock.Any()).DoAndReturn(func(*cloudstack.CreateTagsParams) (*cloudstack.CreateTagsResponse, error) {
+		calls++
+
+		return &cloudstack.CreateTagsResponse{}, nil
+	}).AnyTimes()
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, SessionAffinity: corev1.ServiceAffinityNone},
+	}
+	for i := range numPorts {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Protocol: corev1.ProtocolTCP, Port: int32(8000 + i), NodePort: int32(30000 + i),
+		})
+	}
+	nodes := []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+	cs.client.Resourcetags = mockTags
+	cs.eventRecorder = record.NewFakeRecorder(1000)
+
+	// Create the load balancer with all ports first.
+	if _, err := cs.EnsureLoadBalancer(b.Context(), "cluster", service, nodes); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	calls = 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Alternate the last port between two numbers, so every iteration deletes one rule and creates another.
+		last := &service.Spec.Ports[numPorts-1]
+		last.Port = int32(9000 + i%2)
+		if _, err := cs.EnsureLoadBalancer(b.Context(), "cluster", service, nodes); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+	b.ReportMetric(float64(calls)/float64(b.N), "api-calls/op")
+}
+
+func TestLoadBalancerName(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	if got, want := LoadBalancerName("kubernetes", service), "K8s_svc_kubernetes_default_web"; got != want {
+		t.Errorf("LoadBalancerName() = %q, want %q", got, want)
+	}
+
+	long := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("a", 300)}}
+	if got := LoadBalancerName("kubernetes", long); len(got) != 255 || !strings.HasPrefix(got, "K8s_svc_kubernetes_default_aaa") {
+		t.Errorf("LoadBalancerName() = %q (%d characters), want the name truncated to 255 characters", got, len(got))
+	}
+
+	cs := &CSCloud{}
+	if got, want := cs.GetLoadBalancerName(t.Context(), "kubernetes", service), LoadBalancerName("kubernetes", service); got != want {
+		t.Errorf("GetLoadBalancerName() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadBalancerRuleName(t *testing.T) {
+	tests := []struct {
+		protocol LoadBalancerProtocol
+		port     int32
+		want     string
+	}{
+		{LoadBalancerProtocolTCP, 80, "K8s_svc_kubernetes_default_web-tcp-80"},
+		{LoadBalancerProtocolUDP, 53, "K8s_svc_kubernetes_default_web-udp-53"},
+		{LoadBalancerProtocolTCPProxy, 443, "K8s_svc_kubernetes_default_web-tcp-proxy-443"},
+	}
+
+	for _, tt := range tests {
+		if got := LoadBalancerRuleName("K8s_svc_kubernetes_default_web", tt.protocol, tt.port); got != tt.want {
+			t.Errorf("LoadBalancerRuleName(%v, %d) = %q, want %q", tt.protocol, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestLoadBalancerRuleNames(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerProxyProtocol: "true"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Protocol: corev1.ProtocolTCP, Port: 443},
+			{Protocol: corev1.ProtocolUDP, Port: 53},
+			{Protocol: corev1.ProtocolSCTP, Port: 9000},
+		}},
+	}
+
+	want := []string{"K8s_svc_kubernetes_default_web-tcp-proxy-443", "K8s_svc_kubernetes_default_web-udp-53"}
+	if got := LoadBalancerRuleNames("kubernetes", service); !slices.Equal(got, want) {
+		t.Errorf("LoadBalancerRuleNames() = %q, want %q", got, want)
+	}
+
+	scheme := NameScheme{Prefix: "k8s-", Separator: "-"}
+	want = []string{"k8s-kubernetes-default-web-tcp-proxy-443", "k8s-kubernetes-default-web-udp-53"}
+	if got := scheme.LoadBalancerRuleNames("kubernetes", service); !slices.Equal(got, want) {
+		t.Errorf("NameScheme.LoadBalancerRuleNames() = %q, want %q", got, want)
+	}
+}
+
+func TestNameScheme(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+
+	t.Run("zero value is the default scheme", func(t *testing.T) {
+		if got, want := (NameScheme{}).LoadBalancerName("kubernetes", service), LoadBalancerName("kubernetes", service); got != want {
+			t.Errorf("LoadBalancerName() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("custom prefix and separator", func(t *testing.T) {
+		scheme := NameScheme{Prefix: "lb.", Separator: "."}
+		if got, want := scheme.LoadBalancerName("kubernetes", service), "lb.kubernetes.default.web"; got != want {
+			t.Errorf("LoadBalancerName() = %q, want %q", got, want)
+		}
+
+		cs := &CSCloud{nameScheme: scheme}
+		if got, want := cs.GetLoadBalancerName(t.Context(), "kubernetes", service), "lb.kubernetes.default.web"; got != want {
+			t.Errorf("GetLoadBalancerName() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("hash suffix", func(t *testing.T) {
+		scheme := NameScheme{HashSuffix: true}
+		got := scheme.LoadBalancerName("kubernetes", service)
+		if !strings.HasPrefix(got, "K8s_svc_kubernetes_default_web_") || len(got) != len("K8s_svc_kubernetes_default_web_")+nameHashLength {
+			t.Errorf("LoadBalancerName() = %q, want the default name followed by a hash", got)
+		}
+		if again := scheme.LoadBalancerName("kubernetes", service); again != got {
+			t.Errorf("LoadBalancerName() = %q, then %q, want a stable name", got, again)
+		}
+	})
+
+	t.Run("hash suffix keeps truncated names unique", func(t *testing.T) {
+		scheme := NameScheme{HashSuffix: true}
+		long1 := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("a", 300) + "1"}}
+		long2 := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("a", 300) + "2"}}
+
+		name1 := scheme.LoadBalancerName("kubernetes", long1)
+		name2 := scheme.LoadBalancerName("kubernetes", long2)
+		if len(name1) != 255 || len(name2) != 255 {
+			t.Errorf("names have %d and %d characters, want 255", len(name1), len(name2))
+		}
+		if name1 == name2 {
+			t.Errorf("LoadBalancerName() = %q for both services, want different names", name1)
+		}
+	})
+
+	t.Run("hash suffix prevents prefix aliasing", func(t *testing.T) {
+		scheme := NameScheme{HashSuffix: true}
+		foo := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"}}
+		fooTCP := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo-tcp"}}
+
+		fooTCPName := scheme.LoadBalancerName("kubernetes", fooTCP)
+		rules := []*cloudstack.LoadBalancerRule{
+			{Name: LoadBalancerRuleName(fooTCPName, LoadBalancerProtocolTCP, 80)},
+			{Name: LoadBalancerRuleName("a1b2c3d4", LoadBalancerProtocolTCP, 80)},
+		}
+		if got := filterRulesByPrefix(rules, scheme.LoadBalancerName("kubernetes", foo)+"-"); len(got) != 0 {
+			t.Errorf("rules of foo = %v, want none", got)
+		}
+		if got := filterRulesByPrefix(rules, fooTCPName+"-"); len(got) != 1 {
+			t.Errorf("found %d rules of foo-tcp, want 1", len(got))
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		tests := []struct {
+			scheme  NameScheme
+			wantErr bool
+		}{
+			{NameScheme{}, false},
+			{NameScheme{Prefix: "lb_", Separator: "."}, false},
+			{NameScheme{Prefix: "lb-"}, true},
+			{NameScheme{Separator: "-"}, true},
+			{NameScheme{Prefix: "a1"}, true},
+		}
+
+		for _, tt := range tests {
+			if err := tt.scheme.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("%+v.validate() = %v, wantErr %v", tt.scheme, err, tt.wantErr)
+			}
+		}
+	})
+}
+
+func TestServiceLocks(t *testing.T) {
+	var locks serviceLocks
+
+	// Reconciles of the same service never overlap.
+	var wg sync.WaitGroup
+	var active, maxActive atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer locks.lock("default/web")()
+
+			n := active.Add(1)
+			for {
+				m := maxActive.Load()
+				if n <= m || maxActive.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+		}()
+	}
+	wg.Wait()
+	if got := maxActive.Load(); got != 1 {
+		t.Errorf("max concurrent reconciles of one service = %d, want 1", got)
+	}
+
+	// A reconcile of another service is not blocked.
+	unlock := locks.lock("default/web")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		locks.lock("default/other")()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reconcile of another service is blocked")
+	}
+	unlock()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("locks = %v, want all locks to be dropped", locks.locks)
+	}
+}
+
+func TestFilterRulesByPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []*cloudstack.LoadBalancerRule
+		prefix string
+		want   []string // expected rule names
+	}{
+		{
+			name: "exact prefix match",
+			rules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-80"},
+				{Name: "K8s_svc_c_ns_foo-tcp-443"},
+			},
+			prefix: "K8s_svc_c_ns_foo-",
+			want:   []string{"K8s_svc_c_ns_foo-tcp-80", "K8s_svc_c_ns_foo-tcp-443"},
+		},
+		{
+			name: "filters out superset names",
+			rules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-80"},
+				{Name: "K8s_svc_c_ns_foobar-tcp-80"},
+			},
+			prefix: "K8s_svc_c_ns_foo-",
+			want:   []string{"K8s_svc_c_ns_foo-tcp-80"},
+		},
+		{
+			name:   "empty input",
+			rules:  []*cloudstack.LoadBalancerRule{},
+			prefix: "K8s_svc_c_ns_foo-",
+			want:   nil,
+		},
+		{
+			name: "no matches",
+			rules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_bar-tcp-80"},
+				{Name: "K8s_svc_c_ns_baz-tcp-80"},
+			},
+			prefix: "K8s_svc_c_ns_foo-",
+			want:   nil,
+		},
+		{
+			name:   "nil input",
+			rules:  nil,
+			prefix: "K8s_svc_c_ns_foo-",
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterRulesByPrefix(tt.rules, tt.prefix)
+			var gotNames []string
+			for _, r := range got {
+				gotNames = append(gotNames, r.Name)
+			}
+			if len(gotNames) != len(tt.want) {
+				t.Fatalf("filterRulesByPrefix() returned %d rules, want %d: got %v", len(gotNames), len(tt.want), gotNames)
+			}
+			for i, name := range gotNames {
+				if name != tt.want[i] {
+					t.Errorf("filterRulesByPrefix()[%d].Name = %q, want %q", i, name, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClusterScopedResources(t *testing.T) {
+	// Cluster "prod" with namespace "a_b" and cluster "prod_a" with namespace "b" share the load balancer name.
+	const name = "K8s_svc_prod_a_b_web"
+	clusterTag := func(cluster string) []cloudstack.Tags {
+		return []cloudstack.Tags{{Key: serviceClusterTagKey, Value: cluster}}
+	}
+
+	t.Run("rules of another cluster are ignored", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 3,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: name + "-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1", Tags: clusterTag("prod")},
+				{Name: name + "-tcp-443", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+				{Name: name + "-udp-53", Publicip: "5.6.7.8", Publicipid: "ip-2", Tags: clusterTag("prod_a")},
+			},
+		}, nil)
+
+		cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "prod", nil, name, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(lb.rules) != 2 {
+			t.Errorf("rules = %v, want the tagged and untagged rules of cluster prod", lb.rules)
+		}
+		if _, ok := lb.rules[name+"-udp-53"]; ok {
+			t.Errorf("rule of cluster prod_a was not ignored")
+		}
+		if lb.ipAddrID != "ip-1" {
+			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-1")
+		}
+	})
+
+	t.Run("firewall rules of another cluster are never owned", func(t *testing.T) {
+		lb := &loadBalancer{clusterName: "prod"}
+		if lb.ownsFirewallRule(&cloudstack.FirewallRule{Tags: clusterTag("prod_a")}) {
+			t.Errorf("firewall rule of cluster prod_a is owned")
+		}
+		if !lb.ownsFirewallRule(&cloudstack.FirewallRule{Tags: clusterTag("prod")}) {
+			t.Errorf("firewall rule of cluster prod is not owned")
+		}
+		if !lb.ownsFirewallRule(&cloudstack.FirewallRule{}) {
+			t.Errorf("untagged firewall rule is not owned")
+		}
+	})
+
+	t.Run("IP of another cluster is not used", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}).Times(2)
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-2", Ipaddress: "5.6.7.8", Allocated: "2023-01-01T00:00:00+0000", Tags: clusterTag("prod_a")},
+			},
+		}, nil).Times(2)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			clusterName:      "prod",
+		}
+
+		if err := lb.getPublicIPAddress("5.6.7.8"); err == nil || !strings.Contains(err.Error(), "another cluster") {
+			t.Errorf("err = %v, want an error for the IP of another cluster", err)
+		}
+		lb.ipAddr, lb.ipAddrID = "", ""
+		if found, err := lb.lookupPublicIPAddress("5.6.7.8"); err != nil || found {
+			t.Errorf("lookupPublicIPAddress() = %v, %v, want the IP of another cluster not to be recovered", found, err)
+		}
+	})
+}
+
+func TestGetLoadBalancerByNameFiltering(t *testing.T) {
+	t.Run("keyword results filtered to exact prefix", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+
+		// CloudStack returns both "foo" and "foobar" rules due to LIKE matching
+		listResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 2,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+				{Name: "K8s_svc_c_ns_foobar-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+			},
+		}
+
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams)
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(listResp, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", nil, "K8s_svc_c_ns_foo", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(lb.rules) != 1 {
+			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
+		}
+		if _, ok := lb.rules["K8s_svc_c_ns_foo-tcp-80"]; !ok {
+			t.Errorf("expected rule K8s_svc_c_ns_foo-tcp-80 to be present")
+		}
+		if lb.ipAddr != "1.2.3.4" {
+			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "1.2.3.4")
+		}
+	})
+
+	t.Run("legacy fallback with filtering", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+
+		// First call (modern name) returns foobar rules but NOT foo rules → filtered to 0
+		modernResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foobar-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+			},
+		}
+
+		// Second call (legacy name) returns matching rule
+		legacyResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "a1b2c3d4-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(modernResp, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(legacyResp, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", nil, "K8s_svc_c_ns_foo", "a1b2c3d4")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lb.name != "a1b2c3d4" {
+			t.Errorf("lb.name = %q, want %q", lb.name, "a1b2c3d4")
+		}
+		if len(lb.rules) != 1 {
+			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
+		}
+		if lb.ipAddr != "1.2.3.4" {
+			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "1.2.3.4")
+		}
+	})
+
+	t.Run("falls back to the default scheme name", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+
+		emptyResp := &cloudstack.ListLoadBalancerRulesResponse{}
+		defaultResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			},
+		}
+
+		// The legacy name is looked up as well, it may have rules that were not renamed yet.
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(defaultResp, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", nil, "lb.c.ns.foo", "K8s_svc_c_ns_foo", "a1b2c3d4")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lb.name != "K8s_svc_c_ns_foo" {
+			t.Errorf("lb.name = %q, want %q", lb.name, "K8s_svc_c_ns_foo")
+		}
+		if len(lb.rules) != 1 {
+			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
+		}
+	})
+
+	t.Run("legacy results also filtered", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+
+		// First call: no matching rules after filtering
+		modernResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count:             0,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+		}
+
+		// Second call (legacy): returns both exact match and superset
+		legacyResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 2,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "a1b2-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+				{Name: "a1b2c3d4-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(modernResp, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(legacyResp, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", nil, "K8s_svc_c_ns_foo", "a1b2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lb.name != "a1b2" {
+			t.Errorf("lb.name = %q, want %q", lb.name, "a1b2")
+		}
+		if len(lb.rules) != 1 {
+			t.Fatalf("expected 1 rule, got %d", len(lb.rules))
+		}
+		if _, ok := lb.rules["a1b2-tcp-80"]; !ok {
+			t.Errorf("expected rule a1b2-tcp-80 to be present")
+		}
+	})
+
+	t.Run("rules of a service named foo-tcp are not taken", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 3,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+				{Name: "K8s_svc_c_ns_foo-tcp-udp-53", Publicip: "5.6.7.8", Publicipid: "ip-2",
+					Tags: []cloudstack.Tags{{Key: serviceNamespaceTagKey, Value: "ns"}, {Key: serviceNameTagKey, Value: "foo-tcp"}}},
+				{Name: "K8s_svc_c_ns_foo-tcp-proxy-8080", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			},
+		}, nil)
+
+		cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+		foo := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"}}
+
+		// The tcp-proxy rule of foo has a name that starts like those of foo-tcp, but ends in a protocol and port.
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", foo, "K8s_svc_c_ns_foo")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := slices.Sorted(maps.Keys(lb.rules)); !slices.Equal(got, []string{"K8s_svc_c_ns_foo-tcp-proxy-8080"}) {
+			t.Errorf("rules = %v, want only the tcp-proxy rule of foo", got)
+		}
+	})
+
+	t.Run("fallback rules of a service named foo-tcp are not taken", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		serviceTags := func(name string) []cloudstack.Tags {
+			return []cloudstack.Tags{{Key: serviceNamespaceTagKey, Value: "ns"}, {Key: serviceNameTagKey, Value: name}}
+		}
+
+		// With a hashed name, the default scheme name of foo is a prefix of the rule names of foo-tcp.
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: 5,
+				LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+					{Name: "K8s_svc_c_ns_foo-tcp-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+					{Name: "K8s_svc_c_ns_foo-tcp-udp-53", Publicip: "5.6.7.8", Publicipid: "ip-2", Tags: serviceTags("foo-tcp")},
+					{Name: "K8s_svc_c_ns_foo-tcp-8080", Publicip: "5.6.7.8", Publicipid: "ip-2"},
+					{Name: "K8s_svc_c_ns_foo-tcp-443", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+					{Name: "K8s_svc_c_ns_foo-udp-9000", Publicip: "1.2.3.4", Publicipid: "ip-1", Tags: serviceTags("foo")},
+				},
+			}, nil),
+			// Port 80 has no rule, so the rules tagged with the service are looked up as well.
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: 1,
+				LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+					{Name: "K8s_svc_c_ns_foo-tcp-tcp-80", Publicip: "5.6.7.8", Publicipid: "ip-2", Tags: serviceTags("foo-tcp")},
+				},
+			}, nil),
+		)
+
+		cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+		foo := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Port: 80, Protocol: corev1.ProtocolTCP},
+				{Port: 443, Protocol: corev1.ProtocolTCP},
+			}},
+		}
+
+		lb, err := cs.getLoadBalancerByName(t.Context(), "c", foo, "K8s_svc_c_ns_foo_a1b2c3d4", "K8s_svc_c_ns_foo")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := slices.Sorted(maps.Keys(lb.rules))
+		want := []string{"K8s_svc_c_ns_foo-tcp-443", "K8s_svc_c_ns_foo-udp-9000"}
+		if !slices.Equal(got, want) {
+			t.Errorf("rules = %v, want %v", got, want)
+		}
+		if lb.ipAddrID != "ip-1" {
+			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-1")
+		}
+	})
+}
+
+func TestGetLoadBalancerByNameSplitRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	gomock.InOrder(
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}),
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "K8s_svc_c_ns_foo-tcp-80", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			},
+		}, nil),
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Name: "a1b2-tcp-443", Publicip: "1.2.3.4", Publicipid: "ip-1"},
+			},
+		}, nil),
+	)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			LoadBalancer: mockLB,
+		},
+	}
+
+	lb, err := cs.getLoadBalancerByName(t.Context(), "c", nil, "K8s_svc_c_ns_foo", "a1b2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lb.name != "K8s_svc_c_ns_foo" {
+		t.Errorf("lb.name = %q, want %q", lb.name, "K8s_svc_c_ns_foo")
+	}
+	for _, ruleName := range []string{"K8s_svc_c_ns_foo-tcp-80", "a1b2-tcp-443"} {
+		if _, ok := lb.rules[ruleName]; !ok {
+			t.Errorf("rule %q missing from %v", ruleName, lb.rules)
+		}
+	}
+
+	// The rule under the legacy name is found for its port until it is renamed.
+	if lbRule, ok := lb.ruleForPort(LoadBalancerProtocolTCP, 443); !ok || lbRule.Name != "a1b2-tcp-443" {
+		t.Errorf("ruleForPort(tcp, 443) = %v, %v, want a1b2-tcp-443", lbRule, ok)
+	}
+	if lbRule, ok := lb.ruleForPort(LoadBalancerProtocolTCP, 43); ok {
+		t.Errorf("ruleForPort(tcp, 43) = %v, want none", lbRule)
+	}
+}
+
+// --- Fix B tests ---
+
+func TestLookupPublicIPAddress(t *testing.T) {
+	t.Run("found and allocated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		resp := &cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{
+					Id:        "ip-123",
+					Ipaddress: "203.0.113.1",
+				},
+			},
+		}
+
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+		}
+
+		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !found {
+			t.Fatalf("expected found = true")
+		}
+		if lb.ipAddr != "203.0.113.1" {
+			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
+		}
+		if lb.ipAddrID != "ip-123" {
+			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-123")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		resp := &cloudstack.ListPublicIpAddressesResponse{
+			Count:             0,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{},
+		}
+
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+		}
+
+		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if found {
+			t.Fatalf("expected found = false")
+		}
+		if lb.ipAddr != "" {
+			t.Errorf("ipAddr should be empty, got %q", lb.ipAddr)
+		}
+	})
+
+	t.Run("API error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(nil, errors.New("API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+		}
+
+		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if found {
+			t.Fatalf("expected found = false on error")
+		}
+		if !strings.Contains(err.Error(), "error looking up IP address") {
+			t.Errorf("error = %q, want to contain 'error looking up IP address'", err.Error())
+		}
+	})
+
+	t.Run("project ID propagation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		resp := &cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{
+					Id:        "ip-123",
+					Ipaddress: "203.0.113.1",
+				},
+			},
+		}
+
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+			projectID: "proj-456",
+		}
+
+		found, err := lb.lookupPublicIPAddress("203.0.113.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !found {
+			t.Fatalf("expected found = true")
+		}
+	})
+}
+
+// --- Fix C tests ---
+
+// setupGetLoadBalancerByNameEmpty sets up mock expectations for getLoadBalancerByName
+// when it should return an empty result (no matching LB rules). This requires three
+// ListLoadBalancerRules calls: one for the modern name, one for the legacy name and
+// one for the service tags.
+func setupGetLoadBalancerByNameEmpty(mockLB *cloudstack.MockLoadBalancerServiceIface) {
+	emptyResp := &cloudstack.ListLoadBalancerRulesResponse{Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{}}
+	// Modern name call
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil)
+	// Legacy name fallback call
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil)
+	// Service tags fallback call
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(emptyResp, nil)
+}
+
+// setupGetLoadBalancerByNameEmptyWithoutPorts is setupGetLoadBalancerByNameEmpty for a service without ports,
+// whose rules are not looked up by the service tags.
+func setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB *cloudstack.MockLoadBalancerServiceIface) {
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil).Times(2)
+}
+
+// setupVerifyRulesDeleted expects verifyRulesDeleted to look up a deleted rule by its ID, returning left when
+// CloudStack still lists it.
+func setupVerifyRulesDeleted(mockLB *cloudstack.MockLoadBalancerServiceIface, id string, left ...*cloudstack.LoadBalancerRule) {
+	p := &cloudstack.ListLoadBalancerRulesParams{}
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(p)
+	mockLB.EXPECT().ListLoadBalancerRules(p).DoAndReturn(func(p *cloudstack.ListLoadBalancerRulesParams) (*cloudstack.ListLoadBalancerRulesResponse, error) {
+		if got, _ := p.GetId(); got != id {
+			return nil, fmt.Errorf("unexpected rule ID %q, want %q", got, id)
+		}
+
+		return &cloudstack.ListLoadBalancerRulesResponse{Count: len(left), LoadBalancerRules: left}, nil
+	})
+}
+
+// setupNoStaleRulesOnNewIP expects deleteStaleRulesOfNewIP to find no rules on a newly associated IP.
+func setupNoStaleRulesOnNewIP(mockLB *cloudstack.MockLoadBalancerServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface) {
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+}
+
+// setupNoPublicIPConflict expects checkPublicIPConflict to find no rules on the requested IP.
+func setupNoPublicIPConflict(mockLB *cloudstack.MockLoadBalancerServiceIface) {
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+}
+
+func TestFreePublicIP(t *testing.T) {
+	ips := []*cloudstack.PublicIpAddress{
+		{Id: "ip-1", Ipaddress: "203.0.113.1", State: "Allocated", Vlanid: "vlan-id-1", Vlanname: "vlan://100"},
+		{Id: "ip-10", Ipaddress: "203.0.113.10", State: "Free", Vlanid: "vlan-id-1", Vlanname: "vlan://100"},
+		{Id: "ip-3", Ipaddress: "203.0.113.3", State: "Free", Vlanid: "vlan-id-1", Vlanname: "vlan://100"},
+		{Id: "ip-2", Ipaddress: "203.0.113.2", State: "Free", Vlanid: "vlan-id-2", Vlanname: "vlan://200"},
+		{Id: "ip-4", Ipaddress: "203.0.113.4", State: "Allocated", Vlanid: "vlan-id-3", Vlanname: "vlan://300"},
+	}
+
+	tests := []struct {
+		name    string
+		vlan    string
+		want    string
+		wantErr error
+	}{
+		{name: "lowest free IP of the VLAN", vlan: "vlan://100", want: "203.0.113.3"},
+		{name: "lowest free IP of any VLAN", want: "203.0.113.2"},
+		{name: "unknown VLAN", vlan: "vlan://400", wantErr: errPublicIPVLANNotFound},
+		{name: "VLAN without free IPs", vlan: "vlan://300", wantErr: errInsufficientCapacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			listParams := &cloudstack.ListPublicIpAddressesParams{}
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+			mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count: len(ips), PublicIpAddresses: ips,
+			}, nil)
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+				publicIPVLAN:     tt.vlan,
+			}
+
+			got, err := lb.freePublicIP("zone-1")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("freePublicIP() = %q, want %q", got, tt.want)
+			}
+			if zone, _ := listParams.GetZoneid(); zone != "zone-1" {
+				t.Errorf("listed zone %q, want zone-1", zone)
+			}
+		})
+	}
+
+	t.Run("IPs of the VLAN on a later page", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		firstPage := make([]*cloudstack.PublicIpAddress, publicIPsPageSize)
+		for i := range firstPage {
+			firstPage[i] = &cloudstack.PublicIpAddress{
+				Id: fmt.Sprintf("ip-%d", i), Ipaddress: fmt.Sprintf("198.51.%d.%d", i/256, i%256), State: "Free", Vlanname: "vlan://100",
+			}
+		}
+		secondPage := []*cloudstack.PublicIpAddress{
+			{Id: "ip-vlan", Ipaddress: "203.0.113.5", State: "Free", Vlanname: "vlan://200"},
+		}
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		var pages []int
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(listParams).DoAndReturn(func(p *cloudstack.ListPublicIpAddressesParams) (*cloudstack.ListPublicIpAddressesResponse, error) {
+			page, _ := p.GetPage()
+			pages = append(pages, page)
+			if page == 1 {
+				return &cloudstack.ListPublicIpAddressesResponse{Count: publicIPsPageSize + 1, PublicIpAddresses: firstPage}, nil
+			}
+
+			return &cloudstack.ListPublicIpAddressesResponse{Count: publicIPsPageSize + 1, PublicIpAddresses: secondPage}, nil
+		}).Times(2)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			publicIPVLAN:     "vlan://200",
+		}
+
+		got, err := lb.freePublicIP("zone-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "203.0.113.5" {
+			t.Errorf("freePublicIP() = %q, want %q", got, "203.0.113.5")
+		}
+		if !slices.Equal(pages, []int{1, 2}) {
+			t.Errorf("listed pages %v, want [1 2]", pages)
+		}
+	})
+
+	t.Run("incomplete listing fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 2, PublicIpAddresses: ips[:1],
+		}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			publicIPVLAN:     "vlan://100",
+		}
+
+		// A free IP on the missing page could be lower, or the only one of the VLAN.
+		if _, err := lb.freePublicIP("zone-1"); err == nil || !strings.Contains(err.Error(), "listed 1 of 2 IPs") {
+			t.Fatalf("error = %v, want the incomplete listing", err)
+		}
+	})
+}
+
+func TestAssociatePublicIPAddressVLAN(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+	setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1", Zoneid: "zone-1"}, 1, nil)
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count: 1,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			{Id: "ip-1", Ipaddress: "203.0.113.1", State: "Free", Vlanname: "vlan://100"},
+		},
+	}, nil)
+	associateParams := &cloudstack.AssociateIpAddressParams{}
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams)
+	mockAddress.EXPECT().AssociateIpAddress(associateParams).Return(&cloudstack.AssociateIpAddressResponse{
+		Id: "ip-1", Ipaddress: "203.0.113.1",
+	}, nil)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Network: mockNetwork, Firewall: mockFirewall},
+		networkID:        "net-1",
+		publicIPVLAN:     "vlan://100",
+	}
+
+	if err := lb.associatePublicIPAddress(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip, _ := associateParams.GetIpaddress(); ip != "203.0.113.1" {
+		t.Errorf("associated IP %q, want 203.0.113.1", ip)
+	}
+	if lb.ipAddrID != "ip-1" {
+		t.Errorf("ipAddrID = %q, want ip-1", lb.ipAddrID)
+	}
+}
+
+func TestAssociatePublicIPAddressLowest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+	setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1", Zoneid: "zone-1"}, 1, nil)
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count: 3,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			{Id: "ip-9", Ipaddress: "203.0.113.9", State: "Free", Vlanname: "vlan://100"},
+			{Id: "ip-1", Ipaddress: "203.0.113.1", State: "Allocated", Vlanname: "vlan://100"},
+			{Id: "ip-5", Ipaddress: "203.0.113.5", State: "Free", Vlanname: "vlan://200"},
+		},
+	}, nil)
+	associateParams := &cloudstack.AssociateIpAddressParams{}
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams)
+	mockAddress.EXPECT().AssociateIpAddress(associateParams).Return(&cloudstack.AssociateIpAddressResponse{
+		Id: "ip-5", Ipaddress: "203.0.113.5",
+	}, nil)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Network: mockNetwork, Firewall: mockFirewall},
+		networkID:        "net-1",
+		ipSelection:      ipSelectionLowest,
+	}
+
+	if err := lb.associatePublicIPAddress(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip, _ := associateParams.GetIpaddress(); ip != "203.0.113.5" {
+		t.Errorf("associated IP %q, want 203.0.113.5", ip)
+	}
+}
+
+func TestLookupServicePublicIPAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		ips       []*cloudstack.PublicIpAddress
+		wantFound bool
+		wantID    string
+	}{
+		{name: "no retained IP"},
+		{
+			name: "retained IP in the nodes network",
+			ips: []*cloudstack.PublicIpAddress{
+				{Id: "ip-other", Ipaddress: "203.0.113.1", Associatednetworkid: "net-2"},
+				{Id: "ip-1", Ipaddress: "203.0.113.2", Associatednetworkid: "net-1"},
+			},
+			wantFound: true,
+			wantID:    "ip-1",
+		},
+		{
+			name: "retained IP in another network",
+			ips: []*cloudstack.PublicIpAddress{
+				{Id: "ip-other", Ipaddress: "203.0.113.1", Associatednetworkid: "net-2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			tags := map[string]string{serviceClusterTagKey: "cluster", serviceNamespaceTagKey: "default", serviceNameTagKey: "web"}
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			listParams := &cloudstack.ListPublicIpAddressesParams{}
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+			mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             len(tt.ips),
+				PublicIpAddresses: tt.ips,
+			}, nil)
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+				networkID:        "net-1",
+				serviceTags:      tags,
+			}
+
+			found, err := lb.lookupServicePublicIPAddress()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, ok := listParams.GetTags(); !ok || !maps.Equal(got, tags) {
+				t.Errorf("tags = %v, want %v", got, tags)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("found = %v, want %v", found, tt.wantFound)
+			}
+			if lb.ipAddrID != tt.wantID {
+				t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestLookupLeakedPublicIPAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		ips       []*cloudstack.PublicIpAddress
+		ruleCount map[string]int
+		wantFound bool
+		wantID    string
+	}{
+		{name: "no IP of the service"},
+		{
+			name: "IP without rules is reused",
+			ips: []*cloudstack.PublicIpAddress{
+				{Id: "ip-rules", Ipaddress: "203.0.113.1", Associatednetworkid: "net-1"},
+				{Id: "ip-nat", Ipaddress: "203.0.113.2", Associatednetworkid: "net-1", Isstaticnat: true},
+				{Id: "ip-1", Ipaddress: "203.0.113.3", Associatednetworkid: "net-1"},
+			},
+			ruleCount: map[string]int{"ip-rules": 2},
+			wantFound: true,
+			wantID:    "ip-1",
+		},
+		{
+			name: "IP with rules is not reused",
+			ips: []*cloudstack.PublicIpAddress{
+				{Id: "ip-rules", Ipaddress: "203.0.113.1", Associatednetworkid: "net-1"},
+			},
+			ruleCount: map[string]int{"ip-rules": 1},
+		},
+		{
+			name: "IP in another network is not reused",
+			ips: []*cloudstack.PublicIpAddress{
+				{Id: "ip-other", Ipaddress: "203.0.113.1", Associatednetworkid: "net-2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			tags := map[string]string{serviceClusterTagKey: "cluster", serviceNamespaceTagKey: "default", serviceNameTagKey: "web"}
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			listParams := &cloudstack.ListPublicIpAddressesParams{}
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+			mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             len(tt.ips),
+				PublicIpAddresses: tt.ips,
+			}, nil)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().DoAndReturn(func() *cloudstack.ListLoadBalancerRulesParams {
+				return &cloudstack.ListLoadBalancerRulesParams{}
+			}).AnyTimes()
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).DoAndReturn(func(p *cloudstack.ListLoadBalancerRulesParams) (*cloudstack.ListLoadBalancerRulesResponse, error) {
+				id, _ := p.GetPublicipid()
+
+				return &cloudstack.ListLoadBalancerRulesResponse{Count: tt.ruleCount[id]}, nil
+			}).AnyTimes()
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB},
+				networkID:        "net-1",
+				serviceTags:      tags,
+			}
+
+			found, err := lb.lookupLeakedPublicIPAddress()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, ok := listParams.GetTags(); !ok || !maps.Equal(got, tags) {
+				t.Errorf("tags = %v, want %v", got, tags)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("found = %v, want %v", found, tt.wantFound)
+			}
+			if lb.ipAddrID != tt.wantID {
+				t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerRecoverLeakedIP(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupVerifyHosts(mockVM)
+
+	// The IP tagged with the service has no rules, so it is reused instead of associating a new one.
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count: 1,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			{Id: "ip-leaked", Ipaddress: "10.0.0.1", Allocated: "2023-01-01"},
+		},
+	}, nil)
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+
+	// The IPv6 family stops EnsureLoadBalancer right after the service is annotated.
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+			IPFamilies:      []corev1.IPFamily{corev1.IPv6Protocol},
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+	cs.recoverLeakedIPs = true
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err == nil {
+		t.Fatalf("expected an IP family mismatch error")
+	}
+	if got := service.Annotations[ServiceAnnotationLoadBalancerID]; got != "ip-leaked" {
+		t.Errorf("ID annotation = %q, want %q", got, "ip-leaked")
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if !strings.Contains(strings.Join(events, "\n"), "RecoveredLoadBalancerIP") {
+		t.Errorf("expected a RecoveredLoadBalancerIP event, got %v", events)
+	}
+}
+
+func TestEnsureLoadBalancerDeletedOrphanedIP(t *testing.T) {
+	t.Run("orphaned IP released via annotation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		// getLoadBalancerByName returns no rules (2 ListLoadBalancerRules calls)
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		// lookupPublicIPAddress finds the orphaned IP
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-orphan", Ipaddress: "10.0.0.1"},
+			},
+		}, nil)
+
+		// shouldReleaseLoadBalancerIP: no other rules on this IP
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+		}, nil)
+
+		// releaseLoadBalancerIP
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-orphan").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+				},
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("orphaned IP found by its tags when annotations are not written", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		// The stale ID annotation is ignored, so the rules are looked up by name.
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-orphan", Ipaddress: "10.0.0.1"},
+			},
+		}, nil)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-orphan").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerWriteAnnotations: "false",
+					ServiceAnnotationLoadBalancerID:               "ip-stale",
+				},
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := map[string]string{serviceClusterTagKey: "cluster", serviceNamespaceTagKey: "default", serviceNameTagKey: "foo"}
+		if tags, _ := listParams.GetTags(); !maps.Equal(tags, want) {
+			t.Errorf("listed IPs by tags %v, want %v", tags, want)
+		}
+		if got := countPatches(cs.kclient.(*fake.Clientset)); got != 0 {
+			t.Errorf("patches = %d, want 0", got)
+		}
+	})
+
+	t.Run("no annotation returns nil", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("IP already gone returns nil", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		// lookupPublicIPAddress: not found
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 0, PublicIpAddresses: []*cloudstack.PublicIpAddress{},
+		}, nil)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+				},
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("release fails returns error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		// lookupPublicIPAddress
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-orphan", Ipaddress: "10.0.0.1"},
+			},
+		}, nil)
+
+		// shouldRelease: yes
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+		}, nil)
+
+		// releaseLoadBalancerIP fails on every attempt
+		setupFastIPReleaseBackoff(t)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-orphan").Return(&cloudstack.DisassociateIpAddressParams{}).Times(ipReleaseBackoff.Steps)
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).
+			Return(nil, errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4250): release failed")).Times(ipReleaseBackoff.Steps)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+				},
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "error releasing orphaned load balancer IP") {
+			t.Errorf("error = %q, want to contain 'error releasing orphaned load balancer IP'", err.Error())
+		}
+	})
+
+	t.Run("keep-ip annotation prevents release", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmptyWithoutPorts(mockLB)
+
+		// lookupPublicIPAddress
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-user", Ipaddress: "10.0.0.1"},
+			},
+		}, nil)
+		// shouldReleaseLoadBalancerIP returns false because keep-ip annotation is set
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+					ServiceAnnotationLoadBalancerKeepIP:  "true",
+				},
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestEnsureLoadBalancerDeletedSharedIP(t *testing.T) {
+	tags := func(name, port string) []cloudstack.Tags {
+		return []cloudstack.Tags{
+			{Key: serviceClusterTagKey, Value: "cluster"},
+			{Key: serviceNamespaceTagKey, Value: "default"},
+			{Key: serviceNameTagKey, Value: name},
+			{Key: firewallRulePortTagKey, Value: port},
+		}
+	}
+	newService := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		}
+	}
+
+	// setupDeleteWeb sets up the deletion of the port 80 rule of the web service, on an IP that also has
+	// the firewall rules of the api service for port 443 and ICMP. No other load balancer rule is left on the IP.
+	setupDeleteWeb := func(mockLB *cloudstack.MockLoadBalancerServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface) {
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).Times(3)
+		gomock.InOrder(
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: 1,
+				LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+					Id: "rule-web", Name: "K8s_svc_cluster_default_web-tcp-80", Publicip: "10.0.0.1", Publicipid: "ip-1",
+					Publicport: "80", Protocol: "tcp",
+				}},
+			}, nil),
+			// The legacy name has no rules.
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+			// Verifying the deletion no longer finds the deleted rule by its ID.
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+		)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-web").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		apiRules := []*cloudstack.FirewallRule{
+			{Id: "fw-api", Protocol: "tcp", Startport: 443, Endport: 443, Cidrlist: defaultAllowedCIDR, Tags: tags("api", "tcp/443")},
+			{Id: "fw-api-icmp", Protocol: "icmp", Icmptype: -1, Icmpcode: -1, Cidrlist: defaultAllowedCIDR, Tags: tags("api", "icmp")},
+		}
+		webRule := &cloudstack.FirewallRule{Id: "fw-web", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR, Tags: tags("web", "tcp/80")}
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(2)
+		gomock.InOrder(
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 3, FirewallRules: append([]*cloudstack.FirewallRule{webRule}, apiRules...),
+			}, nil),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 2, FirewallRules: apiRules,
+			}, nil),
+		)
+		// Only the firewall rule of the web service is deleted.
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-web").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+	}
+
+	t.Run("IP is kept while another service uses it", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupDeleteWeb(mockLB, mockFirewall)
+
+		web := newService("web")
+		// The api service requests the same IP for port 443, but did not create its rule yet.
+		api := newService("api")
+		api.Spec.Ports = []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 443}}
+
+		cs := newTestCSCloud(mockLB, nil, nil, nil, mockFirewall, web)
+		cs.kclient = fake.NewSimpleClientset(web, api)
+		cs.serviceLister = newTestServiceLister(web, api)
+
+		if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", web); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("last service releases the IP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		setupDeleteWeb(mockLB, mockFirewall)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+
+		web := newService("web")
+		// The api service is being deleted, its rules were already removed.
+		api := newService("api")
+		api.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		api.Finalizers = []string{"service.kubernetes.io/load-balancer-cleanup"}
+
+		cs := newTestCSCloud(mockLB, mockAddress, nil, nil, mockFirewall, web)
+		cs.kclient = fake.NewSimpleClientset(web, api)
+		cs.serviceLister = newTestServiceLister(web, api)
+
+		if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", web); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestEnsureLoadBalancerDeletedRetry(t *testing.T) {
+	rule := func(id, port string) *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{
+			Id: id, Name: "K8s_svc_cluster_default_foo-tcp-" + port, Publicip: "10.0.0.1", Publicipid: "ip-1",
+			Publicport: port, Protocol: "tcp",
+		}
+	}
+	// setupLookup expects the rules of the service to be listed under its name and its empty legacy name.
+	setupLookup := func(mockLB *cloudstack.MockLoadBalancerServiceIface, rules ...*cloudstack.LoadBalancerRule) {
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: len(rules), LoadBalancerRules: rules,
+		}, nil)
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	}
+	// setupDeleteRule expects a rule without firewall rules to be deleted, returning err.
+	setupDeleteRule := func(mockLB *cloudstack.MockLoadBalancerServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface, id string, err error) {
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		p := &cloudstack.DeleteLoadBalancerRuleParams{}
+		p.SetId(id)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams(id).Return(p)
+		mockLB.EXPECT().DeleteLoadBalancerRule(p).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, err)
+	}
+	// The service was changed from type LoadBalancer to ClusterIP.
+	newService := func() *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+		}
+	}
+
+	t.Run("partial deletion converges on retry", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		service := newService()
+		cs := newTestCSCloud(mockLB, mockAddress, nil, nil, mockFirewall, service)
+
+		// The first attempt fails to delete the rule for port 443, so the IP and the annotations are kept.
+		setupLookup(mockLB, rule("rule-80", "80"), rule("rule-443", "443"))
+		setupDeleteRule(mockLB, mockFirewall, "rule-80", nil)
+		setupDeleteRule(mockLB, mockFirewall, "rule-443", errors.New("rule is busy"))
+		setupNoICMPFirewallRules(mockFirewall)
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err == nil || !strings.Contains(err.Error(), "rule is busy") {
+			t.Fatalf("EnsureLoadBalancerDeleted() error = %v, want the error of the failed rule", err)
+		}
+		if service.Annotations[ServiceAnnotationLoadBalancerAddress] != "10.0.0.1" {
+			t.Errorf("annotations were removed after a partial deletion: %v", service.Annotations)
+		}
+
+		// The retry deletes the remaining rule, releases the IP and verifies that no rule is left.
+		setupLookup(mockLB, rule("rule-443", "443"))
+		setupDeleteRule(mockLB, mockFirewall, "rule-443", nil)
+		setupNoICMPFirewallRules(mockFirewall)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+		setupVerifyRulesDeleted(mockLB, "rule-443")
+
+		if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service); err != nil {
+			t.Fatalf("unexpected error on retry: %v", err)
+		}
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerAddress]; ok {
+			t.Errorf("annotations were not removed after the deletion converged: %v", service.Annotations)
+		}
+	})
+
+	t.Run("failed IP release is not reported as leaked", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		service := newService()
+		cs := newTestCSCloud(mockLB, mockAddress, nil, nil, mockFirewall, service)
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
+
+		setupLookup(mockLB, rule("rule-80", "80"))
+		setupDeleteRule(mockLB, mockFirewall, "rule-80", nil)
+		setupNoICMPFirewallRules(mockFirewall)
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).
+			Return(nil, errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): release failed"))
+
+		before := publicIPOperationCount(t, publicIPOperationReleaseFailed, "")
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err == nil || !strings.Contains(err.Error(), "release failed") {
+			t.Fatalf("EnsureLoadBalancerDeleted() error = %v, want the error of the release", err)
+		}
+		// The service controller retries the deletion, which releases the IP again.
+		if got := publicIPOperationCount(t, publicIPOperationReleaseFailed, "") - before; got != 0 {
+			t.Errorf("release_failed counter increased by %v, want 0", got)
+		}
+		close(recorder.Events)
+		for event := range recorder.Events {
+			if strings.Contains(event, "ReleasingLoadBalancerIPFailed") {
+				t.Errorf("unexpected event %q, the release is retried", event)
+			}
+		}
+	})
+
+	t.Run("rule left after deletion", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		service := newService()
+		service.Annotations[ServiceAnnotationLoadBalancerKeepIP] = "true"
+		cs := newTestCSCloud(mockLB, nil, nil, nil, mockFirewall, service)
+
+		setupLookup(mockLB, rule("rule-80", "80"))
+		setupDeleteRule(mockLB, mockFirewall, "rule-80", nil)
+		setupNoICMPFirewallRules(mockFirewall)
+		// CloudStack still lists the rule after it was deleted.
+		setupVerifyRulesDeleted(mockLB, "rule-80", rule("rule-80", "80"))
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if !errors.Is(err, errLoadBalancerRulesLeft) {
+			t.Fatalf("EnsureLoadBalancerDeleted() error = %v, want %v", err, errLoadBalancerRulesLeft)
+		}
+		if service.Annotations[ServiceAnnotationLoadBalancerAddress] != "10.0.0.1" {
+			t.Errorf("annotations were removed although a rule is left: %v", service.Annotations)
+		}
+	})
+}
+
+func TestServicesSharingIP(t *testing.T) {
+	service := func(name string, mutate func(*corev1.Service)) *corev1.Service {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		}
+		mutate(svc)
+
+		return svc
+	}
+
+	web := service("web", func(*corev1.Service) {})
+	cs := &CSCloud{serviceLister: newTestServiceLister(
+		web,
+		service("by-id", func(s *corev1.Service) { s.Annotations = map[string]string{ServiceAnnotationLoadBalancerID: "ip-1"} }),
+		service("by-address", func(s *corev1.Service) { s.Spec.LoadBalancerIP = "10.0.0.1" }),
+		service("by-status", func(s *corev1.Service) {
+			s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+		}),
+		service("other-ip", func(s *corev1.Service) { s.Spec.LoadBalancerIP = "10.0.0.2" }),
+		service("cluster-ip", func(s *corev1.Service) {
+			s.Spec.Type = corev1.ServiceTypeClusterIP
+			s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+		}),
+		service("unmanaged", func(s *corev1.Service) {
+			s.Spec.LoadBalancerIP = "10.0.0.1"
+			s.Annotations = map[string]string{ServiceAnnotationLoadBalancerManaged: "false"}
+		}),
+	)}
+
+	got, err := cs.servicesSharingIP(web, "10.0.0.1", "ip-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	slices.Sort(got)
+	if want := []string{"default/by-address", "default/by-id", "default/by-status"}; !slices.Equal(got, want) {
+		t.Errorf("servicesSharingIP() = %v, want %v", got, want)
+	}
+}
+
+func TestServicesSharingIPFromInformer(t *testing.T) {
+	web := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+	api := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerIP: "10.0.0.1"},
+	}
+	kclient := fake.NewSimpleClientset(web, api)
+	informerFactory := informers.NewSharedInformerFactory(kclient, 0)
+
+	cs := &CSCloud{}
+	cs.SetInformers(informerFactory)
+	informerFactory.Start(t.Context().Done())
+	informerFactory.WaitForCacheSync(t.Context().Done())
+	synced := len(kclient.Actions())
+
+	got, err := cs.servicesSharingIP(web, "10.0.0.1", "ip-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"default/api"}; !slices.Equal(got, want) {
+		t.Errorf("servicesSharingIP() = %v, want %v", got, want)
+	}
+
+	// The services come from the informer cache, the API server is not called.
+	if actions := kclient.Actions()[synced:]; len(actions) != 0 {
+		t.Errorf("unexpected API calls: %v", actions)
+	}
+}
+
+func TestOwnsFirewallRuleSharedIP(t *testing.T) {
+	lb := &loadBalancer{
+		clusterName: "cluster",
+		serviceTags: newServiceTags("cluster", &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}),
+	}
+
+	tests := []struct {
+		name string
+		tags []cloudstack.Tags
+		want bool
+	}{
+		{name: "untagged rule", want: true},
+		{
+			name: "rule of the service",
+			tags: []cloudstack.Tags{{Key: serviceNamespaceTagKey, Value: "default"}, {Key: serviceNameTagKey, Value: "web"}},
+			want: true,
+		},
+		{
+			name: "rule of another service",
+			tags: []cloudstack.Tags{{Key: serviceNamespaceTagKey, Value: "default"}, {Key: serviceNameTagKey, Value: "api"}},
+		},
+		{
+			name: "rule of a service in another namespace",
+			tags: []cloudstack.Tags{{Key: serviceNamespaceTagKey, Value: "other"}, {Key: serviceNameTagKey, Value: "web"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lb.ownsFirewallRule(&cloudstack.FirewallRule{Id: "fw-1", Tags: tt.tags}); got != tt.want {
+				t.Errorf("ownsFirewallRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerDeletedAnnotationCleanup(t *testing.T) {
+	// allLBAnnotations returns a map with all 6 CloudStack LB annotations set.
+	allLBAnnotations := func() map[string]string {
+		return map[string]string{
+			ServiceAnnotationLoadBalancerProxyProtocol:        "true",
+			ServiceAnnotationLoadBalancerLoadbalancerHostname: "lb.example.com",
+			ServiceAnnotationLoadBalancerAddress:              "10.0.0.1",
+			ServiceAnnotationLoadBalancerKeepIP:               "false",
+			ServiceAnnotationLoadBalancerID:                   "ip-1",
+			ServiceAnnotationLoadBalancerNetworkID:            "net-1",
+		}
+	}
+
+	lbAnnotationKeys := []string{
+		ServiceAnnotationLoadBalancerProxyProtocol,
+		ServiceAnnotationLoadBalancerLoadbalancerHostname,
+		ServiceAnnotationLoadBalancerAddress,
+		ServiceAnnotationLoadBalancerKeepIP,
+		ServiceAnnotationLoadBalancerID,
+		ServiceAnnotationLoadBalancerNetworkID,
+	}
+
+	t.Run("annotations removed after successful deletion", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		// getLoadBalancerByName returns one rule
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{
+					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Publicport: "80",
+					Protocol: "tcp", Networkid: "net-1",
+				},
+			},
+		}, nil)
+
+		// deleteFirewallRule
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 0, FirewallRules: []*cloudstack.FirewallRule{},
+		}, nil)
+
+		// deleteLoadBalancerRule
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		// deleteICMPFirewallRules
+		setupNoICMPFirewallRules(mockFirewall)
+
+		// shouldReleaseLoadBalancerIP: no keep-ip, no other rules
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+		}, nil)
+
+		// releaseLoadBalancerIP
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+
+		// verifyRulesDeleted
+		setupVerifyRulesDeleted(mockLB, "rule-1")
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: allLBAnnotations(),
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+				Firewall:     mockFirewall,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, key := range lbAnnotationKeys {
+			if _, ok := service.Annotations[key]; ok {
+				t.Errorf("annotation %q should have been removed", key)
+			}
+		}
+	})
+
+	t.Run("annotations preserved when deletion fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		// getLoadBalancerByName returns one rule
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{
+					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Publicport: "80",
+					Protocol: "tcp", Networkid: "net-1",
+				},
+			},
+		}, nil).Times(1)
+
+		// deleteFirewallRule fails
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("firewall error"))
+
+		// deleteLoadBalancerRule fails
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(nil, errors.New("delete rule error"))
+
+		// deleteICMPFirewallRules fails as well
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("firewall error"))
+
+		// The IP is not released while resources on it may be left.
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: allLBAnnotations(),
+			},
+		}
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Address:      mockAddress,
+				Firewall:     mockFirewall,
+			},
+			kclient:       fake.NewSimpleClientset(service),
+			serviceLister: newTestServiceLister(service),
+			eventRecorder: record.NewFakeRecorder(10),
+		}
+
+		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+
+		for _, key := range lbAnnotationKeys {
+			if _, ok := service.Annotations[key]; !ok {
+				t.Errorf("annotation %q should have been preserved on error", key)
+			}
+		}
+	})
+}
+
+// --- Fix D tests ---
+
+// newTestCSCloud creates a minimal CSCloud with mocks for EnsureLoadBalancer tests.
+// The provided service is pre-created in the fake clientset so the service patcher can find it.
+func newTestCSCloud(mockLB *cloudstack.MockLoadBalancerServiceIface, mockAddress *cloudstack.MockAddressServiceIface, mockVM *cloudstack.MockVirtualMachineServiceIface, mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface, service *corev1.Service) *CSCloud {
+	return &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			LoadBalancer:   mockLB,
+			Address:        mockAddress,
+			VirtualMachine: mockVM,
+			Network:        mockNetwork,
+			Firewall:       mockFirewall,
+		},
+		kclient:       fake.NewSimpleClientset(service),
+		serviceLister: newTestServiceLister(service),
+		eventRecorder: record.NewFakeRecorder(10),
+	}
+}
+
+// newTestServiceLister returns a service lister of the given services, like the one set by SetInformers.
+func newTestServiceLister(services ...*corev1.Service) corelisters.ServiceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, service := range services {
+		_ = indexer.Add(service)
+	}
+
+	return corelisters.NewServiceLister(indexer)
+}
+
+// setupVerifyHosts sets up mock expectations for verifyHosts returning one node.
+func setupVerifyHosts(mockVM *cloudstack.MockVirtualMachineServiceIface) {
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+		Count: 1,
+		VirtualMachines: []*cloudstack.VirtualMachine{
+			{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1"}}},
+		},
+	}, nil)
+}
+
+// setupCreateRuleAndFirewall sets up mock expectations for creating one LB rule
+// with firewall, which is the common tail of EnsureLoadBalancer tests.
+func setupCreateRuleAndFirewall(mockLB *cloudstack.MockLoadBalancerServiceIface, mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface, ip, ipID string) {
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+		Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+		Networkid: "net-1", Privateport: "30080", Publicport: "80",
+		Publicip: ip, Publicipid: ipID, Protocol: "tcp",
+	}, nil)
+	mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+	mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil)
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{Count: 0, FirewallRules: []*cloudstack.FirewallRule{}}, nil)
+	mockFirewall.EXPECT().NewCreateFirewallRuleParams(gomock.Any(), gomock.Any()).Return(&cloudstack.CreateFirewallRuleParams{})
+	mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+}
+
+// setupResourceTags sets up mock expectations for tagging one new resource of each of the given
+// types, f.e. "PublicIpAddress" for a newly allocated IP and "FirewallRule" for a new firewall rule.
+func setupResourceTags(ctrl *gomock.Controller, cs *CSCloud, resourceTypes ...string) {
+	mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+	for _, resourceType := range resourceTypes {
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceType, gomock.Any()).Return(&cloudstack.CreateTagsParams{})
+	}
+	mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).Times(len(resourceTypes))
+	cs.client.Resourcetags = mockTags
+}
+
+// setupNoICMPFirewallRules sets up mock expectations for the ICMP firewall cleanup of a
+// service without ServiceAnnotationLoadBalancerAllowICMP.
+func setupNoICMPFirewallRules(mockFirewall *cloudstack.MockFirewallServiceIface) {
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{Count: 0, FirewallRules: []*cloudstack.FirewallRule{}}, nil)
+}
+
+func TestEnsureLoadBalancerOpenFirewall(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupNoPublicIPConflict(mockLB)
+	setupVerifyHosts(mockVM)
+
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count:             1,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "10.0.0.1"}},
+	}, nil)
+
+	// The rule opens the firewall itself, so no firewall rules are listed or created for its port.
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		(&cloudstack.LoadBalancerService{}).NewCreateLoadBalancerRuleParams)
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).DoAndReturn(func(p *cloudstack.CreateLoadBalancerRuleParams) (*cloudstack.CreateLoadBalancerRuleResponse, error) {
+		if open, ok := p.GetOpenfirewall(); !ok || !open {
+			t.Errorf("openfirewall = %v (set: %v), want true", open, ok)
+		}
+		if cidrs, ok := p.GetCidrlist(); ok {
+			t.Errorf("cidrlist = %v, want none in a network with the Firewall service", cidrs)
+		}
+
+		return &cloudstack.CreateLoadBalancerRuleResponse{
+			Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80",
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+		}, nil
+	})
+	mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+	mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil)
+	setupNoICMPFirewallRules(mockFirewall)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:                    []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+			SessionAffinity:          corev1.ServiceAffinityNone,
+			LoadBalancerSourceRanges: []string{"192.0.2.0/24"},
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+	cs.openFirewall = true
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+	setupResourceTags(ctrl, cs, "LoadBalancer")
+
+	status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status == nil || len(status.Ingress) == 0 || status.Ingress[0].IP != "10.0.0.1" {
+		t.Fatalf("status = %v, want ingress IP 10.0.0.1", status)
+	}
+
+	// The source ranges cannot be enforced, which is reported on the service.
+	close(recorder.Events)
+	var ignored bool
+	for event := range recorder.Events {
+		ignored = ignored || strings.Contains(event, "Warning SourceRangesIgnored")
+	}
+	if !ignored {
+		t.Errorf("expected a SourceRangesIgnored event")
+	}
+}
+
+func TestEnsureLoadBalancerAnnotationRecovery(t *testing.T) {
+	t.Run("recovers annotated IP on retry", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		// getLoadBalancerByName: no rules (2 LB list calls: modern + legacy)
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupNoPublicIPConflict(mockLB)
+		setupVerifyHosts(mockVM)
+
+		// lookupPublicIPAddress: finds the annotated IP
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-recovered", Ipaddress: "10.0.0.1"},
+			},
+		}, nil)
+
+		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.1", "ip-recovered")
+		setupNoICMPFirewallRules(mockFirewall)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
+		}
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "LoadBalancer", "FirewallRule")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status == nil || len(status.Ingress) == 0 {
+			t.Fatalf("expected non-empty status")
+		}
+		if status.Ingress[0].IP != "10.0.0.1" {
+			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.1")
+		}
+	})
+
+	t.Run("auto-allocates when no IP specified", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
+
+		// No annotation, no spec.LoadBalancerIP → auto-allocate via associatePublicIPAddress
+		// GetNetworkByID called twice: once for associatePublicIPAddress, once for firewall check
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+		}, 1, nil).Times(2)
+
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-new", Ipaddress: "10.0.0.2",
+		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+		// createLoadBalancerRule + firewall (but GetNetworkByID already set up above)
+		mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+		mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+			Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80",
+			Publicip: "10.0.0.2", Publicipid: "ip-new", Protocol: "tcp",
+		}, nil)
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{Count: 0, FirewallRules: []*cloudstack.FirewallRule{}}, nil)
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams(gomock.Any(), gomock.Any()).Return(&cloudstack.CreateFirewallRuleParams{})
+		mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+		setupNoICMPFirewallRules(mockFirewall)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
+		}
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer", "FirewallRule")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status == nil || len(status.Ingress) == 0 {
+			t.Fatalf("expected non-empty status")
+		}
+		if status.Ingress[0].IP != "10.0.0.2" {
+			t.Errorf("status IP = %q, want %q (new allocation)", status.Ingress[0].IP, "10.0.0.2")
+		}
+
+		// The IDs of the IP and the rules are exported for external tooling.
+		updated, err := cs.kclient.CoreV1().Services("default").Get(t.Context(), "foo", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := updated.Annotations[ServiceAnnotationLoadBalancerID]; got != "ip-new" {
+			t.Errorf("IP ID annotation = %q, want %q", got, "ip-new")
+		}
+		if got := updated.Annotations[ServiceAnnotationLoadBalancerRuleIDs]; got != "tcp/80=rule-1" {
+			t.Errorf("rule IDs annotation = %q, want %q", got, "tcp/80=rule-1")
+		}
+	})
+
+	t.Run("annotation-specified IP is allocated on fresh LB", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupNoPublicIPConflict(mockLB)
+		setupVerifyHosts(mockVM)
+
+		// lookupPublicIPAddress for annotated IP: found (already allocated)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-new", Ipaddress: "10.0.0.2", Allocated: "2023-01-01"},
+			},
+		}, nil)
+
+		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.2", "ip-new")
+		setupNoICMPFirewallRules(mockFirewall)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerAddress: "10.0.0.2", // user-specified desired IP
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
+		}
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "LoadBalancer", "FirewallRule")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status == nil || len(status.Ingress) == 0 {
+			t.Fatalf("expected non-empty status")
+		}
+		if status.Ingress[0].IP != "10.0.0.2" {
+			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.2")
+		}
+	})
+
+	t.Run("spec.LoadBalancerIP fallback used when no annotation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
+
+		// getLoadBalancerIP for spec IP (10.0.0.2) → getPublicIPAddress
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-new", Ipaddress: "10.0.0.2", Allocated: "2023-01-01"},
+			},
+		}, nil)
+		setupNoPublicIPConflict(mockLB)
+
+		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.2", "ip-new")
+		setupNoICMPFirewallRules(mockFirewall)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "default",
+				// No annotation — spec.LoadBalancerIP used as fallback
+			},
+			Spec: corev1.ServiceSpec{
+				LoadBalancerIP: "10.0.0.2",
+				Ports: []corev1.ServicePort{
+					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
+		}
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "LoadBalancer", "FirewallRule")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status == nil || len(status.Ingress) == 0 {
+			t.Fatalf("expected non-empty status")
+		}
+		if status.Ingress[0].IP != "10.0.0.2" {
+			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.2")
+		}
+	})
+}
+
+func TestUnmanagedLoadBalancer(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerManaged: "false",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+
+	// No mocks are set up: any CloudStack API call would panic.
+	cs := &CSCloud{
+		client:        &cloudstack.CloudStackClient{},
+		kclient:       fake.NewSimpleClientset(service),
+		serviceLister: newTestServiceLister(service),
+		eventRecorder: record.NewFakeRecorder(10),
+	}
+
+	status, exists, err := cs.GetLoadBalancer(t.Context(), "cluster", service)
+	if err != nil || exists || status != nil {
+		t.Errorf("GetLoadBalancer() = (%v, %v, %v), want (nil, false, nil)", status, exists, err)
+	}
+
+	status, err = cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+	if !errors.Is(err, cloudprovider.ImplementedElsewhere) {
+		t.Errorf("EnsureLoadBalancer() error = %v, want %v", err, cloudprovider.ImplementedElsewhere)
+	}
+	if status != nil {
+		t.Errorf("EnsureLoadBalancer() status = %v, want nil", status)
+	}
+
+	if err := cs.UpdateLoadBalancer(t.Context(), "cluster", service, nodes); !errors.Is(err, cloudprovider.ImplementedElsewhere) {
+		t.Errorf("UpdateLoadBalancer() error = %v, want %v", err, cloudprovider.ImplementedElsewhere)
+	}
+
+	if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service); !errors.Is(err, cloudprovider.ImplementedElsewhere) {
+		t.Errorf("EnsureLoadBalancerDeleted() error = %v, want %v", err, cloudprovider.ImplementedElsewhere)
+	}
+
+	if _, ok := service.Annotations[ServiceAnnotationLoadBalancerAddress]; ok {
+		t.Errorf("unmanaged service must not be annotated")
+	}
+}
+
+func TestWithAnnotationDefaults(t *testing.T) {
+	cs := &CSCloud{
+		annotationDefaults: map[string]string{
+			ServiceAnnotationLoadBalancerProxyProtocol: "true",
+			ServiceAnnotationLoadBalancerKeepIP:        "true",
+		},
+	}
+
+	t.Run("service annotation takes precedence over default", func(t *testing.T) {
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					ServiceAnnotationLoadBalancerProxyProtocol: "false",
+				},
+			},
+		}
+
+		annotated := cs.withAnnotationDefaults(service)
+		if getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerProxyProtocol, false) {
+			t.Errorf("proxy-protocol should not be overridden by the default")
+		}
+		if !getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerKeepIP, false) {
+			t.Errorf("keep-ip should be taken from the default")
+		}
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerKeepIP]; ok {
+			t.Errorf("defaults must not be written to the original service")
+		}
+	})
+
+	t.Run("service without annotations gets defaults", func(t *testing.T) {
+		annotated := cs.withAnnotationDefaults(&corev1.Service{})
+		if !getBoolFromServiceAnnotation(annotated, ServiceAnnotationLoadBalancerProxyProtocol, false) {
+			t.Errorf("proxy-protocol should be taken from the default")
+		}
+	})
+
+	t.Run("no defaults returns the service as-is", func(t *testing.T) {
+		service := &corev1.Service{}
+		if got := (&CSCloud{}).withAnnotationDefaults(service); got != service {
+			t.Errorf("expected the same service to be returned")
+		}
+	})
+}
+
+func TestGetLoadBalancerSourceRanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		specRanges    []string
+		annotation    string
+		defaultRanges []string
+		want          []string
+		wantErrPart   string
+	}{
+		{
+			name: "defaults to allow-all",
+			want: []string{defaultAllowedCIDR},
+		},
+		{
+			name:          "protocol default when the service sets no ranges",
+			defaultRanges: []string{"10.0.0.0/8", " 192.168.0.0/16"},
+			want:          []string{"10.0.0.0/8", "192.168.0.0/16"},
+		},
+		{
+			name:          "annotation takes precedence over protocol default",
+			annotation:    "172.16.0.0/12",
+			defaultRanges: []string{"10.0.0.0/8"},
+			want:          []string{"172.16.0.0/12"},
+		},
+		{
+			name:       "annotation with several ranges",
+			annotation: "10.0.0.0/8, 192.168.0.0/16",
+			want:       []string{"10.0.0.0/8", "192.168.0.0/16"},
+		},
+		{
+			name:       "spec takes precedence over annotation",
+			specRanges: []string{"172.16.0.0/12"},
+			annotation: "10.0.0.0/8",
+			want:       []string{"172.16.0.0/12"},
+		},
+		{
+			name:        "bad annotation entry is named with its position",
+			annotation:  "10.0.0.0/8,192.168.0.0/16, 10.1.2.300/32,172.16.0.0/12",
+			wantErrPart: `entry 3 ("10.1.2.300/32")`,
+		},
+		{
+			name:        "bad spec entry is named with its position",
+			specRanges:  []string{"10.0.0.0/8", "not-a-cidr"},
+			wantErrPart: `entry 2 ("not-a-cidr")`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				Spec: corev1.ServiceSpec{LoadBalancerSourceRanges: tt.specRanges},
+			}
+			if tt.annotation != "" {
+				service.Annotations = map[string]string{corev1.AnnotationLoadBalancerSourceRangesKey: tt.annotation}
+			}
+
+			got, err := getLoadBalancerSourceRanges(service, tt.defaultRanges)
+			if tt.wantErrPart != "" {
+				if err == nil {
+					t.Fatalf("expected error containing %q", tt.wantErrPart)
+				}
+				if !strings.Contains(err.Error(), tt.wantErrPart) {
+					t.Errorf("error = %q, want it to contain %q", err.Error(), tt.wantErrPart)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !compareStringSlice(got.StringSlice(), tt.want) {
+				t.Errorf("getLoadBalancerSourceRanges() = %v, want %v", got.StringSlice(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLoadBalancerAlgorithm(t *testing.T) {
+	tests := []struct {
+		name             string
+		affinity         corev1.ServiceAffinity
+		annotation       string
+		defaultAlgorithm string
+		want             string
+		wantErr          bool
+	}{
+		{name: "no affinity", affinity: corev1.ServiceAffinityNone, want: "roundrobin"},
+		{name: "unset affinity", want: "roundrobin"},
+		{name: "client IP affinity", affinity: corev1.ServiceAffinityClientIP, want: "source"},
+		{name: "annotation overrides affinity", affinity: corev1.ServiceAffinityClientIP, annotation: "leastconn", want: "leastconn"},
+		{name: "default for no affinity", affinity: corev1.ServiceAffinityNone, defaultAlgorithm: "leastconn", want: "leastconn"},
+		{name: "default for unset affinity", defaultAlgorithm: "leastconn", want: "leastconn"},
+		{name: "default ignored for client IP affinity", affinity: corev1.ServiceAffinityClientIP, defaultAlgorithm: "leastconn", want: "source"},
+		{name: "annotation overrides default", affinity: corev1.ServiceAffinityNone, annotation: "source", defaultAlgorithm: "leastconn", want: "source"},
+		{name: "invalid annotation", affinity: corev1.ServiceAffinityNone, annotation: "random", wantErr: true},
+		{name: "unsupported affinity", affinity: "Other", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{Spec: corev1.ServiceSpec{SessionAffinity: tt.affinity}}
+			if tt.annotation != "" {
+				service.Annotations = map[string]string{ServiceAnnotationLoadBalancerAlgorithm: tt.annotation}
+			}
+
+			got, err := getLoadBalancerAlgorithm(service, tt.defaultAlgorithm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getLoadBalancerAlgorithm() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPortAlgorithms(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Name: "db", Port: 5432, Protocol: corev1.ProtocolTCP},
+	}
+
+	tests := []struct {
+		name       string
+		annotation string
+		want       map[int32]string
+		wantErr    string
+	}{
+		{name: "no annotation"},
+		{name: "by number and name", annotation: "80=roundrobin, db=source", want: map[int32]string{80: "roundrobin", 5432: "source"}},
+		{name: "same algorithm twice", annotation: "80=leastconn,http=leastconn", want: map[int32]string{80: "leastconn"}},
+		{name: "conflicting algorithms", annotation: "80=leastconn,http=source", wantErr: "conflicting algorithms"},
+		{name: "unknown port", annotation: "443=source", wantErr: "not a port of the service"},
+		{name: "invalid algorithm", annotation: "db=random", wantErr: "unsupported load balancer algorithm"},
+		{name: "malformed entry", annotation: "source", wantErr: "must be <port>=<algorithm>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{Spec: corev1.ServiceSpec{Ports: ports}}
+			if tt.annotation != "" {
+				service.Annotations = map[string]string{ServiceAnnotationLoadBalancerPortAlgorithm: tt.annotation}
+			}
+
+			got, err := getPortAlgorithms(service)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("getPortAlgorithms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMixedPortAlgorithms(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams("roundrobin", "rule-http", 30080, 80).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams("source", "rule-db", 30432, 5432).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{Id: "rule-1"}, nil).Times(2)
+
+	updateParams := &cloudstack.UpdateLoadBalancerRuleParams{}
+	mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-existing").Return(updateParams)
+	mockLB.EXPECT().UpdateLoadBalancerRule(updateParams).Return(&cloudstack.UpdateLoadBalancerRuleResponse{}, nil)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+		ipAddr:           "1.1.1.1",
+		algorithm:        "roundrobin",
+		portAlgorithms:   map[int32]string{5432: "source"},
+		rules: map[string]*cloudstack.LoadBalancerRule{
+			"rule-existing": {
+				Id:          "rule-existing",
+				Name:        "rule-existing",
+				Publicip:    "1.1.1.1",
+				Privateport: "30432",
+				Publicport:  "5432",
+				Algorithm:   "roundrobin",
+				Protocol:    LoadBalancerProtocolTCP.CSProtocol(),
+			},
+		},
+	}
+	http := corev1.ServicePort{Name: "http", Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}
+	db := corev1.ServicePort{Name: "db", Port: 5432, NodePort: 30432, Protocol: corev1.ProtocolTCP}
+
+	if _, err := lb.createLoadBalancerRule("rule-http", http, LoadBalancerProtocolTCP); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := lb.createLoadBalancerRule("rule-db", db, LoadBalancerProtocolTCP); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rule, needsUpdate, err := lb.checkLoadBalancerRule("rule-existing", db, LoadBalancerProtocolTCP)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rule == nil || !needsUpdate {
+		t.Fatalf("rule = %v, needsUpdate = %v, want the roundrobin rule of the source port to be updated", rule, needsUpdate)
+	}
+	if err := lb.updateLoadBalancerRule("rule-existing", db, LoadBalancerProtocolTCP); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if algorithm, _ := updateParams.GetAlgorithm(); algorithm != "source" {
+		t.Errorf("updated algorithm = %q, want source", algorithm)
+	}
+}
+
+func TestGetLoadBalancerIPMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		proxyProtocol string
+		ipMode        string
+		want          corev1.LoadBalancerIPMode
+		wantErr       bool
+	}{
+		{name: "default", want: corev1.LoadBalancerIPModeVIP},
+		{name: "proxy protocol", proxyProtocol: "true", want: corev1.LoadBalancerIPModeProxy},
+		{name: "VIP overrides proxy protocol", proxyProtocol: "true", ipMode: "VIP", want: corev1.LoadBalancerIPModeVIP},
+		{name: "Proxy without proxy protocol", ipMode: "Proxy", want: corev1.LoadBalancerIPModeProxy},
+		{name: "invalid annotation", proxyProtocol: "true", ipMode: "proxy", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+			if tt.proxyProtocol != "" {
+				service.Annotations[ServiceAnnotationLoadBalancerProxyProtocol] = tt.proxyProtocol
+			}
+			if tt.ipMode != "" {
+				service.Annotations[ServiceAnnotationLoadBalancerIPMode] = tt.ipMode
+			}
+
+			got, err := getLoadBalancerIPMode(service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getLoadBalancerIPMode() = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			status := (&loadBalancer{ipAddr: "10.0.0.1", ipMode: got}).generateLoadBalancerStatus(service)
+			if mode := status.Ingress[0].IPMode; mode == nil || *mode != tt.want {
+				t.Errorf("status ipMode = %v, want %q", mode, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBackendPortMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		targetPort intstr.IntOrString
+		want       backendPortMode
+		wantErr    bool
+	}{
+		{name: "default", want: backendPortNodePort},
+		{name: "service port", annotation: "service-port", want: backendPortServicePort},
+		{name: "numeric target port", annotation: "target-port", targetPort: intstr.FromInt32(8080), want: backendPortTargetPort},
+		{name: "named target port", annotation: "target-port", targetPort: intstr.FromString("http"), wantErr: true},
+		{name: "invalid annotation", annotation: "pod-port", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: tt.targetPort}}}}
+			if tt.annotation != "" {
+				service.Annotations = map[string]string{ServiceAnnotationLoadBalancerBackendPort: tt.annotation}
+			}
+
+			got, err := getBackendPortMode(service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getBackendPortMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrivatePort(t *testing.T) {
+	port := corev1.ServicePort{Port: 80, NodePort: 30080, TargetPort: intstr.FromInt32(8080)}
+	tests := []struct {
+		mode backendPortMode
+		port corev1.ServicePort
+		want int
+	}{
+		{mode: "", port: port, want: 30080},
+		{mode: backendPortNodePort, port: port, want: 30080},
+		{mode: backendPortServicePort, port: port, want: 80},
+		{mode: backendPortTargetPort, port: port, want: 8080},
+		{mode: backendPortTargetPort, port: corev1.ServicePort{Port: 80}, want: 80},
+	}
+
+	for _, tt := range tests {
+		lb := &loadBalancer{backendPort: tt.mode}
+		if got := lb.privatePort(tt.port); got != tt.want {
+			t.Errorf("privatePort() with mode %q = %d, want %d", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestPodHostingNodes(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+	}
+	nodeName := func(name string) *string { return &name }
+	notReady := false
+
+	endpointSlice := func(name, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+			},
+			Endpoints: endpoints,
+		}
+	}
+
+	t.Run("nodes with ready endpoints", func(t *testing.T) {
+		cs := &CSCloud{kclient: fake.NewSimpleClientset(
+			endpointSlice("web-1", "web",
+				discoveryv1.Endpoint{NodeName: nodeName("node-1")},
+				discoveryv1.Endpoint{NodeName: nodeName("node-2"), Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			),
+			endpointSlice("web-2", "web", discoveryv1.Endpoint{NodeName: nodeName("node-3")}),
+			endpointSlice("other-1", "other", discoveryv1.Endpoint{NodeName: nodeName("node-2")}),
+		)}
+
+		got, err := cs.podHostingNodes(t.Context(), service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var names []string
+		for _, node := range got {
+			names = append(names, node.Name)
+		}
+		if want := []string{"node-1", "node-3"}; !slices.Equal(names, want) {
+			t.Errorf("podHostingNodes() = %v, want %v", names, want)
+		}
+	})
+
+	t.Run("all nodes without ready endpoints", func(t *testing.T) {
+		cs := &CSCloud{kclient: fake.NewSimpleClientset()}
+
+		got, err := cs.podHostingNodes(t.Context(), service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != len(nodes) {
+			t.Errorf("podHostingNodes() returned %d nodes, want all %d", len(got), len(nodes))
+		}
+	})
+}
+
+func TestGetSessionAffinityTimeout(t *testing.T) {
+	timeout := int32(600)
+	tests := []struct {
+		name string
+		spec corev1.ServiceSpec
+		want int32
+	}{
+		{name: "no session affinity", spec: corev1.ServiceSpec{SessionAffinity: corev1.ServiceAffinityNone}},
+		{name: "ClientIP without config", spec: corev1.ServiceSpec{SessionAffinity: corev1.ServiceAffinityClientIP}},
+		{
+			name: "ClientIP with timeout",
+			spec: corev1.ServiceSpec{
+				SessionAffinity:       corev1.ServiceAffinityClientIP,
+				SessionAffinityConfig: &corev1.SessionAffinityConfig{ClientIP: &corev1.ClientIPConfig{TimeoutSeconds: &timeout}},
+			},
+			want: 600,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getSessionAffinityTimeout(&corev1.Service{Spec: tt.spec}); got != tt.want {
+				t.Errorf("getSessionAffinityTimeout() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSourceStickinessSupported(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []cloudstack.NetworkServiceInternalCapability
+		want         bool
+	}{
+		{name: "capability not reported"},
+		{
+			name: "source based supported",
+			capabilities: []cloudstack.NetworkServiceInternalCapability{{
+				Name:  "SupportedStickinessMethods",
+				Value: `[{"methodname":"LbCookie","paramlist":[]},{"methodname":"SourceBased","paramlist":[]}]`,
+			}},
+			want: true,
+		},
+		{
+			name: "source based not supported",
+			capabilities: []cloudstack.NetworkServiceInternalCapability{{
+				Name:  "SupportedStickinessMethods",
+				Value: `[{"methodname":"LbCookie","paramlist":[]}]`,
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+				Id:      "net-1",
+				Service: []cloudstack.NetworkServiceInternal{{Name: "Lb", Capability: tt.capabilities}},
+			}, 1, nil)
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Network: mockNetwork},
+				networkID:        "net-1",
+			}
+
+			got, err := lb.isSourceStickinessSupported()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("isSourceStickinessSupported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileStickinessPolicy(t *testing.T) {
+	policy := func(expire string) []*cloudstack.LBStickinessPolicy {
+		return []*cloudstack.LBStickinessPolicy{{
+			Lbruleid: "rule-1",
+			Stickinesspolicy: []cloudstack.LBStickinessPolicyStickinesspolicy{{
+				Id: "policy-1", Name: stickinessPolicyName, Methodname: stickinessMethodSourceBased,
+				Params: map[string]string{"expire": expire},
+			}},
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		timeout    int32
+		existing   []*cloudstack.LBStickinessPolicy
+		wantDelete bool
+		wantCreate bool
+	}{
+		{name: "policy created", timeout: 600, wantCreate: true},
+		{name: "policy up-to-date", timeout: 600, existing: policy("600s")},
+		{name: "timeout changed", timeout: 300, existing: policy("600s"), wantDelete: true, wantCreate: true},
+		{name: "session affinity removed", existing: policy("600s"), wantDelete: true},
+		{name: "nothing to do"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			listParams := &cloudstack.ListLBStickinessPoliciesParams{}
+			mockLB.EXPECT().NewListLBStickinessPoliciesParams().Return(listParams)
+			mockLB.EXPECT().ListLBStickinessPolicies(listParams).Return(&cloudstack.ListLBStickinessPoliciesResponse{
+				Count:                len(tt.existing),
+				LBStickinessPolicies: tt.existing,
+			}, nil)
+			if tt.wantDelete {
+				deleteParams := &cloudstack.DeleteLBStickinessPolicyParams{}
+				mockLB.EXPECT().NewDeleteLBStickinessPolicyParams("policy-1").Return(deleteParams)
+				mockLB.EXPECT().DeleteLBStickinessPolicy(deleteParams).Return(&cloudstack.DeleteLBStickinessPolicyResponse{}, nil)
+			}
+			createParams := &cloudstack.CreateLBStickinessPolicyParams{}
+			if tt.wantCreate {
+				mockLB.EXPECT().NewCreateLBStickinessPolicyParams("rule-1", stickinessMethodSourceBased, stickinessPolicyName).Return(createParams)
+				mockLB.EXPECT().CreateLBStickinessPolicy(createParams).Return(&cloudstack.CreateLBStickinessPolicyResponse{}, nil)
+			}
+
+			lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+
+			if err := lb.reconcileStickinessPolicy(&cloudstack.LoadBalancerRule{Id: "rule-1", Name: "web-tcp-80"}, tt.timeout); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id, _ := listParams.GetLbruleid(); id != "rule-1" {
+				t.Errorf("listed policies of rule %q, want %q", id, "rule-1")
+			}
+			if tt.wantCreate {
+				want := map[string]string{"expire": fmt.Sprintf("%ds", tt.timeout)}
+				if got, _ := createParams.GetParam(); !maps.Equal(got, want) {
+					t.Errorf("policy params = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerAlgorithmAnnotation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+		Count: 1,
+		LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+			Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80",
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+		}},
+	}, nil)
+	// The legacy name has no rules.
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	setupVerifyHosts(mockVM)
+
+	// Only the algorithm annotation changed, so the rule is updated in place.
+	updateParams := &cloudstack.UpdateLoadBalancerRuleParams{}
+	mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-1").Return(updateParams)
+	mockLB.EXPECT().UpdateLoadBalancerRule(updateParams).Return(&cloudstack.UpdateLoadBalancerRuleResponse{}, nil)
+	mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+	mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+		Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+	}, nil)
+
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil)
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+		Count: 1,
+		FirewallRules: []*cloudstack.FirewallRule{
+			{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR},
+		},
+	}, nil)
+	setupNoICMPFirewallRules(mockFirewall)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "leastconn"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if algorithm, _ := updateParams.GetAlgorithm(); algorithm != "leastconn" {
+		t.Errorf("updated algorithm = %q, want %q", algorithm, "leastconn")
+	}
+}
+
+func TestEnsureLoadBalancerRemovedICMPAnnotation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+		Count: 1,
+		LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+			Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80",
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+		}},
+	}, nil)
+	// The legacy name has no rules.
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	setupVerifyHosts(mockVM)
+	mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+	mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+		Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+	}, nil)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil)
+
+	// The ICMP rule created for the allow-icmp annotation is still there, after the annotation was removed.
+	rules := &cloudstack.ListFirewallRulesResponse{
+		Count: 2,
+		FirewallRules: []*cloudstack.FirewallRule{
+			{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR},
+			{
+				Id: "fw-icmp", Protocol: ProtoICMP, Icmptype: -1, Icmpcode: -1, Cidrlist: defaultAllowedCIDR,
+				Tags: []cloudstack.Tags{
+					{Key: serviceNamespaceTagKey, Value: "default"},
+					{Key: serviceNameTagKey, Value: "foo"},
+					{Key: firewallRulePortTagKey, Value: ProtoICMP},
+				},
+			},
+		},
+	}
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(2)
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(rules, nil).Times(2)
+	mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-icmp").Return(&cloudstack.DeleteFirewallRuleParams{})
+	mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEnsureLoadBalancerSourceRangesAnnotation(t *testing.T) {
+	tests := []struct {
+		name         string
+		sourceRanges string
+		wantUpdate   bool
+	}{
+		{name: "annotation changed", sourceRanges: "10.0.0.0/8", wantUpdate: true},
+		{name: "annotation unchanged", sourceRanges: defaultAllowedCIDR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: 1,
+				LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+					Networkid: "net-1", Privateport: "30080", Publicport: "80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+				}},
+			}, nil)
+			// The legacy name has no rules.
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+			setupVerifyHosts(mockVM)
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+				Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+			}, nil)
+
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+				Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+			}, 1, nil)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1,
+				FirewallRules: []*cloudstack.FirewallRule{
+					{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR, Ipaddressid: "ip-1"},
+				},
+			}, nil)
+			createParams := &cloudstack.CreateFirewallRuleParams{}
+			if tt.wantUpdate {
+				mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-1").Return(&cloudstack.DeleteFirewallRuleParams{})
+				mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+				mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(createParams)
+				mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-2"}, nil)
+			}
+			setupNoICMPFirewallRules(mockFirewall)
+
+			// Only the annotation is set, spec.loadBalancerSourceRanges is empty.
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "foo",
+					Namespace:   "default",
+					Annotations: map[string]string{corev1.AnnotationLoadBalancerSourceRangesKey: tt.sourceRanges},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+					},
+					SessionAffinity: corev1.ServiceAffinityNone,
+				},
+			}
+			cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+			if tt.wantUpdate {
+				setupResourceTags(ctrl, cs, "FirewallRule")
+			}
+			nodes := []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			}
+
+			if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cidrs, _ := createParams.GetCidrlist(); tt.wantUpdate && !slices.Equal(cidrs, []string{"10.0.0.0/8"}) {
+				t.Errorf("created firewall rule CIDRs = %v, want [10.0.0.0/8]", cidrs)
+			}
+		})
+	}
+}
+
+func TestUpdateLoadBalancerEmptyNodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		emptyNodes  string
+		nodes       []*corev1.Node
+		wantRemoval bool
+		wantEvent   string
+	}{
+		{name: "no nodes keeps the hosts", emptyNodes: emptyNodesKeep, wantEvent: "keeping the current hosts"},
+		{name: "unmatched nodes keep the hosts", emptyNodes: emptyNodesKeep, nodes: []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-9"}}}, wantEvent: "could not match any"},
+		{name: "no nodes removes the hosts", emptyNodes: emptyNodesRemove, wantRemoval: true, wantEvent: "removing all hosts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count: 1,
+				LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+					Networkid: "net-1", Privateport: "30080", Publicport: "80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+				}},
+			}, nil)
+			// The legacy name has no rules.
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+			if len(tt.nodes) > 0 {
+				setupVerifyHosts(mockVM)
+			}
+			removeParams := &cloudstack.RemoveFromLoadBalancerRuleParams{}
+			if tt.wantRemoval {
+				mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+				mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+					Count: 2, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}, {Id: "vm-2"}},
+				}, nil)
+				mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams("rule-1").Return(removeParams)
+				mockLB.EXPECT().RemoveFromLoadBalancerRule(removeParams).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil)
+			}
+
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+					SessionAffinity: corev1.ServiceAffinityNone,
+				},
+			}
+			cs := newTestCSCloud(mockLB, nil, mockVM, nil, nil, service)
+			cs.emptyNodes = tt.emptyNodes
+			recorder := record.NewFakeRecorder(10)
+			cs.eventRecorder = recorder
+
+			if err := cs.UpdateLoadBalancer(t.Context(), "cluster", service, tt.nodes); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ids, _ := removeParams.GetVirtualmachineids(); tt.wantRemoval && !slices.Equal(slices.Sorted(slices.Values(ids)), []string{"vm-1", "vm-2"}) {
+				t.Errorf("removed hosts = %v, want [vm-1 vm-2]", ids)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, "Warning NoEligibleNodes") || !strings.Contains(event, tt.wantEvent) {
+					t.Errorf("event = %q, want a NoEligibleNodes warning containing %q", event, tt.wantEvent)
+				}
+			default:
+				t.Errorf("expected a NoEligibleNodes event")
+			}
+		})
+	}
+}
 
-		service := &corev1.Service{
+func TestEnsureLoadBalancerProtocolSwitch(t *testing.T) {
+	existingRule := func() *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{
+			Id: "rule-old", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80",
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+		}
+	}
+	newService := func() *corev1.Service {
+		return &corev1.Service{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "foo",
 				Namespace: "default",
 				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+					ServiceAnnotationLoadBalancerProxyProtocol: "true",
 				},
 			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
 		}
-
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
+	}
+	newRuleResp := &cloudstack.CreateLoadBalancerRuleResponse{
+		Id: "rule-new", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-proxy-80",
+		Networkid: "net-1", Privateport: "30080", Publicport: "80",
+		Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp-proxy",
+	}
+	setupFirewallUpToDate := func(mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface) {
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+		}, 1, nil)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 1,
+			FirewallRules: []*cloudstack.FirewallRule{
+				{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR},
 			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
+		}, nil)
+		setupNoICMPFirewallRules(mockFirewall)
+	}
+
+	t.Run("rule is switched in place", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1, LoadBalancerRules: []*cloudstack.LoadBalancerRule{existingRule()},
+		}, nil)
+		// The legacy name has no rules.
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		setupVerifyHosts(mockVM)
+
+		// The rule is neither deleted nor created, and keeps its host.
+		updateParams := &cloudstack.UpdateLoadBalancerRuleParams{}
+		gomock.InOrder(
+			mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-old").Return(updateParams),
+			mockLB.EXPECT().UpdateLoadBalancerRule(updateParams).Return(&cloudstack.UpdateLoadBalancerRuleResponse{}, nil),
+			mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-old").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+			mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+				Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+			}, nil),
+		)
+		// The firewall rule is still valid for tcp-proxy and must not be touched.
+		setupFirewallUpToDate(mockNetwork, mockFirewall)
+
+		service := newService()
+		cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
 		}
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
-		if err != nil {
+		if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if name, _ := updateParams.GetName(); name != "K8s_svc_cluster_default_foo-tcp-proxy-80" {
+			t.Errorf("name = %q, want the name of the tcp-proxy rule", name)
+		}
+		if protocol, _ := updateParams.GetProtocol(); protocol != "tcp-proxy" {
+			t.Errorf("protocol = %q, want tcp-proxy", protocol)
+		}
 	})
 
-	t.Run("release fails returns error", func(t *testing.T) {
+	t.Run("rule is replaced when CloudStack refuses the update", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-
-		setupGetLoadBalancerByNameEmpty(mockLB)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 
-		// lookupPublicIPAddress
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-orphan", Ipaddress: "10.0.0.1"},
-			},
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1, LoadBalancerRules: []*cloudstack.LoadBalancerRule{existingRule()},
 		}, nil)
+		// The legacy name has no rules.
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		setupVerifyHosts(mockVM)
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-old").Return(&cloudstack.UpdateLoadBalancerRuleParams{}),
+			mockLB.EXPECT().UpdateLoadBalancerRule(gomock.Any()).Return(nil, errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Unable to update the protocol of rule rule-old")),
+			mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-old").Return(&cloudstack.DeleteLoadBalancerRuleParams{}),
+			mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil),
+			mockLB.EXPECT().NewCreateLoadBalancerRuleParams("roundrobin", "K8s_svc_cluster_default_foo-tcp-proxy-80", 30080, 80).Return(&cloudstack.CreateLoadBalancerRuleParams{}),
+			mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(newRuleResp, nil),
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-new").Return(&cloudstack.AssignToLoadBalancerRuleParams{}),
+			mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		)
+		setupFirewallUpToDate(mockNetwork, mockFirewall)
+
+		service := newService()
+		cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "LoadBalancer")
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("old rule is kept when the update fails transiently", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
 
-		// shouldRelease: yes
 		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
 		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
-			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+			Count: 1, LoadBalancerRules: []*cloudstack.LoadBalancerRule{existingRule()},
 		}, nil)
+		// The legacy name has no rules.
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		setupVerifyHosts(mockVM)
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+		}, 1, nil)
 
-		// releaseLoadBalancerIP fails
-		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-orphan").Return(&cloudstack.DisassociateIpAddressParams{})
-		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(nil, errors.New("release failed"))
+		// The old rule must not be deleted.
+		mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-old").Return(&cloudstack.UpdateLoadBalancerRuleParams{})
+		mockLB.EXPECT().UpdateLoadBalancerRule(gomock.Any()).Return(nil, errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4250): resource unavailable"))
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+		service := newService()
+		cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, nil, service)
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		}
+
+		if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err == nil || !strings.Contains(err.Error(), "resource unavailable") {
+			t.Fatalf("EnsureLoadBalancer() error = %v, want the error of the update", err)
+		}
+	})
+}
+
+func TestCheckLoadBalancerIPFamily(t *testing.T) {
+	tests := []struct {
+		name     string
+		families []corev1.IPFamily
+		ip       string
+		wantErr  bool
+	}{
+		{name: "no families requested", ip: "2001:db8::1"},
+		{name: "IPv4 matches", families: []corev1.IPFamily{corev1.IPv4Protocol}, ip: "203.0.113.1"},
+		{name: "IPv6 matches", families: []corev1.IPFamily{corev1.IPv6Protocol}, ip: "2001:db8::1"},
+		{name: "dual-stack accepts IPv6", families: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}, ip: "2001:db8::1"},
+		{name: "IPv6 requested, IPv4 allocated", families: []corev1.IPFamily{corev1.IPv6Protocol}, ip: "203.0.113.1", wantErr: true},
+		{name: "IPv4 requested, IPv6 allocated", families: []corev1.IPFamily{corev1.IPv4Protocol}, ip: "2001:db8::1", wantErr: true},
+		{name: "invalid IP", families: []corev1.IPFamily{corev1.IPv4Protocol}, ip: "not-an-ip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{Spec: corev1.ServiceSpec{IPFamilies: tt.families}}
+
+			err := checkLoadBalancerIPFamily(service, tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLoadBalancerIPFamily() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerIPFamilyMismatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupNoPublicIPConflict(mockLB)
+	setupVerifyHosts(mockVM)
+
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count: 1,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			{Id: "ip-1", Ipaddress: "10.0.0.1", Allocated: "2023-01-01"},
+		},
+	}, nil)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+			IPFamilies:      []corev1.IPFamily{corev1.IPv6Protocol},
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err == nil || !strings.Contains(err.Error(), "IPv4") {
+		t.Fatalf("expected an IP family mismatch error, got %v", err)
+	}
+	if got := service.Annotations[ServiceAnnotationLoadBalancerID]; got != "ip-1" {
+		t.Errorf("ID annotation = %q, want %q so the IP can be cleaned up", got, "ip-1")
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if !strings.Contains(strings.Join(events, "\n"), "IPFamilyMismatch") {
+		t.Errorf("expected an IPFamilyMismatch event, got %v", events)
+	}
+}
+
+func TestEnsureLoadBalancerZoneAnnotation(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		zoneAnnotation bool
+		want           string
+	}{
+		{name: "enabled", zoneAnnotation: true, want: "zone-1"},
+		{name: "disabled", zoneAnnotation: false, want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+			setupGetLoadBalancerByNameEmpty(mockLB)
+			setupNoPublicIPConflict(mockLB)
+			setupVerifyHosts(mockVM)
+
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count: 1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{
+					{Id: "ip-1", Ipaddress: "10.0.0.1", Allocated: "2023-01-01", Zonename: "zone-1"},
+				},
+			}, nil)
+
+			// The IPv6 family stops EnsureLoadBalancer right after the service is annotated.
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "default",
+					Annotations: map[string]string{
+						ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+						ServiceAnnotationLoadBalancerZone:    "stale-zone",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+					},
+					SessionAffinity: corev1.ServiceAffinityNone,
+					IPFamilies:      []corev1.IPFamily{corev1.IPv6Protocol},
+				},
+			}
+			cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+			cs.zoneAnnotation = tc.zoneAnnotation
+			nodes := []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			}
+
+			if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err == nil {
+				t.Fatalf("expected an IP family mismatch error")
+			}
+			if got := service.Annotations[ServiceAnnotationLoadBalancerZone]; got != tc.want {
+				t.Errorf("zone annotation = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerWriteAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotation  string
+		wantPatches int
+	}{
+		{name: "default", wantPatches: 1},
+		{name: "disabled", annotation: "false", wantPatches: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+			setupGetLoadBalancerByNameEmpty(mockLB)
+			setupNoPublicIPConflict(mockLB)
+			setupVerifyHosts(mockVM)
+
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count: 1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{
+					{Id: "ip-1", Ipaddress: "10.0.0.1", Allocated: "2023-01-01"},
+				},
+			}, nil)
+
+			// The IPv6 family stops EnsureLoadBalancer right after the service is annotated.
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "foo",
+					Namespace:   "default",
+					Annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+					},
+					SessionAffinity: corev1.ServiceAffinityNone,
+					IPFamilies:      []corev1.IPFamily{corev1.IPv6Protocol},
 				},
+			}
+			if tc.annotation != "" {
+				service.Annotations[ServiceAnnotationLoadBalancerWriteAnnotations] = tc.annotation
+			}
+			cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+			nodes := []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			}
+
+			if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err == nil {
+				t.Fatalf("expected an IP family mismatch error")
+			}
+			if got := countPatches(cs.kclient.(*fake.Clientset)); got != tc.wantPatches {
+				t.Errorf("patches = %d, want %d", got, tc.wantPatches)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerNoEligibleNodes(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
 			},
-		}
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"pool": "workers"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2", Labels: map[string]string{"pool": "workers"}}},
+	}
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
+	tests := []struct {
+		name  string
+		nodes []*corev1.Node
+		want  string
+	}{
+		{name: "all nodes filtered by the node selector", nodes: nodes, want: `none of the 2 node(s) match the load balancer node-selector "pool=ingress"`},
+		{name: "no nodes passed", nodes: nil, want: "no nodes were passed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			// No VMs are listed and no rules are created.
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			setupGetLoadBalancerByNameEmpty(mockLB)
+
+			cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service.DeepCopy())
+			recorder := record.NewFakeRecorder(10)
+			cs.eventRecorder = recorder
+			selector, err := labels.Parse("pool=ingress")
+			if err != nil {
+				t.Fatalf("invalid selector: %v", err)
+			}
+			cs.nodeSelector = selector
+
+			_, err = cs.EnsureLoadBalancer(t.Context(), "cluster", service.DeepCopy(), tt.nodes)
+			if !errors.Is(err, errNoEligibleNodes) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %v containing %q", err, errNoEligibleNodes, tt.want)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, "Warning NoEligibleNodes no eligible nodes for load balancer") {
+					t.Errorf("event = %q, want a NoEligibleNodes warning", event)
+				}
+			default:
+				t.Errorf("expected a NoEligibleNodes event")
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerInternal(t *testing.T) {
+	node := func(name, ip string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}},
+		}
+	}
+	newService := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+				SessionAffinity: corev1.ServiceAffinityNone,
 			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
 		}
+	}
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
-		if err == nil {
-			t.Fatalf("expected error")
+	t.Run("no public IP is allocated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		// Only the lookup of an existing load balancer, no IP or rule calls.
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		setupGetLoadBalancerByNameEmpty(mockLB)
+
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerInternal: "true"})
+		cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service)
+		nodes := []*corev1.Node{node("node-2", "10.0.0.12"), node("node-1", "10.0.0.11")}
+
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-		if !strings.Contains(err.Error(), "error releasing orphaned load balancer IP") {
-			t.Errorf("error = %q, want to contain 'error releasing orphaned load balancer IP'", err.Error())
+		var ips []string
+		for _, ingress := range status.Ingress {
+			ips = append(ips, ingress.IP)
+		}
+		if want := []string{"10.0.0.11", "10.0.0.12"}; !slices.Equal(ips, want) {
+			t.Errorf("status IPs = %v, want %v", ips, want)
+		}
+	})
+
+	t.Run("requested IP takes precedence", func(t *testing.T) {
+		service := newService(map[string]string{
+			ServiceAnnotationLoadBalancerInternal: "true",
+			ServiceAnnotationLoadBalancerAddress:  "203.0.113.1",
+		})
+		if isInternalLoadBalancer(service) {
+			t.Errorf("isInternalLoadBalancer() = true, want false for a service with a requested IP")
+		}
+	})
+
+	t.Run("UpdateLoadBalancer does nothing", func(t *testing.T) {
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerInternal: "true"})
+		cs := newTestCSCloud(nil, nil, nil, nil, nil, service)
+
+		if err := cs.UpdateLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{node("node-1", "10.0.0.11")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("nodes without internal IPs", func(t *testing.T) {
+		if _, err := internalLoadBalancerStatus([]*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}); !errors.Is(err, errNoEligibleNodes) {
+			t.Errorf("err = %v, want %v", err, errNoEligibleNodes)
+		}
+	})
+}
+
+func TestEnsureLoadBalancerStaticNAT(t *testing.T) {
+	newService := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
 		}
-	})
+	}
+	nodes := []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	firewallNetwork := &cloudstack.Network{Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}}}
 
-	t.Run("keep-ip annotation prevents release", func(t *testing.T) {
+	t.Run("maps the IP to the single backend instead of creating rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockNAT := cloudstack.NewMockNATServiceIface(ctrl)
 
 		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
 
-		// lookupPublicIPAddress
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-user", Ipaddress: "10.0.0.1"},
+		// associatePublicIPAddress and the firewall check each look up the network.
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(firewallNetwork, 1, nil).Times(2)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{Id: "ip-1", Ipaddress: "10.0.0.1"}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-1", gomock.Any()).Return(&cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "10.0.0.1"}, 1, nil)
+		enableParams := &cloudstack.EnableStaticNatParams{}
+		mockNAT.EXPECT().NewEnableStaticNatParams("ip-1", "vm-1").Return(enableParams)
+		mockNAT.EXPECT().EnableStaticNat(enableParams).Return(&cloudstack.EnableStaticNatResponse{}, nil)
+
+		// updateFirewallRule opens the service port, then the firewall rules of removed ports and ICMP are cleaned up.
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+		createParams := &cloudstack.CreateFirewallRuleParams{}
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(createParams)
+		mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2,
+			FirewallRules: []*cloudstack.FirewallRule{
+				{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80},
+				{Id: "fw-old", Protocol: "tcp", Startport: 8080, Endport: 8080},
 			},
 		}, nil)
-		// shouldReleaseLoadBalancerIP returns false because keep-ip annotation is set
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-old").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+		setupNoICMPFirewallRules(mockFirewall)
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
-					ServiceAnnotationLoadBalancerKeepIP:  "true",
-				},
-			},
-		}
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerStaticNAT: "true"})
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		cs.client.NAT = mockNAT
+		setupResourceTags(ctrl, cs, "PublicIpAddress", "FirewallRule")
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
-			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
+		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status == nil || len(status.Ingress) == 0 || status.Ingress[0].IP != "10.0.0.1" {
+			t.Fatalf("status = %v, want ingress IP 10.0.0.1", status)
+		}
+		if networkID, _ := enableParams.GetNetworkid(); networkID != "net-1" {
+			t.Errorf("static NAT network = %q, want %q", networkID, "net-1")
+		}
+		if port, _ := createParams.GetStartport(); port != 80 {
+			t.Errorf("firewall rule port = %d, want the service port 80", port)
 		}
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
+		updated, err := cs.kclient.CoreV1().Services("default").Get(t.Context(), "foo", metav1.GetOptions{})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if got := updated.Annotations[ServiceAnnotationLoadBalancerStaticNATVirtualMachineID]; got != "vm-1" {
+			t.Errorf("static NAT VM annotation = %q, want %q", got, "vm-1")
+		}
 	})
-}
 
-func TestEnsureLoadBalancerDeletedAnnotationCleanup(t *testing.T) {
-	// allLBAnnotations returns a map with all 6 CloudStack LB annotations set.
-	allLBAnnotations := func() map[string]string {
-		return map[string]string{
-			ServiceAnnotationLoadBalancerProxyProtocol:        "true",
-			ServiceAnnotationLoadBalancerLoadbalancerHostname: "lb.example.com",
-			ServiceAnnotationLoadBalancerAddress:              "10.0.0.1",
-			ServiceAnnotationLoadBalancerKeepIP:               "false",
-			ServiceAnnotationLoadBalancerID:                   "ip-1",
-			ServiceAnnotationLoadBalancerNetworkID:            "net-1",
-		}
-	}
+	t.Run("more than one backend is rejected", func(t *testing.T) {
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerStaticNAT: "true"})
+		recorder := record.NewFakeRecorder(10)
+		cs := &CSCloud{eventRecorder: recorder}
+		lb := &loadBalancer{hostIDs: []string{"vm-1", "vm-2"}, ipAddr: "10.0.0.1", ipAddrID: "ip-1"}
 
-	lbAnnotationKeys := []string{
-		ServiceAnnotationLoadBalancerProxyProtocol,
-		ServiceAnnotationLoadBalancerLoadbalancerHostname,
-		ServiceAnnotationLoadBalancerAddress,
-		ServiceAnnotationLoadBalancerKeepIP,
-		ServiceAnnotationLoadBalancerID,
-		ServiceAnnotationLoadBalancerNetworkID,
-	}
+		if err := cs.reconcileStaticNATTarget(lb, service); err == nil {
+			t.Fatalf("expected error")
+		}
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "StaticNATRequiresSingleBackend") {
+				t.Errorf("event = %q, want StaticNATRequiresSingleBackend", event)
+			}
+		default:
+			t.Error("expected a StaticNATRequiresSingleBackend event")
+		}
+	})
 
-	t.Run("annotations removed after successful deletion", func(t *testing.T) {
+	t.Run("more than one backend keeps the existing rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
 
-		// getLoadBalancerByName returns one rule
+		// The service has a load balancer rule and two backends when the annotation is added. No rule may be
+		// deleted, any call to delete one fails the test.
 		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
 		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
 			Count: 1,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{
-					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80",
-					Publicip: "10.0.0.1", Publicipid: "ip-1", Publicport: "80",
-					Protocol: "tcp", Networkid: "net-1",
-				},
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+				Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+				Networkid: "net-1", Privateport: "30080", Publicport: "80",
+				Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+			}},
+		}, nil)
+		// The legacy name has no rules.
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 2,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1"}}},
+				{Id: "vm-2", Name: "node-2", Nic: []cloudstack.Nic{{Networkid: "net-1"}}},
 			},
 		}, nil)
 
-		// deleteFirewallRule
-		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
-		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
-			Count: 0, FirewallRules: []*cloudstack.FirewallRule{},
-		}, nil)
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerStaticNAT: "true"})
+		cs := newTestCSCloud(mockLB, nil, mockVM, nil, nil, service)
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
 
-		// deleteLoadBalancerRule
-		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
-		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+		twoNodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		}
+		if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, twoNodes); err == nil {
+			t.Fatalf("expected error")
+		}
+		close(recorder.Events)
+		found := false
+		for event := range recorder.Events {
+			found = found || strings.Contains(event, "StaticNATRequiresSingleBackend")
+		}
+		if !found {
+			t.Error("expected a StaticNATRequiresSingleBackend event")
+		}
+	})
 
-		// shouldReleaseLoadBalancerIP: no keep-ip, no other rules
-		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
-		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
-			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
-		}, nil)
+	t.Run("UpdateLoadBalancer moves the mapping to the new backend", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
 
-		// releaseLoadBalancerIP
-		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
-		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNAT := cloudstack.NewMockNATServiceIface(ctrl)
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        "foo",
-				Namespace:   "default",
-				Annotations: allLBAnnotations(),
-			},
-		}
+		// The ID-based lookup, the name-based lookup and the tags find no rules.
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).Times(2)
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil).Times(4)
+		setupVerifyHosts(mockVM)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
-				Firewall:     mockFirewall,
-			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
-		}
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-1", gomock.Any()).Return(&cloudstack.PublicIpAddress{
+			Id: "ip-1", Ipaddress: "10.0.0.1", Isstaticnat: true, Virtualmachineid: "vm-old",
+		}, 1, nil)
+		gomock.InOrder(
+			mockNAT.EXPECT().NewDisableStaticNatParams("ip-1").Return(&cloudstack.DisableStaticNatParams{}),
+			mockNAT.EXPECT().DisableStaticNat(gomock.Any()).Return(&cloudstack.DisableStaticNatResponse{}, nil),
+			mockNAT.EXPECT().NewEnableStaticNatParams("ip-1", "vm-1").Return(&cloudstack.EnableStaticNatParams{}),
+			mockNAT.EXPECT().EnableStaticNat(gomock.Any()).Return(&cloudstack.EnableStaticNatResponse{}, nil),
+		)
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
+		service := newService(map[string]string{
+			ServiceAnnotationLoadBalancerStaticNAT:                 "true",
+			ServiceAnnotationLoadBalancerAddress:                   "10.0.0.1",
+			ServiceAnnotationLoadBalancerID:                        "ip-1",
+			ServiceAnnotationLoadBalancerStaticNATVirtualMachineID: "vm-old",
+		})
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+		cs.client.NAT = mockNAT
 
-		for _, key := range lbAnnotationKeys {
-			if _, ok := service.Annotations[key]; ok {
-				t.Errorf("annotation %q should have been removed", key)
-			}
+		if err := cs.UpdateLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("annotations preserved when deletion fails", func(t *testing.T) {
+	t.Run("mapping and firewall rules are removed on delete", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockNAT := cloudstack.NewMockNATServiceIface(ctrl)
 
-		// getLoadBalancerByName returns one rule
+		// The ID-based lookup, the name-based lookup and the tags find no rules.
 		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).Times(2)
-		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
-			Count: 1,
-			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
-				{
-					Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80",
-					Publicip: "10.0.0.1", Publicipid: "ip-1", Publicport: "80",
-					Protocol: "tcp", Networkid: "net-1",
-				},
-			},
-		}, nil).Times(1)
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil).Times(4)
 
-		// deleteFirewallRule fails
 		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
-		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("firewall error"))
-
-		// deleteLoadBalancerRule fails
-		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
-		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(nil, errors.New("delete rule error"))
-
-		// shouldReleaseLoadBalancerIP is still called (IP cleanup attempted even on rule errors)
-		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
-			Count: 0, LoadBalancerRules: []*cloudstack.LoadBalancerRule{},
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count:         1,
+			FirewallRules: []*cloudstack.FirewallRule{{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80}},
 		}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-1").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+		setupNoICMPFirewallRules(mockFirewall)
 
-		// releaseLoadBalancerIP also fails
-		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
-		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(nil, errors.New("release failed"))
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-1", gomock.Any()).Return(&cloudstack.PublicIpAddress{
+			Id: "ip-1", Ipaddress: "10.0.0.1", Isstaticnat: true, Virtualmachineid: "vm-1",
+		}, 1, nil)
+		mockNAT.EXPECT().NewDisableStaticNatParams("ip-1").Return(&cloudstack.DisableStaticNatParams{})
+		mockNAT.EXPECT().DisableStaticNat(gomock.Any()).Return(&cloudstack.DisableStaticNatResponse{}, nil)
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        "foo",
-				Namespace:   "default",
-				Annotations: allLBAnnotations(),
-			},
-		}
+		// The kept IP is looked up, but not released.
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count:             1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "10.0.0.1"}},
+		}, nil)
 
-		cs := &CSCloud{
-			client: &cloudstack.CloudStackClient{
-				LoadBalancer: mockLB,
-				Address:      mockAddress,
-				Firewall:     mockFirewall,
-			},
-			kclient:       fake.NewSimpleClientset(service),
-			eventRecorder: record.NewFakeRecorder(10),
-		}
+		service := newService(map[string]string{
+			ServiceAnnotationLoadBalancerStaticNAT:                 "true",
+			ServiceAnnotationLoadBalancerKeepIP:                    "true",
+			ServiceAnnotationLoadBalancerAddress:                   "10.0.0.1",
+			ServiceAnnotationLoadBalancerID:                        "ip-1",
+			ServiceAnnotationLoadBalancerStaticNATVirtualMachineID: "vm-1",
+		})
+		cs := newTestCSCloud(mockLB, mockAddress, nil, nil, mockFirewall, service)
+		cs.client.NAT = mockNAT
 
-		err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service)
-		if err == nil {
-			t.Fatalf("expected error")
+		if err := cs.EnsureLoadBalancerDeleted(t.Context(), "cluster", service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-
-		for _, key := range lbAnnotationKeys {
-			if _, ok := service.Annotations[key]; !ok {
-				t.Errorf("annotation %q should have been preserved on error", key)
-			}
+		if _, ok := service.Annotations[ServiceAnnotationLoadBalancerStaticNATVirtualMachineID]; ok {
+			t.Errorf("static NAT VM annotation was not removed")
 		}
 	})
 }
 
-// --- Fix D tests ---
-
-// newTestCSCloud creates a minimal CSCloud with mocks for EnsureLoadBalancer tests.
-// The provided service is pre-created in the fake clientset so the service patcher can find it.
-func newTestCSCloud(mockLB *cloudstack.MockLoadBalancerServiceIface, mockAddress *cloudstack.MockAddressServiceIface, mockVM *cloudstack.MockVirtualMachineServiceIface, mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface, service *corev1.Service) *CSCloud {
-	return &CSCloud{
-		client: &cloudstack.CloudStackClient{
-			LoadBalancer:   mockLB,
-			Address:        mockAddress,
-			VirtualMachine: mockVM,
-			Network:        mockNetwork,
-			Firewall:       mockFirewall,
-		},
-		kclient:       fake.NewSimpleClientset(service),
-		eventRecorder: record.NewFakeRecorder(10),
+func TestEnsureLoadBalancerUDPInVPC(t *testing.T) {
+	vpcNetwork := func(protocols string) *cloudstack.Network {
+		return &cloudstack.Network{
+			Id: "net-1", Vpcid: "vpc-1",
+			Service: []cloudstack.NetworkServiceInternal{
+				{Name: "Lb", Capability: []cloudstack.NetworkServiceInternalCapability{{Name: "SupportedProtocols", Value: protocols}}},
+				{Name: "NetworkACL"},
+			},
+		}
+	}
+	newService := func() *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Port: 53, NodePort: 30053, Protocol: corev1.ProtocolUDP},
+				},
+				SessionAffinity: corev1.ServiceAffinityNone,
+			},
+		}
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
 	}
-}
-
-// setupVerifyHosts sets up mock expectations for verifyHosts returning one node.
-func setupVerifyHosts(mockVM *cloudstack.MockVirtualMachineServiceIface) {
-	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
-	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
-		Count: 1,
-		VirtualMachines: []*cloudstack.VirtualMachine{
-			{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1"}}},
-		},
-	}, nil)
-}
-
-// setupCreateRuleAndFirewall sets up mock expectations for creating one LB rule
-// with firewall, which is the common tail of EnsureLoadBalancer tests.
-func setupCreateRuleAndFirewall(mockLB *cloudstack.MockLoadBalancerServiceIface, mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface, ip, ipID string) {
-	mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
-	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
-		Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
-		Networkid: "net-1", Privateport: "30080", Publicport: "80",
-		Publicip: ip, Publicipid: ipID, Protocol: "tcp",
-	}, nil)
-	mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
-	mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
-
-	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
-		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
-	}, 1, nil)
-	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
-	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{Count: 0, FirewallRules: []*cloudstack.FirewallRule{}}, nil)
-	mockFirewall.EXPECT().NewCreateFirewallRuleParams(gomock.Any(), gomock.Any()).Return(&cloudstack.CreateFirewallRuleParams{})
-	mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
-}
 
-func TestEnsureLoadBalancerAnnotationRecovery(t *testing.T) {
-	t.Run("recovers annotated IP on retry", func(t *testing.T) {
+	t.Run("UDP rule is created on the VPC IP for the tier", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
-		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 
-		// getLoadBalancerByName: no rules (2 LB list calls: modern + legacy)
 		setupGetLoadBalancerByNameEmpty(mockLB)
 		setupVerifyHosts(mockVM)
 
-		// lookupPublicIPAddress: finds the annotated IP
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-recovered", Ipaddress: "10.0.0.1"},
-			},
+		// associatePublicIPAddress, checkUDPSupported and the firewall check each look up the network.
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(vpcNetwork("tcp, udp, tcp-proxy"), 1, nil).Times(3)
+
+		associateParams := &cloudstack.AssociateIpAddressParams{}
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams)
+		mockAddress.EXPECT().AssociateIpAddress(associateParams).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-1", Ipaddress: "10.0.0.1",
 		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 
-		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.1", "ip-recovered")
+		createParams := &cloudstack.CreateLoadBalancerRuleParams{}
+		mockLB.EXPECT().NewCreateLoadBalancerRuleParams("roundrobin", "K8s_svc_cluster_default_foo-udp-53", 30053, 53).Return(createParams)
+		mockLB.EXPECT().CreateLoadBalancerRule(createParams).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+			Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-udp-53",
+			Networkid: "net-1", Privateport: "30053", Publicport: "53",
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "udp",
+		}, nil)
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+		// VPC tiers are protected by network ACLs, so no firewall rules are created.
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
-				},
-			},
-			Spec: corev1.ServiceSpec{
-				Ports: []corev1.ServicePort{
-					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
-				},
-				SessionAffinity: corev1.ServiceAffinityNone,
-			},
-		}
+		service := newService()
 		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-		}
+		setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer")
 
 		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if status == nil || len(status.Ingress) == 0 {
-			t.Fatalf("expected non-empty status")
+		if status == nil || len(status.Ingress) == 0 || status.Ingress[0].IP != "10.0.0.1" {
+			t.Fatalf("status = %v, want ingress IP 10.0.0.1", status)
 		}
-		if status.Ingress[0].IP != "10.0.0.1" {
-			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.1")
+
+		if vpcID, _ := associateParams.GetVpcid(); vpcID != "vpc-1" {
+			t.Errorf("IP associated with VPC %q, want %q", vpcID, "vpc-1")
+		}
+		if networkID, ok := associateParams.GetNetworkid(); ok {
+			t.Errorf("IP associated with network %q, want it associated with the VPC only", networkID)
+		}
+		if protocol, _ := createParams.GetProtocol(); protocol != "udp" {
+			t.Errorf("rule protocol = %q, want %q", protocol, "udp")
+		}
+		if networkID, _ := createParams.GetNetworkid(); networkID != "net-1" {
+			t.Errorf("rule network = %q, want the tier %q", networkID, "net-1")
+		}
+		if publicIPID, _ := createParams.GetPublicipid(); publicIPID != "ip-1" {
+			t.Errorf("rule public IP = %q, want %q", publicIPID, "ip-1")
 		}
 	})
 
-	t.Run("auto-allocates when no IP specified", func(t *testing.T) {
+	t.Run("UDP is refused when the VPC load balancer does not support it", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
 		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
 		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
 		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
-		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
 
 		setupGetLoadBalancerByNameEmpty(mockLB)
 		setupVerifyHosts(mockVM)
-
-		// No annotation, no spec.LoadBalancerIP → auto-allocate via associatePublicIPAddress
-		// GetNetworkByID called twice: once for associatePublicIPAddress, once for firewall check
-		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
-			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
-		}, 1, nil).Times(2)
-
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(vpcNetwork("tcp, tcp-proxy"), 1, nil).Times(3)
 		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
 		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
-			Id: "ip-new", Ipaddress: "10.0.0.2",
+			Id: "ip-1", Ipaddress: "10.0.0.1",
 		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
 
-		// createLoadBalancerRule + firewall (but GetNetworkByID already set up above)
-		mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
-		mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
-			Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
-			Networkid: "net-1", Privateport: "30080", Publicport: "80",
-			Publicip: "10.0.0.2", Publicipid: "ip-new", Protocol: "tcp",
-		}, nil)
-		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
-		mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+		service := newService()
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+		setupResourceTags(ctrl, cs, "PublicIpAddress")
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
 
-		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
-		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{Count: 0, FirewallRules: []*cloudstack.FirewallRule{}}, nil)
-		mockFirewall.EXPECT().NewCreateFirewallRuleParams(gomock.Any(), gomock.Any()).Return(&cloudstack.CreateFirewallRuleParams{})
-		mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+		_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if err == nil || !strings.Contains(err.Error(), "does not support UDP") {
+			t.Fatalf("expected a UDP not supported error, got %v", err)
+		}
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-			},
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		if !strings.Contains(strings.Join(events, "\n"), "UDPNotSupported") {
+			t.Errorf("expected an UDPNotSupported event, got %v", events)
+		}
+	})
+}
+
+func TestEnsureLoadBalancerRuleCIDRs(t *testing.T) {
+	existingRule := func(cidrlist string) *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{
+			Id: "rule-old", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+			Networkid: "net-1", Privateport: "30080", Publicport: "80", Cidrlist: cidrlist,
+			Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+		}
+	}
+	firewallNetwork := &cloudstack.Network{Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}}}
+	lbNetwork := func(provider string) *cloudstack.Network {
+		return &cloudstack.Network{Id: "net-1", Service: []cloudstack.NetworkServiceInternal{
+			{Name: "Lb", Provider: []cloudstack.NetworkServiceInternalProvider{{Name: provider}}},
+		}}
+	}
+	plainNetwork := lbNetwork("VirtualRouter")
+
+	tests := []struct {
+		name         string
+		network      *cloudstack.Network
+		existing     *cloudstack.LoadBalancerRule
+		wantCreate   bool
+		wantCIDRs    []string
+		wantFirewall bool
+		// wantIgnored expects a LoadBalancerSourceRangesIgnored event.
+		wantIgnored bool
+	}{
+		{name: "firewall rule in a network with the Firewall service", network: firewallNetwork, wantCreate: true, wantFirewall: true},
+		{name: "rule CIDR list in a network without the Firewall service", network: plainNetwork, wantCreate: true, wantCIDRs: []string{"10.0.0.0/8"}},
+		{name: "rule CIDR list in a VPC tier", network: lbNetwork("VpcVirtualRouter"), wantCreate: true, wantCIDRs: []string{"10.0.0.0/8"}},
+		{
+			name: "source ranges are ignored without CIDR support", network: lbNetwork("Netscaler"), wantCreate: true,
+			wantIgnored: true,
+		},
+		{name: "rule with the same CIDR list is kept", network: plainNetwork, existing: existingRule("10.0.0.0/8")},
+		{name: "rule with another CIDR list is recreated", network: plainNetwork, existing: existingRule("0.0.0.0/0"), wantCreate: true, wantCIDRs: []string{"10.0.0.0/8"}},
+		// CloudStack versions that do not keep the CIDR list list it empty.
+		{name: "rule listed without a CIDR list is kept", network: plainNetwork, existing: existingRule("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+			setupVerifyHosts(mockVM)
+			var tags []string
+			if tt.existing == nil {
+				setupGetLoadBalancerByNameEmpty(mockLB)
+				mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(tt.network, 1, nil)
+				mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+				mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+					Id: "ip-1", Ipaddress: "10.0.0.1",
+				}, nil)
+				setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+				tags = append(tags, "PublicIpAddress")
+			} else {
+				mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+				mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+					Count: 1, LoadBalancerRules: []*cloudstack.LoadBalancerRule{tt.existing},
+				}, nil)
+				// The legacy name has no rules.
+				mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+			}
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(tt.network, 1, nil)
+
+			createParams := &cloudstack.CreateLoadBalancerRuleParams{}
+			if tt.wantCreate {
+				if tt.existing != nil {
+					mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-old").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+					mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+				}
+				mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(createParams)
+				mockLB.EXPECT().CreateLoadBalancerRule(createParams).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+					Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+					Networkid: "net-1", Privateport: "30080", Publicport: "80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+				}, nil)
+				mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+				mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+				tags = append(tags, "LoadBalancer")
+			} else {
+				mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-old").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{})
+				mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+					Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+				}, nil)
+			}
+
+			firewallParams := &cloudstack.CreateFirewallRuleParams{}
+			if tt.wantFirewall {
+				mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+				mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+				mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(firewallParams)
+				mockFirewall.EXPECT().CreateFirewallRule(firewallParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+				setupNoICMPFirewallRules(mockFirewall)
+				tags = append(tags, "FirewallRule")
+			}
+
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+				Spec: corev1.ServiceSpec{
+					Ports:                    []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+					SessionAffinity:          corev1.ServiceAffinityNone,
+					LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+				},
+			}
+			cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+			if len(tags) > 0 {
+				setupResourceTags(ctrl, cs, tags...)
+			}
+			recorder := record.NewFakeRecorder(10)
+			cs.eventRecorder = recorder
+
+			if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			close(recorder.Events)
+			ignored := false
+			for event := range recorder.Events {
+				ignored = ignored || strings.Contains(event, "LoadBalancerSourceRangesIgnored")
+			}
+			if ignored != tt.wantIgnored {
+				t.Errorf("LoadBalancerSourceRangesIgnored event emitted = %v, want %v", ignored, tt.wantIgnored)
+			}
+			if cidrs, _ := createParams.GetCidrlist(); !slices.Equal(cidrs, tt.wantCIDRs) {
+				t.Errorf("rule CIDR list = %v, want %v", cidrs, tt.wantCIDRs)
+			}
+			if cidrs, _ := firewallParams.GetCidrlist(); tt.wantFirewall && !slices.Equal(cidrs, []string{"10.0.0.0/8"}) {
+				t.Errorf("firewall rule CIDR list = %v, want [10.0.0.0/8]", cidrs)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerNetworkError(t *testing.T) {
+	newService := func() *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
 			Spec: corev1.ServiceSpec{
 				Ports: []corev1.ServicePort{
 					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
@@ -3821,55 +10813,287 @@ func TestEnsureLoadBalancerAnnotationRecovery(t *testing.T) {
 				SessionAffinity: corev1.ServiceAffinityNone,
 			},
 		}
-		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-		}
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
 
-		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if status == nil || len(status.Ingress) == 0 {
-			t.Fatalf("expected non-empty status")
+	tests := []struct {
+		name                         string
+		skipFirewallOnNetworkError   bool
+		assumeFirewallOnNetworkError bool
+		wantErr                      bool
+		wantRetry                    bool
+		wantPortError                string
+		wantEvent                    string
+	}{
+		{name: "reconcile fails by default", wantErr: true},
+		// The rule is created, the port reports that its firewall rules were skipped, and the service is requeued
+		// to configure them.
+		{name: "firewall is skipped when enabled", skipFirewallOnNetworkError: true, wantRetry: true, wantPortError: PortErrorFirewallRulesSkipped, wantEvent: "FirewallRulesSkipped"},
+		{name: "firewall is assumed when enabled", assumeFirewallOnNetworkError: true, wantEvent: "FirewallSupportAssumed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+			setupGetLoadBalancerByNameEmpty(mockLB)
+			setupVerifyHosts(mockVM)
+
+			// The first lookup is for the IP association, the second one for the firewall fails.
+			gomock.InOrder(
+				mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil),
+				mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(nil, -1, errors.New("connection reset")),
+			)
+			mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+			mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+				Id: "ip-1", Ipaddress: "10.0.0.1",
+			}, nil)
+			setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+			// The network is looked up before the rule is created, so a failure creates no rule.
+			if !tt.wantErr {
+				mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+				mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+					Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+					Networkid: "net-1", Privateport: "30080", Publicport: "80",
+					Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+				}, nil)
+				mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{})
+				mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil)
+			}
+
+			service := newService()
+			cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+			switch {
+			case tt.wantErr:
+				setupResourceTags(ctrl, cs, "PublicIpAddress")
+			case tt.assumeFirewallOnNetworkError:
+				// The firewall rule of the port is created, and the ICMP rules are reconciled.
+				mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+				mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+				mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(&cloudstack.CreateFirewallRuleParams{})
+				mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+				setupNoICMPFirewallRules(mockFirewall)
+				setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer", "FirewallRule")
+			default:
+				setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer")
+			}
+			recorder := record.NewFakeRecorder(10)
+			cs.eventRecorder = recorder
+			cs.skipFirewallOnNetworkError = tt.skipFirewallOnNetworkError
+			cs.assumeFirewallOnNetworkError = tt.assumeFirewallOnNetworkError
+
+			status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+
+				return
+			}
+			if tt.wantRetry {
+				var retryErr *cloudproviderapi.RetryError
+				if !errors.As(err, &retryErr) || retryErr.RetryAfter() != firewallRulesSkippedRetryDelay {
+					t.Fatalf("err = %v, want a RetryError after %v", err, firewallRulesSkippedRetryDelay)
+				}
+				// The status of a requeued service is written by the CCM itself.
+				got, err := cs.kclient.CoreV1().Services("default").Get(t.Context(), "foo", metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				status = &got.Status.LoadBalancer
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status == nil || len(status.Ingress) == 0 || status.Ingress[0].IP != "10.0.0.1" {
+				t.Fatalf("status = %v, want ingress IP 10.0.0.1", status)
+			}
+			ports := status.Ingress[0].Ports
+			if len(ports) != 1 || ports[0].Port != 80 {
+				t.Fatalf("port status = %+v, want port 80", ports)
+			}
+			if got := ptr.Deref(ports[0].Error, ""); got != tt.wantPortError {
+				t.Errorf("error of port 80 = %q, want %q", got, tt.wantPortError)
+			}
+
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			if !strings.Contains(strings.Join(events, "\n"), tt.wantEvent) {
+				t.Errorf("expected a %s event, got %v", tt.wantEvent, events)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerReconcileEvent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(nil, errors.New("API error"))
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, mockVM, nil, nil, service)
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+	cs.reconcileEvents = true
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "LoadBalancerReconciled") || !strings.Contains(event, "reconcile failed") {
+			t.Errorf("unexpected event %q", event)
 		}
-		if status.Ingress[0].IP != "10.0.0.2" {
-			t.Errorf("status IP = %q, want %q (new allocation)", status.Ingress[0].IP, "10.0.0.2")
+	default:
+		t.Errorf("expected a LoadBalancerReconciled event")
+	}
+}
+
+func TestCheckLoadBalancerProvider(t *testing.T) {
+	lbService := func(providers ...string) cloudstack.NetworkServiceInternal {
+		svc := cloudstack.NetworkServiceInternal{Name: "Lb"}
+		for _, p := range providers {
+			svc.Provider = append(svc.Provider, cloudstack.NetworkServiceInternalProvider{Name: p})
 		}
-	})
 
-	t.Run("annotation-specified IP is allocated on fresh LB", func(t *testing.T) {
-		ctrl := gomock.NewController(t)
-		t.Cleanup(ctrl.Finish)
+		return svc
+	}
 
-		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
-		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
-		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
-		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
-		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+	tests := []struct {
+		name     string
+		services []cloudstack.NetworkServiceInternal
+		provider string
+		wantErr  string
+	}{
+		{
+			name:     "provider matches",
+			services: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}, lbService("Netscaler")},
+			provider: "Netscaler",
+		},
+		{
+			name:     "provider matches case-insensitively",
+			services: []cloudstack.NetworkServiceInternal{lbService("VirtualRouter")},
+			provider: "virtualrouter",
+		},
+		{
+			name:     "other provider",
+			services: []cloudstack.NetworkServiceInternal{lbService("VirtualRouter")},
+			provider: "Netscaler",
+			wantErr:  "uses [VirtualRouter]",
+		},
+		{
+			name:     "no load balancer service",
+			services: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+			provider: "Netscaler",
+			wantErr:  "does not offer a load balancer",
+		},
+	}
 
-		setupGetLoadBalancerByNameEmpty(mockLB)
-		setupVerifyHosts(mockVM)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
 
-		// lookupPublicIPAddress for annotated IP: found (already allocated)
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-new", Ipaddress: "10.0.0.2", Allocated: "2023-01-01"},
-			},
-		}, nil)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1", Service: tt.services}, 1, nil)
 
-		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.2", "ip-new")
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Network: mockNetwork},
+				networkID:        "net-1",
+			}
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				Annotations: map[string]string{
-					ServiceAnnotationLoadBalancerAddress: "10.0.0.2", // user-specified desired IP
-				},
+			err := lb.checkLoadBalancerProvider(tt.provider)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerProviderUnavailable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupVerifyHosts(mockVM)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1",
+		Service: []cloudstack.NetworkServiceInternal{
+			{Name: "Lb", Provider: []cloudstack.NetworkServiceInternalProvider{{Name: "VirtualRouter"}}},
+		},
+	}, 1, nil)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerProvider: "Netscaler",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
 			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, nil, service)
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+
+	if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "LoadBalancerProviderUnavailable") {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Errorf("expected a LoadBalancerProviderUnavailable event")
+	}
+}
+
+func TestEnsureLoadBalancerRequireFirewall(t *testing.T) {
+	newService := func() *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
 			Spec: corev1.ServiceSpec{
 				Ports: []corev1.ServicePort{
 					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
@@ -3877,24 +11101,45 @@ func TestEnsureLoadBalancerAnnotationRecovery(t *testing.T) {
 				SessionAffinity: corev1.ServiceAffinityNone,
 			},
 		}
-		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-		}
+	}
+	nodes := []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
 
-		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		if status == nil || len(status.Ingress) == 0 {
-			t.Fatalf("expected non-empty status")
+	t.Run("network without firewall fails before anything is created", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Lb"}},
+		}, 1, nil)
+
+		service := newService()
+		cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, nil, service)
+		cs.requireFirewall = true
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
+
+		_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if !errors.Is(err, errFirewallNotSupported) {
+			t.Fatalf("error = %v, want errFirewallNotSupported", err)
 		}
-		if status.Ingress[0].IP != "10.0.0.2" {
-			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.2")
+
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "FirewallNotSupported") {
+				t.Errorf("unexpected event %q", event)
+			}
+		default:
+			t.Errorf("expected a FirewallNotSupported event")
 		}
 	})
 
-	t.Run("spec.LoadBalancerIP fallback used when no annotation", func(t *testing.T) {
+	t.Run("network with firewall is reconciled", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
 
@@ -3906,47 +11151,26 @@ func TestEnsureLoadBalancerAnnotationRecovery(t *testing.T) {
 
 		setupGetLoadBalancerByNameEmpty(mockLB)
 		setupVerifyHosts(mockVM)
-
-		// getLoadBalancerIP for spec IP (10.0.0.2) → getPublicIPAddress
-		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
-		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
-			Count: 1,
-			PublicIpAddresses: []*cloudstack.PublicIpAddress{
-				{Id: "ip-new", Ipaddress: "10.0.0.2", Allocated: "2023-01-01"},
-			},
+		// checkFirewallSupported, associatePublicIPAddress and the firewall rules each get the network.
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+			Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+		}, 1, nil).Times(2)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-1", Ipaddress: "10.0.0.1",
 		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.1", "ip-1")
+		setupNoICMPFirewallRules(mockFirewall)
 
-		setupCreateRuleAndFirewall(mockLB, mockNetwork, mockFirewall, "10.0.0.2", "ip-new")
-
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "default",
-				// No annotation — spec.LoadBalancerIP used as fallback
-			},
-			Spec: corev1.ServiceSpec{
-				LoadBalancerIP: "10.0.0.2",
-				Ports: []corev1.ServicePort{
-					{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
-				},
-				SessionAffinity: corev1.ServiceAffinityNone,
-			},
-		}
+		service := newService()
 		cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
-		nodes := []*corev1.Node{
-			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
-		}
+		cs.requireFirewall = true
+		setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer", "FirewallRule")
 
-		status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
-		if err != nil {
+		if _, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if status == nil || len(status.Ingress) == 0 {
-			t.Fatalf("expected non-empty status")
-		}
-		if status.Ingress[0].IP != "10.0.0.2" {
-			t.Errorf("status IP = %q, want %q", status.Ingress[0].IP, "10.0.0.2")
-		}
 	})
 }
 
@@ -4019,6 +11243,25 @@ func TestShouldReleaseLoadBalancerIPKeepIP(t *testing.T) {
 		}
 	})
 
+	t.Run("disable-ip-release prevents release", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		cs := &CSCloud{disableIPRelease: true}
+		lb := &loadBalancer{
+			ipAddr:   "10.0.0.1",
+			ipAddrID: "ip-1",
+		}
+
+		release, err := cs.shouldReleaseLoadBalancerIP(lb, &corev1.Service{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if release {
+			t.Error("expected shouldReleaseLoadBalancerIP to return false when IP release is disabled")
+		}
+	})
+
 	t.Run("keep-ip false allows release", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
@@ -4029,7 +11272,7 @@ func TestShouldReleaseLoadBalancerIPKeepIP(t *testing.T) {
 			Count: 0,
 		}, nil)
 
-		cs := &CSCloud{}
+		cs := &CSCloud{serviceLister: newTestServiceLister()}
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				LoadBalancer: mockLB,
@@ -4064,7 +11307,7 @@ func TestShouldReleaseLoadBalancerIPKeepIP(t *testing.T) {
 			Count: 0,
 		}, nil)
 
-		cs := &CSCloud{}
+		cs := &CSCloud{serviceLister: newTestServiceLister()}
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				LoadBalancer: mockLB,
@@ -4093,7 +11336,7 @@ func TestShouldReleaseLoadBalancerIPKeepIP(t *testing.T) {
 			Count: 0,
 		}, nil)
 
-		cs := &CSCloud{}
+		cs := &CSCloud{serviceLister: newTestServiceLister()}
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				LoadBalancer: mockLB,
@@ -4186,7 +11429,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancerByID("my-lb", "ip-1", "net-1")
+		lb, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "net-1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4231,7 +11474,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancerByID("my-lb", "ip-1", "net-1")
+		lb, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "net-1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4270,7 +11513,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancerByID("my-lb", "ip-1", "net-1")
+		lb, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "net-1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4295,7 +11538,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		_, err := cs.getLoadBalancerByID("my-lb", "ip-1", "net-1")
+		_, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "net-1")
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -4333,7 +11576,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		_, err := cs.getLoadBalancerByID("my-lb", "ip-1", "net-1")
+		_, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "net-1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4367,7 +11610,7 @@ func TestGetLoadBalancerByID(t *testing.T) {
 			},
 		}
 
-		_, err := cs.getLoadBalancerByID("my-lb", "ip-1", "")
+		_, err := cs.getLoadBalancerByID(t.Context(), "cluster", nil, "my-lb", "ip-1", "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4409,7 +11652,7 @@ func TestGetLoadBalancerOrchestrator(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancer(service, "my-lb", "legacy-lb")
+		lb, err := cs.getLoadBalancer(t.Context(), "cluster", service, "my-lb", "legacy-lb")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4465,7 +11708,7 @@ func TestGetLoadBalancerOrchestrator(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancer(service, "my-lb", "")
+		lb, err := cs.getLoadBalancer(t.Context(), "cluster", service, "my-lb", "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4502,7 +11745,7 @@ func TestGetLoadBalancerOrchestrator(t *testing.T) {
 
 		service := &corev1.Service{} // no annotations
 
-		lb, err := cs.getLoadBalancer(service, "my-lb", "")
+		lb, err := cs.getLoadBalancer(t.Context(), "cluster", service, "my-lb", "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -4538,7 +11781,7 @@ func TestGetLoadBalancerOrchestrator(t *testing.T) {
 			},
 		}
 
-		_, err := cs.getLoadBalancer(service, "my-lb", "")
+		_, err := cs.getLoadBalancer(t.Context(), "cluster", service, "my-lb", "")
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -4547,3 +11790,553 @@ func TestGetLoadBalancerOrchestrator(t *testing.T) {
 		}
 	})
 }
+
+func TestRecordLastError(t *testing.T) {
+	const earlier = "2026-01-02T03:04:05Z"
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		err         error
+		wantError   string
+		wantTime    string
+	}{
+		{
+			name: "success without error",
+		},
+		{
+			name:        "success clears the error",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerLastError: "ReconcileFailed", ServiceAnnotationLoadBalancerLastErrorTime: earlier},
+		},
+		{
+			name:      "failure records the reason",
+			err:       fmt.Errorf("%w: 2 of 2 IPs in use", errInsufficientCapacity),
+			wantError: "InsufficientCapacity",
+		},
+		{
+			name:      "unknown error records a generic reason",
+			err:       errors.New("boom"),
+			wantError: "ReconcileFailed",
+		},
+		{
+			name:      "requeue records its own reason",
+			err:       cloudproviderapi.NewRetryError("retrying", time.Minute),
+			wantError: "Requeued",
+		},
+		{
+			name:      "CloudStack error code records its class",
+			err:       errors.New("CloudStack API error 532 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'public_ip' reached"),
+			wantError: "InsufficientCapacity",
+		},
+		{
+			name:        "same reason with another message keeps the time",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerLastError: "InsufficientCapacity", ServiceAnnotationLoadBalancerLastErrorTime: earlier},
+			err:         fmt.Errorf("%w: 3 of 3 IPs in use", errInsufficientCapacity),
+			wantError:   "InsufficientCapacity",
+			wantTime:    earlier,
+		},
+		{
+			name:        "new reason updates the time",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerLastError: "InsufficientCapacity", ServiceAnnotationLoadBalancerLastErrorTime: earlier},
+			err:         errors.New("bang"),
+			wantError:   "ReconcileFailed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+
+			recordLastError(service, tt.err)
+
+			gotError, hasError := service.Annotations[ServiceAnnotationLoadBalancerLastError]
+			gotTime, hasTime := service.Annotations[ServiceAnnotationLoadBalancerLastErrorTime]
+			if tt.err == nil {
+				if hasError || hasTime {
+					t.Errorf("annotations = %v, want the last error removed", service.Annotations)
+				}
+
+				return
+			}
+			if gotError != tt.wantError {
+				t.Errorf("last error = %q, want %q", gotError, tt.wantError)
+			}
+			if tt.wantTime != "" {
+				if gotTime != tt.wantTime {
+					t.Errorf("last error time = %q, want %q", gotTime, tt.wantTime)
+				}
+
+				return
+			}
+			if _, err := time.Parse(time.RFC3339, gotTime); err != nil || gotTime == earlier {
+				t.Errorf("last error time = %q, want the current time", gotTime)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancerLastError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	setupGetLoadBalancerByNameEmpty(mockLB)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "bogus"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service)
+
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nil)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	updated, getErr := cs.kclient.CoreV1().Services("default").Get(t.Context(), "foo", metav1.GetOptions{})
+	if getErr != nil {
+		t.Fatalf("failed to get service: %v", getErr)
+	}
+	if got := updated.Annotations[ServiceAnnotationLoadBalancerLastError]; got != "ReconcileFailed" {
+		t.Errorf("last error = %q, want %q", got, "ReconcileFailed")
+	}
+	if updated.Annotations[ServiceAnnotationLoadBalancerLastErrorTime] == "" {
+		t.Errorf("expected the last error time to be patched")
+	}
+}
+
+func TestEnsureLoadBalancerAllowedProtocols(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	setupGetLoadBalancerByNameEmpty(mockLB)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 53, NodePort: 30053, Protocol: corev1.ProtocolTCP},
+				{Port: 53, NodePort: 30054, Protocol: corev1.ProtocolUDP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, nil, nil, nil, service)
+	cs.allowedProtocols = []LoadBalancerProtocol{LoadBalancerProtocolTCP}
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+
+	// No hosts are verified and no IP is associated, the mocks would fail otherwise.
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+	if !errors.Is(err, errProtocolNotAllowed) {
+		t.Fatalf("error = %v, want errProtocolNotAllowed", err)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "ProtocolNotAllowed") || !strings.Contains(event, "udp") {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Errorf("expected a ProtocolNotAllowed event")
+	}
+}
+
+func TestEnsureLoadBalancerDisableIPAssociation(t *testing.T) {
+	newService := func(ip string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+				SessionAffinity: corev1.ServiceAffinityNone,
+				LoadBalancerIP:  ip,
+			},
+		}
+	}
+	nodes := []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+
+	t.Run("service without an IP fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
+
+		service := newService("")
+		cs := newTestCSCloud(mockLB, nil, mockVM, nil, nil, service)
+		cs.disableIPAssociation = true
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
+
+		// No IP is associated, the address mock would fail otherwise.
+		_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if !errors.Is(err, errIPAssociationDisabled) {
+			t.Fatalf("error = %v, want errIPAssociationDisabled", err)
+		}
+		if !strings.Contains(err.Error(), "spec.loadBalancerIP") {
+			t.Errorf("error = %q, want it to explain how to request an IP", err.Error())
+		}
+
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "IPAssociationDisabled") {
+				t.Errorf("unexpected event %q", event)
+			}
+		default:
+			t.Errorf("expected an IPAssociationDisabled event")
+		}
+	})
+
+	t.Run("requested IP that is not allocated fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		setupGetLoadBalancerByNameEmpty(mockLB)
+		setupVerifyHosts(mockVM)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count:             1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "203.0.113.10"}},
+		}, nil)
+
+		service := newService("203.0.113.10")
+		cs := newTestCSCloud(mockLB, mockAddress, mockVM, nil, nil, service)
+		cs.disableIPAssociation = true
+
+		_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+		if !errors.Is(err, errIPAssociationDisabled) {
+			t.Fatalf("error = %v, want errIPAssociationDisabled", err)
+		}
+	})
+}
+
+func TestEnsureLoadBalancerStaleFirewallRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupVerifyHosts(mockVM)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil).Times(2)
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+	mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+		Id: "ip-1", Ipaddress: "10.0.0.1",
+	}, nil)
+	setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+	mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{}).Times(2)
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+		Id: "rule-1", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-80",
+		Networkid: "net-1", Privateport: "30080", Publicport: "80",
+		Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+	}, nil)
+	mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+		Id: "rule-2", Algorithm: "roundrobin", Name: "K8s_svc_cluster_default_foo-tcp-443",
+		Networkid: "net-1", Privateport: "30443", Publicport: "443",
+		Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+	}, nil)
+	mockLB.EXPECT().NewAssignToLoadBalancerRuleParams(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleParams{}).Times(2)
+	mockLB.EXPECT().AssignToLoadBalancerRule(gomock.Any()).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil).Times(2)
+
+	// The old rule of port 80 cannot be deleted, the new one is created anyway. Port 443 only gets a new rule.
+	oldRule := &cloudstack.FirewallRule{Id: "fw-old", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "192.168.0.0/16", Ipaddressid: "ip-1"}
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(3)
+	gomock.InOrder(
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 1, FirewallRules: []*cloudstack.FirewallRule{oldRule},
+		}, nil),
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+			Count: 2,
+			FirewallRules: []*cloudstack.FirewallRule{
+				oldRule,
+				{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "0.0.0.0/0", Ipaddressid: "ip-1"},
+			},
+		}, nil),
+		// The IP has no ICMP rules.
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil),
+	)
+	mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-old").Return(&cloudstack.DeleteFirewallRuleParams{})
+	mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(nil, errors.New("delete API error"))
+	mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-1", "tcp").Return(&cloudstack.CreateFirewallRuleParams{}).Times(2)
+	mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-1"}, nil)
+	mockFirewall.EXPECT().CreateFirewallRule(gomock.Any()).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-2"}, nil)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				{Port: 443, NodePort: 30443, Protocol: corev1.ProtocolTCP},
+			},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+	// Both new firewall rules are tagged with a single call.
+	setupResourceTags(ctrl, cs, "PublicIpAddress", "LoadBalancer", "LoadBalancer", "FirewallRule")
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+
+	// The reconcile finishes, but the service is requeued to retry the deletion of the old rule.
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+	var retryErr *cloudproviderapi.RetryError
+	if !errors.As(err, &retryErr) || retryErr.RetryAfter() != staleFirewallRulesRetryDelay {
+		t.Fatalf("err = %v, want a RetryError after %v", err, staleFirewallRulesRetryDelay)
+	}
+
+	// The status is written anyway, and only port 80 reports the old rule that is left.
+	got, err := cs.kclient.CoreV1().Services("default").Get(t.Context(), "foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Status.LoadBalancer.Ingress) != 1 || got.Status.LoadBalancer.Ingress[0].IP != "10.0.0.1" {
+		t.Fatalf("status = %+v, want ingress IP 10.0.0.1", got.Status.LoadBalancer)
+	}
+	want := []corev1.PortStatus{
+		{Port: 80, Protocol: corev1.ProtocolTCP, Error: ptr.To(PortErrorStaleFirewallRules)},
+		{Port: 443, Protocol: corev1.ProtocolTCP},
+	}
+	if !cmp.Equal(got.Status.LoadBalancer.Ingress[0].Ports, want) {
+		t.Errorf("port status = %+v, want %+v", got.Status.LoadBalancer.Ingress[0].Ports, want)
+	}
+	if got := service.Annotations[ServiceAnnotationLoadBalancerRuleIDs]; got != "tcp/443=rule-2,tcp/80=rule-1" {
+		t.Errorf("rule IDs annotation = %q, want the rule to be reconciled", got)
+	}
+
+	close(recorder.Events)
+	found := false
+	for event := range recorder.Events {
+		if strings.Contains(event, "StaleFirewallRules") && strings.Contains(event, "192.168.0.0/16") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a StaleFirewallRules event naming the old source range")
+	}
+}
+
+func TestEnsureLoadBalancerDeletesStaleFirewallRulesOnRequeue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	// Both reconciles find the same rule and hosts. The second one looks the rules up by the load balancer ID
+	// annotation of the first one, without the legacy name.
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).Times(2)
+	gomock.InOrder(
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+				Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+				Networkid: "net-1", Privateport: "30080", Publicport: "80",
+				Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+			}},
+		}, nil),
+		// The legacy name has no rules.
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{{
+				Id: "rule-1", Name: "K8s_svc_cluster_default_foo-tcp-80", Algorithm: "roundrobin",
+				Networkid: "net-1", Privateport: "30080", Publicport: "80",
+				Publicip: "10.0.0.1", Publicipid: "ip-1", Protocol: "tcp",
+			}},
+		}, nil),
+	)
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}).Times(2)
+	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+		Count:           1,
+		VirtualMachines: []*cloudstack.VirtualMachine{{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1"}}}},
+	}, nil).Times(2)
+	mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}).Times(2)
+	mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+		Count: 1, LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+	}, nil).Times(2)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{
+		Id: "net-1", Service: []cloudstack.NetworkServiceInternal{{Name: "Firewall"}},
+	}, 1, nil).Times(2)
+
+	// The wanted rule is in place, next to an old rule that is only deleted by the second reconcile. Each
+	// reconcile lists the rules for the port and for ICMP.
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(4)
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+		Count: 2,
+		FirewallRules: []*cloudstack.FirewallRule{
+			{Id: "fw-old", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: "192.168.0.0/16", Ipaddressid: "ip-1"},
+			{Id: "fw-1", Protocol: "tcp", Startport: 80, Endport: 80, Cidrlist: defaultAllowedCIDR, Ipaddressid: "ip-1"},
+		},
+	}, nil).Times(4)
+	mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-old").Return(&cloudstack.DeleteFirewallRuleParams{}).Times(2)
+	gomock.InOrder(
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(nil, errors.New("delete API error")),
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil),
+	)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, nil, mockVM, mockNetwork, mockFirewall, service)
+	nodes := []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+	var retryErr *cloudproviderapi.RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("err = %v, want a RetryError", err)
+	}
+
+	// The requeued reconcile of the unchanged service deletes the old rule and clears the error of the port.
+	status, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status == nil || len(status.Ingress) != 1 {
+		t.Fatalf("status = %v, want a single ingress", status)
+	}
+	if want := []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}; !cmp.Equal(status.Ingress[0].Ports, want) {
+		t.Errorf("port status = %+v, want %+v", status.Ingress[0].Ports, want)
+	}
+}
+
+func TestEnsureLoadBalancerRetriesReleasingUncheckedIP(t *testing.T) {
+	setupFastIPReleaseBackoff(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupVerifyHosts(mockVM)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+	mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+		Id: "ip-1", Ipaddress: "10.0.0.1",
+	}, nil)
+
+	// The rules of the new IP cannot be listed, so the IP is released; the first attempt fails transiently.
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("list API error"))
+	mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}).Times(2)
+	gomock.InOrder(
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(nil, errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4250): resource unavailable")),
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
+	)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+	setupResourceTags(ctrl, cs, "PublicIpAddress")
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+	if err == nil || !strings.Contains(err.Error(), "list API error") {
+		t.Fatalf("err = %v, want the error of listing the rules", err)
+	}
+	if got, ok := service.Annotations[ServiceAnnotationLoadBalancerAddress]; ok {
+		t.Errorf("address annotation = %q, want the released IP not to be recorded", got)
+	}
+
+	close(recorder.Events)
+	for event := range recorder.Events {
+		if strings.Contains(event, "ReleasingLoadBalancerIPFailed") {
+			t.Errorf("unexpected event %q, the IP was released on the second attempt", event)
+		}
+	}
+}
+
+func TestEnsureLoadBalancerReportsLeakedUncheckedIP(t *testing.T) {
+	setupFastIPReleaseBackoff(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+	setupGetLoadBalancerByNameEmpty(mockLB)
+	setupVerifyHosts(mockVM)
+	mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+	mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+	mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+		Id: "ip-1", Ipaddress: "10.0.0.1",
+	}, nil)
+
+	// The rules of the new IP cannot be listed, so the IP is released, which fails permanently.
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(nil, errors.New("list API error"))
+	mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{})
+	mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).
+		Return(nil, errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): release failed"))
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Ports:           []corev1.ServicePort{{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP}},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	cs := newTestCSCloud(mockLB, mockAddress, mockVM, mockNetwork, mockFirewall, service)
+	setupResourceTags(ctrl, cs, "PublicIpAddress")
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+
+	before := publicIPOperationCount(t, publicIPOperationReleaseFailed, "")
+	_, err := cs.EnsureLoadBalancer(t.Context(), "cluster", service, []*corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}})
+	if err == nil || !strings.Contains(err.Error(), "list API error") {
+		t.Fatalf("err = %v, want the error of listing the rules", err)
+	}
+	if got := publicIPOperationCount(t, publicIPOperationReleaseFailed, "") - before; got != 1 {
+		t.Errorf("release_failed counter increased by %v, want 1", got)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "ReleasingLoadBalancerIPFailed") || !strings.Contains(event, "10.0.0.1") {
+			t.Errorf("event = %q, want ReleasingLoadBalancerIPFailed for 10.0.0.1", event)
+		}
+	default:
+		t.Error("expected a ReleasingLoadBalancerIPFailed event")
+	}
+}
@@ -20,13 +20,34 @@
 package cloudstack
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/klog/v2"
 )
 
 const testClusterName = "testCluster"
@@ -63,6 +84,1279 @@ func TestReadConfig(t *testing.T) {
 	}
 }
 
+func TestReadConfigAnnotationDefaults(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`
+ [Global]
+ api-url    = https://cloudstack.url
+ api-key    = a-valid-api-key
+ secret-key = a-valid-secret-key
+
+ [annotation-default "service.beta.kubernetes.io/cloudstack-load-balancer-proxy-protocol"]
+ value = true
+
+ [annotation-default "service.beta.kubernetes.io/load-balancer-source-ranges"]
+ value = 10.0.0.0/8,192.168.0.0/16
+ `))
+	if err != nil {
+		t.Fatalf("Should succeed when a valid config is provided: %v", err)
+	}
+
+	defaults, err := parseAnnotationDefaults(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := defaults[ServiceAnnotationLoadBalancerProxyProtocol]; got != "true" {
+		t.Errorf("proxy-protocol default = %q, want %q", got, "true")
+	}
+	if got := defaults[corev1.AnnotationLoadBalancerSourceRangesKey]; got != "10.0.0.0/8,192.168.0.0/16" {
+		t.Errorf("source-ranges default = %q, want %q", got, "10.0.0.0/8,192.168.0.0/16")
+	}
+
+	cfg, err = readConfig(strings.NewReader(`
+ [annotation-default "service.beta.kubernetes.io/cloudstack-load-balancer-address"]
+ value = 203.0.113.10
+ `))
+	if err != nil {
+		t.Fatalf("Should succeed when a valid config is provided: %v", err)
+	}
+	if _, err := parseAnnotationDefaults(cfg); err == nil {
+		t.Errorf("expected an error when defaulting a managed annotation")
+	}
+}
+
+func TestNewCSCloudNodeSelector(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cfg.LoadBalancer.NodeSelector = "pool=ingress,!drain"
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.nodeSelector == nil || cs.nodeSelector.String() != "!drain,pool=ingress" {
+		t.Errorf("nodeSelector = %v, want %q", cs.nodeSelector, "!drain,pool=ingress")
+	}
+
+	cfg.LoadBalancer.NodeSelector = "pool in (ingress"
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "node-selector") {
+		t.Errorf("expected a node-selector error, got %v", err)
+	}
+}
+
+func TestNewCSCloudVMCacheTTL(t *testing.T) {
+	tests := []struct {
+		ttl       string
+		wantCache bool
+		wantErr   bool
+	}{
+		{ttl: ""},
+		{ttl: "0s"},
+		{ttl: "5s", wantCache: true},
+		{ttl: "-1s", wantErr: true},
+		{ttl: "five", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cfg := &CSConfig{}
+		cfg.Global.APIURL = "https://cloudstack.url"
+		cfg.Global.APIKey = "a-valid-api-key"
+		cfg.Global.SecretKey = "a-valid-secret-key"
+		cfg.LoadBalancer.VMCacheTTL = tt.ttl
+
+		cs, err := newCSCloud(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("vm-cache-ttl %q: error = %v, wantErr %v", tt.ttl, err, tt.wantErr)
+
+			continue
+		}
+		if err == nil && (cs.vmCache != nil) != tt.wantCache {
+			t.Errorf("vm-cache-ttl %q: cache enabled = %v, want %v", tt.ttl, cs.vmCache != nil, tt.wantCache)
+		}
+	}
+}
+
+func TestNewCSCloudVerifyHostsRetries(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.verifyHostsRetries != 0 || cs.verifyHostsRetryDelay != defaultVerifyHostsRetryDelay {
+		t.Errorf("retries = %d, delay = %v, want 0 and %v", cs.verifyHostsRetries, cs.verifyHostsRetryDelay, defaultVerifyHostsRetryDelay)
+	}
+
+	cfg.LoadBalancer.VerifyHostsRetries = 3
+	cfg.LoadBalancer.VerifyHostsRetryDelay = "500ms"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.verifyHostsRetries != 3 || cs.verifyHostsRetryDelay != 500*time.Millisecond {
+		t.Errorf("retries = %d, delay = %v, want 3 and 500ms", cs.verifyHostsRetries, cs.verifyHostsRetryDelay)
+	}
+
+	cfg.LoadBalancer.VerifyHostsRetries = -1
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for negative retries")
+	}
+}
+
+func TestNewCSCloudHostMatching(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.hostMatching != nil {
+		t.Errorf("hostMatching = %v, want nil", cs.hostMatching)
+	}
+
+	cfg.LoadBalancer.HostMatching = "ip, label,name"
+	cfg.LoadBalancer.HostMatchingLabel = "example.com/vm-id"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"ip", "label", "name"}; !slices.Equal(cs.hostMatching, want) || cs.hostMatchingLabel != "example.com/vm-id" {
+		t.Errorf("hostMatching = %v, label = %q, want %v and example.com/vm-id", cs.hostMatching, cs.hostMatchingLabel, want)
+	}
+
+	for _, tt := range []struct{ matching, label string }{
+		{matching: "hostname"},
+		{matching: "ip,ip"},
+		{matching: "ip,"},
+		{matching: "label"},
+		{matching: "ip", label: "example.com/vm-id"},
+	} {
+		cfg.LoadBalancer.HostMatching = tt.matching
+		cfg.LoadBalancer.HostMatchingLabel = tt.label
+		if _, err := newCSCloud(cfg); err == nil {
+			t.Errorf("expected an error for host-matching %q and host-matching-label %q", tt.matching, tt.label)
+		}
+	}
+}
+
+func TestNewCSCloudEmptyNodes(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	for value, want := range map[string]string{"": emptyNodesKeep, "keep": emptyNodesKeep, "remove": emptyNodesRemove} {
+		cfg.LoadBalancer.EmptyNodes = value
+		cs, err := newCSCloud(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", value, err)
+		}
+		if cs.emptyNodes != want {
+			t.Errorf("emptyNodes for %q = %q, want %q", value, cs.emptyNodes, want)
+		}
+	}
+
+	cfg.LoadBalancer.EmptyNodes = "drain"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for empty-nodes %q", cfg.LoadBalancer.EmptyNodes)
+	}
+}
+
+func TestNewCSCloudIPSharing(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	for value, want := range map[string]string{"": ipSharingAllow, "allow": ipSharingAllow, "deny": ipSharingDeny} {
+		cfg.LoadBalancer.IPSharing = value
+		cs, err := newCSCloud(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", value, err)
+		}
+		if cs.ipSharing != want {
+			t.Errorf("ipSharing for %q = %q, want %q", value, cs.ipSharing, want)
+		}
+	}
+
+	cfg.LoadBalancer.IPSharing = "always"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for ip-sharing %q", cfg.LoadBalancer.IPSharing)
+	}
+}
+
+func TestNewCSCloudDefaultAlgorithm(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	for value, want := range map[string]string{"": "roundrobin", "leastconn": "leastconn", "source": "source"} {
+		cfg.LoadBalancer.DefaultAlgorithm = value
+		cs, err := newCSCloud(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", value, err)
+		}
+		if cs.defaultAlgorithm != want {
+			t.Errorf("defaultAlgorithm for %q = %q, want %q", value, cs.defaultAlgorithm, want)
+		}
+	}
+
+	cfg.LoadBalancer.DefaultAlgorithm = "random"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for default-algorithm %q", cfg.LoadBalancer.DefaultAlgorithm)
+	}
+}
+
+func TestNewCSCloudOwnerTag(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key, value := cs.ownerTag("prod"); key != firewallRuleOwnerTagKey || value != firewallRuleOwnerTagValue {
+		t.Errorf("ownerTag() = %q, %q, want the default tag", key, value)
+	}
+
+	cfg.LoadBalancer.OwnerTagKey = "managed-by"
+	cfg.LoadBalancer.OwnerTagValue = "ccm-{cluster}"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key, value := cs.ownerTag("prod"); key != "managed-by" || value != "ccm-prod" {
+		t.Errorf("ownerTag() = %q, %q, want %q, %q", key, value, "managed-by", "ccm-prod")
+	}
+
+	cfg.LoadBalancer.PreviousOwnerTags = "created-by=cloudstack-kubernetes-provider, owner={cluster}"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []cloudstack.Tags{{Key: firewallRuleOwnerTagKey, Value: firewallRuleOwnerTagValue}, {Key: "owner", Value: "prod"}}
+	if got := cs.previousOwnerTagsOf("prod"); !reflect.DeepEqual(got, want) {
+		t.Errorf("previousOwnerTagsOf() = %v, want %v", got, want)
+	}
+	for _, value := range []string{"owner", "owner=", "=prod", serviceClusterTagKey + "=prod"} {
+		cfg.LoadBalancer.PreviousOwnerTags = value
+		if _, err := newCSCloud(cfg); err == nil {
+			t.Errorf("expected an error for previous-owner-tags %q", value)
+		}
+	}
+	cfg.LoadBalancer.PreviousOwnerTags = ""
+
+	// Propagated tags must not overwrite the owner tag.
+	cfg.LoadBalancer.TagLabels = "managed-by"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a propagated label with the owner tag key")
+	}
+
+	cfg.LoadBalancer.TagLabels = ""
+	cfg.LoadBalancer.OwnerTagKey = serviceClusterTagKey
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for owner-tag-key %q", cfg.LoadBalancer.OwnerTagKey)
+	}
+}
+
+func TestNewCSCloudNetworkMismatch(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.networkMismatchRetryDelay != 0 || cs.networkMismatchTimeout != 0 {
+		t.Errorf("retry delay = %v, timeout = %v, want both unset", cs.networkMismatchRetryDelay, cs.networkMismatchTimeout)
+	}
+
+	cfg.LoadBalancer.NetworkMismatchTimeout = "1h"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a timeout without retry delay")
+	}
+
+	cfg.LoadBalancer.NetworkMismatchRetryDelay = "30s"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.networkMismatchRetryDelay != 30*time.Second || cs.networkMismatchTimeout != time.Hour {
+		t.Errorf("retry delay = %v, timeout = %v, want 30s and 1h", cs.networkMismatchRetryDelay, cs.networkMismatchTimeout)
+	}
+}
+
+func TestNewCSCloudFirewallOnNetworkError(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.AssumeFirewallOnNetworkError = true
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cs.assumeFirewallOnNetworkError {
+		t.Errorf("assume-firewall-on-network-error is not set")
+	}
+
+	cfg.LoadBalancer.SkipFirewallOnNetworkError = true
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for both skip-firewall-on-network-error and assume-firewall-on-network-error")
+	}
+}
+
+func TestNewCSCloudAllowedProtocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []LoadBalancerProtocol
+		wantErr bool
+	}{
+		{name: "all protocols by default"},
+		{name: "tcp only", value: "tcp", want: []LoadBalancerProtocol{LoadBalancerProtocolTCP}},
+		{name: "duplicates and spaces", value: " tcp, tcp-proxy ,tcp", want: []LoadBalancerProtocol{LoadBalancerProtocolTCP, LoadBalancerProtocolTCPProxy}},
+		{name: "unknown protocol", value: "tcp,sctp", wantErr: true},
+		{name: "empty entry", value: "tcp,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{}
+			cfg.Global.APIURL = "https://cloudstack.url"
+			cfg.Global.APIKey = "a-valid-api-key"
+			cfg.Global.SecretKey = "a-valid-secret-key"
+			cfg.LoadBalancer.AllowedProtocols = tt.value
+
+			cs, err := newCSCloud(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for allowed-protocols %q", tt.value)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(cs.allowedProtocols, tt.want) {
+				t.Errorf("allowed protocols = %v, want %v", cs.allowedProtocols, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCSCloudHostVMStates(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.hostVMStates != nil {
+		t.Errorf("host VM states = %v, want all states by default", cs.hostVMStates)
+	}
+
+	cfg.LoadBalancer.HostVMStates = "Running, Migrating"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"Running", "Migrating"}; !slices.Equal(cs.hostVMStates, want) {
+		t.Errorf("host VM states = %v, want %v", cs.hostVMStates, want)
+	}
+
+	cfg.LoadBalancer.HostVMStates = "Running,,Migrating"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for an empty state")
+	}
+}
+
+func TestNewCSCloudDisableIPAssociation(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.DisableIPAssociation = true
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cs.disableIPAssociation {
+		t.Errorf("disable-ip-association is not set")
+	}
+	if !cs.disableIPRelease {
+		t.Errorf("disable-ip-association must keep the IPs of the pool allocated")
+	}
+}
+
+func TestNewCSCloudCapacityReserve(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.CapacityReserve = 3
+
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "requires capacity-check") {
+		t.Errorf("error = %v, want capacity-reserve to require capacity-check", err)
+	}
+
+	cfg.LoadBalancer.CapacityCheck = true
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.capacityReserve != 3 {
+		t.Errorf("capacity reserve = %d, want 3", cs.capacityReserve)
+	}
+
+	cfg.LoadBalancer.CapacityReserve = -1
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a negative capacity-reserve")
+	}
+}
+
+func TestNewCSCloudHostBatchSize(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.HostBatchSize = 50
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.hostBatchSize != 50 {
+		t.Errorf("host batch size = %d, want 50", cs.hostBatchSize)
+	}
+
+	cfg.LoadBalancer.HostBatchSize = -1
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a negative host-batch-size")
+	}
+}
+
+func TestNewCSCloudIPSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection string
+		pool      string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: ipSelectionCloudStack},
+		{name: "lowest", selection: "lowest", want: ipSelectionLowest},
+		{name: "pool", selection: "pool", pool: "vlan://100", want: ipSelectionPool},
+		{name: "pool without VLAN", selection: "pool", wantErr: true},
+		{name: "VLAN without pool", selection: "lowest", pool: "vlan://100", wantErr: true},
+		{name: "unknown strategy", selection: "random", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{}
+			cfg.Global.APIURL = "https://cloudstack.url"
+			cfg.Global.APIKey = "a-valid-api-key"
+			cfg.Global.SecretKey = "a-valid-secret-key"
+			cfg.LoadBalancer.IPSelection = tt.selection
+			cfg.LoadBalancer.IPPool = tt.pool
+
+			cs, err := newCSCloud(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cs.ipSelection != tt.want || cs.ipPool != tt.pool {
+				t.Errorf("ip selection = %q, %q, want %q, %q", cs.ipSelection, cs.ipPool, tt.want, tt.pool)
+			}
+		})
+	}
+}
+
+func TestNewCSCloudRetryBackoff(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.CapacityRetryDelay = "1m"
+	cfg.LoadBalancer.CapacityRetryMaxDelay = "30m"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := cs.retryBackoffs[retryClassCapacity], (retryBackoff{delay: time.Minute, maxDelay: 30 * time.Minute}); got != want {
+		t.Errorf("capacity backoff = %v, want %v", got, want)
+	}
+	if _, ok := cs.retryBackoffs[retryClassUnavailable]; ok {
+		t.Errorf("unavailable backoff is set without unavailable-retry-delay")
+	}
+
+	// Without the options, capacity failures are requeued after a minute, and unavailable ones after the probe
+	// interval of api-failure-backoff when api-failure-threshold is set.
+	cfg.LoadBalancer.CapacityRetryDelay = ""
+	cfg.LoadBalancer.CapacityRetryMaxDelay = ""
+	cfg.Global.APIFailureThreshold = 3
+	cfg.Global.APIFailureBackoff = "2m"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := cs.retryBackoffs[retryClassCapacity], (retryBackoff{delay: defaultCapacityRetryDelay, maxDelay: defaultRetryMaxDelay}); got != want {
+		t.Errorf("default capacity backoff = %v, want %v", got, want)
+	}
+	if got, want := cs.retryBackoffs[retryClassUnavailable], (retryBackoff{delay: 2 * time.Minute, maxDelay: defaultRetryMaxDelay}); got != want {
+		t.Errorf("default unavailable backoff = %v, want %v", got, want)
+	}
+
+	// A delay of 0 leaves the class to the backoff of the service controller.
+	cfg.LoadBalancer.CapacityRetryDelay = "0"
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cs.retryBackoffs[retryClassCapacity]; ok {
+		t.Errorf("capacity backoff is set with capacity-retry-delay 0")
+	}
+	cfg.Global.APIFailureThreshold = 0
+
+	cfg.LoadBalancer.UnavailableRetryMaxDelay = "1m"
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for unavailable-retry-max-delay without unavailable-retry-delay")
+	}
+}
+
+func TestNewCSCloudSelfTest(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.SelfTestNetworkID = "net-test"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.selfTestNetworkID != "" {
+		t.Errorf("self-test network = %q, want none without self-test", cs.selfTestNetworkID)
+	}
+
+	cfg.LoadBalancer.SelfTest = true
+	cs, err = newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cs.selfTestNetworkID != "net-test" {
+		t.Errorf("self-test network = %q, want net-test", cs.selfTestNetworkID)
+	}
+
+	cfg.LoadBalancer.SelfTestNetworkID = ""
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a self-test without network")
+	}
+}
+
+func TestNewCSCloudDefaultSourceRanges(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.DefaultSourceRangesTCP = "10.0.0.0/8,192.168.0.0/16"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := cs.defaultSourceRanges[ProtoTCP], []string{"10.0.0.0/8", "192.168.0.0/16"}; !compareStringSlice(got, want) {
+		t.Errorf("tcp default source ranges = %v, want %v", got, want)
+	}
+	if got := cs.defaultSourceRanges[ProtoUDP]; got != nil {
+		t.Errorf("udp default source ranges = %v, want none", got)
+	}
+
+	cfg.LoadBalancer.DefaultSourceRangesUDP = "10.0.0.0/8,not-a-cidr"
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "default-source-ranges-udp") {
+		t.Errorf("err = %v, want an error for the invalid udp default source ranges", err)
+	}
+}
+
+func TestNewCSCloudNameScheme(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = "https://cloudstack.url"
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.NamePrefix = "lb_"
+	cfg.LoadBalancer.NameHashSuffix = true
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (NameScheme{Prefix: "lb_", HashSuffix: true}); cs.nameScheme != want {
+		t.Errorf("nameScheme = %+v, want %+v", cs.nameScheme, want)
+	}
+
+	cfg.LoadBalancer.NameSeparator = "-"
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "name-separator") {
+		t.Errorf("err = %v, want an error for the invalid name separator", err)
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("apiKey") != "new-api-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"listzonesresponse":{"errorcode":401,"errortext":"unable to verify user credentials"}}`))
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"listzonesresponse":{"count":0}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "old-api-key"
+	cfg.Global.SecretKey = "old-secret-key"
+	cfg.Global.CredentialsSecret = "kube-system/cloudstack-credentials"
+
+	newCloud := func(t *testing.T, apiKey string) (*CSCloud, *record.FakeRecorder) {
+		t.Helper()
+
+		cs, err := newCSCloud(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		recorder := record.NewFakeRecorder(10)
+		cs.eventRecorder = recorder
+		cs.kclient = fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cloudstack-credentials"},
+			Data: map[string][]byte{
+				"api-key":    []byte(apiKey),
+				"secret-key": []byte("new-secret-key"),
+			},
+		})
+
+		return cs, recorder
+	}
+
+	t.Run("valid credentials replace the client", func(t *testing.T) {
+		calls.Store(0)
+		cs, recorder := newCloud(t, "new-api-key")
+		old := cs.apiClient()
+
+		if err := cs.refreshCredentials(t.Context()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cs.apiClient() == old {
+			t.Errorf("client was not replaced")
+		}
+		if event := <-recorder.Events; !strings.Contains(event, "CloudStackCredentialsRotated") {
+			t.Errorf("event = %q, want CloudStackCredentialsRotated", event)
+		}
+
+		// Unchanged credentials are not verified again.
+		if err := cs.refreshCredentials(t.Context()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("API calls = %d, want 1", got)
+		}
+	})
+
+	t.Run("invalid credentials keep the client", func(t *testing.T) {
+		cs, recorder := newCloud(t, "wrong-api-key")
+		old := cs.apiClient()
+
+		if err := cs.refreshCredentials(t.Context()); err == nil {
+			t.Fatalf("expected an error for invalid credentials")
+		}
+		if cs.apiClient() != old {
+			t.Errorf("client was replaced by one with invalid credentials")
+		}
+		if event := <-recorder.Events; !strings.Contains(event, "Warning InvalidCloudStackCredentials") {
+			t.Errorf("event = %q, want InvalidCloudStackCredentials", event)
+		}
+	})
+
+	t.Run("secret without keys in the cloud config", func(t *testing.T) {
+		calls.Store(0)
+		withoutKeys := *cfg
+		withoutKeys.Global.APIKey = ""
+		withoutKeys.Global.SecretKey = ""
+		cs, err := newCSCloud(&withoutKeys)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cs.apiClient() != nil {
+			t.Fatalf("client is created before the secret was read")
+		}
+		cs.eventRecorder = record.NewFakeRecorder(10)
+		cs.kclient = fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cloudstack-credentials"},
+			Data: map[string][]byte{
+				"api-key":    []byte("new-api-key"),
+				"secret-key": []byte("new-secret-key"),
+			},
+		})
+
+		// Without a client to fall back to, the credentials of the secret are used without verifying them.
+		cs.loadCredentials(t.Context().Done())
+		if cs.apiClient() == nil {
+			t.Fatalf("client was not created from the secret")
+		}
+		if got := calls.Load(); got != 0 {
+			t.Errorf("API calls = %d, want 0", got)
+		}
+
+		withoutSecret := withoutKeys
+		withoutSecret.Global.CredentialsSecret = ""
+		if _, err := newCSCloud(&withoutSecret); err == nil {
+			t.Errorf("expected an error without keys and credentials-secret")
+		}
+	})
+
+	t.Run("invalid secret reference", func(t *testing.T) {
+		invalid := *cfg
+		invalid.Global.CredentialsSecret = "cloudstack-credentials"
+		if _, err := newCSCloud(&invalid); err == nil || !strings.Contains(err.Error(), "credentials-secret") {
+			t.Errorf("err = %v, want an error for the invalid credentials-secret", err)
+		}
+	})
+}
+
+func TestNewCSCloudReconcileEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"listvirtualmachinesresponse":{"count":0}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.LoadBalancer.ReconcileEvents = true
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cs.reconcileEvents {
+		t.Fatalf("reconcileEvents = false, want true")
+	}
+
+	// Each reconcile counts its own calls, also while others run at the same time.
+	var first, second atomic.Int64
+	var wg sync.WaitGroup
+	for count, calls := range map[*atomic.Int64]int{&first: 1, &second: 3} {
+		ctx := withAPICallCounter(t.Context(), count)
+		for range calls {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := cs.listAllVirtualMachines(ctx); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+	}
+	// Calls outside of a reconcile are not counted.
+	if _, err := cs.listAllVirtualMachines(t.Context()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	if got := first.Load(); got != 1 {
+		t.Errorf("first reconcile counted %d API calls, want 1", got)
+	}
+	if got := second.Load(); got != 3 {
+		t.Errorf("second reconcile counted %d API calls, want 3", got)
+	}
+}
+
+func TestNewCSCloudTraceAPICalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("apiKey") != "a-valid-api-key" {
+			t.Errorf("request parameters were not passed on: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"listvirtualmachinesresponse":{"count":1,"virtualmachine":[{"id":"vm-1","password":"vm-secret"}]}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	var logs bytes.Buffer
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	_ = flags.Set("logtostderr", "false")
+	_ = flags.Set("v", strconv.Itoa(apiTraceVerbosity))
+	klog.SetOutput(&logs)
+	t.Cleanup(func() {
+		_ = flags.Set("v", "0")
+		_ = flags.Set("logtostderr", "true")
+	})
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.Global.TraceAPICalls = true
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vms, err := cs.listAllVirtualMachines(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vms) != 1 || vms[0].Id != "vm-1" {
+		t.Errorf("virtual machines = %v, want vm-1", vms)
+	}
+
+	klog.Flush()
+	out := logs.String()
+	for _, want := range []string{"CloudStack API request", "CloudStack API response", "listVirtualMachines", "vm-1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace does not contain %q:\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"a-valid-api-key", "vm-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("trace contains %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "apiKey="+redactedValue) || !strings.Contains(out, "signature="+redactedValue) {
+		t.Errorf("trace does not contain the redacted credentials:\n%s", out)
+	}
+}
+
+func TestNewCSCloudHTMLResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		want        string
+	}{
+		{
+			name:        "proxy error page",
+			contentType: "text/html; charset=utf-8",
+			status:      http.StatusBadGateway,
+			body:        "<html><head><title>502 Bad Gateway</title></head><body><h1>502 Bad Gateway</h1></body></html>",
+			want:        `status 502 Bad Gateway and the page "502 Bad Gateway"`,
+		},
+		{
+			name:        "login page served as JSON",
+			contentType: "application/json",
+			status:      http.StatusOK,
+			body:        "\n<!DOCTYPE html>\n<html><head><title>Sign in &amp; continue</title></head></html>",
+			want:        `status 200 OK and the page "Sign in & continue"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(server.Close)
+
+			cfg := &CSConfig{}
+			cfg.Global.APIURL = server.URL
+			cfg.Global.APIKey = "a-valid-api-key"
+			cfg.Global.SecretKey = "a-valid-secret-key"
+
+			cs, err := newCSCloud(cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, err = cs.listAllVirtualMachines(t.Context())
+			if !errors.Is(err, errHTMLResponse) {
+				t.Fatalf("err = %v, want errHTMLResponse", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "check that api-url") {
+				t.Errorf("err = %v, want it to contain %q and advice", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigHTTPClientTimeouts(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`
+ [Global]
+ dial-timeout            = 5s
+ response-header-timeout = 2m
+ `))
+	if err != nil {
+		t.Fatalf("should succeed when a valid config is provided: %v", err)
+	}
+
+	timeouts, err := parseHTTPClientTimeouts(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := httpClientTimeouts{dial: 5 * time.Second, tlsHandshake: defaultTLSHandshakeTimeout, responseHeader: 2 * time.Minute}
+	if timeouts != want {
+		t.Errorf("timeouts = %+v, want %+v", timeouts, want)
+	}
+	if client := newHTTPClient(&tls.Config{}, timeouts, false, false); client.Timeout != 2*time.Minute {
+		t.Errorf("client timeout = %v, want %v", client.Timeout, 2*time.Minute)
+	}
+
+	cfg.Global.TLSHandshakeTimeout = "-1s"
+	if _, err := parseHTTPClientTimeouts(cfg); err == nil {
+		t.Errorf("expected an error for a negative tls-handshake-timeout")
+	}
+}
+
+func TestNewCSCloudResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.Global.ResponseHeaderTimeout = "50ms"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := cs.listAllVirtualMachines(t.Context()); err == nil {
+		t.Fatalf("expected a timeout error")
+	}
+}
+
+func TestNewCSCloudAPIFailureThreshold(t *testing.T) {
+	var requests, status atomic.Int64
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(status.Load()))
+		_, _ = w.Write([]byte(`{"listzonesresponse":{"count":0}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.Global.APIFailureThreshold = 2
+	cfg.Global.APIFailureBackoff = "30s"
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	cs.apiHealth.now = func() time.Time { return now }
+
+	listZones := func() error {
+		_, err := cs.client.Zone.ListZones(cs.client.Zone.NewListZonesParams())
+
+		return err
+	}
+
+	// The first failures reach CloudStack, after that calls fail without being sent.
+	for range 2 {
+		if err := listZones(); err == nil || errors.Is(err, errCloudStackUnavailable) {
+			t.Fatalf("err = %v, want the error of the API", err)
+		}
+	}
+	if err := listZones(); !errors.Is(err, errCloudStackUnavailable) {
+		t.Fatalf("err = %v, want errCloudStackUnavailable", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+
+	// A reconcile failing on the unavailable API does not report itself.
+	recorder := record.NewFakeRecorder(10)
+	cs.eventRecorder = recorder
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+	cs.recordReconcileEvent(service, time.Second, 0, fmt.Errorf("error: %w", errCloudStackUnavailable))
+
+	// After the backoff a single probe is sent, which recovers the API.
+	status.Store(http.StatusOK)
+	now = now.Add(30 * time.Second)
+	if err := listZones(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+
+	cs.recordAPIRecovery(service, nil)
+	cs.recordAPIRecovery(service, nil)
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	if len(events) != 1 || !strings.Contains(events[0], "CloudStackAPIRecovered") {
+		t.Errorf("events = %v, want a single CloudStackAPIRecovered event", events)
+	}
+
+	cfg.Global.APIFailureThreshold = -1
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a negative api-failure-threshold")
+	}
+}
+
+func TestNewCSCloudMaxConcurrentAPICalls(t *testing.T) {
+	registerMetrics()
+
+	received := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received <- struct{}{}
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"listvirtualmachinesresponse":{"count":0}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := &CSConfig{}
+	cfg.Global.APIURL = server.URL
+	cfg.Global.APIKey = "a-valid-api-key"
+	cfg.Global.SecretKey = "a-valid-secret-key"
+	cfg.Global.MaxConcurrentAPICalls = 1
+	cfg.Global.APIFailureThreshold = 1
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first request holds the only slot while the server blocks it.
+	first := make(chan error, 1)
+	go func() {
+		_, err := cs.listAllVirtualMachines(t.Context())
+		first <- err
+	}()
+	<-received
+	if got, _ := testutil.GetGaugeMetricValue(apiRequestsInFlight); got != 1 {
+		t.Errorf("requests in flight = %v, want 1", got)
+	}
+
+	// A second request gives up waiting for a slot once its reconcile is cancelled.
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := cs.listAllVirtualMachines(ctx); err == nil || !strings.Contains(err.Error(), "waiting for a free CloudStack API slot") {
+		t.Errorf("err = %v, want the wait for a slot to end with the reconcile", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the wait for a slot took %v, want it to end with the reconcile", elapsed)
+	}
+	select {
+	case <-received:
+		t.Errorf("the second request reached the server")
+	default:
+	}
+
+	// Closing the response body of the first request frees the slot again. The request that did not get a
+	// slot was not counted as an API failure, so the API is not considered unavailable.
+	close(unblock)
+	if err := <-first; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cs.listAllVirtualMachines(t.Context()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := testutil.GetGaugeMetricValue(apiRequestsInFlight); got != 0 {
+		t.Errorf("requests in flight = %v, want 0", got)
+	}
+
+	cfg.Global.MaxConcurrentAPICalls = -1
+	if _, err := newCSCloud(cfg); err == nil {
+		t.Errorf("expected an error for a negative max-concurrent-api-calls")
+	}
+}
+
+func TestNewCSCloudCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"listvirtualmachinesresponse":{"count":0}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	newCloud := func(t *testing.T, mutate func(cfg *CSConfig)) (*CSCloud, error) {
+		t.Helper()
+
+		cfg := &CSConfig{}
+		cfg.Global.APIURL = server.URL
+		cfg.Global.APIKey = "a-valid-api-key"
+		cfg.Global.SecretKey = "a-valid-secret-key"
+		mutate(cfg)
+
+		return newCSCloud(cfg)
+	}
+
+	t.Run("untrusted server is rejected", func(t *testing.T) {
+		cs, err := newCloud(t, func(*CSConfig) {})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := cs.listAllVirtualMachines(t.Context()); err == nil {
+			t.Fatalf("expected a certificate verification error")
+		}
+	})
+
+	t.Run("server is trusted with ca-file", func(t *testing.T) {
+		cs, err := newCloud(t, func(cfg *CSConfig) { cfg.Global.CAFile = caFile })
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := cs.listAllVirtualMachines(t.Context()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ca-file without certificates", func(t *testing.T) {
+		emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+		if err := os.WriteFile(emptyFile, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatalf("failed to write CA file: %v", err)
+		}
+		if _, err := newCloud(t, func(cfg *CSConfig) { cfg.Global.CAFile = emptyFile }); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("client certificate without key", func(t *testing.T) {
+		if _, err := newCloud(t, func(cfg *CSConfig) { cfg.Global.ClientCertFile = caFile }); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestReadConfigZoneMapping(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`
+ [zone-mapping "Zone AMS-01"]
+ kubernetes-zone = ams-01
+ region          = eu-west
+
+ [zone-mapping "fra1"]
+ region = eu-central
+ `))
+	if err != nil {
+		t.Fatalf("should succeed when a valid config is provided: %v", err)
+	}
+
+	mapping, err := parseZoneMapping(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]topologyLabels{
+		"Zone AMS-01": {zone: "ams-01", region: "eu-west"},
+		"fra1":        {zone: "fra1", region: "eu-central"},
+	}
+	if !reflect.DeepEqual(mapping, want) {
+		t.Errorf("zone mapping = %v, want %v", mapping, want)
+	}
+
+	cfg.ZoneMapping["fra1"].Region = "eu central"
+	if _, err := parseZoneMapping(cfg); err == nil {
+		t.Errorf("expected an error for an invalid region label")
+	}
+}
+
+func TestValidateZoneMapping(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	client := cloudstack.NewMockClient(ctrl)
+	mockZone := client.Zone.(*cloudstack.MockZoneServiceIface) //nolint:forcetypeassert
+	mockZone.EXPECT().NewListZonesParams().Return(&cloudstack.ListZonesParams{}).Times(2)
+	mockZone.EXPECT().ListZones(gomock.Any()).Return(&cloudstack.ListZonesResponse{
+		Count: 1, Zones: []*cloudstack.Zone{{Name: "ams1"}},
+	}, nil).Times(2)
+
+	cs := &CSCloud{
+		client:      client,
+		zoneMapping: map[string]topologyLabels{"ams1": {zone: "ams-01"}},
+	}
+	missing, err := cs.missingMappedZones()
+	if err != nil || len(missing) != 0 {
+		t.Errorf("missingMappedZones() = %v, %v, want no missing zones", missing, err)
+	}
+
+	cs.zoneMapping["fra1"] = topologyLabels{zone: "fra-01"}
+	missing, err = cs.missingMappedZones()
+	if err != nil || !slices.Equal(missing, []string{"fra1"}) {
+		t.Errorf("missingMappedZones() = %v, %v, want [fra1]", missing, err)
+	}
+}
+
+func TestNewCSCloudZoneMappingWithoutAPI(t *testing.T) {
+	// The zones are validated after the CCM started, so an unavailable API does not stop it.
+	cfg, err := readConfig(strings.NewReader(`
+ [Global]
+ api-url    = https://127.0.0.1:1
+ api-key    = a-valid-api-key
+ secret-key = a-valid-secret-key
+
+ [zone-mapping "ams1"]
+ kubernetes-zone = ams-01
+ `))
+	if err != nil {
+		t.Fatalf("should succeed when a valid config is provided: %v", err)
+	}
+
+	cs, err := newCSCloud(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cs.topologyLabelsForZone("ams1"); got.zone != "ams-01" {
+		t.Errorf("zone of ams1 = %q, want ams-01", got.zone)
+	}
+}
+
 // This allows acceptance testing against an existing CloudStack environment.
 func configFromEnv() (*CSConfig, bool) {
 	cfg := &CSConfig{}
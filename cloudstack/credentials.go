@@ -0,0 +1,209 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultCredentialsRefreshInterval is how often the credentials Secret is read when no interval is configured.
+	defaultCredentialsRefreshInterval = time.Minute
+
+	// credentialsRetryInterval is the interval between attempts to read the credentials Secret at startup, while
+	// there is no client with the keys of the cloud config to fall back to.
+	credentialsRetryInterval = 5 * time.Second
+
+	// The keys of the API key and secret key in the credentials Secret, named like the cloud config options.
+	credentialsSecretAPIKey    = "api-key"
+	credentialsSecretSecretKey = "secret-key"
+)
+
+// credentialsSource reads the CloudStack API credentials from a Kubernetes Secret, so they can be rotated
+// without restarting the controller.
+type credentialsSource struct {
+	namespace string
+	name      string
+	refresh   time.Duration
+
+	// newClient builds a client with the given credentials and the settings of the cloud config.
+	newClient func(apiKey, secretKey string) *cloudstack.CloudStackClient
+
+	// apiKey and secretKey are the credentials of the current client, empty while there is none.
+	apiKey    string
+	secretKey string
+}
+
+// newCredentialsSource parses the namespace/name reference of the credentials Secret.
+func newCredentialsSource(secret, refreshInterval, apiKey, secretKey string, newClient func(apiKey, secretKey string) *cloudstack.CloudStackClient) (*credentialsSource, error) {
+	namespace, name, ok := strings.Cut(secret, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid credentials-secret %q: must be namespace/name", secret)
+	}
+
+	refresh, err := parseDurationOption("credentials-refresh-interval", refreshInterval, defaultCredentialsRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credentialsSource{
+		namespace: namespace,
+		name:      name,
+		refresh:   refresh,
+		newClient: newClient,
+		apiKey:    apiKey,
+		secretKey: secretKey,
+	}, nil
+}
+
+// apiClient returns the current CloudStack client. Callers should use the returned client for all
+// calls that belong together, as the client is replaced when the credentials are rotated.
+func (cs *CSCloud) apiClient() *cloudstack.CloudStackClient {
+	cs.clientMu.RLock()
+	defer cs.clientMu.RUnlock()
+
+	return cs.client
+}
+
+// reconcileClient returns the client for the CloudStack API calls of a reconcile. With reconcile-events or
+// max-concurrent-api-calls, this is a client of its own that sends the requests with ctx, as cloudstack-go
+// builds them without a context: only the calls of this reconcile are counted in the counter of ctx, see
+// withAPICallCounter, and cancelling the reconcile ends the wait for a free API slot. Otherwise it is the
+// current client.
+func (cs *CSCloud) reconcileClient(ctx context.Context) *cloudstack.CloudStackClient {
+	cs.clientMu.RLock()
+	defer cs.clientMu.RUnlock()
+
+	if cs.newContextClient == nil || cs.client == nil {
+		return cs.client
+	}
+
+	return cs.newContextClient(ctx, cs.apiKey, cs.secretKey)
+}
+
+// setAPIClient replaces the CloudStack client with client, which uses apiKey and secretKey.
+func (cs *CSCloud) setAPIClient(client *cloudstack.CloudStackClient, apiKey, secretKey string) {
+	cs.clientMu.Lock()
+	defer cs.clientMu.Unlock()
+
+	cs.client, cs.apiKey, cs.secretKey = client, apiKey, secretKey
+}
+
+// refreshCredentials reads the credentials Secret and replaces the CloudStack client when the credentials
+// changed. The new credentials are verified with a listZones call first; when that fails, the current
+// client is kept and an InvalidCloudStackCredentials warning event is emitted on the Secret. Without a
+// current client, the credentials are used as they are, as there is nothing to fall back to.
+func (cs *CSCloud) refreshCredentials(ctx context.Context) error {
+	source := cs.credentials
+
+	secret, err := cs.kclient.CoreV1().Secrets(source.namespace).Get(ctx, source.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading credentials secret %s/%s: %w", source.namespace, source.name, err)
+	}
+
+	apiKey := strings.TrimSpace(string(secret.Data[credentialsSecretAPIKey]))
+	secretKey := strings.TrimSpace(string(secret.Data[credentialsSecretSecretKey]))
+	if apiKey == "" || secretKey == "" {
+		err := fmt.Errorf("credentials secret %s/%s must contain %q and %q", source.namespace, source.name, credentialsSecretAPIKey, credentialsSecretSecretKey)
+		cs.eventRecorder.Event(secret, corev1.EventTypeWarning, "InvalidCloudStackCredentials", err.Error())
+
+		return err
+	}
+	if apiKey == source.apiKey && secretKey == source.secretKey {
+		return nil
+	}
+
+	client := source.newClient(apiKey, secretKey)
+	if cs.apiClient() == nil {
+		cs.setAPIClient(client, apiKey, secretKey)
+		source.apiKey, source.secretKey = apiKey, secretKey
+		klog.Infof("Using the CloudStack credentials of secret %s/%s", source.namespace, source.name)
+
+		return nil
+	}
+	if _, err := client.Zone.ListZones(client.Zone.NewListZonesParams()); err != nil {
+		err = fmt.Errorf("keeping the current CloudStack credentials, the credentials in secret %s/%s failed: %w", source.namespace, source.name, err)
+		cs.eventRecorder.Event(secret, corev1.EventTypeWarning, "InvalidCloudStackCredentials", err.Error())
+
+		return err
+	}
+
+	cs.setAPIClient(client, apiKey, secretKey)
+	source.apiKey, source.secretKey = apiKey, secretKey
+
+	klog.Infof("Switched to the CloudStack credentials of secret %s/%s", source.namespace, source.name)
+	cs.eventRecorder.Event(secret, corev1.EventTypeNormal, "CloudStackCredentialsRotated", "Switched to the CloudStack credentials of this secret")
+
+	return nil
+}
+
+// loadCredentials reads the credentials Secret before the first CloudStack API call. Without api-key and
+// secret-key in the cloud config there is no client until the Secret was read, so reading it is retried
+// until it succeeds or stop is closed; otherwise the keys of the cloud config are used after a failure.
+func (cs *CSCloud) loadCredentials(stop <-chan struct{}) {
+	_ = wait.PollUntilContextCancel(wait.ContextForChannel(stop), credentialsRetryInterval, true, func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, cs.credentials.refresh)
+		defer cancel()
+
+		err := cs.refreshCredentials(ctx)
+		switch {
+		case err == nil:
+			return true, nil
+		case cs.apiClient() != nil:
+			klog.Errorf("Error reading the CloudStack credentials, using those of the cloud config: %v", err)
+
+			return true, nil
+		default:
+			klog.Errorf("Error reading the CloudStack credentials, retrying in %v: %v", credentialsRetryInterval, err)
+
+			return false, nil
+		}
+	})
+}
+
+// watchCredentials reads the credentials Secret every refresh interval until stop is closed. The first read is
+// done by loadCredentials.
+func (cs *CSCloud) watchCredentials(stop <-chan struct{}) {
+	ticker := time.NewTicker(cs.credentials.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cs.credentials.refresh)
+		if err := cs.refreshCredentials(ctx); err != nil {
+			klog.Errorf("Error refreshing the CloudStack credentials: %v", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	metricsNamespace = "cloudstack"
+
+	// Values for the operation label of publicIPOperations.
+	publicIPOperationAllocate = "allocate"
+	publicIPOperationRelease  = "release"
+	publicIPOperationReuse    = "reuse"
+
+	// publicIPOperationReleaseFailed counts IPs that could not be released and are not retried
+	// either, and that operators have to release manually.
+	publicIPOperationReleaseFailed = "release_failed"
+)
+
+var (
+	// publicIPOperations counts public IP allocations, releases, failed releases and reuses of existing IPs.
+	// Allocations that keep outgrowing releases indicate leaked IPs.
+	publicIPOperations = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      "loadbalancer",
+			Name:           "public_ip_operations_total",
+			Help:           "Number of public IP addresses allocated, released, failed to release or reused by the load balancer, by project.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "project"},
+	)
+
+	// selfTestSuccess is the result of the load balancer self-test at startup. It is only registered once the
+	// self-test finished, so it is missing while the self-test is disabled or still running, rather than 0.
+	selfTestSuccess = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      "loadbalancer",
+			Name:           "self_test_success",
+			Help:           "Whether the load balancer self-test at startup succeeded (1) or failed (0).",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// apiRequestsInFlight is the number of CloudStack API requests holding a slot of max-concurrent-api-calls.
+	apiRequestsInFlight = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      "api",
+			Name:           "requests_in_flight",
+			Help:           "Number of CloudStack API requests in flight, when max-concurrent-api-calls is set.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// publicIPHeadroom is the number of public IPs left below the public IP limit, as last seen by capacity-check.
+	publicIPHeadroom = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      "loadbalancer",
+			Name:           "public_ip_headroom",
+			Help:           "Number of public IP addresses that can still be allocated before the limit is reached, by project. Only set by capacity-check for limited accounts and projects.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"project"},
+	)
+
+	registerMetricsOnce         sync.Once
+	registerSelfTestSuccessOnce sync.Once
+)
+
+// registerMetrics registers the provider metrics with the legacy registry,
+// which is served by the cloud-controller-manager on its metrics endpoint.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(publicIPOperations)
+		legacyregistry.MustRegister(apiRequestsInFlight)
+		legacyregistry.MustRegister(publicIPHeadroom)
+	})
+}
+
+// recordPublicIPOperation increments the public IP counter for the given operation and project.
+func recordPublicIPOperation(operation, projectID string) {
+	publicIPOperations.WithLabelValues(operation, projectID).Inc()
+}
+
+// recordSelfTestResult registers the self-test gauge and sets it to the result of the self-test.
+func recordSelfTestResult(success bool) {
+	registerSelfTestSuccessOnce.Do(func() { legacyregistry.MustRegister(selfTestSuccess) })
+
+	if success {
+		selfTestSuccess.Set(1)
+	} else {
+		selfTestSuccess.Set(0)
+	}
+}
+
+// recordPublicIPHeadroom sets the number of public IPs left below the limit of the project.
+func recordPublicIPHeadroom(projectID string, headroom int64) {
+	publicIPHeadroom.WithLabelValues(projectID).Set(float64(headroom))
+}
+
+// forgetPublicIPHeadroom removes the headroom of a project without a public IP limit.
+func forgetPublicIPHeadroom(projectID string) {
+	publicIPHeadroom.DeleteLabelValues(projectID)
+}
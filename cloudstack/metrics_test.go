@@ -0,0 +1,136 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func publicIPOperationCount(t *testing.T, operation, projectID string) float64 {
+	t.Helper()
+
+	v, err := testutil.GetCounterMetricValue(publicIPOperations.WithLabelValues(operation, projectID))
+	if err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+
+	return v
+}
+
+func TestPublicIPOperationMetrics(t *testing.T) {
+	registerMetrics()
+
+	t.Run("allocation is counted", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-1", Ipaddress: "10.0.0.1",
+		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB, Address: mockAddress, Network: mockNetwork, Firewall: mockFirewall},
+			networkID:        "net-1",
+			projectID:        "metrics-allocate",
+		}
+
+		before := publicIPOperationCount(t, publicIPOperationAllocate, "metrics-allocate")
+		if err := lb.associatePublicIPAddress(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := publicIPOperationCount(t, publicIPOperationAllocate, "metrics-allocate") - before; got != 1 {
+			t.Errorf("allocate counter increased by %v, want 1", got)
+		}
+	})
+
+	t.Run("release is counted only on success", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		gomock.InOrder(
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}),
+			mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(nil, errors.New("release failed")),
+			mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(&cloudstack.DisassociateIpAddressParams{}),
+			mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "10.0.0.1",
+			ipAddrID:         "ip-1",
+			projectID:        "metrics-release",
+		}
+
+		before := publicIPOperationCount(t, publicIPOperationRelease, "metrics-release")
+		if err := lb.releaseLoadBalancerIP(); err == nil {
+			t.Fatalf("expected error")
+		}
+		if got := publicIPOperationCount(t, publicIPOperationRelease, "metrics-release") - before; got != 0 {
+			t.Errorf("release counter increased by %v after a failed release, want 0", got)
+		}
+		if err := lb.releaseLoadBalancerIP(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := publicIPOperationCount(t, publicIPOperationRelease, "metrics-release") - before; got != 1 {
+			t.Errorf("release counter increased by %v, want 1", got)
+		}
+	})
+
+	t.Run("already allocated IP is counted as reuse", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Id: "ip-1", Ipaddress: "10.0.0.1", Allocated: "2023-01-01"},
+			},
+		}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			projectID:        "metrics-reuse",
+		}
+
+		before := publicIPOperationCount(t, publicIPOperationReuse, "metrics-reuse")
+		if err := lb.getPublicIPAddress("10.0.0.1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := publicIPOperationCount(t, publicIPOperationReuse, "metrics-reuse") - before; got != 1 {
+			t.Errorf("reuse counter increased by %v, want 1", got)
+		}
+	})
+}
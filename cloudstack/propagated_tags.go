@@ -0,0 +1,174 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxTagLength is the maximum length of the key and the value of a CloudStack resource tag.
+const maxTagLength = 255
+
+// propagatedTag is a service label or annotation that is propagated as a tag onto the rules of the service.
+type propagatedTag struct {
+	// annotation selects the annotation instead of the label with the key.
+	annotation bool
+	key        string
+	// tagKey is the key of the tag, the sanitized key of the label or annotation.
+	tagKey string
+}
+
+// parsePropagatedTags parses the tag-labels and tag-annotations options, comma-separated label and annotation keys.
+// They must not map to the keys of the tags we set ourselves, including ownerTagKey.
+func parsePropagatedTags(labels, annotations, ownerTagKey string) ([]propagatedTag, error) {
+	reserved := append(slices.Clone(serviceTagKeys), ownerTagKey)
+
+	var tags []propagatedTag
+	for _, option := range []struct {
+		name       string
+		value      string
+		annotation bool
+	}{
+		{name: "tag-labels", value: labels},
+		{name: "tag-annotations", value: annotations, annotation: true},
+	} {
+		if strings.TrimSpace(option.value) == "" {
+			continue
+		}
+
+		for key := range strings.SplitSeq(option.value, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				return nil, fmt.Errorf("invalid load balancer %s %q: keys must not be empty", option.name, option.value)
+			}
+
+			tagKey := sanitizeTagKey(key)
+			if slices.Contains(reserved, tagKey) {
+				return nil, fmt.Errorf("invalid load balancer %s %q: tag key %q is used by the provider itself", option.name, option.value, tagKey)
+			}
+			if slices.ContainsFunc(tags, func(t propagatedTag) bool { return t.tagKey == tagKey }) {
+				return nil, fmt.Errorf("invalid load balancer %s %q: more than one key maps to tag key %q", option.name, option.value, tagKey)
+			}
+
+			tags = append(tags, propagatedTag{annotation: option.annotation, key: key, tagKey: tagKey})
+		}
+	}
+
+	return tags, nil
+}
+
+// sanitizeTagKey turns a label or annotation key into a tag key. Characters other than letters, digits,
+// '.', '-' and '_' are replaced by '_', so "example.com/cost-center" becomes "example.com_cost-center",
+// and the key is cut off at maxTagLength.
+func sanitizeTagKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	return truncateTag(key)
+}
+
+// truncateTag cuts a tag key or value off at maxTagLength characters.
+func truncateTag(s string) string {
+	if runes := []rune(s); len(runes) > maxTagLength {
+		return string(runes[:maxTagLength])
+	}
+
+	return s
+}
+
+// propagatedServiceTags returns the tags propagated from the labels and annotations of the service. Labels and
+// annotations that are not set, or set to an empty value, are left out, as CloudStack tags must have a value.
+func (cs *CSCloud) propagatedServiceTags(service *corev1.Service) map[string]string {
+	if len(cs.propagatedTags) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range cs.propagatedTags {
+		source := service.Labels
+		if tag.annotation {
+			source = service.Annotations
+		}
+		if value := source[tag.key]; value != "" {
+			tags[tag.tagKey] = truncateTag(value)
+		}
+	}
+
+	return tags
+}
+
+// reconcilePropagatedTags updates the propagated tags of an existing rule to the current labels and annotations
+// of the service. Tags of keys that are not propagated are left alone. Like the other tags, they are informational,
+// so failures are logged and retried on the next reconcile.
+func (lb *loadBalancer) reconcilePropagatedTags(resourceID, resourceType string, current []cloudstack.Tags) {
+	if len(lb.propagatedTagKeys) == 0 {
+		return
+	}
+
+	currentTags := make(map[string]string, len(current))
+	for _, tag := range current {
+		currentTags[tag.Key] = tag.Value
+	}
+
+	stale := map[string]string{}
+	for _, key := range lb.propagatedTagKeys {
+		value, ok := currentTags[key]
+		if ok && value != lb.propagatedTags[key] {
+			stale[key] = value
+		}
+	}
+	missing := map[string]string{}
+	for key, value := range lb.propagatedTags {
+		if currentTags[key] != value {
+			missing[key] = value
+		}
+	}
+
+	// A tag cannot be overwritten, so a changed tag is deleted before it is created again.
+	if len(stale) > 0 {
+		klog.V(4).Infof("Deleting propagated tags %v of %v %v", slices.Sorted(maps.Keys(stale)), resourceType, resourceID)
+		p := lb.Resourcetags.NewDeleteTagsParams([]string{resourceID}, resourceType)
+		p.SetTags(stale)
+		if _, err := lb.Resourcetags.DeleteTags(p); err != nil {
+			klog.Warningf("Error deleting propagated tags of %v %v: %v", resourceType, resourceID, err)
+
+			return
+		}
+	}
+	if len(missing) > 0 {
+		klog.V(4).Infof("Creating propagated tags %v of %v %v", slices.Sorted(maps.Keys(missing)), resourceType, resourceID)
+		p := lb.Resourcetags.NewCreateTagsParams([]string{resourceID}, resourceType, missing)
+		if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+			klog.Warningf("Error creating propagated tags of %v %v: %v", resourceType, resourceID, err)
+		}
+	}
+}
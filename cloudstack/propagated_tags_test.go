@@ -0,0 +1,194 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParsePropagatedTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      string
+		annotations string
+		want        []propagatedTag
+		wantErr     string
+	}{
+		{name: "empty"},
+		{
+			name:        "labels and annotations",
+			labels:      "cost-center, team",
+			annotations: "example.com/data-classification",
+			want: []propagatedTag{
+				{key: "cost-center", tagKey: "cost-center"},
+				{key: "team", tagKey: "team"},
+				{annotation: true, key: "example.com/data-classification", tagKey: "example.com_data-classification"},
+			},
+		},
+		{name: "empty key", labels: "cost-center,", wantErr: "keys must not be empty"},
+		{name: "reserved key", annotations: serviceNameTagKey, wantErr: "used by the provider itself"},
+		{name: "owner tag key", labels: firewallRuleOwnerTagKey, wantErr: "used by the provider itself"},
+		{name: "duplicate tag key", labels: "team", annotations: "team", wantErr: "more than one key"},
+		{name: "duplicate after sanitizing", labels: "example.com/team,example.com_team", wantErr: "more than one key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePropagatedTags(tt.labels, tt.annotations, firewallRuleOwnerTagKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePropagatedTags() error = %v, want containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePropagatedTags() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePropagatedTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeTagKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"cost-center", "cost-center"},
+		{"example.com/cost-center", "example.com_cost-center"},
+		{"a b:c", "a_b_c"},
+		{strings.Repeat("k", 300), strings.Repeat("k", maxTagLength)},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeTagKey(tt.key); got != tt.want {
+			t.Errorf("sanitizeTagKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPropagatedServiceTags(t *testing.T) {
+	cs := &CSCloud{propagatedTags: []propagatedTag{
+		{key: "cost-center", tagKey: "cost-center"},
+		{key: "team", tagKey: "team"},
+		{annotation: true, key: "example.com/data-classification", tagKey: "example.com_data-classification"},
+	}}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"cost-center": strings.Repeat("v", 300), "team": ""},
+			Annotations: map[string]string{
+				"example.com/data-classification": "internal",
+				"cost-center":                     "ignored",
+			},
+		},
+	}
+
+	want := map[string]string{
+		"cost-center":                     strings.Repeat("v", maxTagLength),
+		"example.com_data-classification": "internal",
+	}
+	if got := cs.propagatedServiceTags(service); !reflect.DeepEqual(got, want) {
+		t.Errorf("propagatedServiceTags() = %v, want %v", got, want)
+	}
+}
+
+func TestReconcilePropagatedTags(t *testing.T) {
+	t.Run("nothing configured", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Resourcetags: cloudstack.NewMockResourcetagsServiceIface(ctrl)},
+		}
+		lb.reconcilePropagatedTags("rule-1", "LoadBalancer", []cloudstack.Tags{{Key: "other", Value: "x"}})
+	})
+
+	t.Run("up-to-date tags are left alone", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		lb := &loadBalancer{
+			CloudStackClient:  &cloudstack.CloudStackClient{Resourcetags: cloudstack.NewMockResourcetagsServiceIface(ctrl)},
+			propagatedTags:    map[string]string{"team": "a"},
+			propagatedTagKeys: []string{"team", "cost-center"},
+		}
+		lb.reconcilePropagatedTags("rule-1", "LoadBalancer", []cloudstack.Tags{{Key: "team", Value: "a"}})
+	})
+
+	t.Run("changed, removed and new tags", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteTagsParams{}
+		gomock.InOrder(
+			mockTags.EXPECT().NewDeleteTagsParams([]string{"fw-1"}, "FirewallRule").Return(deleteParams),
+			mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"fw-1"}, "FirewallRule", map[string]string{
+				"team":        "b",
+				"cost-center": "42",
+			}).Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient:  &cloudstack.CloudStackClient{Resourcetags: mockTags},
+			propagatedTags:    map[string]string{"team": "b", "cost-center": "42"},
+			propagatedTagKeys: []string{"team", "cost-center", "data-classification"},
+		}
+		lb.reconcilePropagatedTags("fw-1", "FirewallRule", []cloudstack.Tags{
+			{Key: serviceNameTagKey, Value: "foo"},
+			{Key: "team", Value: "a"},
+			{Key: "data-classification", Value: "internal"},
+		})
+
+		got, _ := deleteParams.GetTags()
+		if want := map[string]string{"team": "a", "data-classification": "internal"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("deleted tags = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("failed delete skips the create", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewDeleteTagsParams([]string{"rule-1"}, "LoadBalancer").Return(&cloudstack.DeleteTagsParams{})
+		mockTags.EXPECT().DeleteTags(gomock.Any()).Return(nil, errors.New("API error"))
+
+		lb := &loadBalancer{
+			CloudStackClient:  &cloudstack.CloudStackClient{Resourcetags: mockTags},
+			propagatedTags:    map[string]string{"team": "b"},
+			propagatedTagKeys: []string{"team"},
+		}
+		lb.reconcilePropagatedTags("rule-1", "LoadBalancer", []cloudstack.Tags{{Key: "team", Value: "a"}})
+	})
+}
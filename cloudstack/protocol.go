@@ -20,6 +20,11 @@
 package cloudstack
 
 import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -80,23 +85,143 @@ func (p LoadBalancerProtocol) IPProtocol() string {
 //	v1.ProtocolTCP="tcp" + annotation "service.beta.kubernetes.io/cloudstack-load-balancer-proxy-protocol"
 //	                     -> "tcp-proxy" (CloudStack 4.6 and later)
 //
+// The backend protocol annotation "service.beta.kubernetes.io/cloudstack-load-balancer-backend-protocol"
+// overrides the proxy protocol annotation for the ports it lists. The PROXY protocol only applies to TCP: UDP ports
+// ignore the proxy protocol annotation, and are invalid with the proxy backend protocol.
+//
 // Other values return LoadBalancerProtocolInvalid.
+//
+// The protocol does not depend on the IP family of the service. CloudStack only creates load balancer rules,
+// static NAT and the firewall rules of a public IP on IPv4 public IPs, so every port is served on IPv4, and the
+// ICMP firewall rules always use ProtoICMP. An IP of the wrong family is rejected by checkLoadBalancerIPFamily.
 func ProtocolFromServicePort(port corev1.ServicePort, service *corev1.Service) LoadBalancerProtocol {
+	// An invalid annotation is reported by checkBackendProtocols, the ports then fall back to the defaults.
+	backend, _ := getBackendProtocols(service)
 	proxy := getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerProxyProtocol, false)
 	switch port.Protocol {
 	case corev1.ProtocolTCP:
-		if proxy {
+		switch backend[port.Port] {
+		case "":
+			if proxy {
+				return LoadBalancerProtocolTCPProxy
+			}
+
+			return LoadBalancerProtocolTCP
+		case BackendProtocolTCP:
+			return LoadBalancerProtocolTCP
+		case BackendProtocolProxy:
 			return LoadBalancerProtocolTCPProxy
+		default:
+			return LoadBalancerProtocolInvalid
 		}
-
-		return LoadBalancerProtocolTCP
 	case corev1.ProtocolUDP:
+		if b := backend[port.Port]; b != "" && b != BackendProtocolUDP {
+			return LoadBalancerProtocolInvalid
+		}
+
 		return LoadBalancerProtocolUDP
 	default:
 		return LoadBalancerProtocolInvalid
 	}
 }
 
+// Backend protocols of the backend protocol annotation. CloudStack load balancer rules have a single protocol,
+// which determines what the backends receive: plain TCP, TCP with a PROXY protocol header, or UDP.
+const (
+	BackendProtocolTCP   = "tcp"
+	BackendProtocolProxy = "proxy"
+	BackendProtocolUDP   = "udp"
+)
+
+// getBackendProtocols parses the backend protocol annotation, a comma-separated list of <port>=<protocol>,
+// into the backend protocols by service port.
+func getBackendProtocols(service *corev1.Service) (map[int32]string, error) {
+	value := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerBackendProtocol, "")
+	if value == "" {
+		return nil, nil
+	}
+
+	protocols := make(map[int32]string)
+	for entry := range strings.SplitSeq(value, ",") {
+		portValue, protocol, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		port, err := strconv.ParseInt(portValue, 10, 32)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid backend protocol %q: must be <port>=<protocol>", entry)
+		}
+
+		switch protocol {
+		case BackendProtocolTCP, BackendProtocolProxy, BackendProtocolUDP:
+			protocols[int32(port)] = protocol
+		default:
+			return nil, fmt.Errorf("invalid backend protocol %q for port %d: must be %s, %s or %s",
+				protocol, port, BackendProtocolTCP, BackendProtocolProxy, BackendProtocolUDP)
+		}
+	}
+
+	return protocols, nil
+}
+
+// checkBackendProtocols returns an error when the backend protocol annotation is invalid, names a port the service
+// does not have, or combines a port with a backend protocol that CloudStack cannot provide, f.e. proxy on UDP.
+func checkBackendProtocols(service *corev1.Service) error {
+	protocols, err := getBackendProtocols(service)
+	if err != nil {
+		return err
+	}
+
+	for port, protocol := range protocols {
+		i := slices.IndexFunc(service.Spec.Ports, func(p corev1.ServicePort) bool { return p.Port == port })
+		if i < 0 {
+			return fmt.Errorf("backend protocol set for port %d, which is not a port of the service", port)
+		}
+		if ProtocolFromServicePort(service.Spec.Ports[i], service) == LoadBalancerProtocolInvalid {
+			return fmt.Errorf("backend protocol %s is not supported for %s port %d", protocol, service.Spec.Ports[i].Protocol, port)
+		}
+	}
+
+	return nil
+}
+
+// parseAllowedProtocols parses the allowed-protocols option, a comma-separated list of CloudStack load balancer
+// protocol names. An empty value returns nil, which allows all protocols.
+func parseAllowedProtocols(value string) ([]LoadBalancerProtocol, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var protocols []LoadBalancerProtocol
+	for name := range strings.SplitSeq(value, ",") {
+		name = strings.TrimSpace(name)
+		protocol := ProtocolFromLoadBalancer(name)
+		if name == "" || protocol == LoadBalancerProtocolInvalid {
+			return nil, fmt.Errorf("invalid load balancer allowed-protocols %q: %q must be %s, %s or %s",
+				value, name, ProtoTCP, ProtoUDP, ProtoTCPProxy)
+		}
+		if !slices.Contains(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+	}
+
+	return protocols, nil
+}
+
+// checkAllowedProtocols returns errProtocolNotAllowed when a port of the service would get a load balancer
+// protocol that is not in allowed. A nil allowed permits all protocols.
+func checkAllowedProtocols(service *corev1.Service, allowed []LoadBalancerProtocol) error {
+	if allowed == nil {
+		return nil
+	}
+
+	for _, port := range service.Spec.Ports {
+		protocol := ProtocolFromServicePort(port, service)
+		if protocol != LoadBalancerProtocolInvalid && !slices.Contains(allowed, protocol) {
+			return fmt.Errorf("%w: protocol %s of port %d is not allowed by the cloud config", errProtocolNotAllowed, protocol, port.Port)
+		}
+	}
+
+	return nil
+}
+
 // ProtocolFromLoadBalancer returns the protocol corresponding to the
 // CloudStack load balancer protocol name.
 func ProtocolFromLoadBalancer(protocol string) LoadBalancerProtocol {
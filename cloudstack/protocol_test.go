@@ -20,6 +20,7 @@
 package cloudstack
 
 import (
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -121,11 +122,61 @@ func TestProtocolFromServicePort(t *testing.T) {
 			port: corev1.ServicePort{Protocol: corev1.ProtocolUDP},
 			want: LoadBalancerProtocolUDP,
 		},
+		{
+			name: "UDP ignores proxy annotation",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolUDP},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerProxyProtocol: "true",
+			},
+			want: LoadBalancerProtocolUDP,
+		},
 		{
 			name: "SCTP is invalid",
 			port: corev1.ServicePort{Protocol: corev1.ProtocolSCTP},
 			want: LoadBalancerProtocolInvalid,
 		},
+		{
+			name: "backend protocol proxy on TCP port",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 443},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerBackendProtocol: "443=proxy",
+			},
+			want: LoadBalancerProtocolTCPProxy,
+		},
+		{
+			name: "backend protocol tcp overrides proxy annotation",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 80},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerProxyProtocol:   "true",
+				ServiceAnnotationLoadBalancerBackendProtocol: "80=tcp,443=proxy",
+			},
+			want: LoadBalancerProtocolTCP,
+		},
+		{
+			name: "proxy annotation applies to ports without backend protocol",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 8443},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerProxyProtocol:   "true",
+				ServiceAnnotationLoadBalancerBackendProtocol: "80=tcp",
+			},
+			want: LoadBalancerProtocolTCPProxy,
+		},
+		{
+			name: "backend protocol udp on TCP port is invalid",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: 53},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerBackendProtocol: "53=udp",
+			},
+			want: LoadBalancerProtocolInvalid,
+		},
+		{
+			name: "backend protocol proxy on UDP port is invalid",
+			port: corev1.ServicePort{Protocol: corev1.ProtocolUDP, Port: 53},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerBackendProtocol: "53=proxy",
+			},
+			want: LoadBalancerProtocolInvalid,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -142,6 +193,51 @@ func TestProtocolFromServicePort(t *testing.T) {
 	}
 }
 
+func TestCheckBackendProtocols(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 80},
+		{Protocol: corev1.ProtocolTCP, Port: 443},
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "no annotation"},
+		{name: "valid", value: "80=tcp, 443=proxy,53=udp"},
+		{name: "missing protocol", value: "80", wantErr: "must be <port>=<protocol>"},
+		{name: "invalid port", value: "http=tcp", wantErr: "must be <port>=<protocol>"},
+		{name: "unknown protocol", value: "443=tls", wantErr: `invalid backend protocol "tls"`},
+		{name: "unknown port", value: "8080=proxy", wantErr: "port 8080, which is not a port of the service"},
+		{name: "proxy on UDP", value: "53=proxy", wantErr: "backend protocol proxy is not supported for UDP port 53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-svc"},
+				Spec:       corev1.ServiceSpec{Ports: ports},
+			}
+			if tt.value != "" {
+				svc.Annotations = map[string]string{ServiceAnnotationLoadBalancerBackendProtocol: tt.value}
+			}
+
+			err := checkBackendProtocols(svc)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkBackendProtocols() unexpected error: %v", err)
+				}
+
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkBackendProtocols() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestProtocolFromLoadBalancer(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -0,0 +1,190 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	cloudproviderapi "k8s.io/cloud-provider/api"
+	"k8s.io/klog/v2"
+)
+
+// defaultRetryMaxDelay is the default maximum delay of the requeues of a transient failure class.
+const defaultRetryMaxDelay = 10 * time.Minute
+
+// defaultCapacityRetryDelay is the delay of the first requeue of a capacity failure when none is configured. An
+// exhausted quota rarely clears within the seconds of the default backoff of the service controller.
+const defaultCapacityRetryDelay = time.Minute
+
+// retryClass is a class of transient failures that is requeued with its own backoff.
+type retryClass string
+
+const (
+	// retryClassCapacity are failures because a resource limit or the capacity of the zone is exhausted,
+	// f.e. the public IP quota of the account. These take long to clear, if at all.
+	retryClassCapacity retryClass = "capacity"
+	// retryClassUnavailable are failures because the management server is unavailable or too busy to answer.
+	retryClassUnavailable retryClass = "unavailable"
+)
+
+// CloudStack API error codes of transient failures, see org.apache.cloudstack.api.ApiErrorCode.
+const (
+	csErrorAPILimitExceeded     = 429
+	csErrorAccountResourceLimit = 532
+	csErrorInsufficientCapacity = 533
+	csErrorResourceUnavailable  = 534
+)
+
+// csErrorCodeRegexp extracts the error code from the errors of the CloudStack API client, which are not typed.
+var csErrorCodeRegexp = regexp.MustCompile(`CloudStack API error (\d+) `)
+
+// csErrorCode returns the CloudStack API error code of err, or 0 if it has none.
+func csErrorCode(err error) int {
+	m := csErrorCodeRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(m[1])
+
+	return code
+}
+
+// retryBackoff is the delay of the first requeue of a failure class, doubled on every consecutive failure up to maxDelay.
+type retryBackoff struct {
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// retryState is the failure class of the last reconcile of a service and how often it failed with it in a row.
+type retryState struct {
+	class    retryClass
+	failures int
+}
+
+// parseRetryBackoff parses the delay and max-delay options of a failure class. An empty delay uses defaultDelay,
+// a delay of 0 disables the backoff.
+func parseRetryBackoff(class retryClass, delay, maxDelay string, defaultDelay time.Duration) (*retryBackoff, error) {
+	d, err := parseDurationOption(fmt.Sprintf("load balancer %s-retry-delay", class), delay, defaultDelay)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseDurationOption(fmt.Sprintf("load balancer %s-retry-max-delay", class), maxDelay, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == 0 {
+		if m > 0 {
+			return nil, fmt.Errorf("load balancer %s-retry-max-delay requires %s-retry-delay", class, class)
+		}
+
+		return nil, nil
+	}
+	if m == 0 {
+		m = max(d, defaultRetryMaxDelay)
+	}
+	if m < d {
+		return nil, fmt.Errorf("invalid load balancer %s-retry-max-delay %v: must not be less than %s-retry-delay %v", class, m, class, d)
+	}
+
+	return &retryBackoff{delay: d, maxDelay: m}, nil
+}
+
+// transientRetryClass returns the transient failure class of err, or "" if it is not a known transient failure.
+func transientRetryClass(err error) retryClass {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errInsufficientCapacity):
+		return retryClassCapacity
+	case errors.Is(err, errCloudStackUnavailable), errors.Is(err, cloudstack.AsyncTimeoutErr):
+		return retryClassUnavailable
+	}
+
+	switch csErrorCode(err) {
+	case csErrorAccountResourceLimit, csErrorInsufficientCapacity:
+		return retryClassCapacity
+	case csErrorAPILimitExceeded, csErrorResourceUnavailable:
+		return retryClassUnavailable
+	}
+
+	return ""
+}
+
+// isTransientError returns true if err is a transient failure that may succeed when the call is retried right
+// away: a known transient CloudStack API error, or a request that did not get an answer from the API at all.
+func isTransientError(err error) bool {
+	var urlErr *url.Error
+
+	return transientRetryClass(err) != "" || errors.As(err, &urlErr)
+}
+
+// transientRetryError returns err as a RetryError when it is a transient failure whose class has a backoff
+// configured, so the service is requeued after the backoff of its class instead of the default rate limit of
+// the service controller. The delay doubles while the service keeps failing with the same class. Any other
+// result of the reconcile starts the backoff over.
+func (cs *CSCloud) transientRetryError(service *corev1.Service, err error) error {
+	key := service.Namespace + "/" + service.Name
+	class := transientRetryClass(err)
+	backoff, ok := cs.retryBackoffs[class]
+
+	cs.retryMu.Lock()
+	defer cs.retryMu.Unlock()
+
+	if !ok {
+		delete(cs.retryStates, key)
+
+		return err
+	}
+
+	state := cs.retryStates[key]
+	if state.class != class {
+		state = retryState{class: class}
+	}
+	state.failures++
+	if cs.retryStates == nil {
+		cs.retryStates = make(map[string]retryState)
+	}
+	cs.retryStates[key] = state
+
+	delay := backoff.delay
+	for i := 1; i < state.failures && delay < backoff.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, backoff.maxDelay)
+
+	klog.V(4).Infof("Reconcile of service %v failed with a %v failure %d time(s) in a row, requeueing in %v", key, class, state.failures, delay)
+
+	return cloudproviderapi.NewRetryError(fmt.Sprintf("%v, retrying in %v", err, delay), delay)
+}
+
+// resetTransientRetry forgets the transient failures of the service.
+func (cs *CSCloud) resetTransientRetry(service *corev1.Service) {
+	cs.retryMu.Lock()
+	defer cs.retryMu.Unlock()
+
+	delete(cs.retryStates, service.Namespace+"/"+service.Name)
+}
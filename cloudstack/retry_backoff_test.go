@@ -0,0 +1,189 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudproviderapi "k8s.io/cloud-provider/api"
+)
+
+func TestParseRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name         string
+		delay        string
+		maxDelay     string
+		defaultDelay time.Duration
+		want         *retryBackoff
+		wantErr      string
+	}{
+		{name: "disabled"},
+		{name: "default delay", defaultDelay: time.Minute, want: &retryBackoff{delay: time.Minute, maxDelay: defaultRetryMaxDelay}},
+		{name: "default delay with max delay", maxDelay: "30m", defaultDelay: time.Minute, want: &retryBackoff{delay: time.Minute, maxDelay: 30 * time.Minute}},
+		{name: "default delay disabled", delay: "0", defaultDelay: time.Minute},
+		{name: "default max delay", delay: "1m", want: &retryBackoff{delay: time.Minute, maxDelay: defaultRetryMaxDelay}},
+		{name: "delay above default max delay", delay: "15m", want: &retryBackoff{delay: 15 * time.Minute, maxDelay: 15 * time.Minute}},
+		{name: "max delay", delay: "5s", maxDelay: "1m", want: &retryBackoff{delay: 5 * time.Second, maxDelay: time.Minute}},
+		{name: "max delay without delay", maxDelay: "1m", wantErr: "requires capacity-retry-delay"},
+		{name: "max delay below delay", delay: "1m", maxDelay: "5s", wantErr: "must not be less than"},
+		{name: "invalid delay", delay: "soon", wantErr: "invalid load balancer capacity-retry-delay"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetryBackoff(retryClassCapacity, tt.delay, tt.maxDelay, tt.defaultDelay)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRetryBackoff() error = %v, want containing %q", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRetryBackoff() unexpected error: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseRetryBackoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransientRetryClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want retryClass
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "other error", err: errors.New("other error"), want: ""},
+		{name: "public IP limit", err: fmt.Errorf("error: %w", errInsufficientCapacity), want: retryClassCapacity},
+		{
+			name: "account resource limit",
+			err:  errors.New("CloudStack API error 532 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'public_ip' for account has been exceeded"),
+			want: retryClassCapacity,
+		},
+		{
+			name: "insufficient address capacity",
+			err:  fmt.Errorf("associating IP: %w", errors.New("CloudStack API error 533 (CSExceptionErrorCode: 4365): Insufficient address capacity")),
+			want: retryClassCapacity,
+		},
+		{name: "API unavailable", err: fmt.Errorf("listing rules: %w", errCloudStackUnavailable), want: retryClassUnavailable},
+		{name: "async job timeout", err: fmt.Errorf("creating rule: %w", cloudstack.AsyncTimeoutErr), want: retryClassUnavailable},
+		{name: "API limit exceeded", err: errors.New("CloudStack API error 429 (CSExceptionErrorCode: 9999): API limit exceeded"), want: retryClassUnavailable},
+		{name: "parameter error", err: errors.New("CloudStack API error 431 (CSExceptionErrorCode: 9999): Unable to find IP"), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transientRetryClass(tt.err); got != tt.want {
+				t.Errorf("transientRetryClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransientRetryError(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	capacity := fmt.Errorf("%w: public IP limit reached", errInsufficientCapacity)
+	unavailable := fmt.Errorf("listing rules: %w", errCloudStackUnavailable)
+
+	retryAfter := func(t *testing.T, err error) time.Duration {
+		t.Helper()
+
+		var retryErr *cloudproviderapi.RetryError
+		if !errors.As(err, &retryErr) {
+			t.Fatalf("err = %v, want a RetryError", err)
+		}
+		if !strings.Contains(err.Error(), "public IP limit reached") && !strings.Contains(err.Error(), "unavailable") {
+			t.Errorf("err = %v, want the original error in the message", err)
+		}
+
+		return retryErr.RetryAfter()
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		cs := &CSCloud{}
+		if err := cs.transientRetryError(service, capacity); err != capacity {
+			t.Errorf("err = %v, want %v", err, capacity)
+		}
+	})
+
+	t.Run("doubles up to the max delay", func(t *testing.T) {
+		cs := &CSCloud{retryBackoffs: map[retryClass]retryBackoff{
+			retryClassCapacity: {delay: time.Minute, maxDelay: 5 * time.Minute},
+		}}
+
+		for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+			if got := retryAfter(t, cs.transientRetryError(service, capacity)); got != want {
+				t.Errorf("retry after = %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("other results start over", func(t *testing.T) {
+		cs := &CSCloud{retryBackoffs: map[retryClass]retryBackoff{
+			retryClassCapacity:    {delay: time.Minute, maxDelay: time.Hour},
+			retryClassUnavailable: {delay: 10 * time.Second, maxDelay: time.Hour},
+		}}
+
+		retryAfter(t, cs.transientRetryError(service, capacity))
+		retryAfter(t, cs.transientRetryError(service, capacity))
+		if got := retryAfter(t, cs.transientRetryError(service, unavailable)); got != 10*time.Second {
+			t.Errorf("retry after = %v after another failure class, want 10s", got)
+		}
+
+		other := errors.New("other error")
+		if err := cs.transientRetryError(service, other); err != other {
+			t.Errorf("err = %v, want %v", err, other)
+		}
+		if got := retryAfter(t, cs.transientRetryError(service, unavailable)); got != 10*time.Second {
+			t.Errorf("retry after = %v after another error, want 10s", got)
+		}
+
+		if err := cs.transientRetryError(service, nil); err != nil {
+			t.Errorf("err = %v, want nil", err)
+		}
+		if got := retryAfter(t, cs.transientRetryError(service, unavailable)); got != 10*time.Second {
+			t.Errorf("retry after = %v after a successful reconcile, want 10s", got)
+		}
+
+		cs.resetTransientRetry(service)
+		if _, ok := cs.retryStates["default/foo"]; ok {
+			t.Error("retry state kept after reset")
+		}
+	})
+
+	t.Run("classes without backoff are not retried", func(t *testing.T) {
+		cs := &CSCloud{retryBackoffs: map[retryClass]retryBackoff{
+			retryClassUnavailable: {delay: 10 * time.Second, maxDelay: time.Hour},
+		}}
+		if err := cs.transientRetryError(service, capacity); err != capacity {
+			t.Errorf("err = %v, want %v", err, capacity)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// instanceSync remembers the hosts that the last successful reconcile of each service assigned to its
+// load balancer rules, so they can be compared with the instances CloudStack reports on a schedule. The
+// service controller only reconciles on node and service changes, so a host that CloudStack dropped from
+// a rule out-of-band, f.e. during a VM migration, would otherwise not be noticed.
+type instanceSync struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	services map[string]instanceSyncEntry
+}
+
+type instanceSyncEntry struct {
+	clusterName string
+	hostIDs     []string
+}
+
+func newInstanceSync(interval time.Duration) *instanceSync {
+	return &instanceSync{
+		interval: interval,
+		services: map[string]instanceSyncEntry{},
+	}
+}
+
+// set stores the hosts the rules of the service are expected to have.
+func (s *instanceSync) set(key, clusterName string, hostIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.services[key] = instanceSyncEntry{clusterName: clusterName, hostIDs: slices.Clone(hostIDs)}
+}
+
+// forget drops the service, so its rules are not synced until it is reconciled successfully again.
+func (s *instanceSync) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.services, key)
+}
+
+// entries returns a copy of the services to sync.
+func (s *instanceSync) entries() map[string]instanceSyncEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.services)
+}
+
+// recordInstanceSyncHosts remembers the hosts of the service after a reconcile. After a failed reconcile, the
+// hosts of the rules are unknown, so the service is not synced until the next successful one.
+func (cs *CSCloud) recordInstanceSyncHosts(clusterName string, service *corev1.Service, hostIDs []string, err error) {
+	if cs.instanceSync == nil {
+		return
+	}
+
+	key := service.Namespace + "/" + service.Name
+	if err != nil {
+		cs.instanceSync.forget(key)
+
+		return
+	}
+	cs.instanceSync.set(key, clusterName, hostIDs)
+}
+
+// runInstanceSync syncs the instances of the load balancer rules every instance-sync-interval until stop is closed.
+func (cs *CSCloud) runInstanceSync(stop <-chan struct{}) {
+	wait.Until(cs.syncRuleInstances, cs.instanceSync.interval, stop)
+}
+
+// syncRuleInstances re-assigns the hosts that are missing from the rules of every service. The services are
+// synced one after another, so the sync adds at most one CloudStack API call at a time to the reconciles.
+func (cs *CSCloud) syncRuleInstances() {
+	entries := cs.instanceSync.entries()
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		if err := cs.syncServiceRuleInstances(key, entries[key]); err != nil {
+			klog.Errorf("Error syncing the instances of the load balancer rules of service %v: %v", key, err)
+		}
+	}
+}
+
+// syncServiceRuleInstances re-assigns the hosts that are missing from the rules of a single service. Hosts that
+// are assigned but not expected are left to the next reconcile of the service.
+func (cs *CSCloud) syncServiceRuleInstances(key string, entry instanceSyncEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cs.instanceSync.interval)
+	defer cancel()
+
+	// Serialize with reconciles of the service, which may change its rules and hosts.
+	defer cs.serviceLocks.lock(key)()
+
+	namespace, name, _ := strings.Cut(key, "/")
+	service, err := cs.kclient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cs.instanceSync.forget(key)
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get service: %w", err)
+	}
+	if !cs.isLoadBalancerManaged(service) || service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		cs.instanceSync.forget(key)
+
+		return nil
+	}
+
+	lbName := cs.GetLoadBalancerName(ctx, entry.clusterName, service)
+	lb, err := cs.getLoadBalancer(ctx, entry.clusterName, service, lbName, cs.getLoadBalancerFallbackNames(ctx, entry.clusterName, service)...)
+	if err != nil {
+		return err
+	}
+
+	for _, ruleName := range slices.Sorted(maps.Keys(lb.rules)) {
+		lbRule := lb.rules[ruleName]
+		restored, err := lb.restoreRuleHosts(lbRule, entry.hostIDs)
+		if err != nil {
+			return err
+		}
+		if len(restored) > 0 {
+			msg := fmt.Sprintf("Re-assigned host(s) %v that were missing from load balancer rule %v", restored, lbRule.Name)
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "RestoredLoadBalancerHosts", msg)
+			klog.Warning(msg)
+		}
+	}
+
+	return nil
+}
+
+// restoreRuleHosts assigns the hosts that are expected, but missing from the instances CloudStack reports for the
+// rule, and returns them. The instances are always listed, as the rule members cache does not see such changes.
+func (lb *loadBalancer) restoreRuleHosts(lbRule *cloudstack.LoadBalancerRule, hostIDs []string) ([]string, error) {
+	current, err := lb.listRuleInstances(lbRule)
+	if err != nil {
+		return nil, err
+	}
+
+	assign, _ := symmetricDifference(hostIDs, current)
+	if len(assign) == 0 {
+		return nil, nil
+	}
+
+	// The cached members claimed the hosts were assigned, so they are listed again by the next reconcile.
+	lb.invalidateRuleMembers(lbRule)
+	if err := lb.assignHostsToRule(lbRule, assign); err != nil {
+		return nil, fmt.Errorf("error re-assigning missing hosts to rule %v: %w", lbRule.Name, err)
+	}
+
+	return assign, nil
+}
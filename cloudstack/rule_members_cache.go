@@ -0,0 +1,91 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ruleMembersCache remembers the hosts assigned to each load balancer rule after a reconcile,
+// so the next reconcile (f.e. when a node was added) can assign the new hosts without first
+// listing the instances of every rule. Changes made outside the provider are only noticed
+// once an entry expired.
+type ruleMembersCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]ruleMembersCacheEntry
+}
+
+type ruleMembersCacheEntry struct {
+	hostIDs []string
+	expires time.Time
+}
+
+func newRuleMembersCache(ttl time.Duration) *ruleMembersCache {
+	return &ruleMembersCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]ruleMembersCacheEntry{},
+	}
+}
+
+// get returns the cached hosts of the rule, if there are any that did not expire yet. Expired entries of all
+// rules are evicted, so rules that are no longer reconciled, f.e. as they were deleted outside the provider,
+// do not stay in the cache.
+func (c *ruleMembersCache) get(ruleID string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	maps.DeleteFunc(c.entries, func(_ string, entry ruleMembersCacheEntry) bool {
+		return !now.Before(entry.expires)
+	})
+
+	entry, ok := c.entries[ruleID]
+	if !ok {
+		return nil, false
+	}
+
+	return entry.hostIDs, true
+}
+
+// set stores the hosts that are assigned to the rule.
+func (c *ruleMembersCache) set(ruleID string, hostIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[ruleID] = ruleMembersCacheEntry{
+		hostIDs: slices.Clone(hostIDs),
+		expires: c.now().Add(c.ttl),
+	}
+}
+
+// invalidate drops the cached hosts of the rule.
+func (c *ruleMembersCache) invalidate(ruleID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, ruleID)
+}
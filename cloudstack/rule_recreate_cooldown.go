@@ -0,0 +1,73 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"sync"
+	"time"
+)
+
+// ruleRecreateCooldown remembers when each load balancer rule was last deleted to be recreated with new
+// values, so a service whose spec flaps between two versions does not drop the connections of its rules on
+// every reconcile. Rules are tracked by the service and port they are for, see recreateCooldownKey, as a
+// recreated rule gets a new ID and a renamed rule a new name.
+type ruleRecreateCooldown struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	recreated map[string]time.Time
+}
+
+func newRuleRecreateCooldown(window time.Duration) *ruleRecreateCooldown {
+	return &ruleRecreateCooldown{
+		window:    window,
+		now:       time.Now,
+		recreated: map[string]time.Time{},
+	}
+}
+
+// remaining returns how long the rule may not be recreated yet, or 0 if it may be recreated now.
+func (c *ruleRecreateCooldown) remaining(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	at, ok := c.recreated[key]
+	if !ok {
+		return 0
+	}
+
+	return max(at.Add(c.window).Sub(c.now()), 0)
+}
+
+// record remembers that the rule is being recreated now. Rules whose window passed are forgotten, so the
+// rules of deleted services are not remembered forever.
+func (c *ruleRecreateCooldown) record(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, at := range c.recreated {
+		if !now.Before(at.Add(c.window)) {
+			delete(c.recreated, k)
+		}
+	}
+	c.recreated[key] = now
+}
@@ -0,0 +1,113 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// selfTestName is the name of the load balancer rule created by the self-test.
+	selfTestName = "K8s_ccm_self_test"
+	// selfTestPort is the public and private port of the self-test rule.
+	selfTestPort = 30999
+	// selfTestCIDR is the only source allowed by the self-test firewall rule, a documentation range
+	// (TEST-NET-3), so the self-test load balancer is never reachable.
+	selfTestCIDR = "203.0.113.0/24"
+)
+
+// runSelfTest creates a public IP, a load balancer rule and a firewall rule in the self-test network,
+// verifies the rule and deletes everything again. This exercises the permissions and offerings the load
+// balancers need, usually before the first service is reconciled. The result is logged and exposed as a metric.
+func (cs *CSCloud) runSelfTest() error {
+	klog.Infof("Running load balancer self-test in network %v", cs.selfTestNetworkID)
+
+	err := cs.selfTest()
+	if err != nil {
+		klog.Errorf("Load balancer self-test failed, load balancers will likely fail as well: %v", err)
+	} else {
+		klog.Info("Load balancer self-test succeeded")
+	}
+	recordSelfTestResult(err == nil)
+
+	return err
+}
+
+// selfTest provisions and tears down the self-test load balancer. Resources that were created are
+// always deleted, also when a later step failed, and teardown errors fail the self-test.
+func (cs *CSCloud) selfTest() (err error) {
+	lb := &loadBalancer{
+		CloudStackClient: cs.apiClient(),
+		name:             selfTestName,
+		algorithm:        "roundrobin",
+		networkID:        cs.selfTestNetworkID,
+		projectID:        cs.projectID,
+		backendPort:      backendPortNodePort,
+
+		ownedFirewallRulesOnly:  cs.ownedFirewallRulesOnly,
+		keepRangedFirewallRules: cs.keepRangedFirewallRules,
+	}
+	lb.ownerTagKey, lb.ownerTagValue = cs.ownerTag("")
+	lb.previousOwnerTags = cs.previousOwnerTagsOf("")
+
+	if err := lb.associatePublicIPAddress(); err != nil {
+		if errors.Is(err, errNewIPCheckFailed) {
+			err = lb.discardNewIP(err, lb.releaseLoadBalancerIP)
+		}
+
+		return fmt.Errorf("self-test: %w", err)
+	}
+	defer func() {
+		if releaseErr := lb.releaseLoadBalancerIP(); releaseErr != nil {
+			err = errors.Join(err, fmt.Errorf("self-test teardown: %w", releaseErr))
+		}
+	}()
+
+	port := corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: selfTestPort, NodePort: selfTestPort}
+	lbRule, err := lb.createLoadBalancerRule(selfTestName, port, LoadBalancerProtocolTCP)
+	if err != nil {
+		return fmt.Errorf("self-test: %w", err)
+	}
+	defer func() {
+		if deleteErr := lb.deleteLoadBalancerRuleAndFirewall(lbRule); deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("self-test teardown: %w", deleteErr))
+		}
+	}()
+
+	if _, err := lb.updateFirewallRule(lb.ipAddrID, selfTestPort, LoadBalancerProtocolTCP, []string{selfTestCIDR}); err != nil {
+		return fmt.Errorf("self-test: %w", err)
+	}
+
+	r, _, err := lb.LoadBalancer.GetLoadBalancerRuleByID(lbRule.Id, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		return fmt.Errorf("self-test: error retrieving load balancer rule %v: %w", lbRule.Name, err)
+	}
+	if r.Publicipid != lb.ipAddrID || r.Publicport != lbRule.Publicport {
+		return fmt.Errorf("self-test: load balancer rule %v has public IP %v and port %v, want %v and %v",
+			lbRule.Name, r.Publicipid, r.Publicport, lb.ipAddrID, lbRule.Publicport)
+	}
+
+	return nil
+}
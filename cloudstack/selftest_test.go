@@ -0,0 +1,139 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func selfTestGauge(t *testing.T) float64 {
+	t.Helper()
+
+	v, err := testutil.GetGaugeMetricValue(selfTestSuccess)
+	if err != nil {
+		t.Fatalf("failed to read gauge: %v", err)
+	}
+
+	return v
+}
+
+func TestRunSelfTest(t *testing.T) {
+	registerMetrics()
+
+	// setupSelfTestIP sets up the allocation and release of the self-test IP.
+	setupSelfTestIP := func(mockLB *cloudstack.MockLoadBalancerServiceIface, mockAddress *cloudstack.MockAddressServiceIface,
+		mockNetwork *cloudstack.MockNetworkServiceIface, mockFirewall *cloudstack.MockFirewallServiceIface,
+	) {
+		mockNetwork.EXPECT().GetNetworkByID("net-test", gomock.Any()).Return(&cloudstack.Network{Id: "net-test"}, 1, nil)
+		mockAddress.EXPECT().NewAssociateIpAddressParams().Return(&cloudstack.AssociateIpAddressParams{})
+		mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(&cloudstack.AssociateIpAddressResponse{
+			Id: "ip-test", Ipaddress: "203.0.113.10",
+		}, nil)
+		setupNoStaleRulesOnNewIP(mockLB, mockFirewall)
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-test").Return(&cloudstack.DisassociateIpAddressParams{})
+		mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+	}
+
+	t.Run("provisions and tears down the load balancer", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		setupSelfTestIP(mockLB, mockAddress, mockNetwork, mockFirewall)
+
+		mockLB.EXPECT().NewCreateLoadBalancerRuleParams("roundrobin", selfTestName, selfTestPort, selfTestPort).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+		mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleResponse{
+			Id: "rule-test", Name: selfTestName, Publicport: "30999", Publicipid: "ip-test", Publicip: "203.0.113.10", Protocol: "tcp",
+		}, nil)
+
+		firewallRule := &cloudstack.FirewallRule{Id: "fw-test", Protocol: "tcp", Startport: selfTestPort, Endport: selfTestPort, Cidrlist: selfTestCIDR}
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).Times(2)
+		gomock.InOrder(
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil),
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{
+				Count: 1, FirewallRules: []*cloudstack.FirewallRule{firewallRule},
+			}, nil),
+		)
+		createParams := &cloudstack.CreateFirewallRuleParams{}
+		mockFirewall.EXPECT().NewCreateFirewallRuleParams("ip-test", "tcp").Return(createParams)
+		mockFirewall.EXPECT().CreateFirewallRule(createParams).Return(&cloudstack.CreateFirewallRuleResponse{Id: "fw-test"}, nil)
+		mockFirewall.EXPECT().NewDeleteFirewallRuleParams("fw-test").Return(&cloudstack.DeleteFirewallRuleParams{})
+		mockFirewall.EXPECT().DeleteFirewallRule(gomock.Any()).Return(&cloudstack.DeleteFirewallRuleResponse{}, nil)
+
+		mockLB.EXPECT().GetLoadBalancerRuleByID("rule-test", gomock.Any()).Return(&cloudstack.LoadBalancerRule{
+			Id: "rule-test", Publicport: "30999", Publicipid: "ip-test",
+		}, 1, nil)
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-test").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+		mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		cs := &CSCloud{
+			client:            &cloudstack.CloudStackClient{LoadBalancer: mockLB, Address: mockAddress, Network: mockNetwork, Firewall: mockFirewall},
+			selfTestNetworkID: "net-test",
+		}
+
+		if err := cs.runSelfTest(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, _ := createParams.GetCidrlist(); len(got) != 1 || got[0] != selfTestCIDR {
+			t.Errorf("firewall rule CIDRs = %v, want %v", got, selfTestCIDR)
+		}
+		if got := selfTestGauge(t); got != 1 {
+			t.Errorf("self-test gauge = %v, want 1", got)
+		}
+	})
+
+	t.Run("failure releases the IP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+		setupSelfTestIP(mockLB, mockAddress, mockNetwork, mockFirewall)
+
+		mockLB.EXPECT().NewCreateLoadBalancerRuleParams(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateLoadBalancerRuleParams{})
+		mockLB.EXPECT().CreateLoadBalancerRule(gomock.Any()).Return(nil, errors.New("not allowed to create load balancer rules"))
+
+		cs := &CSCloud{
+			client:            &cloudstack.CloudStackClient{LoadBalancer: mockLB, Address: mockAddress, Network: mockNetwork, Firewall: mockFirewall},
+			selfTestNetworkID: "net-test",
+		}
+
+		err := cs.runSelfTest()
+		if err == nil || !strings.Contains(err.Error(), "not allowed to create load balancer rules") {
+			t.Fatalf("error = %v, want the rule creation error", err)
+		}
+		if got := selfTestGauge(t); got != 0 {
+			t.Errorf("self-test gauge = %v, want 0", got)
+		}
+	})
+}
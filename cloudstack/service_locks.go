@@ -0,0 +1,65 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package cloudstack
+
+import "sync"
+
+// serviceLocks serializes the load balancer reconciles of a service, so overlapping reconciles do
+// not race on its rules and IP, while reconciles of different services still run concurrently.
+// The zero value is ready to use.
+type serviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*serviceLock
+}
+
+type serviceLock struct {
+	sync.Mutex
+	// waiters is the number of reconciles holding or waiting for the lock, the lock is
+	// dropped from the map once it reaches zero.
+	waiters int
+}
+
+// lock locks the service with the given key and returns the function that unlocks it again.
+func (l *serviceLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*serviceLock{}
+	}
+	sl, ok := l.locks[key]
+	if !ok {
+		sl = &serviceLock{}
+		l.locks[key] = sl
+	}
+	sl.waiters++
+	l.mu.Unlock()
+
+	sl.Lock()
+
+	return func() {
+		sl.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		sl.waiters--
+		if sl.waiters == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
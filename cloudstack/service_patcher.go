@@ -23,7 +23,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"reflect"
+	"maps"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -49,18 +49,23 @@ func newServicePatcher(kclient kubernetes.Interface, base *corev1.Service) servi
 
 // Patch will submit a patch request for the Service unless the updated service
 // reference contains the same set of annotations as the base copied during
-// servicePatcher initialization.
+// servicePatcher initialization. Annotations are compared by key and value, so
+// rewriting a value with itself or a nil map becoming empty does not cause a patch.
 func (sp *servicePatcher) Patch(ctx context.Context, err error) error {
-	if reflect.DeepEqual(sp.base.Annotations, sp.updated.Annotations) {
+	if maps.Equal(sp.base.Annotations, sp.updated.Annotations) {
 		return err
 	}
 	perr := patchService(ctx, sp.kclient, sp.base, sp.updated)
+	// An aggregate hides a RetryError from errors.As, so the error is only wrapped when the patch failed too.
+	if perr == nil {
+		return err
+	}
 
 	return utilerrors.NewAggregate([]error{err, perr})
 }
 
-// patchService makes patch request to the Service object.
-func patchService(ctx context.Context, client kubernetes.Interface, cur, mod *corev1.Service) error {
+// patchService makes patch request to the Service object, or to the given subresource of it.
+func patchService(ctx context.Context, client kubernetes.Interface, cur, mod *corev1.Service, subresources ...string) error {
 	curJSON, err := json.Marshal(cur)
 	if err != nil {
 		return fmt.Errorf("failed to serialize current service object: %w", err)
@@ -78,10 +83,20 @@ func patchService(ctx context.Context, client kubernetes.Interface, cur, mod *co
 	if len(patch) == 0 || string(patch) == "{}" {
 		return nil
 	}
-	_, err = client.CoreV1().Services(cur.Namespace).Patch(ctx, cur.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	_, err = client.CoreV1().Services(cur.Namespace).Patch(ctx, cur.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, subresources...)
 	if err != nil {
 		return fmt.Errorf("failed to patch service object %s/%s: %w", cur.Namespace, cur.Name, err)
 	}
 
 	return nil
 }
+
+// patchLoadBalancerStatus writes the load balancer status of a service that is requeued. The service controller
+// only writes the status of a successful reconcile, so without this the status of the previous one would be kept.
+func patchLoadBalancerStatus(ctx context.Context, client kubernetes.Interface, service *corev1.Service, status *corev1.LoadBalancerStatus) error {
+	cur := service.DeepCopy()
+	mod := cur.DeepCopy()
+	mod.Status.LoadBalancer = *status
+
+	return patchService(ctx, client, cur, mod, "status")
+}
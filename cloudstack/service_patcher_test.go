@@ -0,0 +1,135 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func countPatches(client *fake.Clientset) int {
+	patches := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			patches++
+		}
+	}
+
+	return patches
+}
+
+func TestServicePatcher(t *testing.T) {
+	newService := func(annotations map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Annotations: annotations},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		update      func(service *corev1.Service)
+		wantPatches int
+	}{
+		{
+			name: "identical value is not patched",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerAddress: "10.0.0.1",
+				ServiceAnnotationLoadBalancerID:      "ip-1",
+			},
+			update: func(service *corev1.Service) {
+				setServiceAnnotation(service, ServiceAnnotationLoadBalancerID, "ip-1")
+				setServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, "10.0.0.1")
+			},
+		},
+		{
+			name: "rebuilt map with the same content is not patched",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerAddress:   "10.0.0.1",
+				ServiceAnnotationLoadBalancerID:        "ip-1",
+				ServiceAnnotationLoadBalancerNetworkID: "net-1",
+			},
+			update: func(service *corev1.Service) {
+				service.Annotations = map[string]string{
+					ServiceAnnotationLoadBalancerNetworkID: "net-1",
+					ServiceAnnotationLoadBalancerID:        "ip-1",
+					ServiceAnnotationLoadBalancerAddress:   "10.0.0.1",
+				}
+			},
+		},
+		{
+			name: "nil annotations becoming empty is not patched",
+			update: func(service *corev1.Service) {
+				service.Annotations = map[string]string{}
+			},
+		},
+		{
+			name:        "changed value is patched",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+			update: func(service *corev1.Service) {
+				setServiceAnnotation(service, ServiceAnnotationLoadBalancerAddress, "10.0.0.2")
+			},
+			wantPatches: 1,
+		},
+		{
+			name:        "removed annotation is patched",
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"},
+			update:      deleteLoadBalancerAnnotations,
+			wantPatches: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newService(tt.annotations)
+			client := fake.NewSimpleClientset(service)
+			client.ClearActions()
+
+			patcher := newServicePatcher(client, service)
+			tt.update(service)
+			if err := patcher.Patch(t.Context(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := countPatches(client); got != tt.wantPatches {
+				t.Errorf("patch calls = %d, want %d", got, tt.wantPatches)
+			}
+		})
+	}
+
+	t.Run("error is returned without patching", func(t *testing.T) {
+		service := newService(map[string]string{ServiceAnnotationLoadBalancerAddress: "10.0.0.1"})
+		client := fake.NewSimpleClientset(service)
+		client.ClearActions()
+
+		reconcileErr := errors.New("reconcile failed")
+		patcher := newServicePatcher(client, service)
+		if err := patcher.Patch(t.Context(), reconcileErr); !errors.Is(err, reconcileErr) {
+			t.Errorf("Patch() error = %v, want %v", err, reconcileErr)
+		}
+		if got := countPatches(client); got != 0 {
+			t.Errorf("patch calls = %d, want 0", got)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// isStaticNAT returns whether the service asks for a static NAT mapping instead of load balancer rules.
+func isStaticNAT(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNAT, false)
+}
+
+// ensureStaticNAT replaces the load balancer rules of the service with a static NAT mapping from its public IP
+// to the single backend node, and opens the service ports on the firewall of the IP. The VM is recorded on the
+// service, so the mapping is removed again when the service stops using static NAT or is deleted.
+func (cs *CSCloud) ensureStaticNAT(ctx context.Context, lb *loadBalancer, service, annotated *corev1.Service) (*corev1.LoadBalancerStatus, error) {
+	// Static NAT cannot be enabled on an IP that still has load balancer rules.
+	var errs []error
+	for _, lbRule := range lb.rules {
+		klog.V(4).Infof("Deleting load balancer rule %v to switch to static NAT", lbRule.Name)
+		if err := lb.deleteLoadBalancerRuleAndFirewall(lbRule); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerRuleIDs)
+
+	if err := cs.reconcileStaticNATTarget(lb, service); err != nil {
+		return nil, err
+	}
+	setServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNATVirtualMachineID, lb.hostIDs[0])
+
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return nil, fmt.Errorf("could not find network with ID %s: %w", lb.networkID, err)
+		}
+
+		return nil, fmt.Errorf("failed to get network with ID %s: %w", lb.networkID, err)
+	}
+	if !isFirewallSupported(network.Service) {
+		return lb.generateLoadBalancerStatus(annotated), nil
+	}
+
+	ports := make(map[string]bool)
+	staleFirewallRules := false
+	lb.portErrors = make(map[int32]string)
+	for _, port := range service.Spec.Ports {
+		protocol := ProtocolFromServicePort(port, annotated)
+		if protocol == LoadBalancerProtocolInvalid {
+			return nil, fmt.Errorf("unsupported load balancer protocol: %v", port.Protocol)
+		}
+
+		sourceRanges, err := getLoadBalancerSourceRanges(annotated, cs.defaultSourceRanges[protocol.IPProtocol()])
+		if err != nil {
+			cs.eventRecorder.Event(service, corev1.EventTypeWarning, "InvalidLoadBalancerSourceRanges", err.Error())
+
+			return nil, err
+		}
+
+		klog.V(4).Infof("Creating firewall rules for static NAT: %v (%v:%v:%v)", lb.name, protocol, lb.ipAddr, port.Port)
+		if _, err := lb.updateFirewallRule(lb.ipAddrID, int(port.Port), protocol, sourceRanges.StringSlice()); err != nil {
+			if !errors.Is(err, errStaleFirewallRules) {
+				return nil, err
+			}
+			cs.warnStaleFirewallRules(service, err)
+			lb.portErrors[port.Port] = PortErrorStaleFirewallRules
+			staleFirewallRules = true
+		}
+		ports[fmt.Sprintf("%s/%d", protocol.IPProtocol(), port.Port)] = true
+	}
+
+	// Unlike with load balancer rules, the firewall rules of removed ports are not deleted together with a rule.
+	if err := lb.deletePortFirewallRules(lb.ipAddrID, ports); err != nil {
+		return nil, err
+	}
+
+	if err := cs.reconcileICMPFirewallRules(lb, service, annotated); err != nil {
+		return nil, err
+	}
+
+	if staleFirewallRules {
+		return nil, cs.requeuePortErrors(ctx, service, lb.generateLoadBalancerStatus(annotated), staleFirewallRulesError(service))
+	}
+
+	return lb.generateLoadBalancerStatus(annotated), nil
+}
+
+// checkStaticNATBackend returns an error when the load balancer does not have exactly one host, which static NAT
+// maps the public IP to. It is checked before the rules of the service are touched, so a service with several
+// backends keeps its load balancer rules.
+func (cs *CSCloud) checkStaticNATBackend(lb *loadBalancer, service *corev1.Service) error {
+	if len(lb.hostIDs) != 1 {
+		err := fmt.Errorf("static NAT maps the public IP to a single VM, but %d nodes are eligible as backend", len(lb.hostIDs))
+		cs.eventRecorder.Event(service, corev1.EventTypeWarning, "StaticNATRequiresSingleBackend", err.Error())
+
+		return err
+	}
+
+	return nil
+}
+
+// reconcileStaticNATTarget maps the public IP of the load balancer to its single host with static NAT,
+// moving the mapping when it points to another VM.
+func (cs *CSCloud) reconcileStaticNATTarget(lb *loadBalancer, service *corev1.Service) error {
+	if err := cs.checkStaticNATBackend(lb, service); err != nil {
+		return err
+	}
+	vmID := lb.hostIDs[0]
+
+	ip, _, err := lb.Address.GetPublicIpAddressByID(lb.ipAddrID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		return fmt.Errorf("error retrieving public IP %v: %w", lb.ipAddr, err)
+	}
+
+	if !ip.Isstaticnat || ip.Virtualmachineid != vmID {
+		if ip.Isstaticnat {
+			klog.V(4).Infof("Moving static NAT of IP %v from VM %v to VM %v", lb.ipAddr, ip.Virtualmachineid, vmID)
+			if err := lb.disableStaticNAT(); err != nil {
+				return err
+			}
+		}
+
+		if err := lb.enableStaticNAT(vmID); err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("Enabled static NAT from IP %s to VM %s for service %s/%s", lb.ipAddr, vmID, service.Namespace, service.Name)
+		cs.eventRecorder.Event(service, corev1.EventTypeNormal, "EnabledStaticNAT", msg)
+		klog.Info(msg)
+	}
+
+	return nil
+}
+
+// deleteStaticNAT removes the static NAT mapping that ensureStaticNAT recorded on the service,
+// together with the firewall rules of the IP, so the IP can be used for load balancer rules or be released.
+func (cs *CSCloud) deleteStaticNAT(lb *loadBalancer, service *corev1.Service) error {
+	if getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNATVirtualMachineID, "") == "" {
+		return nil
+	}
+
+	ipAddrID := lb.ipAddrID
+	if ipAddrID == "" {
+		ipAddrID = getLoadBalancerID(service)
+	}
+	if ipAddrID == "" {
+		deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNATVirtualMachineID)
+
+		return nil
+	}
+
+	if err := lb.deletePortFirewallRules(ipAddrID, nil); err != nil {
+		return err
+	}
+	if _, err := lb.deleteICMPFirewallRules(ipAddrID); err != nil {
+		return err
+	}
+
+	// The mapping may already be gone after an interrupted deletion.
+	ip, _, err := lb.Address.GetPublicIpAddressByID(ipAddrID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		return fmt.Errorf("error retrieving public IP %v: %w", ipAddrID, err)
+	}
+	if ip.Isstaticnat {
+		p := lb.NAT.NewDisableStaticNatParams(ipAddrID)
+		if _, err := lb.NAT.DisableStaticNat(p); err != nil {
+			return fmt.Errorf("error disabling static NAT of IP %v: %w", ip.Ipaddress, err)
+		}
+
+		msg := fmt.Sprintf("Disabled static NAT of IP %s for service %s/%s", ip.Ipaddress, service.Namespace, service.Name)
+		cs.eventRecorder.Event(service, corev1.EventTypeNormal, "DisabledStaticNAT", msg)
+		klog.Info(msg)
+	}
+
+	deleteServiceAnnotation(service, ServiceAnnotationLoadBalancerStaticNATVirtualMachineID)
+
+	return nil
+}
+
+// enableStaticNAT maps the public IP of the load balancer to the VM.
+func (lb *loadBalancer) enableStaticNAT(vmID string) error {
+	p := lb.NAT.NewEnableStaticNatParams(lb.ipAddrID, vmID)
+	if lb.networkID != "" {
+		p.SetNetworkid(lb.networkID)
+	}
+
+	if _, err := lb.NAT.EnableStaticNat(p); err != nil {
+		return fmt.Errorf("error enabling static NAT from IP %v to VM %v: %w", lb.ipAddr, vmID, err)
+	}
+
+	return nil
+}
+
+// disableStaticNAT removes the static NAT mapping of the public IP of the load balancer.
+func (lb *loadBalancer) disableStaticNAT() error {
+	p := lb.NAT.NewDisableStaticNatParams(lb.ipAddrID)
+
+	if _, err := lb.NAT.DisableStaticNat(p); err != nil {
+		return fmt.Errorf("error disabling static NAT of IP %v: %w", lb.ipAddr, err)
+	}
+
+	return nil
+}
+
+// deletePortFirewallRules deletes the TCP and UDP firewall rules of the public IP, except those for the
+// protocol and port combinations in keep, f.e. "tcp/80". Only rules we own are deleted.
+func (lb *loadBalancer) deletePortFirewallRules(publicIPID string, keep map[string]bool) error {
+	firewallRules, err := lb.listFirewallRules(publicIPID)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, rule := range firewallRules {
+		if rule.Protocol == ProtoICMP || keep[fmt.Sprintf("%s/%d", rule.Protocol, rule.Startport)] || !lb.ownsFirewallRule(rule) {
+			continue
+		}
+
+		klog.V(4).Infof("Deleting firewall rule %v", ruleToString(rule))
+		p := lb.Firewall.NewDeleteFirewallRuleParams(rule.Id)
+		if _, err := lb.Firewall.DeleteFirewallRule(p); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error deleting firewall rule %v: %w", rule.Id, err))
+		} else {
+			lb.recordFirewallRuleChange(false, rule)
+		}
+	}
+
+	return errs
+}
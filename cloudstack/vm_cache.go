@@ -0,0 +1,101 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+)
+
+// vmListCache caches the virtual machine list per project for a short time, so a burst of
+// load balancer reconciles (f.e. after a node was added) shares a single list call.
+type vmListCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*vmListCacheEntry
+}
+
+type vmListCacheEntry struct {
+	// mu is held while the list is fetched, so concurrent callers wait for the
+	// in-flight request instead of issuing their own.
+	mu      sync.Mutex
+	vms     []*cloudstack.VirtualMachine
+	expires time.Time
+}
+
+func newVMListCache(ttl time.Duration) *vmListCache {
+	return &vmListCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*vmListCacheEntry{},
+	}
+}
+
+// get returns the cached list for the project, calling fetch when it is missing or expired.
+// The boolean result reports whether the list was served from the cache.
+func (c *vmListCache) get(projectID string, fetch func() ([]*cloudstack.VirtualMachine, error)) ([]*cloudstack.VirtualMachine, bool, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[projectID]
+	if !ok {
+		entry = &vmListCacheEntry{}
+		c.entries[projectID] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.vms != nil && c.now().Before(entry.expires) {
+		return entry.vms, true, nil
+	}
+
+	vms, err := fetch()
+	if err != nil {
+		entry.vms = nil
+
+		return nil, false, err
+	}
+	if vms == nil {
+		vms = []*cloudstack.VirtualMachine{}
+	}
+
+	entry.vms = vms
+	entry.expires = c.now().Add(c.ttl)
+
+	return vms, false, nil
+}
+
+// invalidate drops the cached list for the project.
+func (c *vmListCache) invalidate(projectID string) {
+	c.mu.Lock()
+	entry, ok := c.entries[projectID]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	entry.mu.Lock()
+	entry.vms = nil
+	entry.mu.Unlock()
+}